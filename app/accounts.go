@@ -32,23 +32,25 @@ type OAuth struct {
 }
 
 type AccountMetadata struct {
-	Password              []byte             `json:"pw,omitempty"`
-	Key                   *SSHKey            `json:"key,omitempty"`
-	Blurb                 []byte             `json:"blurb,omitempty"`
-	Icon                  ImageMetadata      `json:"icon,omitempty"`
-	Name                  string             `json:"name,omitempty"`
-	ID                    string             `json:"id,omitempty"`
-	URL                   string             `json:"url,omitempty"`
-	InboxIRI              string             `json:"inbox,omitempty"`
-	OutboxIRI             string             `json:"outbox,omitempty"`
-	LikedIRI              string             `json:"liked,omitempty"`
-	FollowersIRI          string             `json:"followers,omitempty"`
-	FollowingIRI          string             `json:"following,omitempty"`
-	OAuth                 OAuth              `json:-`
-	AuthorizationEndPoint string             `json:-`
-	TokenEndPoint         string             `json:-`
-	OutboxUpdated         time.Time          `json:-`
-	outbox                pub.ItemCollection
+	Password              []byte        `json:"pw,omitempty"`
+	Key                   *SSHKey       `json:"key,omitempty"`
+	Blurb                 []byte        `json:"blurb,omitempty"`
+	Icon                  ImageMetadata `json:"icon,omitempty"`
+	Name                  string        `json:"name,omitempty"`
+	ID                    string        `json:"id,omitempty"`
+	URL                   string        `json:"url,omitempty"`
+	InboxIRI              string        `json:"inbox,omitempty"`
+	OutboxIRI             string        `json:"outbox,omitempty"`
+	LikedIRI              string        `json:"liked,omitempty"`
+	FollowersIRI          string        `json:"followers,omitempty"`
+	FollowingIRI          string        `json:"following,omitempty"`
+	OAuth                 OAuth         `json:-`
+	AuthorizationEndPoint string        `json:-`
+	TokenEndPoint         string        `json:-`
+	OutboxUpdated         time.Time     `json:-`
+	// SecondFactor is set when the session was authenticated with a second factor
+	SecondFactor bool `json:-`
+	outbox       pub.ItemCollection
 }
 
 type AccountCollection []Account
@@ -194,21 +196,12 @@ func (a AccountCollection) Contains(b Account) bool {
 	return false
 }
 
-func (h *handler)accountFromPost(r *http.Request) (Account, error) {
+func (h *handler) accountFromPost(r *http.Request) (Account, error) {
 	if r.Method != http.MethodPost {
 		return AnonymousAccount, errors.Errorf("invalid http method type")
 	}
 
-	a := &AnonymousAccount
-	hash := r.PostFormValue("hash")
-	if len(hash) > 0 {
-		// NOTE(marius): coming from an invite
-		s := h.storage
-		a, _ = s.LoadAccount(context.TODO(), actors.IRI(s.BaseURL()).AddPath(hash))
-	}
-	if accountsEqual(*a, AnonymousAccount) {
-		*a = Account{Metadata: &AccountMetadata{}}
-	}
+	a := &Account{Metadata: &AccountMetadata{}}
 	pw := r.PostFormValue("pw")
 	pwConfirm := r.PostFormValue("pw-confirm")
 	if pw != pwConfirm {
@@ -2,6 +2,7 @@ package app
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	pub "github.com/go-ap/activitypub"
 	"github.com/go-ap/errors"
@@ -10,8 +11,8 @@ import (
 	"github.com/mariusor/go-littr/internal/assets"
 	"github.com/mariusor/go-littr/internal/config"
 	"github.com/mariusor/go-littr/internal/log"
-	"github.com/writeas/go-nodeinfo"
 	"net/http"
+	"time"
 )
 
 const (
@@ -31,9 +32,12 @@ var (
 	// SystemAccount
 	SystemAccount = Account{Handle: System, Hash: SystemHash, Metadata: new(AccountMetadata)}
 	// DeletedItem
-	DeletedItem = Item{Title: Deleted, Hash: AnonymousHash, Metadata: new(ItemMetadata), pub: &pub.Tombstone{} }
+	DeletedItem = Item{Title: Deleted, Hash: AnonymousHash, Metadata: new(ItemMetadata), pub: &pub.Tombstone{}}
 )
 
+// deliveriesFlushTimeout is how long the commands wait for their activities to be delivered before exiting
+const deliveriesFlushTimeout = 5 * time.Minute
+
 var (
 	listenHost string
 	listenPort int64
@@ -76,13 +80,19 @@ type Collection interface{}
 var Instance Application
 
 // New instantiates a new Application
-func New(c *config.Configuration, host string, port int, ver string, m *chi.Mux) Application {
+func New(c *config.Configuration, host string, port int, ver string, m *chi.Mux) (Application, error) {
 	app := Application{Version: ver, Mux: m}
-	app.setUp(c, host, port)
-	return app
+	err := app.setUp(c, host, port)
+	return app, err
 }
 
 func (a *Application) setUp(c *config.Configuration, host string, port int) error {
+	a.configure(c, host, port)
+	return a.Front()
+}
+
+// configure loads the settings of the application and makes it the global Instance
+func (a *Application) configure(c *config.Configuration, host string, port int) {
 	a.Conf = c
 	a.Logger = log.Dev(c.LogLevel)
 	if c.Secure {
@@ -103,8 +113,6 @@ func (a *Application) setUp(c *config.Configuration, host string, port int) erro
 		c.APIURL = fmt.Sprintf("%s/api", a.BaseURL)
 	}
 	Instance = *a
-	a.Front()
-	return nil
 }
 
 func (a *Application) Front() error {
@@ -125,18 +133,17 @@ func (a *Application) Front() error {
 	r.With(front.Repository).Route("/", front.Routes(a.Conf))
 
 	// .well-known
-	cfg := NodeInfoConfig()
-	ni := nodeinfo.NewService(cfg, NodeInfoResolverNew(front.storage.fedbox))
 	// Web-Finger
 	r.Route("/.well-known", func(r chi.Router) {
 		r.Get("/webfinger", front.HandleWebFinger)
 		r.Get("/host-meta", front.HandleHostMeta)
-		r.Get("/nodeinfo", ni.NodeInfoDiscover)
+		r.Get("/nodeinfo", front.HandleNodeInfoDiscover)
 		r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 			errors.HandleError(errors.NotFoundf("%s", r.RequestURI)).ServeHTTP(w, r)
 		})
 	})
-	r.Get("/nodeinfo", ni.NodeInfo)
+	r.Get("/nodeinfo", front.HandleNodeInfo)
+	r.Get("/nodeinfo/{version}", front.HandleNodeInfo)
 	r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 		front.v.HandleErrors(w, r, errors.NotFoundf("%s", r.RequestURI))
 	})
@@ -146,6 +153,49 @@ func (a *Application) Front() error {
 	return nil
 }
 
+// BackfillKeys generates signing keys of type typ for the local accounts that don't have one.
+// It loads only the FedBOX repository, not the whole frontend, and waits for the Update activities publishing
+// the new keys to be delivered, at most for deliveriesFlushTimeout.
+func BackfillKeys(ctx context.Context, c *config.Configuration, ver, typ string) (int, error) {
+	a := Application{Version: ver}
+	a.configure(c, "", config.DefaultListenPort)
+	if len(c.DataPath) == 0 {
+		return 0, errors.NotValidf("no data path, DATA_PATH needs to be set")
+	}
+	conf := appConfig{
+		Configuration: *a.Conf,
+		BaseURL:       a.BaseURL,
+		Logger:        a.Logger.New(log.Ctx{"package": "keys"}),
+	}
+	repo, err := ActivityPubService(conf)
+	if err != nil {
+		return 0, err
+	}
+	defer repo.Close()
+	if err := repo.loadApplicationAccount(ctx, GetOauth2Config("fedbox", a.BaseURL)); err != nil {
+		return 0, errors.Annotatef(err, "unable to authenticate the OAuth2 client")
+	}
+	if len(typ) == 0 {
+		typ = c.SignatureKeyType
+	}
+	count, err := repo.BackfillKeys(ctx, keyType(typ))
+
+	fctx, cancel := context.WithTimeout(ctx, deliveriesFlushTimeout)
+	defer cancel()
+	if ferr := repo.Flush(fctx); ferr != nil {
+		a.Logger.Errorf("%s, they can be retried from the deliveries page", ferr)
+	}
+	return count, err
+}
+
+// Close stops the background work of the application, like the delivery of the outgoing activities
+func (a Application) Close() {
+	if a.front == nil || a.front.storage == nil {
+		return
+	}
+	a.front.storage.Close()
+}
+
 type Cacheable interface {
 	GetAge() int
 }
@@ -0,0 +1,182 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ap/errors"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+const (
+	captchaPoW  = "pow"
+	captchaText = "text"
+
+	// powDifficulty is the number of leading zero bits the SHA-256 of the proof of work needs to have,
+	// browsers need a couple of seconds for it
+	powDifficulty = 16
+
+	// captchaTimeout is how long the captcha on the registration page stays valid
+	captchaTimeout = 30 * time.Minute
+
+	sessionCaptchaKey     = "__captcha"
+	sessionCaptchaTimeKey = "__captcha_time"
+)
+
+// captcha is the challenge the registration form needs to solve, either a proof of work that the browser computes
+// or a question for the user
+type captcha struct {
+	Type string
+	// Challenge is the random value the proof of work starts from
+	Challenge  string
+	Difficulty int
+	Question   string
+}
+
+var numberWords = []string{"zero", "one", "two", "three", "four", "five", "six", "seven", "eight", "nine", "ten"}
+
+func randomInt(max int64) int {
+	n, err := rand.Int(rand.Reader, big.NewInt(max))
+	if err != nil {
+		return 0
+	}
+	return int(n.Int64())
+}
+
+// newTextCaptcha returns a simple arithmetic question, with the numbers written as words, and its answer
+func newTextCaptcha() (string, string) {
+	a, b := randomInt(10)+1, randomInt(10)+1
+	if randomInt(2) == 0 && a >= b {
+		return fmt.Sprintf("What is %s minus %s?", numberWords[a], numberWords[b]), strconv.Itoa(a - b)
+	}
+	return fmt.Sprintf("What is %s plus %s?", numberWords[a], numberWords[b]), strconv.Itoa(a + b)
+}
+
+// textCaptchaValid accepts the answer either in digits or in words
+func textCaptchaValid(expected, answer string) bool {
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	for i, w := range numberWords {
+		if answer == w {
+			answer = strconv.Itoa(i)
+		}
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(answer)) == 1
+}
+
+// powLeadingZeros returns the number of leading zero bits of the SHA-256 of the challenge followed by the nonce
+func powLeadingZeros(challenge, nonce string) int {
+	sum := sha256.Sum256([]byte(challenge + nonce))
+	zeros := 0
+	for _, b := range sum {
+		zeros += bits.LeadingZeros8(b)
+		if b != 0 {
+			break
+		}
+	}
+	return zeros
+}
+
+// powValid checks the nonce the browser found for the challenge
+func powValid(challenge, nonce string, difficulty int) bool {
+	if len(nonce) == 0 || len(nonce) > 32 {
+		return false
+	}
+	return powLeadingZeros(challenge, nonce) >= difficulty
+}
+
+// newCaptcha returns a captcha of the type, and the value that we keep in the session to check the solution with
+func newCaptcha(typ string) (*captcha, string) {
+	switch typ {
+	case captchaPoW:
+		b := make([]byte, 16)
+		rand.Read(b)
+		c := &captcha{Type: captchaPoW, Challenge: hex.EncodeToString(b), Difficulty: powDifficulty}
+		return c, c.Challenge
+	case captchaText:
+		q, answer := newTextCaptcha()
+		return &captcha{Type: captchaText, Question: q}, answer
+	}
+	return nil, ""
+}
+
+// captchaEnabled returns true if the registration page uses a captcha
+func (h *handler) captchaEnabled() bool {
+	return h.conf.RegistrationCaptcha == captchaPoW || h.conf.RegistrationCaptcha == captchaText
+}
+
+// issueCaptcha saves a new captcha to the session and returns it, so the registration page can show it
+func (h *handler) issueCaptcha(w http.ResponseWriter, r *http.Request) *captcha {
+	if !h.captchaEnabled() {
+		return nil
+	}
+	s, err := h.v.s.get(w, r)
+	if err != nil || s == nil {
+		return nil
+	}
+	c, expected := newCaptcha(h.conf.RegistrationCaptcha)
+	s.Values[sessionCaptchaKey] = expected
+	s.Values[sessionCaptchaTimeKey] = time.Now().Unix()
+	// NOTE(marius): the session needs to be saved before the page is rendered, so new visitors get its cookie
+	if err := h.v.s.save(w, r); err != nil {
+		h.errFn(log.Ctx{"err": err})("unable to save captcha to session")
+		return nil
+	}
+	return c
+}
+
+// verifyCaptcha checks the solution of the captcha from the session, captchas can be used only once
+func (h *handler) verifyCaptcha(w http.ResponseWriter, r *http.Request) error {
+	if !h.captchaEnabled() {
+		return nil
+	}
+	s, err := h.v.s.get(w, r)
+	if err != nil || s == nil {
+		return errors.Newf("unable to load the captcha, please try again")
+	}
+	expected, _ := s.Values[sessionCaptchaKey].(string)
+	issued, _ := s.Values[sessionCaptchaTimeKey].(int64)
+	delete(s.Values, sessionCaptchaKey)
+	delete(s.Values, sessionCaptchaTimeKey)
+	if len(expected) == 0 || time.Since(time.Unix(issued, 0)) > captchaTimeout {
+		return errors.NotValidf("the captcha expired, please try again")
+	}
+	solution := r.PostFormValue("captcha")
+	switch h.conf.RegistrationCaptcha {
+	case captchaPoW:
+		if powValid(expected, solution, powDifficulty) {
+			return nil
+		}
+	case captchaText:
+		if textCaptchaValid(expected, solution) {
+			return nil
+		}
+	}
+	return errors.NotValidf("invalid captcha answer")
+}
+
+// RegistrationModelMw adds a new captcha, and the registration settings of the instance, to the registration page.
+// The model is copied, as ModelMw shares it between the requests.
+func (h *handler) RegistrationModelMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		m := ContextRegisterModel(r.Context())
+		if m == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rm := *m
+		rm.Captcha = h.issueCaptcha(w, r)
+		rm.VerifyEmail = h.conf.RegistrationVerifyEmail
+		rm.Approval = h.conf.RegistrationApproval
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ModelCtxtKey, &rm)))
+	})
+}
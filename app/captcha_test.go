@@ -0,0 +1,62 @@
+package app
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPowValid(t *testing.T) {
+	// NOTE(marius): the nonce was found with the same code as the registration page's JavaScript
+	if !powValid("abcd", "40156", 16) {
+		t.Errorf("expected valid proof of work")
+	}
+	if powValid("abcd", "40157", 16) {
+		t.Errorf("expected invalid proof of work")
+	}
+	if powValid("abcd", "", 0) {
+		t.Errorf("expected empty nonce to be invalid")
+	}
+
+	c, expected := newCaptcha(captchaPoW)
+	if c.Challenge != expected || c.Difficulty != powDifficulty {
+		t.Fatalf("invalid proof of work captcha %v", c)
+	}
+	for nonce := 0; nonce < 1<<24; nonce++ {
+		if powValid(expected, strconv.Itoa(nonce), 8) {
+			return
+		}
+	}
+	t.Errorf("unable to find a nonce for %s", expected)
+}
+
+func TestTextCaptchaValid(t *testing.T) {
+	tests := []struct {
+		expected string
+		answer   string
+		valid    bool
+	}{
+		{"7", "7", true},
+		{"7", " seven ", true},
+		{"7", "Seven", true},
+		{"7", "8", false},
+		{"12", "twelve", false},
+		{"12", "12", true},
+		{"7", "", false},
+	}
+	for _, tt := range tests {
+		if valid := textCaptchaValid(tt.expected, tt.answer); valid != tt.valid {
+			t.Errorf("textCaptchaValid(%q, %q) = %t, expected %t", tt.expected, tt.answer, valid, tt.valid)
+		}
+	}
+
+	for i := 0; i < 50; i++ {
+		c, answer := newCaptcha(captchaText)
+		if !strings.HasPrefix(c.Question, "What is ") {
+			t.Fatalf("invalid question %q", c.Question)
+		}
+		if n, err := strconv.Atoi(answer); err != nil || n < 0 || n > 20 {
+			t.Errorf("invalid answer %q for %q", answer, c.Question)
+		}
+	}
+}
@@ -0,0 +1,455 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-chi/chi"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+var communityNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_]{3,32}$`)
+
+// Community holds the littr specific settings of a community, the ActivityPub Group actor being
+// the one that gets federated
+type Community struct {
+	Name       string       `json:"name"`
+	Owner      string       `json:"owner,omitempty"`
+	Moderators []string     `json:"moderators,omitempty"`
+	Rules      ContentRules `json:"rules,omitempty"`
+	Removed    Hashes       `json:"removed,omitempty"`
+	Account    *Account     `json:"-"`
+}
+
+// IsCommunity returns true if the account is the Group actor of a community
+func (a *Account) IsCommunity() bool {
+	return a != nil && a.pub != nil && a.pub.GetType() == pub.GroupType
+}
+
+// IsModerator returns true if acc can moderate the community.
+// The instance moderators can moderate all communities.
+func (c *Community) IsModerator(acc *Account) bool {
+	if !acc.IsLogged() {
+		return false
+	}
+	if accountIsModerator(acc) {
+		return true
+	}
+	if c == nil {
+		return false
+	}
+	return acc.Handle == c.Owner || stringInSlice(c.Moderators)(acc.Handle)
+}
+
+// IsRemoved returns true if a moderator removed the item with hash h from the community listing
+func (c *Community) IsRemoved(h Hash) bool {
+	return c != nil && c.Removed.Contains(h)
+}
+
+// ModeratorsList returns the handles of the community moderators, in the format the settings form accepts
+func (c *Community) ModeratorsList() string {
+	if c == nil {
+		return ""
+	}
+	return strings.Join(c.Moderators, ", ")
+}
+
+// RulesJSON returns the community rules, in the format the settings form accepts
+func (c *Community) RulesJSON() string {
+	if c == nil || len(c.Rules) == 0 {
+		return ""
+	}
+	dat, err := json.MarshalIndent(c.Rules, "", "  ")
+	if err != nil {
+		return ""
+	}
+	return string(dat)
+}
+
+// compile validates the community rules, the same way we do for the instance wide ones
+func (c *Community) compile() error {
+	for i := range c.Rules {
+		if err := c.Rules[i].compile(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadCommunitySettings returns the settings stored for the community Group actor acc
+func (h *handler) loadCommunitySettings(acc Account) (*Community, error) {
+	c := &Community{Name: acc.Handle}
+	if h.communities != nil {
+		if err := h.communities.Load(acc.Hash.String(), c); err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+		if err := c.compile(); err != nil {
+			return nil, err
+		}
+	}
+	c.Account = &acc
+	return c, nil
+}
+
+// updateCommunitySettings applies fn to the community settings and persists them
+func (h *handler) updateCommunitySettings(c *Community, fn func(*Community) error) error {
+	if h.communities == nil || c == nil || c.Account == nil {
+		return errors.NotValidf("invalid community")
+	}
+	return h.communities.Update(c.Account.Hash.String(), c, func() error {
+		if err := fn(c); err != nil {
+			return err
+		}
+		return c.compile()
+	})
+}
+
+// LoadCommunity loads the Group actor with the name
+func (r *repository) LoadCommunity(ctx context.Context, name string) (*Account, error) {
+	f := &Filters{
+		Name:     CompStrs{EqualsString(name)},
+		Type:     ActivityTypesFilter(pub.GroupType),
+		MaxItems: 1,
+	}
+	accounts, err := r.accounts(ctx, f)
+	if err != nil {
+		return nil, err
+	}
+	for _, acc := range accounts {
+		if acc.IsCommunity() {
+			return &acc, nil
+		}
+	}
+	return nil, errors.NotFoundf("community %q not found", name)
+}
+
+// SaveCommunity creates the Group actor for a new community, attributed to its creator
+func (r *repository) SaveCommunity(ctx context.Context, creator Account, name, summary string) (Account, error) {
+	g := new(pub.Actor)
+	g.Type = pub.GroupType
+	if creator.HasMetadata() && len(creator.Metadata.ID) > 0 {
+		g.AttributedTo = pub.IRI(creator.Metadata.ID)
+	}
+	c := Account{
+		Handle:    name,
+		CreatedBy: &creator,
+		Metadata:  &AccountMetadata{Blurb: []byte(summary)},
+		pub:       g,
+	}
+	return r.SaveAccount(ctx, c)
+}
+
+// AnnounceInCommunity shares the item from the community Group actor to its followers,
+// the way Lemmy communities distribute their posts to the subscribed servers.
+// The activity is posted to the outbox of the Group actor, with a token of its own.
+func (r *repository) AnnounceInCommunity(ctx context.Context, c Account, it Item) error {
+	if !c.HasMetadata() || len(c.Metadata.ID) == 0 || !it.HasMetadata() || len(it.Metadata.ID) == 0 {
+		return errors.NotValidf("invalid community or item")
+	}
+	r, err := r.asAccount(ctx, c)
+	if err != nil {
+		return err
+	}
+	act := &pub.Activity{
+		Type:   pub.AnnounceType,
+		Actor:  pub.IRI(c.Metadata.ID),
+		Object: pub.IRI(it.Metadata.ID),
+		To:     pub.ItemCollection{pub.PublicNS},
+		BCC:    pub.ItemCollection{r.fedbox.Service().ID},
+	}
+	if len(c.Metadata.FollowersIRI) > 0 {
+		act.CC = pub.ItemCollection{pub.IRI(c.Metadata.FollowersIRI)}
+	}
+	if _, _, err := r.toOutbox(ctx, act); err != nil {
+		return errors.Annotatef(err, "unable to announce item in community %s", c.Handle)
+	}
+	return nil
+}
+
+// AcceptCommunityFollow accepts the Follow of the community Group actor, as communities don't need their
+// subscriptions approved, so the remote servers start receiving its Announces.
+func (r *repository) AcceptCommunityFollow(ctx context.Context, c Account, follow *pub.Activity) error {
+	if !c.HasMetadata() || len(c.Metadata.ID) == 0 || follow == nil || follow.Actor == nil {
+		return errors.NotValidf("invalid community or follow")
+	}
+	r, err := r.asAccount(ctx, c)
+	if err != nil {
+		return err
+	}
+	act := &pub.Activity{
+		Type:   pub.AcceptType,
+		Actor:  pub.IRI(c.Metadata.ID),
+		Object: follow,
+		To:     pub.ItemCollection{follow.Actor.GetLink()},
+	}
+	if _, _, err := r.toOutbox(ctx, act); err != nil {
+		return errors.Annotatef(err, "unable to accept follow of community %s", c.Handle)
+	}
+	return nil
+}
+
+// addressedTo returns true if iri is one of the recipients of the activity or of its object
+func addressedTo(act *pub.Activity, iri pub.IRI) bool {
+	contains := func(col pub.ItemCollection) bool {
+		for _, it := range col {
+			if it != nil && it.GetLink().Equals(iri, false) {
+				return true
+			}
+		}
+		return false
+	}
+	found := contains(act.To) || contains(act.CC) || contains(act.BCC) || contains(act.Audience)
+	if !found && act.Object != nil {
+		pub.OnObject(act.Object, func(o *pub.Object) error {
+			found = contains(o.To) || contains(o.CC) || contains(o.BCC) || contains(o.Audience)
+			return nil
+		})
+	}
+	return found
+}
+
+// communityInboxActivity does what Lemmy communities do for the activities they receive from other servers:
+// it accepts the Follows of the Group actor, and announces to its followers the objects created for it.
+func (h *handler) communityInboxActivity(ctx context.Context, c *Community, act *pub.Activity) error {
+	if c == nil || c.Account == nil || !c.Account.HasMetadata() {
+		return nil
+	}
+	group := pub.IRI(c.Account.Metadata.ID)
+	switch act.Type {
+	case pub.FollowType:
+		if act.Object == nil || !act.Object.GetLink().Equals(group, false) {
+			return nil
+		}
+		return h.storage.AcceptCommunityFollow(ctx, *c.Account, act)
+	case pub.CreateType:
+		if act.Object == nil || !ValidContentTypes.Contains(act.Object.GetType()) || !addressedTo(act, group) {
+			return nil
+		}
+		it := Item{Metadata: &ItemMetadata{ID: act.Object.GetLink().String()}}
+		return h.storage.AnnounceInCommunity(ctx, *c.Account, it)
+	}
+	return nil
+}
+
+// LoadCommunityMw loads the community with the name from the URL, and sets it as the author for the
+// request, so the account handlers (follow, ActivityPub representation) work for it the same as for users.
+func (h *handler) LoadCommunityMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		acc, err := h.storage.LoadCommunity(context.TODO(), name)
+		if err != nil {
+			h.ErrorHandler(errors.NewNotFound(err, "community %q", name)).ServeHTTP(w, r)
+			return
+		}
+		c, err := h.loadCommunitySettings(*acc)
+		if err != nil {
+			h.errFn(log.Ctx{"err": err, "community": name})("unable to load community settings")
+			c = &Community{Name: acc.Handle, Account: acc}
+		}
+		ctx := context.WithValue(r.Context(), AuthorCtxtKey, []Account{*acc})
+		ctx = context.WithValue(ctx, CommunityCtxtKey, c)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CommunityListingModelMw creates the listing model for a community page
+func CommunityListingModelMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := ContextCommunity(r.Context())
+		if c == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		m := new(listingModel)
+		m.tpl = "community"
+		m.sortFn = ByDate
+		m.User = c.Account
+		m.Community = c
+		m.Title = fmt.Sprintf("Community %s", c.Name)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ModelCtxtKey, m)))
+	})
+}
+
+// CommunityFiltersMw loads the top level items from the community's inbox,
+// which is where remote servers deliver the submissions addressed to the Group actor
+func CommunityFiltersMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := FiltersFromRequest(r)
+		f.Type = CreateActivitiesFilter
+		f.Object = new(Filters)
+		f.Object.OP = nilIRIs
+		f.Object.Type = ActivityTypesFilter(ValidContentTypes...)
+		ctx := context.WithValue(r.Context(), FilterCtxtKey, []*Filters{f})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// LoadCommunityInboxMw loads the items from the community's inbox, without the ones a moderator removed
+func LoadCommunityInboxMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := ContextCommunity(r.Context())
+		if c == nil || c.Account == nil {
+			ctxtErr(next, w, r, errors.NotFoundf("community not found"))
+			return
+		}
+		f := ContextActivityFilters(r.Context())
+		repo := ContextRepository(r.Context())
+		cursor, err := repo.LoadActorInbox(context.TODO(), c.Account.pub, f...)
+		if err != nil {
+			ctxtErr(next, w, r, errors.Annotatef(err, "unable to load the inbox of community %s", c.Name))
+			return
+		}
+		for h := range cursor.items {
+			if c.IsRemoved(h) {
+				delete(cursor.items, h)
+			}
+		}
+		ctx := context.WithValue(r.Context(), CursorCtxtKey, cursor)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CommunitiesFiltersMw loads the Group actors created on the instance
+func CommunitiesFiltersMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := FiltersFromRequest(r)
+		f.Type = CreateActivitiesFilter
+		f.Object = &Filters{
+			Type: ActivityTypesFilter(pub.GroupType),
+		}
+		m := ContextListingModel(r.Context())
+		m.tpl = "communities"
+		m.Title = "Communities"
+		ctx := context.WithValue(r.Context(), FilterCtxtKey, []*Filters{f})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// CommunityContentModelMw prepares the submission form for a community
+func CommunityContentModelMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c := ContextCommunity(r.Context()); c != nil {
+			if m := ContextContentModel(r.Context()); m != nil {
+				m.Title = fmt.Sprintf("Add new submission to %s", c.Name)
+				m.Message.Label = fmt.Sprintf("Add new submission to %s:", c.Name)
+				m.Message.Back = AccountPermaLink(c.Account)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandleCreateCommunity serves POST /c requests
+func (h *handler) HandleCreateCommunity(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	ctx := context.TODO()
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	if !communityNameRegexp.MatchString(name) {
+		h.v.addFlashMessage(Error, w, r, "The community name needs to have between 3 and 32 letters, digits or underscores")
+		h.v.Redirect(w, r, "/c", http.StatusSeeOther)
+		return
+	}
+	existing, err := h.storage.accounts(ctx, &Filters{Name: CompStrs{EqualsString(name)}, MaxItems: 1})
+	if err != nil {
+		h.v.HandleErrors(w, r, errors.NewBadRequest(err, "unable to verify community %s", name))
+		return
+	}
+	if len(existing) > 0 {
+		h.v.addFlashMessage(Error, w, r, fmt.Sprintf("The name %s is already taken", name))
+		h.v.Redirect(w, r, "/c", http.StatusSeeOther)
+		return
+	}
+	g, err := h.requestRepository(r).SaveCommunity(ctx, *acc, name, strings.TrimSpace(r.PostFormValue("summary")))
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "community": name})("unable to create community")
+		h.v.HandleErrors(w, r, err)
+		return
+	}
+	c := &Community{Name: name, Account: &g}
+	err = h.updateCommunitySettings(c, func(c *Community) error {
+		c.Owner = acc.Handle
+		return nil
+	})
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "community": name})("unable to save community settings")
+	}
+	h.v.Redirect(w, r, AccountPermaLink(&g), http.StatusSeeOther)
+}
+
+// parseModerators splits the comma or space separated list of handles
+func parseModerators(s string) []string {
+	mods := make([]string, 0)
+	for _, m := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\n' || r == '\r' }) {
+		m = strings.TrimPrefix(m, "~")
+		if len(m) > 0 && !stringInSlice(mods)(m) {
+			mods = append(mods, m)
+		}
+	}
+	return mods
+}
+
+// HandleCommunitySettings serves POST /c/{name}/settings requests
+func (h *handler) HandleCommunitySettings(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	c := ContextCommunity(r.Context())
+	if !c.IsModerator(acc) {
+		h.v.HandleErrors(w, r, errors.Forbiddenf("only the community moderators can change its settings"))
+		return
+	}
+	back := AccountPermaLink(c.Account)
+	rules := make(ContentRules, 0)
+	if raw := strings.TrimSpace(r.PostFormValue("rules")); len(raw) > 0 {
+		if err := json.Unmarshal([]byte(raw), &rules); err != nil {
+			h.v.addFlashMessage(Error, w, r, fmt.Sprintf("Invalid rules: %s", err))
+			h.v.Redirect(w, r, back, http.StatusSeeOther)
+			return
+		}
+	}
+	err := h.updateCommunitySettings(c, func(c *Community) error {
+		c.Moderators = parseModerators(r.PostFormValue("moderators"))
+		c.Rules = rules
+		return nil
+	})
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "community": c.Name})("unable to save community settings")
+		h.v.addFlashMessage(Error, w, r, fmt.Sprintf("Unable to save settings: %s", err))
+	} else {
+		h.v.addFlashMessage(Success, w, r, "Community settings saved")
+	}
+	h.v.Redirect(w, r, back, http.StatusSeeOther)
+}
+
+// HandleCommunityRemove serves POST /c/{name}/rm requests, which hide an item from the community listing
+func (h *handler) HandleCommunityRemove(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	c := ContextCommunity(r.Context())
+	if !c.IsModerator(acc) {
+		h.v.HandleErrors(w, r, errors.Forbiddenf("only the community moderators can remove submissions"))
+		return
+	}
+	hash := HashFromString(r.PostFormValue("hash"))
+	if !hash.IsValid() {
+		h.v.HandleErrors(w, r, errors.NotValidf("invalid item"))
+		return
+	}
+	err := h.updateCommunitySettings(c, func(c *Community) error {
+		if !c.Removed.Contains(hash) {
+			c.Removed = append(c.Removed, hash)
+		}
+		return nil
+	})
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "community": c.Name, "hash": hash})("unable to remove item from community")
+		h.v.HandleErrors(w, r, err)
+		return
+	}
+	h.infoFn(log.Ctx{"community": c.Name, "hash": hash, "by": acc.Handle})("removed item from community")
+	h.v.addFlashMessage(Success, w, r, "Submission removed from the community")
+	h.v.Redirect(w, r, AccountPermaLink(c.Account), http.StatusSeeOther)
+}
@@ -0,0 +1,104 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/mariusor/go-littr/internal/config"
+)
+
+func TestCommunity_IsModerator(t *testing.T) {
+	prev := Instance.Conf
+	Instance.Conf = &config.Configuration{Moderators: []string{"admin"}}
+	defer func() { Instance.Conf = prev }()
+
+	c := &Community{Name: "golang", Owner: "johndoe", Moderators: []string{"janedoe"}}
+	tests := []struct {
+		handle string
+		want   bool
+	}{
+		{handle: "admin", want: true},
+		{handle: "johndoe", want: true},
+		{handle: "janedoe", want: true},
+		{handle: "someone", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.handle, func(t *testing.T) {
+			acc := &Account{Handle: tt.handle, CreatedAt: time.Now()}
+			if got := c.IsModerator(acc); got != tt.want {
+				t.Errorf("IsModerator() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+	if c.IsModerator(&AnonymousAccount) {
+		t.Errorf("IsModerator() = true for anonymous account")
+	}
+	var nilCommunity *Community
+	if nilCommunity.IsModerator(&Account{Handle: "johndoe", CreatedAt: time.Now()}) {
+		t.Errorf("IsModerator() = true for nil community")
+	}
+}
+
+func TestParseModerators(t *testing.T) {
+	got := parseModerators("johndoe, ~janedoe\njohndoe  admin")
+	want := []string{"johndoe", "janedoe", "admin"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseModerators() = %v, want %v", got, want)
+	}
+}
+
+func TestCommunity_compile(t *testing.T) {
+	c := &Community{Rules: ContentRules{{Name: "no-spam", Title: "(?i)buy now", Action: RuleActionReject}}}
+	if err := c.compile(); err != nil {
+		t.Fatalf("compile() error = %s", err)
+	}
+	it := Item{Title: "Buy now, cheap watches"}
+	if r := c.Rules.Match(it, Account{}); r == nil || r.Name != "no-spam" {
+		t.Errorf("Match() = %v, want rule no-spam", r)
+	}
+
+	c.Rules = ContentRules{{Name: "invalid", Title: "(", Action: RuleActionFlag}}
+	if err := c.compile(); err == nil {
+		t.Errorf("compile() expected error for invalid expression")
+	}
+}
+
+func TestAddressedTo(t *testing.T) {
+	group := pub.IRI("https://littr.example/c/golang")
+	tests := map[string]struct {
+		act  *pub.Activity
+		want bool
+	}{
+		"to": {
+			act:  &pub.Activity{Type: pub.CreateType, To: pub.ItemCollection{group}},
+			want: true,
+		},
+		"audience": {
+			act:  &pub.Activity{Type: pub.CreateType, Audience: pub.ItemCollection{group}},
+			want: true,
+		},
+		"object cc": {
+			act: &pub.Activity{
+				Type:   pub.CreateType,
+				To:     pub.ItemCollection{pub.PublicNS},
+				Object: &pub.Object{Type: pub.NoteType, CC: pub.ItemCollection{group}},
+			},
+			want: true,
+		},
+		"other recipients": {
+			act: &pub.Activity{
+				Type:   pub.CreateType,
+				To:     pub.ItemCollection{pub.PublicNS},
+				Object: &pub.Object{Type: pub.NoteType, CC: pub.ItemCollection{pub.IRI("https://littr.example/c/rust")}},
+			},
+			want: false,
+		},
+	}
+	for name, tt := range tests {
+		if got := addressedTo(tt.act, group); got != tt.want {
+			t.Errorf("%s: addressedTo() = %t, want %t", name, got, tt.want)
+		}
+	}
+}
@@ -15,6 +15,10 @@ type FlagBits uint8
 const (
 	FlagsDeleted = FlagBits(1 << iota)
 	FlagsPrivate
+	FlagsLocked
+	FlagsSticky
+	FlagsArchived
+	FlagsModeratorLocked
 
 	FlagsNone = FlagBits(0)
 )
@@ -105,6 +109,7 @@ type Item struct {
 	MimeType    string            `json:"-"`
 	Data        string            `json:"-"`
 	Score       int               `json:"-"`
+	Votes       VoteTally         `json:"-"`
 	SubmittedAt time.Time         `json:"-"`
 	SubmittedBy *Account          `json:"by,omitempty"`
 	UpdatedAt   time.Time         `json:"-"`
@@ -118,6 +123,14 @@ type Item struct {
 	children    ItemPtrCollection `json:"-"`
 }
 
+// RankScore returns the score used for ordering the item, with the remote votes weighted according to the configuration
+func (i Item) RankScore() float64 {
+	if i.Votes == (VoteTally{}) {
+		return float64(i.Score)
+	}
+	return i.Votes.Weighted(remoteVoteWeight())
+}
+
 func (i Item) ID() Hash {
 	return i.Hash
 }
@@ -234,7 +247,8 @@ func (h ItemPtrCollection) Sorted() ItemPtrCollection {
 	sort.SliceStable(h, func(i, j int) bool {
 		ii := h[i]
 		ij := h[j]
-		return ii.Score > ij.Score || (ii.Score == ij.Score && ii.SubmittedAt.After(ij.SubmittedAt))
+		si, sj := ii.RankScore(), ij.RankScore()
+		return si > sj || (si == sj && ii.SubmittedAt.After(ij.SubmittedAt))
 	})
 	return h
 }
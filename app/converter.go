@@ -130,10 +130,8 @@ func FromActor(a *Account, p *pub.Actor) error {
 		a.Metadata.LikedIRI = p.Liked.GetLink().String()
 	}
 	if block, _ := pem.Decode([]byte(p.PublicKey.PublicKeyPem)); block != nil {
-		pub := make([]byte, base64.StdEncoding.EncodedLen(len(block.Bytes)))
-		base64.StdEncoding.Encode(pub, block.Bytes)
 		a.Metadata.Key = &SSHKey{
-			Public: pub,
+			Public: block.Bytes,
 		}
 	}
 	if p.Endpoints != nil {
@@ -708,8 +706,8 @@ func (c *TagCollection) FromActivityPub(col pub.ItemCollection) error {
 func LoadFromActivityPubItem(it pub.Item) (Renderable, error) {
 	var (
 		result Renderable
-		err error
-		typ = it.GetType()
+		err    error
+		typ    = it.GetType()
 	)
 
 	if typ == pub.FollowType {
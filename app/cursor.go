@@ -55,7 +55,7 @@ func (r *RenderableList) Append(others ...Renderable) {
 	}
 }
 
-func ByDate (r RenderableList) []Renderable {
+func ByDate(r RenderableList) []Renderable {
 	rl := make([]Renderable, 0)
 	for _, rr := range r {
 		rl = append(rl, rr)
@@ -71,14 +71,14 @@ func ByDate (r RenderableList) []Renderable {
 				subOrder := ii.SubmittedAt.After(ij.SubmittedAt)
 				subSame := ii.SubmittedAt.Sub(ij.SubmittedAt) == 0
 				updOrder := ii.UpdatedAt.After(ij.UpdatedAt)
-				return oki && okj && ( subOrder || (subSame && updOrder))
+				return oki && okj && (subOrder || (subSame && updOrder))
 			}
 		}
 		return ri.Date().After(rj.Date())
 	})
 	return rl
 }
-func ByScore (r RenderableList) []Renderable {
+func ByScore(r RenderableList) []Renderable {
 	rl := make([]Renderable, 0)
 	for _, rr := range r {
 		rl = append(rl, rr)
@@ -91,8 +91,11 @@ func ByScore (r RenderableList) []Renderable {
 			case CommentType:
 				ii, oki := ri.(*Item)
 				ij, okj := rj.(*Item)
-				hi := Hacker(int64(ii.Score), time.Now().Sub(ii.SubmittedAt))
-				hj := Hacker(int64(ij.Score), time.Now().Sub(ij.SubmittedAt))
+				if oki && okj && ii.Sticky() != ij.Sticky() {
+					return ii.Sticky()
+				}
+				hi := Hacker(ii.RankScore(), time.Now().Sub(ii.SubmittedAt))
+				hj := Hacker(ij.RankScore(), time.Now().Sub(ij.SubmittedAt))
 				return oki && okj && hi > hj
 			}
 		}
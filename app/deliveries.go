@@ -0,0 +1,445 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+	"github.com/go-ap/errors"
+	"github.com/go-chi/chi"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+const (
+	// deliveryRetention is how long we keep the delivery status of outgoing activities
+	deliveryRetention   = 7 * 24 * time.Hour
+	deliveriesMaxListed = 100
+	deliveryQueueSize   = 256
+)
+
+type DeliveryState string
+
+const (
+	DeliveryPending   DeliveryState = "pending"
+	DeliveryDelivered DeliveryState = "delivered"
+	DeliveryFailed    DeliveryState = "failed"
+)
+
+// Delivery holds the status of delivering an outgoing activity to one remote inbox
+type Delivery struct {
+	Inbox       string        `json:"inbox"`
+	State       DeliveryState `json:"state"`
+	Attempts    int           `json:"attempts,omitempty"`
+	LastAttempt time.Time     `json:"lastAttempt,omitempty"`
+	StatusCode  int           `json:"statusCode,omitempty"`
+	Error       string        `json:"error,omitempty"`
+}
+
+// OutgoingActivity is an activity littr submitted to the FedBOX outbox, together with the remote
+// inboxes it has to reach
+type OutgoingActivity struct {
+	Hash       Hash            `json:"hash"`
+	ID         string          `json:"id"`
+	Type       string          `json:"type"`
+	Actor      string          `json:"actor"`
+	Published  time.Time       `json:"published"`
+	Resolved   bool            `json:"resolved,omitempty"`
+	Activity   json.RawMessage `json:"activity"`
+	Deliveries []Delivery      `json:"deliveries,omitempty"`
+}
+
+// Count returns the number of deliveries in state st
+func (o OutgoingActivity) Count(st DeliveryState) int {
+	cnt := 0
+	for _, d := range o.Deliveries {
+		if d.State == st {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// State summarizes the state of the deliveries: failed if any of them failed, pending if any of them
+// wasn't attempted yet, or delivered
+func (o OutgoingActivity) State() DeliveryState {
+	if !o.Resolved || o.Count(DeliveryPending) > 0 {
+		return DeliveryPending
+	}
+	if o.Count(DeliveryFailed) > 0 {
+		return DeliveryFailed
+	}
+	return DeliveryDelivered
+}
+
+// retry marks the failed deliveries as pending again, and returns true if there were any
+func (o *OutgoingActivity) retry() bool {
+	retry := !o.Resolved
+	for i, d := range o.Deliveries {
+		if d.State == DeliveryFailed {
+			o.Deliveries[i].State = DeliveryPending
+			retry = true
+		}
+	}
+	return retry
+}
+
+// deliveries keeps track of the outgoing activities and delivers them to the remote inboxes, signed
+// with the keys of their actors.
+type deliveries struct {
+	store *fileStore
+	queue chan Hash
+	// queued counts the activities in the queue and the one being delivered, see repository.Flush
+	queued sync.WaitGroup
+}
+
+func newDeliveries(store *fileStore) *deliveries {
+	return &deliveries{
+		store: store,
+		queue: make(chan Hash, deliveryQueueSize),
+	}
+}
+
+// Track stores the outgoing activity and queues it for delivery
+func (d *deliveries) Track(act pub.Item) error {
+	if d == nil || d.store == nil || act == nil {
+		return nil
+	}
+	o := OutgoingActivity{}
+	err := pub.OnActivity(act, func(a *pub.Activity) error {
+		o.Hash = HashFromIRI(a.GetLink())
+		o.ID = a.GetLink().String()
+		o.Type = string(a.GetType())
+		if a.Actor != nil {
+			o.Actor = a.Actor.GetLink().String()
+		}
+		o.Published = a.Published
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !o.Hash.IsValid() {
+		return errors.NotValidf("invalid activity IRI %s", o.ID)
+	}
+	if o.Published.IsZero() {
+		o.Published = time.Now().UTC()
+	}
+	if o.Activity, err = json.Marshal(act); err != nil {
+		return errors.Annotatef(err, "unable to marshal activity %s", o.ID)
+	}
+	if err = d.store.Save(o.Hash.String(), o); err != nil {
+		return err
+	}
+	d.enqueue(o.Hash)
+	return nil
+}
+
+func (d *deliveries) enqueue(h Hash) {
+	d.queued.Add(1)
+	select {
+	case d.queue <- h:
+	default:
+		d.queued.Done()
+		// NOTE(marius): the queue is full, the activity stays pending until it's retried manually
+	}
+}
+
+// Load returns the outgoing activity with the hash h
+func (d *deliveries) Load(h Hash) (OutgoingActivity, error) {
+	o := OutgoingActivity{}
+	if d == nil || d.store == nil {
+		return o, errors.NotFoundf("activity %s not found", h)
+	}
+	err := d.store.Load(h.String(), &o)
+	return o, err
+}
+
+// Recent returns the latest outgoing activities, newest first, and removes the expired ones
+func (d *deliveries) Recent() ([]OutgoingActivity, error) {
+	recent := make([]OutgoingActivity, 0)
+	if d == nil || d.store == nil {
+		return recent, nil
+	}
+	keys, err := d.store.Keys()
+	if err != nil {
+		return recent, err
+	}
+	for _, k := range keys {
+		o := OutgoingActivity{}
+		if err := d.store.Load(k, &o); err != nil {
+			continue
+		}
+		if time.Since(o.Published) > deliveryRetention {
+			d.store.Delete(k)
+			continue
+		}
+		recent = append(recent, o)
+	}
+	sort.SliceStable(recent, func(i, j int) bool {
+		return recent[i].Published.After(recent[j].Published)
+	})
+	if len(recent) > deliveriesMaxListed {
+		recent = recent[:deliveriesMaxListed]
+	}
+	return recent, nil
+}
+
+// Retry queues the failed deliveries of the activity with the hash h again
+func (d *deliveries) Retry(h Hash) error {
+	if d == nil || d.store == nil {
+		return errors.NotFoundf("activity %s not found", h)
+	}
+	o := OutgoingActivity{}
+	retry := false
+	err := d.store.Update(h.String(), &o, func() error {
+		if !o.Hash.IsValid() {
+			return errors.NotFoundf("activity %s not found", h)
+		}
+		retry = o.retry()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if !retry {
+		return errors.NotValidf("activity %s has no failed deliveries", h)
+	}
+	d.enqueue(h)
+	return nil
+}
+
+// toOutbox submits the activity to the FedBOX outbox, and tracks its delivery to the remote recipients
+func (r *repository) toOutbox(ctx context.Context, act pub.Item) (pub.IRI, pub.Item, error) {
+	iri, ob, err := r.fedbox.ToOutbox(ctx, act)
+	if err != nil {
+		return iri, ob, err
+	}
+	tracked := ob
+	if tracked == nil || !pub.ActivityTypes.Contains(tracked.GetType()) {
+		tracked = act
+		pub.OnActivity(tracked, func(a *pub.Activity) error {
+			if len(a.ID) == 0 {
+				a.ID = iri
+			}
+			return nil
+		})
+	}
+	if err := r.deliveries.Track(tracked); err != nil {
+		r.errFn(log.Ctx{"err": err, "iri": iri})("unable to track activity delivery")
+	}
+	return iri, ob, nil
+}
+
+// deliveryInboxes returns the inboxes of the remote recipients of the activity.
+// The local collections, like the followers of the actor, are expanded to their remote members, while
+// the local actors are skipped, as FedBOX delivers to them.
+func (r *repository) deliveryInboxes(ctx context.Context, act pub.Item) []string {
+	recipients := make(pub.ItemCollection, 0)
+	pub.OnActivity(act, func(a *pub.Activity) error {
+		recipients = append(recipients, a.To...)
+		recipients = append(recipients, a.Bto...)
+		recipients = append(recipients, a.CC...)
+		recipients = append(recipients, a.BCC...)
+		return nil
+	})
+	actors := make(pub.IRIs, 0)
+	for _, rec := range recipients {
+		iri := rec.GetLink()
+		if iri == pub.PublicNS || actors.Contains(iri) {
+			continue
+		}
+		if !HostIsLocal(iri.String()) {
+			actors = append(actors, iri)
+			continue
+		}
+		members := func(ctx context.Context, f *Filters) (pub.CollectionInterface, error) {
+			return r.fedbox.Collection(ctx, iri, Values(f))
+		}
+		err := LoadFromCollection(ctx, members, &colCursor{filters: &Filters{MaxItems: MaxContentItems}}, func(col pub.CollectionInterface) (bool, error) {
+			for _, it := range col.Collection() {
+				if it == nil || HostIsLocal(it.GetLink().String()) || actors.Contains(it.GetLink()) {
+					continue
+				}
+				actors = append(actors, it.GetLink())
+			}
+			// NOTE(marius): we need all the members of the collection, so we keep loading the next pages
+			return false, nil
+		})
+		if err != nil {
+			r.errFn(log.Ctx{"err": err, "iri": iri})("unable to load recipients collection")
+		}
+	}
+	inboxes := make([]string, 0)
+	for _, iri := range actors {
+		it, err := loadRemote(ctx, iri)
+		if err != nil {
+			r.errFn(log.Ctx{"err": err, "iri": iri})("unable to load remote recipient")
+			continue
+		}
+		pub.OnActor(it, func(a *pub.Actor) error {
+			inbox := a.Inbox
+			if a.Endpoints != nil && a.Endpoints.SharedInbox != nil {
+				inbox = a.Endpoints.SharedInbox
+			}
+			if inbox != nil && !stringInSlice(inboxes)(inbox.GetLink().String()) {
+				inboxes = append(inboxes, inbox.GetLink().String())
+			}
+			return nil
+		})
+	}
+	return inboxes
+}
+
+// postToInbox delivers the activity to a remote inbox, and returns the status code of the response
+func postToInbox(ctx context.Context, inbox string, body []byte, sign client.RequestSignFn) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		return 0, errors.Annotatef(err, "invalid inbox %s", inbox)
+	}
+	req.Header.Set("Content-Type", activityJsonMimeType)
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("Digest", bodyDigest(body))
+	req.Header.Set("User-Agent", client.UserAgent)
+	if err := sign(req); err != nil {
+		return 0, errors.Annotatef(err, "unable to sign request")
+	}
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, webFingerMaxBodyBytes))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errors.Newf("%s responded with %s", inbox, resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// deliver attempts the pending deliveries of the activity with the hash h
+func (r *repository) deliver(ctx context.Context, h Hash) error {
+	d := r.deliveries
+	o, err := d.Load(h)
+	if err != nil {
+		return err
+	}
+	act, err := pub.UnmarshalJSON(o.Activity)
+	if err != nil {
+		return errors.Annotatef(err, "invalid activity %s", o.ID)
+	}
+	if !o.Resolved {
+		for _, inbox := range r.deliveryInboxes(ctx, act) {
+			o.Deliveries = append(o.Deliveries, Delivery{Inbox: inbox, State: DeliveryPending})
+		}
+		o.Resolved = true
+	}
+
+	sign := r.deliverySigner(ctx, o.Actor)
+	for i, del := range o.Deliveries {
+		if del.State != DeliveryPending {
+			continue
+		}
+		del.Attempts++
+		del.LastAttempt = time.Now().UTC()
+		del.StatusCode, del.Error = 0, ""
+		if sign == nil {
+			err = errors.Newf("no signing key available for %s", o.Actor)
+		} else {
+			del.StatusCode, err = postToInbox(ctx, del.Inbox, o.Activity, sign)
+		}
+		if err != nil {
+			del.State = DeliveryFailed
+			del.Error = err.Error()
+			r.errFn(log.Ctx{"err": err, "activity": o.ID, "inbox": del.Inbox})("activity delivery failed")
+		} else {
+			del.State = DeliveryDelivered
+		}
+		o.Deliveries[i] = del
+	}
+	return d.store.Save(h.String(), o)
+}
+
+// deliverySigner returns the function that signs the deliveries with the key of the actor.
+// The account is loaded for every activity, so its private key is only kept in memory while it's delivered.
+func (r *repository) deliverySigner(ctx context.Context, actor string) client.RequestSignFn {
+	if len(actor) == 0 {
+		return nil
+	}
+	acc, err := r.LoadAccount(ctx, pub.IRI(actor))
+	if err != nil || !acc.IsValid() {
+		r.errFn(log.Ctx{"err": err, "actor": actor})("unable to load the actor of the activity")
+		return nil
+	}
+	return r.withAccountS2S(acc)
+}
+
+// runDeliveries processes the delivery queue until ctx is done, then closes done.
+// The activity being delivered when ctx is done gets delivered to all its inboxes before we stop, the ones
+// still in the queue stay pending, and can be retried from the deliveries page.
+func (r *repository) runDeliveries(ctx context.Context, done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case h := <-r.deliveries.queue:
+			if err := r.deliver(context.Background(), h); err != nil {
+				r.errFn(log.Ctx{"err": err, "hash": h})("unable to deliver activity")
+			}
+			r.deliveries.queued.Done()
+		}
+	}
+}
+
+// Flush waits for the queued activities to be delivered, or for ctx to be done.
+// It's meant for the commands that exit after queueing their activities, as the activities queued while
+// it's waiting extend the wait.
+func (r *repository) Flush(ctx context.Context) error {
+	if r.deliveries == nil || r.stopDeliveries == nil {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		r.deliveries.queued.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return errors.Annotatef(ctx.Err(), "the queued activities were not delivered")
+	}
+}
+
+// HandleDeliveries serves GET /admin/deliveries, the delivery status of the recent outgoing activities
+func (h *handler) HandleDeliveries(w http.ResponseWriter, r *http.Request) {
+	m := &deliveriesModel{Title: "Outgoing deliveries"}
+	activities, err := h.storage.deliveries.Recent()
+	if err != nil {
+		h.errFn(log.Ctx{"err": err})("unable to load outgoing deliveries")
+		h.v.HandleErrors(w, r, errors.Annotatef(err, "unable to load outgoing deliveries"))
+		return
+	}
+	m.Activities = activities
+	h.v.RenderTemplate(r, w, m.Template(), m)
+}
+
+// HandleDeliveryRetry serves POST /admin/deliveries/{hash}/retry, queuing the failed deliveries again
+func (h *handler) HandleDeliveryRetry(w http.ResponseWriter, r *http.Request) {
+	hash := HashFromString(chi.URLParam(r, "hash"))
+	if err := h.storage.deliveries.Retry(hash); err != nil {
+		h.v.addFlashMessage(Error, w, r, fmt.Sprintf("Unable to retry delivery: %s", err))
+	} else {
+		h.infoFn(log.Ctx{"hash": hash, "by": loggedAccount(r).Handle})("retrying activity delivery")
+		h.v.addFlashMessage(Success, w, r, "The failed deliveries were queued again")
+	}
+	h.v.Redirect(w, r, "/admin/deliveries", http.StatusSeeOther)
+}
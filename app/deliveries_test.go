@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+)
+
+func TestOutgoingActivity_State(t *testing.T) {
+	o := OutgoingActivity{}
+	if st := o.State(); st != DeliveryPending {
+		t.Errorf("State() = %s for unresolved activity, want %s", st, DeliveryPending)
+	}
+	o.Resolved = true
+	if st := o.State(); st != DeliveryDelivered {
+		t.Errorf("State() = %s without recipients, want %s", st, DeliveryDelivered)
+	}
+	o.Deliveries = []Delivery{
+		{Inbox: "https://mastodon.example/inbox", State: DeliveryDelivered},
+		{Inbox: "https://lemmy.example/inbox", State: DeliveryFailed},
+	}
+	if st := o.State(); st != DeliveryFailed {
+		t.Errorf("State() = %s, want %s", st, DeliveryFailed)
+	}
+	if !o.retry() {
+		t.Errorf("retry() = false, expected the failed delivery to be retried")
+	}
+	if st := o.State(); st != DeliveryPending {
+		t.Errorf("State() = %s after retry, want %s", st, DeliveryPending)
+	}
+	if o.Count(DeliveryDelivered) != 1 || o.Count(DeliveryPending) != 1 {
+		t.Errorf("retry() changed the successful deliveries: %v", o.Deliveries)
+	}
+	if o.retry() {
+		t.Errorf("retry() = true, expected no failed deliveries")
+	}
+}
+
+func TestDeliveries_TrackAndRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newFileStore(dir, "deliveries")
+	if err != nil {
+		t.Fatalf("unable to create store: %s", err)
+	}
+	d := newDeliveries(store)
+
+	old := &pub.Activity{
+		ID:        "https://fedbox.littr.example/activities/0f1d5c8e-2f60-11eb-9d4b-0242ac130002",
+		Type:      pub.CreateType,
+		Actor:     pub.IRI("https://fedbox.littr.example/actors/johndoe"),
+		Published: time.Now().Add(-2 * deliveryRetention),
+	}
+	act := &pub.Activity{
+		ID:        "https://fedbox.littr.example/activities/f7e0bd1a-2f5f-11eb-9d4b-0242ac130002",
+		Type:      pub.LikeType,
+		Actor:     pub.IRI("https://fedbox.littr.example/actors/johndoe"),
+		Published: time.Now(),
+	}
+	for _, a := range []*pub.Activity{old, act} {
+		if err := d.Track(a); err != nil {
+			t.Fatalf("Track() error = %s", err)
+		}
+	}
+	if err := d.Track(&pub.Activity{ID: "https://fedbox.littr.example/activities/invalid", Type: pub.LikeType}); err == nil {
+		t.Errorf("Track() expected error for activity without a valid hash")
+	}
+	if len(d.queue) != 2 {
+		t.Errorf("queue has %d activities, want 2", len(d.queue))
+	}
+
+	recent, err := d.Recent()
+	if err != nil {
+		t.Fatalf("Recent() error = %s", err)
+	}
+	if len(recent) != 1 || recent[0].ID != act.ID.String() {
+		t.Fatalf("Recent() = %v, want only %s", recent, act.ID)
+	}
+
+	h := recent[0].Hash
+	o := recent[0]
+	o.Resolved = true
+	o.Deliveries = []Delivery{{Inbox: "https://mastodon.example/inbox", State: DeliveryFailed, Attempts: 1}}
+	if err := store.Save(h.String(), o); err != nil {
+		t.Fatalf("Save() error = %s", err)
+	}
+	if err := d.Retry(h); err != nil {
+		t.Fatalf("Retry() error = %s", err)
+	}
+	if o, _ = d.Load(h); o.State() != DeliveryPending {
+		t.Errorf("State() = %s after Retry(), want %s", o.State(), DeliveryPending)
+	}
+	if err := d.Retry(HashFromString("0f1d5c8e-2f60-11eb-9d4b-0242ac130002")); err == nil {
+		t.Errorf("Retry() expected error for expired activity")
+	}
+}
+
+func TestRepository_Flush(t *testing.T) {
+	r := &repository{deliveries: newDeliveries(nil), stopDeliveries: func() {}}
+	if err := r.Flush(context.Background()); err != nil {
+		t.Errorf("Flush() error = %s, with an empty queue", err)
+	}
+
+	h := HashFromString("6b3e5ba4-5b31-4b5d-9b1c-8e2d7c4f1a20")
+	r.deliveries.enqueue(h)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := r.Flush(ctx); err == nil {
+		t.Errorf("Flush() expected error while the activity is still queued")
+	}
+
+	// NOTE(marius): what runDeliveries does after delivering the activity
+	<-r.deliveries.queue
+	r.deliveries.queued.Done()
+	if err := r.Flush(context.Background()); err != nil {
+		t.Errorf("Flush() error = %s, after the queued activity was delivered", err)
+	}
+}
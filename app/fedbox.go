@@ -3,6 +3,7 @@ package app
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"net/url"
 	"path"
 
@@ -23,8 +24,10 @@ type fedbox struct {
 	baseURL pub.IRI
 	pub     *pub.Actor
 	client  *client.C
-	infoFn  CtxLogFn
-	errFn   CtxLogFn
+	// signer signs the requests of this copy of the fedbox client, see WithSigner
+	signer client.RequestSignFn
+	infoFn CtxLogFn
+	errFn  CtxLogFn
 }
 
 type OptionFn func(*fedbox) error
@@ -58,16 +61,34 @@ func SetURL(s string) OptionFn {
 
 func SetSignFn(signer client.RequestSignFn) OptionFn {
 	return func(f *fedbox) error {
-		f.client.SignFn(signer)
+		f.signer = signer
 		return nil
 	}
 }
 
-func (f *fedbox) SignFn(signer client.RequestSignFn) {
-	if signer == nil {
-		return
+// WithSigner returns a copy of f that signs its requests with signer.
+// The copies share the client, with its transport and caches, the service actor and the loggers with f. The
+// signer travels with the context of each request, so requests made on behalf of different accounts don't interfere.
+func (f *fedbox) WithSigner(signer client.RequestSignFn) *fedbox {
+	ff := *f
+	ff.signer = signer
+	return &ff
+}
+
+// signCtx returns the context for the requests of f, carrying its signer
+func (f fedbox) signCtx(ctx context.Context) context.Context {
+	if f.signer == nil {
+		return ctx
 	}
-	f.client.SignFn(signer)
+	return context.WithValue(ctx, SignerCtxtKey, f.signer)
+}
+
+// signRequest is the signing function of the shared client, it signs the request with the signer from its context
+func signRequest(req *http.Request) error {
+	if sign, ok := req.Context().Value(SignerCtxtKey).(client.RequestSignFn); ok && sign != nil {
+		return sign(req)
+	}
+	return nil
 }
 
 func SetUA(s string) OptionFn {
@@ -87,6 +108,13 @@ var optionLogFn = func(fn CtxLogFn) func(ctx ...client.Ctx) client.LogFn {
 	}
 }
 
+func newClient(infoFn, errFn CtxLogFn) *client.C {
+	return client.New(
+		client.SetErrorLogger(optionLogFn(errFn)),
+		client.SetInfoLogger(optionLogFn(infoFn)),
+	)
+}
+
 func NewClient(o ...OptionFn) (*fedbox, error) {
 	f := fedbox{
 		infoFn: defaultCtxLogFn,
@@ -98,10 +126,8 @@ func NewClient(o ...OptionFn) (*fedbox, error) {
 		}
 	}
 
-	f.client = client.New(
-		client.SetErrorLogger(optionLogFn(f.errFn)),
-		client.SetInfoLogger(optionLogFn(f.infoFn)),
-	)
+	f.client = newClient(f.infoFn, f.errFn)
+	f.client.SignFn(signRequest)
 	service, err := f.client.LoadIRI(f.baseURL)
 	if err != nil {
 		return &f, err
@@ -127,7 +153,7 @@ func (f fedbox) normaliseIRI(i pub.IRI) pub.IRI {
 }
 
 func (f fedbox) collection(ctx context.Context, i pub.IRI) (pub.CollectionInterface, error) {
-	it, err := f.client.CtxLoadIRI(ctx, f.normaliseIRI(i))
+	it, err := f.client.CtxLoadIRI(f.signCtx(ctx), f.normaliseIRI(i))
 	if err != nil {
 		return nil, errors.Annotatef(err, "Unable to load IRI: %s", i)
 	}
@@ -157,7 +183,7 @@ func (f fedbox) collection(ctx context.Context, i pub.IRI) (pub.CollectionInterf
 }
 
 func (f fedbox) object(ctx context.Context, i pub.IRI) (pub.Item, error) {
-	return f.client.CtxLoadIRI(ctx, f.normaliseIRI(i))
+	return f.client.CtxLoadIRI(f.signCtx(ctx), f.normaliseIRI(i))
 }
 
 func rawFilterQuery(f ...client.FilterFn) string {
@@ -365,7 +391,7 @@ func (f fedbox) ToOutbox(ctx context.Context, a pub.Item) (pub.IRI, pub.Item, er
 	if err := validateIRIForRequest(iri); err != nil {
 		return "", nil, errors.Annotatef(err, "Invalid Outbox IRI")
 	}
-	return f.client.CtxToCollection(ctx, f.normaliseIRI(iri), a)
+	return f.client.CtxToCollection(f.signCtx(ctx), f.normaliseIRI(iri), a)
 }
 
 func (f fedbox) ToInbox(ctx context.Context, a pub.Item) (pub.IRI, pub.Item, error) {
@@ -377,12 +403,21 @@ func (f fedbox) ToInbox(ctx context.Context, a pub.Item) (pub.IRI, pub.Item, err
 	if err := validateIRIForRequest(iri); err != nil {
 		return "", nil, errors.Annotatef(err, "Invalid Inbox IRI")
 	}
-	return f.client.CtxToCollection(ctx, f.normaliseIRI(iri), a)
+	return f.client.CtxToCollection(f.signCtx(ctx), f.normaliseIRI(iri), a)
+}
+
+// ToCollection posts the activity to the collection with the iri, used for forwarding received activities
+// to the FedBOX inboxes
+func (f fedbox) ToCollection(ctx context.Context, iri pub.IRI, a pub.Item) (pub.IRI, pub.Item, error) {
+	if err := validateIRIForRequest(iri); err != nil {
+		return "", nil, errors.Annotatef(err, "Invalid collection IRI")
+	}
+	return f.client.CtxToCollection(f.signCtx(ctx), f.normaliseIRI(iri), a)
 }
 
 func (f *fedbox) Service() *pub.Service {
 	if f.pub == nil {
-		return &pub.Actor{ ID: f.baseURL, Type: pub.ServiceType }
+		return &pub.Actor{ID: f.baseURL, Type: pub.ServiceType}
 	}
 	return f.pub
 }
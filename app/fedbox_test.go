@@ -1,6 +1,8 @@
 package app
 
 import (
+	"context"
+	"net/http"
 	"net/url"
 	"testing"
 )
@@ -36,7 +38,7 @@ func Test_RawFilterQuery(t *testing.T) {
 		}
 		var func2 = func() url.Values {
 			return url.Values{
-				"iri": {"foo", "bar"},
+				"iri":  {"foo", "bar"},
 				"type": {"typ"},
 			}
 		}
@@ -47,3 +49,27 @@ func Test_RawFilterQuery(t *testing.T) {
 		}
 	}
 }
+
+func TestFedbox_WithSigner(t *testing.T) {
+	f := &fedbox{client: newClient(defaultCtxLogFn, defaultCtxLogFn)}
+	signedBy := ""
+	ff := f.WithSigner(func(r *http.Request) error {
+		signedBy = "johndoe"
+		return nil
+	})
+	if ff.client != f.client {
+		t.Errorf("WithSigner() created a new client, expected the shared one")
+	}
+	if f.signer != nil {
+		t.Errorf("WithSigner() modified the signer of the original")
+	}
+
+	req, _ := http.NewRequestWithContext(f.signCtx(context.Background()), http.MethodGet, "https://fedbox.littr.example/", nil)
+	if err := signRequest(req); err != nil || len(signedBy) > 0 {
+		t.Errorf("signRequest() = %v, signed by %q, expected an unsigned request", err, signedBy)
+	}
+	req, _ = http.NewRequestWithContext(ff.signCtx(context.Background()), http.MethodGet, "https://fedbox.littr.example/", nil)
+	if err := signRequest(req); err != nil || signedBy != "johndoe" {
+		t.Errorf("signRequest() = %v, signed by %q, expected the request signed by the copy's signer", err, signedBy)
+	}
+}
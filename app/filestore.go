@@ -0,0 +1,134 @@
+package app
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/go-ap/errors"
+)
+
+// fileStore keeps the littr specific data that doesn't have a place in the FedBOX storage,
+// as JSON files in a local directory, one file per key.
+type fileStore struct {
+	m    sync.RWMutex
+	path string
+}
+
+// newFileStore creates the directory name under the base path and returns a store for it.
+// The stores keep private data, like signing keys and tokens, so there's no fallback to a temporary directory.
+func newFileStore(base, name string) (*fileStore, error) {
+	if len(base) == 0 {
+		return nil, errors.NotValidf("no storage path for %s, DATA_PATH needs to be set", name)
+	}
+	p := filepath.Join(base, name)
+	if err := os.MkdirAll(p, 0700); err != nil {
+		return nil, errors.Annotatef(err, "unable to create storage directory %s", p)
+	}
+	return &fileStore{path: p}, nil
+}
+
+func (s *fileStore) file(key string) (string, error) {
+	if len(key) == 0 || strings.ContainsAny(key, `/\`) || key == "." || key == ".." {
+		return "", errors.NotValidf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.path, key+".json"), nil
+}
+
+// writeJSONFile writes v to a temporary file and moves it over f, so readers never see partial writes
+func writeJSONFile(f string, v interface{}) error {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return errors.Annotatef(err, "unable to marshal %s", filepath.Base(f))
+	}
+	tmp := f + ".tmp"
+	if err := ioutil.WriteFile(tmp, dat, 0600); err != nil {
+		return errors.Annotatef(err, "unable to write %s", filepath.Base(f))
+	}
+	return os.Rename(tmp, f)
+}
+
+// Load unmarshals the value stored under key into v
+func (s *fileStore) Load(key string, v interface{}) error {
+	f, err := s.file(key)
+	if err != nil {
+		return err
+	}
+	s.m.RLock()
+	defer s.m.RUnlock()
+	dat, err := ioutil.ReadFile(f)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return errors.NotFoundf("%s not found", key)
+		}
+		return errors.Annotatef(err, "unable to read %s", key)
+	}
+	return json.Unmarshal(dat, v)
+}
+
+// Save stores v under key, replacing the previous value
+func (s *fileStore) Save(key string, v interface{}) error {
+	f, err := s.file(key)
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	return writeJSONFile(f, v)
+}
+
+// Update loads the value stored under key into v, calls fn and saves v back, all while holding the lock
+func (s *fileStore) Update(key string, v interface{}, fn func() error) error {
+	f, err := s.file(key)
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if dat, err := ioutil.ReadFile(f); err == nil {
+		if err := json.Unmarshal(dat, v); err != nil {
+			return errors.Annotatef(err, "unable to unmarshal %s", key)
+		}
+	} else if !os.IsNotExist(err) {
+		return errors.Annotatef(err, "unable to read %s", key)
+	}
+	if err := fn(); err != nil {
+		return err
+	}
+	return writeJSONFile(f, v)
+}
+
+// Delete removes the value stored under key
+func (s *fileStore) Delete(key string) error {
+	f, err := s.file(key)
+	if err != nil {
+		return err
+	}
+	s.m.Lock()
+	defer s.m.Unlock()
+	if err := os.Remove(f); err != nil && !os.IsNotExist(err) {
+		return errors.Annotatef(err, "unable to remove %s", key)
+	}
+	return nil
+}
+
+// Keys returns all the keys that have values in the store
+func (s *fileStore) Keys() ([]string, error) {
+	s.m.RLock()
+	defer s.m.RUnlock()
+	files, err := ioutil.ReadDir(s.path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to read storage directory %s", s.path)
+	}
+	keys := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.IsDir() || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		keys = append(keys, strings.TrimSuffix(f.Name(), ".json"))
+	}
+	return keys, nil
+}
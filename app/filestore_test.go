@@ -0,0 +1,55 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-ap/errors"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := newFileStore("", "test"); err == nil {
+		t.Errorf("newFileStore() should fail without a base path")
+	}
+	s, err := newFileStore(dir, "test")
+	if err != nil {
+		t.Fatalf("unable to create store: %s", err)
+	}
+	var val []string
+	if err := s.Load("missing", &val); !errors.IsNotFound(err) {
+		t.Errorf("Load() error = %v, expected not found", err)
+	}
+	if err := s.Save("../escape", val); err == nil {
+		t.Errorf("Save() should fail for keys containing path separators")
+	}
+	if err := s.Save("key", []string{"one"}); err != nil {
+		t.Fatalf("Save() error = %s", err)
+	}
+	err = s.Update("key", &val, func() error {
+		val = append(val, "two")
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Update() error = %s", err)
+	}
+	loaded := make([]string, 0)
+	if err := s.Load("key", &loaded); err != nil || len(loaded) != 2 || loaded[1] != "two" {
+		t.Errorf("Load() = %v, %v, expected [one two]", loaded, err)
+	}
+	if keys, err := s.Keys(); err != nil || len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("Keys() = %v, %v, expected [key]", keys, err)
+	}
+	if err := s.Delete("key"); err != nil {
+		t.Errorf("Delete() error = %s", err)
+	}
+	if err := s.Load("key", &loaded); !errors.IsNotFound(err) {
+		t.Errorf("Load() after Delete() error = %v, expected not found", err)
+	}
+}
@@ -82,8 +82,8 @@ func ContextActivityFilters(ctx context.Context) []*Filters {
 	return nil
 }
 
-func SelfFiltersMw(id pub.IRI) func (next http.Handler) http.Handler {
-	return func (next http.Handler) http.Handler {
+func SelfFiltersMw(id pub.IRI) func(next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			f := fedFilters(r)
 			f.Actor.IRI = CompStrs{LikeString(id.String())}
@@ -126,17 +126,16 @@ func fedFilters(r *http.Request) *Filters {
 	return f
 }
 
-func FederatedFiltersMw(id pub.IRI) func (next http.Handler) http.Handler {
-	return func (next http.Handler) http.Handler {
-		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			f := fedFilters(r)
-			f.Actor.IRI = CompStrs{DifferentThanString(id.String())}
-			m := ContextListingModel(r.Context())
-			m.Title = "Federated items"
-			ctx := context.WithValue(r.Context(), FilterCtxtKey, []*Filters{f})
-			next.ServeHTTP(w, r.WithContext(ctx))
-		})
-	}
+// FederatedFiltersMw loads the filters for the federated tab.
+// The local items get filtered out by LoadFederatedInboxMw, as FedBOX doesn't support negating filter values.
+func FederatedFiltersMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := fedFilters(r)
+		m := ContextListingModel(r.Context())
+		m.Title = "Federated items"
+		ctx := context.WithValue(r.Context(), FilterCtxtKey, []*Filters{f})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
 }
 
 func LikeString(s string) CompStr {
@@ -171,7 +170,7 @@ func DomainFiltersMw(next http.Handler) http.Handler {
 
 func tagsFilter(tag string) *Filters {
 	f := new(Filters)
-	f.Name = CompStrs{EqualsString(tag), EqualsString("#"+tag)}
+	f.Name = CompStrs{EqualsString(tag), EqualsString("#" + tag)}
 	return f
 }
 
@@ -244,7 +243,7 @@ func MessageFiltersMw(next http.Handler) http.Handler {
 			ctx := context.WithValue(r.Context(), FilterCtxtKey, []*Filters{&fc, &fv})
 			r = r.WithContext(ctx)
 		}
-		next.ServeHTTP(w,r)
+		next.ServeHTTP(w, r)
 	})
 }
 
@@ -352,6 +351,13 @@ func ModerationListing(next http.Handler) http.Handler {
 		ctx := context.TODO()
 		followups, _ := s.loadModerationFollowups(ctx, c.items)
 		c.items = aggregateModeration(c.items, followups)
+		if Instance.Conf.AnonymousModeration {
+			anonymizeModeration(c.items)
+		}
+		if accountIsModerator(loggedAccount(r)) {
+			s.loadModerationLineage(ctx, c.items)
+			s.loadModerationOriginals(ctx, c.items)
+		}
 
 		next.ServeHTTP(w, r)
 	})
@@ -22,15 +22,30 @@ const (
 	csrfName              = "_c"
 	sessionsCookieBackend = "cookie"
 	sessionsFSBackend     = "fs"
+	sessionsBoltBackend   = "boltdb"
 )
 
 type handler struct {
-	conf    appConfig
-	v       *view
-	storage *repository
-	logger  log.Logger
-	infoFn  CtxLogFn
-	errFn   CtxLogFn
+	conf          appConfig
+	v             *view
+	storage       *repository
+	rules         ContentRules
+	report        moderationReportCache
+	threads       *threadStates
+	communities   *fileStore
+	identities    identityStore
+	twoFactor     twoFactorStore
+	loginAttempts loginAttemptStore
+	accessTokens  accessTokenStore
+	sessions      sessionIndex
+	sshKeys       sshKeyStore
+	registrations registrationStore
+	held          heldStore
+	mailer        *mailer
+	nodeInfo      *NodeInfoResolver
+	logger        log.Logger
+	infoFn        CtxLogFn
+	errFn         CtxLogFn
 }
 
 var defaultAccount = AnonymousAccount
@@ -74,6 +89,11 @@ func Init(c appConfig) (*handler, error) {
 		}
 		h.logger = c.Logger
 	}
+	if len(c.DataPath) == 0 {
+		// NOTE(marius): the signing keys, two-factor secrets and access tokens are kept there, we don't want them
+		// ending up in a temporary directory
+		return nil, errors.NotValidf("no data path, DATA_PATH needs to be set")
+	}
 
 	if c.SessionsBackend = os.Getenv("SESSIONS_BACKEND"); c.SessionsBackend == "" {
 		c.SessionsBackend = sessionsFSBackend
@@ -100,45 +120,84 @@ func Init(c appConfig) (*handler, error) {
 			"tokURL":      config.Endpoint.TokenURL,
 			"redirectURL": config.RedirectURL,
 		}
-		if len(config.ClientID) > 0 {
-			oauth, err := h.storage.fedbox.Actor(context.TODO(), actors.IRI(h.storage.BaseURL()).AddPath(config.ClientID))
-			if err != nil {
-				h.conf.UserCreatingEnabled = false
-				h.errFn(log.Ctx{"err": err}, ctx)("Failed to authenticate client")
-			}
-			if oauth != nil {
-				h.storage.app = new(Account)
-				h.storage.app.FromActivityPub(oauth)
-
-				handle := h.storage.app.Handle
-				ctx["handle"] = handle
-				tok, err := config.PasswordCredentialsToken(context.TODO(), handle, config.ClientSecret)
-				if err != nil {
-					h.conf.UserCreatingEnabled = false
-					h.errFn(log.Ctx{"err": err}, ctx)("Failed to authenticate client")
-				} else {
-					if tok == nil {
-						h.conf.UserCreatingEnabled = false
-						h.errFn(ctx)("Failed to load a valid OAuth2 token for client")
-					}
-					h.storage.app.Metadata.OAuth.Provider = provider
-					h.storage.app.Metadata.OAuth.Token = tok
-					h.infoFn(ctx, log.Ctx{
-						"token":   hideString(tok.AccessToken),
-						"type":    tok.TokenType,
-						"refresh": hideString(tok.RefreshToken),
-					})("Loaded valid OAuth2 token for client")
-
-				}
-			}
-		} else {
+		if err := h.storage.loadApplicationAccount(context.TODO(), config); err != nil {
 			h.conf.UserCreatingEnabled = false
-			h.errFn(log.Ctx{"conf": config})("Failed to load OAuth2 ClientID")
+			h.errFn(log.Ctx{"err": err}, ctx)("Failed to authenticate client")
+		} else {
+			tok := h.storage.app.Metadata.OAuth.Token
+			ctx["handle"] = h.storage.app.Handle
+			h.infoFn(ctx, log.Ctx{
+				"token":   hideString(tok.AccessToken),
+				"type":    tok.TokenType,
+				"refresh": hideString(tok.RefreshToken),
+			})("Loaded valid OAuth2 token for client")
 		}
 	}
+	if h.storage != nil {
+		h.nodeInfo = NodeInfoResolverNew(h.storage.fedbox, h.errFn)
+	} else {
+		h.nodeInfo = NodeInfoResolverNew(nil, h.errFn)
+	}
+	if h.rules, err = LoadContentRules(c.ModerationRulesPath); err != nil {
+		h.errFn(log.Ctx{"err": err, "path": c.ModerationRulesPath})("Failed to load content rules")
+	} else if len(h.rules) > 0 {
+		h.infoFn(log.Ctx{"count": len(h.rules), "path": c.ModerationRulesPath})("Loaded content rules")
+	}
+	threadStore, err := newFileStore(c.DataPath, "threads")
+	if err != nil {
+		h.errFn(log.Ctx{"err": err})("Failed to initialize threads storage")
+	}
+	if h.threads, err = loadThreadStates(threadStore); err != nil {
+		h.errFn(log.Ctx{"err": err})("Failed to load threads state")
+	}
+	if h.communities, err = newFileStore(c.DataPath, "communities"); err != nil {
+		h.errFn(log.Ctx{"err": err})("Failed to initialize communities storage")
+	}
+	if h.identities.fileStore, err = newFileStore(c.DataPath, "identities"); err != nil {
+		h.errFn(log.Ctx{"err": err})("Failed to initialize identities storage")
+	}
+	if h.twoFactor.fileStore, err = newFileStore(c.DataPath, "2fa"); err != nil {
+		h.errFn(log.Ctx{"err": err})("Failed to initialize two-factor authentication storage")
+	}
+	if h.loginAttempts.fileStore, err = newFileStore(c.DataPath, "login-attempts"); err != nil {
+		h.errFn(log.Ctx{"err": err})("Failed to initialize login attempts storage")
+	}
+	if h.accessTokens.fileStore, err = newFileStore(c.DataPath, "tokens"); err != nil {
+		h.errFn(log.Ctx{"err": err})("Failed to initialize access tokens storage")
+	}
+	if h.sessions.fileStore, err = newFileStore(c.DataPath, "session-index"); err != nil {
+		h.errFn(log.Ctx{"err": err})("Failed to initialize session index storage")
+	}
+	if h.sshKeys.fileStore, err = newFileStore(c.DataPath, "ssh-keys"); err != nil {
+		h.errFn(log.Ctx{"err": err})("Failed to initialize SSH keys storage")
+	}
+	if h.registrations.fileStore, err = newFileStore(c.DataPath, "registrations"); err != nil {
+		h.errFn(log.Ctx{"err": err})("Failed to initialize registrations storage")
+	}
+	if h.held.fileStore, err = newFileStore(c.DataPath, "held"); err != nil {
+		h.errFn(log.Ctx{"err": err})("Failed to initialize held items storage")
+	}
+	if len(c.SMTPURL) > 0 {
+		from := c.MailFrom
+		if len(from) == 0 {
+			from = fmt.Sprintf("littr@%s", c.HostName)
+		}
+		if h.mailer, err = newMailer(c.SMTPURL, from); err != nil {
+			h.errFn(log.Ctx{"err": err})("Failed to initialize mailer")
+		}
+	}
+	if h.conf.RegistrationVerifyEmail && h.mailer == nil {
+		h.conf.RegistrationVerifyEmail = false
+		h.errFn()("Email verification needs a valid SMTP_URL, disabling it")
+	}
+	if len(c.RegistrationCaptcha) > 0 && !h.captchaEnabled() {
+		h.errFn(log.Ctx{"captcha": c.RegistrationCaptcha})("Invalid registration captcha type, valid are: pow, text")
+	}
 	h.v, err = ViewInit(h.conf, h.infoFn, h.errFn)
 	if err != nil {
 		h.errFn(log.Ctx{"err": err})("Error initializing view")
+	} else if h.v.s.enabled {
+		go h.v.s.collectGarbage(sessionsGCInterval, h.sessions)
 	}
 	return h, err
 }
@@ -150,55 +209,6 @@ func loggedAccount(r *http.Request) *Account {
 	return &defaultAccount
 }
 
-// HandleCallback serves /auth/{provider}/callback request
-func (h *handler) HandleCallback(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	provider := chi.URLParam(r, "provider")
-	providerErr := q["error"]
-	if providerErr != nil {
-		errDescriptions := q["error_description"]
-		var errs = make([]error, 1)
-		errs[0] = errors.Errorf("Error for provider %q:\n", provider)
-		for _, errDesc := range errDescriptions {
-			errs = append(errs, errors.Errorf(errDesc))
-		}
-		h.v.HandleErrors(w, r, errs...)
-		return
-	}
-	code := q.Get("code")
-	state := q.Get("state")
-	if len(code) == 0 {
-		h.v.HandleErrors(w, r, errors.Forbiddenf("%s error: Empty authentication token", provider))
-		return
-	}
-
-	conf := GetOauth2Config(provider, h.conf.BaseURL)
-	tok, err := conf.Exchange(r.Context(), code)
-	if err != nil {
-		h.errFn(log.Ctx{"err": err})("Unable to load token")
-		h.v.HandleErrors(w, r, err)
-		return
-	}
-
-	account := h.v.loadCurrentAccountFromSession(w, r)
-	account.Metadata.OAuth = OAuth{
-		State:    state,
-		Code:     code,
-		Provider: provider,
-		Token:    tok,
-	}
-
-	if strings.ToLower(provider) != "local" {
-		h.v.addFlashMessage(Success, w, r, fmt.Sprintf("Login successful with %s", provider))
-	} else {
-		h.v.addFlashMessage(Success, w, r, "Login successful")
-	}
-	if err := h.v.saveAccountToSession(w, r, account); err != nil {
-		h.errFn()("Unable to save account to session")
-	}
-	h.v.Redirect(w, r, "/", http.StatusFound)
-}
-
 func GetOauth2Config(provider string, localBaseURL string) oauth2.Config {
 	var config oauth2.Config
 	switch strings.ToLower(provider) {
@@ -210,15 +220,17 @@ func GetOauth2Config(provider string, localBaseURL string) oauth2.Config {
 				AuthURL:  "https://github.com/login/oauth/authorize",
 				TokenURL: "https://github.com/login/oauth/access_token",
 			},
+			Scopes: []string{"read:user"},
 		}
 	case "gitlab":
 		config = oauth2.Config{
 			ClientID:     os.Getenv("GITLAB_KEY"),
 			ClientSecret: os.Getenv("GITLAB_SECRET"),
 			Endpoint: oauth2.Endpoint{
-				AuthURL:  "https://gitlab.com/login/oauth/authorize",
-				TokenURL: "https://gitlab.com/login/oauth/access_token",
+				AuthURL:  "https://gitlab.com/oauth/authorize",
+				TokenURL: "https://gitlab.com/oauth/token",
 			},
+			Scopes: []string{"read_user"},
 		}
 	case "facebook":
 		config = oauth2.Config{
@@ -228,6 +240,7 @@ func GetOauth2Config(provider string, localBaseURL string) oauth2.Config {
 				AuthURL:  "https://graph.facebook.com/oauth/authorize",
 				TokenURL: "https://graph.facebook.com/oauth/access_token",
 			},
+			Scopes: []string{"public_profile"},
 		}
 	case "google":
 		config = oauth2.Config{
@@ -237,6 +250,7 @@ func GetOauth2Config(provider string, localBaseURL string) oauth2.Config {
 				AuthURL:  "https://accounts.google.com/o/oauth2/auth", // access_type=offline
 				TokenURL: "https://accounts.google.com/o/oauth2/token",
 			},
+			Scopes: []string{"openid", "profile", "email"},
 		}
 	case "fedbox":
 		fallthrough
@@ -376,7 +390,7 @@ func (h *handler) LoadSession(next http.Handler) http.Handler {
 		return next
 	}
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		h.storage.WithAccount(nil)
+		repo := h.requestRepository(r)
 		acc := AnonymousAccount
 		clearCookie := true
 		if h.v != nil {
@@ -392,6 +406,17 @@ func (h *handler) LoadSession(next http.Handler) http.Handler {
 				ltx["hash"] = acc.Hash
 			}
 			f := new(Filters)
+			if !h.validSession(w, r, acc) {
+				// NOTE(marius): the session was ended from another one, or it predates the session index
+				h.infoFn(ltx)("session missing from the index")
+				h.endSession(w, r)
+				if err := h.v.saveAccountToSession(w, r, defaultAccount); err != nil {
+					h.errFn(ltx, log.Ctx{"err": err.Error()})("unable to clear session account")
+				}
+				h.v.addFlashMessage(Warning, w, r, "Your session has ended, please log in again")
+				h.v.Redirect(w, r, "/login", http.StatusSeeOther)
+				return
+			}
 			if acc.HasMetadata() {
 				f.IRI = CompStrs{EqualsString(acc.Metadata.ID)}
 				ltx["iri"] = acc.Metadata.ID
@@ -400,21 +425,38 @@ func (h *handler) LoadSession(next http.Handler) http.Handler {
 				f.Type = ActivityTypesFilter(ValidActorTypes...)
 			}
 			ctx := context.TODO()
-			if account, err := h.storage.account(ctx, f); err != nil {
+			if account, err := repo.account(ctx, f); err != nil {
 				h.errFn(ltx, log.Ctx{"err": err.Error(), "filters": f})("unable to load actor for session account")
 			} else {
 				loadAccountData(&acc, account)
 			}
 
-			h.storage.WithAccount(&acc)
+			// NOTE(marius): a refreshed token gets saved to the session together with the rest of the account below
+			if acc.HasMetadata() && acc.Metadata.OAuth.Token != nil {
+				if _, err := h.storage.refreshToken(ctx, &acc, sessionTokenRefreshMargin); err != nil {
+					// NOTE(marius): the session can't be used anymore, the user needs to log in again
+					h.errFn(ltx, log.Ctx{"err": err.Error()})("unable to refresh session token")
+					h.endSession(w, r)
+					if err := h.v.saveAccountToSession(w, r, defaultAccount); err != nil {
+						h.errFn(ltx, log.Ctx{"err": err.Error()})("unable to clear session account")
+					}
+					h.v.addFlashMessage(Warning, w, r, "Your session has expired, please log in again")
+					h.v.Redirect(w, r, "/login", http.StatusSeeOther)
+					return
+				}
+			}
+
+			// NOTE(marius): the requests made on behalf of the logged account go through its own copy of the
+			// repository, which we pass down in the request context
+			repo = h.storage.WithAccount(&acc)
 			if len(acc.Followers) == 0 {
 				// TODO(marius): this needs to be moved to where we're handling all Inbox activities, not on page load
-				if err := h.storage.loadAccountsFollowers(ctx, &acc); err != nil {
+				if err := repo.loadAccountsFollowers(ctx, &acc); err != nil {
 					h.infoFn(ltx, log.Ctx{"err": err.Error()})("Unable to load account's followers")
 				}
 			}
 			if len(acc.Following) == 0 {
-				if err := h.storage.loadAccountsFollowing(ctx, &acc); err != nil {
+				if err := repo.loadAccountsFollowing(ctx, &acc); err != nil {
 					h.infoFn(ltx, log.Ctx{"err": err.Error()})("Unable to load account's following")
 				}
 			}
@@ -423,17 +465,18 @@ func (h *handler) LoadSession(next http.Handler) http.Handler {
 				if cursor := ContextCursor(r.Context()); cursor != nil {
 					items = cursor.items.Items()
 				}
-				h.storage.loadAccountVotes(ctx, &acc, items)
+				repo.loadAccountVotes(ctx, &acc, items)
 			}
 			if time.Now().Sub(acc.Metadata.OutboxUpdated) > 5*time.Minute {
-				if err := h.storage.loadAccountsOutbox(ctx, &acc); err != nil {
+				if err := repo.loadAccountsOutbox(ctx, &acc); err != nil {
 					h.errFn(ltx, log.Ctx{"err": err.Error()})("Unable to load account's Outbox")
 				}
 				h.infoFn(ltx, log.Ctx{"updated": acc.Metadata.OutboxUpdated.Format(time.StampMilli)})("Loaded account's outbox")
 				acc.Metadata.OutboxUpdated = time.Now()
 			}
 		}
-		r = r.WithContext(context.WithValue(r.Context(), LoggedAccountCtxtKey, &acc))
+		ctx := context.WithValue(r.Context(), LoggedAccountCtxtKey, &acc)
+		r = r.WithContext(context.WithValue(ctx, RepositoryCtxtKey, repo))
 		if clearCookie {
 			h.v.s.clear(w, r)
 		} else if acc.IsLogged() && h.v != nil {
@@ -462,7 +505,7 @@ func (h handler) NeedsSessions(next http.Handler) http.Handler {
 func (h *handler) HandleAbout(w http.ResponseWriter, r *http.Request) {
 	m := &aboutModel{Title: "About"}
 
-	repo := h.storage
+	repo := h.requestRepository(r)
 	info, err := repo.LoadInfo()
 	if err != nil {
 		h.v.HandleErrors(w, r, errors.NewNotValid(err, "oops!"))
@@ -473,6 +516,47 @@ func (h *handler) HandleAbout(w http.ResponseWriter, r *http.Request) {
 	h.v.RenderTemplate(r, w, m.Template(), m)
 }
 
+// HandleItemHistory serves /~{handle}/{hash}/history and /{year}/{month}/{day}/{hash}/history requests
+func (h *handler) HandleItemHistory(w http.ResponseWriter, r *http.Request) {
+	repo := h.requestRepository(r)
+	ctx := context.TODO()
+	iri := objects.IRI(repo.fedbox.Service()).AddPath(chi.URLParam(r, "hash"))
+	it, err := repo.LoadItem(ctx, iri)
+	if err != nil {
+		h.v.HandleErrors(w, r, errors.NewNotFound(err, "item not found"))
+		return
+	}
+	if !historyVisible(it, loggedAccount(r)) {
+		h.v.HandleErrors(w, r, errors.NotFoundf("item not found"))
+		return
+	}
+	revs, err := repo.LoadRevisions(ctx, it)
+	if err != nil {
+		h.v.HandleErrors(w, r, err)
+		return
+	}
+	m := &historyModel{Title: "Edit history", Content: &it, Revisions: revs, Diffs: revs.Diffs()}
+	if len(it.Title) > 0 {
+		m.Title = fmt.Sprintf("Edit history: %s", it.Title)
+	}
+	h.v.RenderTemplate(r, w, m.Template(), m)
+}
+
+// HandleModerationReport serves the anonymized aggregated report of the moderation activities
+func (h *handler) HandleModerationReport(w http.ResponseWriter, r *http.Request) {
+	m := &moderationReportModel{Title: "Moderation report"}
+
+	report, err := h.report.Load(context.TODO(), h.storage)
+	if err != nil {
+		h.errFn(log.Ctx{"err": err})("Unable to generate moderation report")
+		h.v.HandleErrors(w, r, errors.Annotatef(err, "unable to generate moderation report"))
+		return
+	}
+	m.Report = report
+
+	h.v.RenderTemplate(r, w, m.Template(), m)
+}
+
 func httpErrorResponse(e error) int {
 	if errors.IsBadRequest(e) {
 		return http.StatusBadRequest
@@ -29,8 +29,8 @@ func (h *handler) HandleSubmit(w http.ResponseWriter, r *http.Request) {
 	ctx := context.TODO()
 
 	var (
-		n   Item
-		err error
+		n        Item
+		err      error
 		saveVote = true
 	)
 
@@ -42,11 +42,11 @@ func (h *handler) HandleSubmit(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if err = updateItemFromRequest(r, *acc, &n); err != nil {
-		h.errFn(log.Ctx{ "err": err.Error() })("Error: wrong http method")
+		h.errFn(log.Ctx{"err": err.Error()})("Error: wrong http method")
 		h.v.HandleErrors(w, r, errors.NewMethodNotAllowed(err, ""))
 		return
 	}
-	if c!= nil && len(c.items) > 0 && n.Parent.IsValid() {
+	if c != nil && len(c.items) > 0 && n.Parent.IsValid() {
 		if parent := getItemFromList(n.Parent.Hash, c.items); parent.IsValid() {
 			n.Parent = parent
 			if n.Parent.SubmittedBy.IsValid() {
@@ -65,12 +65,59 @@ func (h *handler) HandleSubmit(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	repo := h.storage
+	if !n.Hash.IsValid() && n.Parent.IsValid() {
+		if err := h.checkAcceptsReplies(ctx, n.Parent); err != nil {
+			h.v.HandleErrors(w, r, err)
+			return
+		}
+	}
+
+	repo := h.requestRepository(r)
+	rules := h.rules
+	comm := ContextCommunity(r.Context())
+	if comm != nil && comm.Account != nil && !n.Hash.IsValid() {
+		// NOTE(marius): addressing the submission to the Group actor delivers it to the community's inbox
+		n.Metadata.To = append(n.Metadata.To, *comm.Account)
+		rules = append(append(ContentRules{}, h.rules...), comm.Rules...)
+	}
+	rule := rules.Match(n, *acc)
+	var held heldItem
+	if rule != nil {
+		h.infoFn(log.Ctx{"rule": rule.Name, "action": rule.Action, "author": acc.Handle})("submission matched content rule")
+		switch rule.Action {
+		case RuleActionReject:
+			h.v.HandleErrors(w, r, errors.Forbiddenf("Unable to save submission, it %s", rule.Reason()))
+			return
+		case RuleActionHold:
+			// NOTE(marius): held submissions are addressed only to the service actor, until a moderator reviews them
+			held = newHeldItem(n, *rule, comm)
+			n.MakePrivate()
+			n.Metadata.To = AccountCollection{repo.systemAccount()}
+			n.Metadata.CC = nil
+			saveVote = false
+		}
+	}
 	if n, err = repo.SaveItem(ctx, n); err != nil {
 		h.errFn(log.Ctx{"err": err.Error()})("unable to save item")
 		h.v.HandleErrors(w, r, err)
 		return
 	}
+	if rule != nil && rule.Action != RuleActionReject {
+		if err := h.reportRuleMatch(ctx, n, *rule, "submission"); err != nil {
+			h.errFn(log.Ctx{"err": err.Error(), "hash": n.Hash, "rule": rule.Name})("unable to report item")
+		}
+		if rule.Action == RuleActionHold {
+			if err := h.saveHeldItem(held, n); err != nil {
+				h.errFn(log.Ctx{"err": err.Error(), "hash": n.Hash, "rule": rule.Name})("unable to save held item")
+			}
+			h.v.addFlashMessage(Info, w, r, "Your submission is being held for moderation")
+		}
+	}
+	if comm != nil && comm.Account != nil && (rule == nil || rule.Action == RuleActionFlag) {
+		if err := repo.AnnounceInCommunity(ctx, *comm.Account, n); err != nil {
+			h.errFn(log.Ctx{"err": err.Error(), "hash": n.Hash, "community": comm.Name})("unable to announce item in community")
+		}
+	}
 
 	if saveVote {
 		v := Vote{
@@ -95,7 +142,7 @@ func (h *handler) HandleSubmit(w http.ResponseWriter, r *http.Request) {
 // HandleDelete serves /~{handle}/rm GET request
 func (h *handler) HandleDelete(w http.ResponseWriter, r *http.Request) {
 	acc := loggedAccount(r)
-	repo := h.storage
+	repo := h.requestRepository(r)
 	iri := objects.IRI(h.storage.fedbox.Service()).AddPath(chi.URLParam(r, "hash"))
 	ctx := context.TODO()
 	p, err := repo.LoadItem(ctx, iri)
@@ -123,7 +170,7 @@ func (h *handler) HandleDelete(w http.ResponseWriter, r *http.Request) {
 // HandleVoting serves /~{handle}/{direction} request
 func (h *handler) HandleVoting(w http.ResponseWriter, r *http.Request) {
 	acc := loggedAccount(r)
-	repo := h.storage
+	repo := h.requestRepository(r)
 	ctx := context.TODO()
 	iri := objects.IRI(h.storage.fedbox.Service()).AddPath(chi.URLParam(r, "hash"))
 	p, err := repo.LoadItem(ctx, iri)
@@ -133,6 +180,11 @@ func (h *handler) HandleVoting(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if isArchived(h.loadThreadRoot(ctx, &p), h.conf.ArchiveAge) {
+		h.v.HandleErrors(w, r, errors.Forbiddenf("the thread is archived, it does not accept new votes"))
+		return
+	}
+
 	direction := path.Base(r.URL.Path)
 	multiplier := 0
 	switch strings.ToLower(direction) {
@@ -174,7 +226,7 @@ func (h *handler) HandleVoting(w http.ResponseWriter, r *http.Request) {
 
 func (h *handler) FollowAccount(w http.ResponseWriter, r *http.Request) {
 	acc := loggedAccount(r)
-	repo := h.storage
+	repo := h.requestRepository(r)
 	var err error
 	toFollow := ContextAuthors(r.Context())
 	if len(toFollow) == 0 {
@@ -194,7 +246,7 @@ func (h *handler) FollowAccount(w http.ResponseWriter, r *http.Request) {
 func (h *handler) HandleFollowRequest(w http.ResponseWriter, r *http.Request) {
 	acc := loggedAccount(r)
 	ctx := context.TODO()
-	repo := h.storage
+	repo := h.requestRepository(r)
 	followers := ContextAuthors(r.Context())
 	if len(followers) == 0 {
 		h.v.HandleErrors(w, r, errors.NotFoundf("account not found"))
@@ -241,11 +293,11 @@ func (h *handler) BlockAccount(w http.ResponseWriter, r *http.Request) {
 
 	reason, err := ContentFromRequest(r, *acc)
 	if err != nil {
-		h.errFn(log.Ctx{ "before": err })("wrong http method")
+		h.errFn(log.Ctx{"before": err})("wrong http method")
 		h.v.HandleErrors(w, r, errors.NewMethodNotAllowed(err, ""))
 		return
 	}
-	repo := h.storage
+	repo := h.requestRepository(r)
 
 	toBlock := ContextAuthors(r.Context())
 	if len(toBlock) == 0 {
@@ -257,6 +309,9 @@ func (h *handler) BlockAccount(w http.ResponseWriter, r *http.Request) {
 		h.v.HandleErrors(w, r, err)
 		return
 	}
+	if h.conf.NotifyInviters && accountIsModerator(acc) {
+		repo.NotifyInviter(context.TODO(), *acc, block, "blocked", &reason)
+	}
 	acc.Metadata.OutboxUpdated = time.Time{}
 	h.v.Redirect(w, r, PermaLink(&block), http.StatusSeeOther)
 }
@@ -267,22 +322,25 @@ func (h *handler) BlockItem(w http.ResponseWriter, r *http.Request) {
 
 	reason, err := ContentFromRequest(r, *acc)
 	if err != nil {
-		h.errFn(log.Ctx{ "before": err })("wrong http method")
+		h.errFn(log.Ctx{"before": err})("wrong http method")
 		h.v.HandleErrors(w, r, errors.NewMethodNotAllowed(err, ""))
 		return
 	}
-	repo := h.storage
+	repo := h.requestRepository(r)
 
 	ctx := context.TODO()
 	it, err := repo.LoadItem(ctx, objects.IRI(repo.fedbox.Service()).AddPath(chi.URLParam(r, "hash")))
 	if err != nil {
-		h.errFn(log.Ctx{ "before": err })("invalid item to report")
+		h.errFn(log.Ctx{"before": err})("invalid item to report")
 		h.v.HandleErrors(w, r, errors.NewNotFound(err, ""))
 	}
 	if err = repo.BlockItem(ctx, *acc, it, &reason); err != nil {
 		h.v.HandleErrors(w, r, err)
 		return
 	}
+	if h.conf.NotifyInviters && accountIsModerator(acc) && it.SubmittedBy.IsValid() {
+		repo.NotifyInviter(ctx, *acc, *it.SubmittedBy, fmt.Sprintf("blocked for %q", it.Title), &reason)
+	}
 	acc.Metadata.OutboxUpdated = time.Time{}
 	h.v.Redirect(w, r, PermaLink(&it), http.StatusSeeOther)
 }
@@ -292,11 +350,11 @@ func (h *handler) ReportAccount(w http.ResponseWriter, r *http.Request) {
 	acc := loggedAccount(r)
 	reason, err := ContentFromRequest(r, *acc)
 	if err != nil {
-		h.errFn(log.Ctx{ "before": err })("Error: wrong http method")
+		h.errFn(log.Ctx{"before": err})("Error: wrong http method")
 		h.v.HandleErrors(w, r, errors.NewMethodNotAllowed(err, ""))
 		return
 	}
-	repo := h.storage
+	repo := h.requestRepository(r)
 
 	byHandleAccounts := ContextAuthors(r.Context())
 	if len(byHandleAccounts) == 0 {
@@ -326,15 +384,15 @@ func (h *handler) ReportItem(w http.ResponseWriter, r *http.Request) {
 
 	reason, err := ContentFromRequest(r, *acc)
 	if err != nil {
-		h.errFn(log.Ctx{ "before": err })("Error: wrong http method")
+		h.errFn(log.Ctx{"before": err})("Error: wrong http method")
 		h.v.HandleErrors(w, r, errors.NewMethodNotAllowed(err, ""))
 		return
 	}
 
-	repo := h.storage
+	repo := h.requestRepository(r)
 	p, err := repo.LoadItem(ctx, objects.IRI(repo.fedbox.Service()).AddPath(chi.URLParam(r, "hash")))
 	if err != nil {
-		h.errFn(log.Ctx{ "before": err })("invalid item to report")
+		h.errFn(log.Ctx{"before": err})("invalid item to report")
 		h.v.HandleErrors(w, r, errors.NewNotFound(err, ""))
 	}
 	if err = repo.ReportItem(ctx, *acc, p, &reason); err != nil {
@@ -402,22 +460,12 @@ func (h *handler) HandleLogin(w http.ResponseWriter, r *http.Request) {
 	}
 	acct.Metadata.OAuth.Provider = "fedbox"
 	acct.Metadata.OAuth.Token = tok
-	s, err := h.v.s.get(w, r)
-	if err != nil {
-		handleErr("Login failed: unable to save session", log.Ctx{
-			"handle": handle,
-			"client": config.ClientID,
-			"state":  state,
-			"error":  fmt.Sprintf("%s", err),
-		})
-		return
-	}
-	s.Values[SessionUserKey] = acct
-	h.v.Redirect(w, r, "/", http.StatusSeeOther)
+	h.loginAccount(w, r, acct, "")
 }
 
 // HandleLogout serves /logout requests
 func (h *handler) HandleLogout(w http.ResponseWriter, r *http.Request) {
+	h.endSession(w, r)
 	h.v.s.clear(w, r)
 	backUrl := "/"
 	if refUrl := r.Header.Get("Referer"); HostIsLocal(refUrl) && !strings.Contains(refUrl, "followed") {
@@ -445,8 +493,22 @@ func (h *handler) ValidateLoggedIn(eh ErrorHandler) Handler {
 	}
 }
 
+// ValidateModerator only lets through requests from the instance moderators
+func (h *handler) ValidateModerator(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		if !accountIsModerator(loggedAccount(r)) {
+			e := errors.Forbiddenf("only moderators can perform this action")
+			h.errFn()("Error: %s", e)
+			h.v.HandleErrors(w, r, e)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
 func (h *handler) ValidateItemAuthor(op string) Handler {
-	return func (next http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
 		fn := func(w http.ResponseWriter, r *http.Request) {
 			ctx := context.TODO()
 			acc := loggedAccount(r)
@@ -454,7 +516,7 @@ func (h *handler) ValidateItemAuthor(op string) Handler {
 			url := r.URL
 			action := path.Base(url.Path)
 			if len(hash) > 0 && action != hash {
-				repo := h.storage
+				repo := h.requestRepository(r)
 				m, err := repo.LoadItem(ctx, objects.IRI(repo.fedbox.Service()).AddPath(hash))
 				if err != nil {
 					ctxtErr(next, w, r, errors.NewNotFound(err, "item"))
@@ -475,7 +537,7 @@ func (h *handler) ValidateItemAuthor(op string) Handler {
 
 // HandleItemRedirect serves /i/{hash} request
 func (h *handler) HandleItemRedirect(w http.ResponseWriter, r *http.Request) {
-	repo := h.storage
+	repo := h.requestRepository(r)
 	ctx := context.TODO()
 	p, err := repo.LoadItem(ctx, objects.IRI(repo.fedbox.Service()).AddPath(chi.URLParam(r, "hash")))
 	if err != nil {
@@ -493,29 +555,7 @@ func getPassCode(h *handler, acc *Account, invitee *Account, r *http.Request) (s
 		acc = h.storage.app
 	}
 
-	// TODO(marius): Start oauth2 authorize session
-	config := GetOauth2Config("fedbox", h.conf.BaseURL)
-	config.Scopes = []string{scopeAnonymousUserCreate}
-	param := oauth2.SetAuthURLParam("actor", invitee.pub.GetLink().String())
-	sessUrl := config.AuthCodeURL(csrf.Token(r), param)
-	res, err := http.Get(sessUrl)
-	if err != nil {
-		return "", err
-	}
-
-	var body []byte
-	if body, err = ioutil.ReadAll(res.Body); err != nil {
-		return "", err
-	}
-	d := osin.AuthorizeData{}
-	if err := json.Unmarshal(body, &d); err != nil {
-		return "", err
-	}
-
-	if d.Code == "" {
-		return "", errors.NotValidf("unable to get session token for setting the user's password")
-	}
-	return d.Code, nil
+	return fedboxAuthCode(GetOauth2Config("fedbox", h.conf.BaseURL), csrf.Token(r), invitee.pub.GetLink())
 }
 
 // HandleSendInvite handles POST /invite requests
@@ -526,8 +566,18 @@ func (h *handler) HandleSendInvite(w http.ResponseWriter, r *http.Request) {
 		h.v.HandleErrors(w, r, errors.BadRequestf("invalid email"))
 		return
 	}
+	if limit := h.conf.InviteSanctionsLimit; limit > 0 && !accountIsModerator(acc) {
+		sanctions, err := h.storage.LoadInviteeSanctions(context.TODO(), *acc)
+		if err != nil {
+			h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to load invitee sanctions")
+		}
+		if sanctions >= limit {
+			h.v.HandleErrors(w, r, errors.Forbiddenf("your invite privileges have been suspended, as the accounts you invited have been sanctioned %d times", sanctions))
+			return
+		}
+	}
 
-	invitee, err := h.storage.SaveAccount(context.TODO(), Account{ CreatedBy: acc })
+	invitee, err := h.requestRepository(r).SaveAccount(context.TODO(), Account{CreatedBy: acc})
 
 	if err != nil {
 		h.v.HandleErrors(w, r, errors.NewBadRequest(err, "unable to save account"))
@@ -555,6 +605,29 @@ func (h *handler) HandleSendInvite(w http.ResponseWriter, r *http.Request) {
 
 // HandleRegister handles POST /register requests
 func (h *handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
+	// NOTE(marius): the accounts claiming a valid invitation don't need a moderator's approval
+	invite := r.PostFormValue("hash")
+	retry := func(msg string) {
+		h.v.addFlashMessage(Error, w, r, msg)
+		h.v.Redirect(w, r, path.Join("/register", invite), http.StatusSeeOther)
+	}
+	if err := h.verifyCaptcha(w, r); err != nil {
+		retry(fmt.Sprintf("Registration failed: %s", err))
+		return
+	}
+	var email string
+	if h.conf.RegistrationVerifyEmail {
+		var err error
+		if email, err = validEmail(r.PostFormValue("email")); err != nil {
+			retry(fmt.Sprintf("Registration failed: %s", err))
+			return
+		}
+	}
+	reason := strings.TrimSpace(r.PostFormValue("reason"))
+	if len([]rune(reason)) > maxRegistrationReason {
+		reason = string([]rune(reason)[:maxRegistrationReason])
+	}
+
 	a, err := h.accountFromPost(r)
 	if err != nil {
 		h.v.HandleErrors(w, r, err)
@@ -575,8 +648,20 @@ func (h *handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 	}
 
 	app := h.storage.app
+	repo := h.storage.WithAccount(app)
+	if len(invite) > 0 {
+		// NOTE(marius): saving the invited account with a handle marks the invitation as used
+		invited, err := repo.LoadInvitation(ctx, invite)
+		if err != nil {
+			h.v.HandleErrors(w, r, err)
+			return
+		}
+		invited.Handle = a.Handle
+		invited.Metadata.Password = a.Metadata.Password
+		a = *invited
+	}
 	a.CreatedBy = app
-	a, err = h.storage.WithAccount(app).SaveAccount(ctx, a)
+	a, err = repo.SaveAccount(ctx, a)
 	if err != nil {
 		h.errFn()("Error: %s", err)
 		h.v.HandleErrors(w, r, err)
@@ -651,6 +736,18 @@ func (h *handler) HandleRegister(w http.ResponseWriter, r *http.Request) {
 		h.v.HandleErrors(w, r, h.storage.handlerErrorResponse(body))
 		return
 	}
+	reg, err := h.saveRegistration(a, reason, email, h.conf.RegistrationApproval && len(invite) == 0)
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": a.Handle})("unable to save registration")
+		h.v.HandleErrors(w, r, errors.Annotatef(err, "unable to save registration"))
+		return
+	}
+	if reg != nil && reg.Status == registrationPending {
+		h.v.addFlashMessage(Info, w, r, "Your account was created, you can log in after a moderator approves it")
+	}
+	if reg != nil && len(reg.Email) > 0 {
+		h.v.addFlashMessage(Info, w, r, fmt.Sprintf("We sent an email to %s, follow the link in it to verify your address before posting", reg.Email))
+	}
 	h.v.Redirect(w, r, "/", http.StatusSeeOther)
 	return
 }
@@ -0,0 +1,295 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-chi/chi"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+// heldItem is a submission that matched a hold content rule. It is kept private, addressed only to the service
+// actor, until a moderator approves it, when it gets the recipients it was submitted with.
+// The activities received from other servers are held before reaching FedBOX, and get forwarded to the inbox
+// they were sent to when they're approved.
+type heldItem struct {
+	// ID is the hash of the item
+	ID string
+	// Item is the IRI of the item
+	Item string
+	// Author is the IRI of the actor that submitted the item
+	Author string
+	Handle string
+	Title  string
+	Rule   string
+	// To and CC are the IRIs of the recipients the item was submitted with
+	To      []string
+	CC      []string
+	Private bool
+	// Community is the name of the community the item was submitted to
+	Community string
+	Created   time.Time
+	// Activity is the received activity, for the items held by the inbox, and Inbox is the FedBOX inbox it
+	// gets forwarded to
+	Activity json.RawMessage `json:",omitempty"`
+	Inbox    string          `json:",omitempty"`
+}
+
+// Link returns the URL of the held item, the remote ones are only available on their server
+func (h heldItem) Link() string {
+	if len(h.Activity) > 0 {
+		return h.Item
+	}
+	return fmt.Sprintf("/i/%s", h.ID)
+}
+
+// heldStore keeps the held items, by the hash of the item
+type heldStore struct {
+	*fileStore
+}
+
+func (s heldStore) Load(hash string) (heldItem, error) {
+	held := heldItem{}
+	if s.fileStore == nil {
+		return held, errors.NotFoundf("held items are not available")
+	}
+	err := s.fileStore.Load(hash, &held)
+	return held, err
+}
+
+// All returns the held items, the oldest first
+func (s heldStore) All() ([]heldItem, error) {
+	if s.fileStore == nil {
+		return nil, nil
+	}
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	items := make([]heldItem, 0)
+	for _, k := range keys {
+		held := heldItem{}
+		if err := s.fileStore.Load(k, &held); err != nil {
+			continue
+		}
+		items = append(items, held)
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].Created.Before(items[j].Created)
+	})
+	return items, nil
+}
+
+func accountsIRIs(accounts AccountCollection) []string {
+	iris := make([]string, 0)
+	for _, a := range accounts {
+		if a.HasMetadata() && len(a.Metadata.ID) > 0 {
+			iris = append(iris, a.Metadata.ID)
+		}
+	}
+	return iris
+}
+
+func accountsFromIRIs(iris []string) AccountCollection {
+	accounts := make(AccountCollection, 0)
+	for _, iri := range iris {
+		accounts = append(accounts, Account{Metadata: &AccountMetadata{ID: iri}})
+	}
+	return accounts
+}
+
+// newHeldItem records the recipients of the submission, before they get replaced with the service actor
+func newHeldItem(it Item, rule ContentRule, comm *Community) heldItem {
+	held := heldItem{
+		Title:   it.Title,
+		Rule:    rule.Name,
+		Private: it.Private(),
+		Created: time.Now().UTC(),
+	}
+	if it.SubmittedBy != nil {
+		held.Handle = it.SubmittedBy.Handle
+		if it.SubmittedBy.HasMetadata() {
+			held.Author = it.SubmittedBy.Metadata.ID
+		}
+	}
+	if it.HasMetadata() {
+		held.To = accountsIRIs(it.Metadata.To)
+		held.CC = accountsIRIs(it.Metadata.CC)
+	}
+	if comm != nil {
+		held.Community = comm.Name
+	}
+	return held
+}
+
+// saveHeldItem adds the saved item to the moderation queue
+func (h *handler) saveHeldItem(held heldItem, it Item) error {
+	held.ID = it.Hash.String()
+	if it.HasMetadata() {
+		held.Item = it.Metadata.ID
+	}
+	return h.held.Save(held.ID, held)
+}
+
+// reportRuleMatch sends the Flag for the item that matched a flag or hold content rule, on behalf of the application,
+// so the automatic reports can't be confused with the ones made by users
+func (h *handler) reportRuleMatch(ctx context.Context, it Item, rule ContentRule, what string) error {
+	app := h.storage.app
+	if app == nil {
+		return errors.Newf("the application account is not available")
+	}
+	reason := Item{
+		MimeType:    MimeTypeText,
+		Data:        fmt.Sprintf("Automatically reported, the %s %s", what, rule.Reason()),
+		SubmittedBy: app,
+		Metadata:    new(ItemMetadata),
+	}
+	return h.storage.WithAccount(app).ReportItem(ctx, *app, it, &reason)
+}
+
+// HandleHeldItems serves GET /admin/held, the submissions waiting for a moderator
+func (h *handler) HandleHeldItems(w http.ResponseWriter, r *http.Request) {
+	m := &heldItemsModel{Title: "Held items"}
+	items, err := h.held.All()
+	if err != nil {
+		h.errFn(log.Ctx{"err": err})("unable to load held items")
+		h.v.HandleErrors(w, r, errors.Annotatef(err, "unable to load held items"))
+		return
+	}
+	m.Items = items
+	h.v.RenderTemplate(r, w, m.Template(), m)
+}
+
+// releaseHeldItem publishes the held item to the recipients it was submitted with, on behalf of its author
+func (h *handler) releaseHeldItem(ctx context.Context, repo *repository, held heldItem, it Item) error {
+	if !held.Private {
+		it.MakePublic()
+	}
+	if it.Metadata == nil {
+		it.Metadata = new(ItemMetadata)
+	}
+	it.Metadata.To = accountsFromIRIs(held.To)
+	it.Metadata.CC = accountsFromIRIs(held.CC)
+	saved, err := repo.SaveItem(ctx, it)
+	if err != nil {
+		return err
+	}
+	if !held.Private {
+		v := Vote{SubmittedBy: saved.SubmittedBy, Item: &saved, Weight: 1 * ScoreMultiplier}
+		if _, err := repo.SaveVote(ctx, v); err != nil {
+			h.errFn(log.Ctx{"err": err, "hash": saved.Hash})("unable to save vote for released item")
+		}
+	}
+	if len(held.Community) > 0 && !held.Private {
+		comm, err := h.storage.LoadCommunity(ctx, held.Community)
+		if err == nil {
+			err = repo.AnnounceInCommunity(ctx, *comm, saved)
+		}
+		if err != nil {
+			h.errFn(log.Ctx{"err": err, "hash": saved.Hash, "community": held.Community})("unable to announce item in community")
+		}
+	}
+	return nil
+}
+
+// releaseHeldActivity forwards the activity received from another server to the FedBOX inbox it was sent to
+func (h *handler) releaseHeldActivity(ctx context.Context, held heldItem) error {
+	act, err := pub.UnmarshalJSON(held.Activity)
+	if err != nil {
+		return errors.Annotatef(err, "invalid held activity")
+	}
+	if err := h.storage.ForwardToInbox(ctx, pub.IRI(held.Inbox), act); err != nil {
+		return err
+	}
+	if len(held.Community) > 0 {
+		comm, err := h.storage.LoadCommunity(ctx, held.Community)
+		if err == nil {
+			var c *Community
+			if c, err = h.loadCommunitySettings(*comm); err == nil {
+				err = pub.OnActivity(act, func(a *pub.Activity) error {
+					return h.communityInboxActivity(ctx, c, a)
+				})
+			}
+		}
+		if err != nil {
+			h.errFn(log.Ctx{"err": err, "iri": held.Item, "community": held.Community})("unable to announce item in community")
+		}
+	}
+	return nil
+}
+
+// moderateHeldItem publishes or deletes the item held for a local author, on their behalf
+func (h *handler) moderateHeldItem(ctx context.Context, held heldItem, approve bool) error {
+	// NOTE(marius): the held item can be changed only by its author, so we act on their behalf
+	author, err := h.storage.LoadAccount(ctx, pub.IRI(held.Author))
+	if err != nil || !author.IsValid() {
+		return errors.NotFoundf("author %s", held.Author)
+	}
+	repo, err := h.storage.asAccount(ctx, *author)
+	if err != nil {
+		return err
+	}
+	it, err := repo.LoadItem(ctx, pub.IRI(held.Item))
+	if err != nil {
+		return err
+	}
+	it.SubmittedBy = author
+	if approve {
+		return h.releaseHeldItem(ctx, repo, held, it)
+	}
+	it.Delete()
+	_, err = repo.SaveItem(ctx, it)
+	return err
+}
+
+// HandleHeldItemDecision serves POST /admin/held/{hash}/{action} requests, where action is approve or reject.
+// Approving publishes the item, rejecting deletes it.
+func (h *handler) HandleHeldItemDecision(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	held, err := h.held.Load(chi.URLParam(r, "hash"))
+	if err != nil {
+		h.v.HandleErrors(w, r, errors.NotFoundf("held item"))
+		return
+	}
+	action := chi.URLParam(r, "action")
+	if action != "approve" && action != "reject" {
+		h.v.HandleErrors(w, r, errors.NotFoundf("invalid action"))
+		return
+	}
+	by := loggedAccount(r)
+	ltx := log.Ctx{"hash": held.ID, "handle": held.Handle, "action": action, "by": by.Handle}
+	fail := func(err error) {
+		h.errFn(ltx, log.Ctx{"err": err})("unable to moderate held item")
+		h.v.addFlashMessage(Error, w, r, fmt.Sprintf("Unable to %s the item: %s", action, err))
+		h.v.Redirect(w, r, "/admin/held", http.StatusSeeOther)
+	}
+
+	if len(held.Activity) > 0 {
+		// NOTE(marius): the rejected activities received from other servers never reached FedBOX
+		if action == "approve" {
+			err = h.releaseHeldActivity(ctx, held)
+		}
+	} else {
+		err = h.moderateHeldItem(ctx, held, action == "approve")
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	if err := h.held.Delete(held.ID); err != nil {
+		h.errFn(ltx, log.Ctx{"err": err})("unable to remove held item")
+	}
+	h.infoFn(ltx)("moderated held item")
+	if action == "approve" {
+		h.v.addFlashMessage(Success, w, r, fmt.Sprintf("Published the item of %s", held.Handle))
+	} else {
+		h.v.addFlashMessage(Success, w, r, fmt.Sprintf("Deleted the item of %s", held.Handle))
+	}
+	h.v.Redirect(w, r, "/admin/held", http.StatusSeeOther)
+}
@@ -0,0 +1,70 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewHeldItem(t *testing.T) {
+	author := Account{Handle: "jdoe", Metadata: &AccountMetadata{ID: "https://example.com/actors/jdoe"}}
+	it := Item{
+		Title:       "Hello",
+		SubmittedBy: &author,
+		Metadata: &ItemMetadata{
+			To: AccountCollection{{Metadata: &AccountMetadata{ID: "https://example.com/actors/group"}}},
+			CC: AccountCollection{{Metadata: &AccountMetadata{ID: "https://example.com/actors/jane"}}, {}},
+		},
+	}
+	held := newHeldItem(it, ContentRule{Name: "links"}, &Community{Name: "group"})
+	if held.Author != author.Metadata.ID || held.Handle != author.Handle {
+		t.Errorf("invalid author %s %s", held.Author, held.Handle)
+	}
+	if held.Rule != "links" || held.Community != "group" || held.Private {
+		t.Errorf("invalid held item %v", held)
+	}
+	if len(held.To) != 1 || held.To[0] != "https://example.com/actors/group" {
+		t.Errorf("invalid recipients %v", held.To)
+	}
+	if len(held.CC) != 1 || held.CC[0] != "https://example.com/actors/jane" {
+		t.Errorf("invalid recipients %v, expected the ones without an IRI to be skipped", held.CC)
+	}
+	to := accountsFromIRIs(held.To)
+	if len(to) != 1 || to[0].Metadata.ID != held.To[0] {
+		t.Errorf("invalid accounts %v", to)
+	}
+}
+
+func TestHeldStore_All(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-held")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := newFileStore(dir, "held")
+	if err != nil {
+		t.Fatalf("unable to create storage: %s", err)
+	}
+	s := heldStore{fs}
+	now := time.Now().UTC()
+	for _, held := range []heldItem{
+		{ID: "6f2b8c8e-1d5e-4f4f-9d4a-2c1b3a4d5e6f", Title: "second", Created: now},
+		{ID: "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d", Title: "first", Created: now.Add(-time.Hour)},
+	} {
+		if err := s.Save(held.ID, held); err != nil {
+			t.Fatalf("unable to save held item: %s", err)
+		}
+	}
+	items, err := s.All()
+	if err != nil {
+		t.Fatalf("unable to load held items: %s", err)
+	}
+	if len(items) != 2 || items[0].Title != "first" || items[1].Title != "second" {
+		t.Errorf("invalid held items %v", items)
+	}
+	if _, err := s.Load("3d4e5f6a-7b8c-4d9e-8f0a-2b3c4d5e6f7a"); err == nil {
+		t.Errorf("expected error loading a missing held item")
+	}
+}
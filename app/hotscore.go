@@ -6,7 +6,7 @@ import (
 )
 
 // represents the statistical confidence
-//var StatisticalConfidence = 1.0 => ~69%, 1.96 => ~95% (default)
+// var StatisticalConfidence = 1.0 => ~69%, 1.96 => ~95% (default)
 var StatisticalConfidence = 1.94
 
 // represents how fast elapsed hours affect the order of an item
@@ -31,9 +31,9 @@ func Wilson(ups, downs int64) float64 {
 
 // hackernews' hot sort
 // https://medium.com/hacking-and-gonzo/how-hacker-news-ranking-algorithm-works-1d9b0cf2c08d
-func Hacker(votes int64, date time.Duration) float64 {
+func Hacker(votes float64, date time.Duration) float64 {
 	hoursAge := date.Hours()
-	return float64(votes-1) / math.Pow(hoursAge+2, HNGravity)
+	return (votes - 1) / math.Pow(hoursAge+2, HNGravity)
 }
 
 // reddit's hot sort
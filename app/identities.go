@@ -0,0 +1,537 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-chi/chi"
+	"github.com/mariusor/go-littr/internal/log"
+	"github.com/openshift/osin"
+	"golang.org/x/oauth2"
+)
+
+const (
+	sessionOAuthStateKey  = "__oauth_state"
+	sessionOAuthInviteKey = "__oauth_invite"
+
+	userInfoMaxBytes = 1 << 16
+)
+
+// authProvider is a third-party OAuth2 provider that littr accounts can log in with
+type authProvider struct {
+	Name string
+	// envKey is the environment variable holding the OAuth2 client key, the provider is enabled when it's set
+	envKey string
+	// userInfo is the end-point returning the identity of the token's owner
+	userInfo string
+	identity func([]byte) (Identity, error)
+}
+
+var authProviders = map[string]authProvider{
+	"github": {
+		Name:     "GitHub",
+		envKey:   "GITHUB_KEY",
+		userInfo: "https://api.github.com/user",
+		identity: githubIdentity,
+	},
+	"gitlab": {
+		Name:     "GitLab",
+		envKey:   "GITLAB_KEY",
+		userInfo: "https://gitlab.com/api/v4/user",
+		identity: gitlabIdentity,
+	},
+	"google": {
+		Name:     "Google",
+		envKey:   "GOOGLE_KEY",
+		userInfo: "https://openidconnect.googleapis.com/v1/userinfo",
+		identity: googleIdentity,
+	},
+	"facebook": {
+		Name:     "Facebook",
+		envKey:   "FACEBOOK_KEY",
+		userInfo: "https://graph.facebook.com/me?fields=id,name,short_name",
+		identity: facebookIdentity,
+	},
+}
+
+func (p authProvider) Enabled() bool {
+	return len(os.Getenv(p.envKey)) > 0
+}
+
+// Identity is an account of a third-party provider, linked to a littr account
+type Identity struct {
+	Provider string
+	ID       string
+	Login    string
+	Name     string
+	// Actor is the IRI of the littr account the identity is linked to
+	Actor string
+	// CreatedAccount is true when the littr account was created from this identity, so it has no password
+	CreatedAccount bool
+	Linked         time.Time
+}
+
+func (i Identity) key() string {
+	return fmt.Sprintf("%s-%s", i.Provider, i.ID)
+}
+
+// ProviderName returns the display name of the identity's provider
+func (i Identity) ProviderName() string {
+	if p, ok := authProviders[i.Provider]; ok {
+		return p.Name
+	}
+	return i.Provider
+}
+
+func githubIdentity(body []byte) (Identity, error) {
+	u := struct {
+		ID    json.Number `json:"id"`
+		Login string      `json:"login"`
+		Name  string      `json:"name"`
+	}{}
+	if err := json.Unmarshal(body, &u); err != nil {
+		return Identity{}, errors.Annotatef(err, "invalid GitHub user")
+	}
+	return Identity{ID: u.ID.String(), Login: u.Login, Name: u.Name}, nil
+}
+
+func gitlabIdentity(body []byte) (Identity, error) {
+	u := struct {
+		ID       json.Number `json:"id"`
+		Username string      `json:"username"`
+		Name     string      `json:"name"`
+	}{}
+	if err := json.Unmarshal(body, &u); err != nil {
+		return Identity{}, errors.Annotatef(err, "invalid GitLab user")
+	}
+	return Identity{ID: u.ID.String(), Login: u.Username, Name: u.Name}, nil
+}
+
+func googleIdentity(body []byte) (Identity, error) {
+	u := struct {
+		Sub       string `json:"sub"`
+		Name      string `json:"name"`
+		GivenName string `json:"given_name"`
+		Email     string `json:"email"`
+	}{}
+	if err := json.Unmarshal(body, &u); err != nil {
+		return Identity{}, errors.Annotatef(err, "invalid Google user")
+	}
+	// NOTE(marius): Google doesn't have user names, we use the local part of the email address or the given name
+	login := u.GivenName
+	if i := strings.Index(u.Email, "@"); i > 0 {
+		login = u.Email[:i]
+	}
+	return Identity{ID: u.Sub, Login: login, Name: u.Name}, nil
+}
+
+func facebookIdentity(body []byte) (Identity, error) {
+	u := struct {
+		ID        string `json:"id"`
+		Name      string `json:"name"`
+		ShortName string `json:"short_name"`
+	}{}
+	if err := json.Unmarshal(body, &u); err != nil {
+		return Identity{}, errors.Annotatef(err, "invalid Facebook user")
+	}
+	return Identity{ID: u.ID, Login: u.ShortName, Name: u.Name}, nil
+}
+
+// loadIdentity fetches the identity of the owner of the token the client was created with
+func (p authProvider) loadIdentity(ctx context.Context, c *http.Client) (Identity, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.userInfo, nil)
+	if err != nil {
+		return Identity{}, err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := c.Do(req)
+	if err != nil {
+		return Identity{}, errors.Annotatef(err, "unable to load %s user", p.Name)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(res.Body, userInfoMaxBytes))
+	if err != nil {
+		return Identity{}, errors.Annotatef(err, "unable to load %s user", p.Name)
+	}
+	if res.StatusCode != http.StatusOK {
+		return Identity{}, errors.WrapWithStatus(res.StatusCode, errors.Newf(""), "unable to load %s user", p.Name)
+	}
+	id, err := p.identity(body)
+	if err != nil {
+		return id, err
+	}
+	if len(id.ID) == 0 {
+		return id, errors.NotValidf("the %s user has no id", p.Name)
+	}
+	return id, nil
+}
+
+// identityStore keeps the links between the third-party identities and the littr accounts
+type identityStore struct {
+	*fileStore
+}
+
+func (s identityStore) Load(provider, id string) (Identity, error) {
+	i := Identity{Provider: provider, ID: id}
+	err := s.fileStore.Load(i.key(), &i)
+	return i, err
+}
+
+func (s identityStore) Link(i Identity) error {
+	if len(i.Actor) == 0 {
+		return errors.NotValidf("no account to link the %s identity to", i.ProviderName())
+	}
+	if i.Linked.IsZero() {
+		i.Linked = time.Now().UTC()
+	}
+	return s.Save(i.key(), i)
+}
+
+func (s identityStore) Unlink(i Identity) error {
+	return s.Delete(i.key())
+}
+
+// ForAccount returns the identities linked to the account with the actor IRI
+func (s identityStore) ForAccount(actor string) ([]Identity, error) {
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]Identity, 0)
+	for _, k := range keys {
+		i := Identity{}
+		if err := s.fileStore.Load(k, &i); err != nil || i.Actor != actor {
+			continue
+		}
+		ids = append(ids, i)
+	}
+	sort.Slice(ids, func(a, b int) bool {
+		return ids[a].Provider < ids[b].Provider
+	})
+	return ids, nil
+}
+
+var invalidHandleChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+
+// identityHandle returns a handle for a new account created from the identity, it matches the
+// rules we use for community names
+func identityHandle(i Identity) string {
+	handle := strings.Trim(invalidHandleChars.ReplaceAllString(i.Login, "_"), "_")
+	if len(handle) > 28 {
+		handle = handle[:28]
+	}
+	if len(handle) < 3 {
+		handle = fmt.Sprintf("%s_%s", i.Provider, handle)
+	}
+	return strings.TrimRight(handle, "_")
+}
+
+// availableHandle returns the first of handle, handle2, handle3... that isn't used by another account
+func (r *repository) availableHandle(ctx context.Context, handle string) (string, error) {
+	for i := 1; i < 100; i++ {
+		h := handle
+		if i > 1 {
+			h = fmt.Sprintf("%s%d", handle, i)
+		}
+		accounts, err := r.accounts(ctx, &Filters{Name: CompStrs{EqualsString(h)}, MaxItems: 1})
+		if err != nil {
+			return "", err
+		}
+		if len(accounts) == 0 {
+			return h, nil
+		}
+	}
+	return "", errors.Newf("unable to find an available handle for %s", handle)
+}
+
+// fedboxAuthCode requests from FedBOX an authorization code for actor, on behalf of the application,
+// with the scope that allows it to act for the accounts it creates
+func fedboxAuthCode(config oauth2.Config, state string, actor pub.IRI) (string, error) {
+	config.Scopes = []string{scopeAnonymousUserCreate}
+	res, err := http.Get(config.AuthCodeURL(state, oauth2.SetAuthURLParam("actor", actor.String())))
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	var body []byte
+	if body, err = ioutil.ReadAll(res.Body); err != nil {
+		return "", err
+	}
+	d := osin.AuthorizeData{}
+	if err := json.Unmarshal(body, &d); err != nil {
+		return "", err
+	}
+	if d.Code == "" {
+		return "", errors.NotValidf("unable to get authorization code for %s", actor)
+	}
+	return d.Code, nil
+}
+
+// accountToken obtains a FedBOX token for the account, for the users that authenticated with a
+// third-party provider and don't have a password we can use for the password credentials grant
+func (r *repository) accountToken(ctx context.Context, a Account, state string) (*oauth2.Token, error) {
+	if !a.HasMetadata() || len(a.Metadata.ID) == 0 {
+		return nil, errors.NotValidf("invalid account %s", a.Handle)
+	}
+	config := GetOauth2Config("fedbox", Instance.BaseURL)
+	code, err := fedboxAuthCode(config, state, pub.IRI(a.Metadata.ID))
+	if err != nil {
+		return nil, err
+	}
+	return config.Exchange(ctx, code)
+}
+
+// asAccount returns a copy of the repository that acts on behalf of a with a new FedBOX token, for the actions
+// littr performs for an account outside of its own requests
+func (r *repository) asAccount(ctx context.Context, a Account) (*repository, error) {
+	tok, err := r.accountToken(ctx, a, randomState())
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to load FedBOX token for %s", a.Handle)
+	}
+	m := *a.Metadata
+	m.OAuth = OAuth{Provider: "fedbox", Token: tok}
+	a.Metadata = &m
+	return r.WithAccount(&a), nil
+}
+
+// identityAccount creates the littr account for an identity that isn't linked to one. When there's an
+// invite, the invited account is used, otherwise it needs user creation to be enabled.
+func (h *handler) identityAccount(ctx context.Context, id Identity, invite string) (*Account, error) {
+	repo := h.storage.WithAccount(h.storage.app)
+	a := &Account{Metadata: &AccountMetadata{}}
+	if len(invite) > 0 {
+		invited, err := repo.LoadInvitation(ctx, invite)
+		if err != nil {
+			return nil, err
+		}
+		a = invited
+	} else if !h.conf.UserCreatingEnabled {
+		return nil, errors.Forbiddenf("new accounts can only be created from an invitation")
+	}
+	handle, err := repo.availableHandle(ctx, identityHandle(id))
+	if err != nil {
+		return nil, err
+	}
+	a.Handle = handle
+	a.CreatedBy = h.storage.app
+	acc, err := repo.SaveAccount(ctx, *a)
+	if err != nil {
+		return nil, err
+	}
+	if !acc.IsValid() || !acc.HasMetadata() || len(acc.Metadata.ID) == 0 {
+		return nil, errors.Newf("unable to save account")
+	}
+	// NOTE(marius): the providers verified the email addresses already, the invited accounts don't need approval
+	if _, err := h.saveRegistration(acc, "", "", h.conf.RegistrationApproval && len(invite) == 0); err != nil {
+		return nil, errors.Annotatef(err, "unable to save registration")
+	}
+	return &acc, nil
+}
+
+func randomState() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// HandleAuthProvider serves /auth/{provider} requests, it redirects to the authorization page of the
+// provider. The optional invite parameter is used when creating an account from an invitation.
+func (h *handler) HandleAuthProvider(w http.ResponseWriter, r *http.Request) {
+	provider := chi.URLParam(r, "provider")
+	if p, ok := authProviders[provider]; !ok || !p.Enabled() {
+		h.v.HandleErrors(w, r, errors.NotFoundf("authentication provider %s", provider))
+		return
+	}
+	s, err := h.v.s.get(w, r)
+	if err != nil {
+		h.v.HandleErrors(w, r, errors.Annotatef(err, "unable to save session"))
+		return
+	}
+	state := randomState()
+	s.Values[sessionOAuthStateKey] = state
+	s.Values[sessionOAuthInviteKey] = r.URL.Query().Get("invite")
+
+	config := GetOauth2Config(provider, h.conf.BaseURL)
+	h.v.Redirect(w, r, config.AuthCodeURL(state), http.StatusFound)
+}
+
+// HandleCallback serves /auth/{provider}/callback request. It loads the identity of the provider's
+// user, and links it to the logged account, or logs in the account it was previously linked to,
+// or creates a new account for it.
+func (h *handler) HandleCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	provider := chi.URLParam(r, "provider")
+	providerErr := q["error"]
+	if providerErr != nil {
+		errDescriptions := q["error_description"]
+		var errs = make([]error, 1)
+		errs[0] = errors.Errorf("Error for provider %q:\n", provider)
+		for _, errDesc := range errDescriptions {
+			errs = append(errs, errors.Errorf(errDesc))
+		}
+		h.v.HandleErrors(w, r, errs...)
+		return
+	}
+	p, ok := authProviders[provider]
+	if !ok || !p.Enabled() {
+		h.v.HandleErrors(w, r, errors.NotFoundf("authentication provider %s", provider))
+		return
+	}
+	code := q.Get("code")
+	if len(code) == 0 {
+		h.v.HandleErrors(w, r, errors.Forbiddenf("%s error: Empty authentication token", provider))
+		return
+	}
+	s, err := h.v.s.get(w, r)
+	if err != nil {
+		h.v.HandleErrors(w, r, errors.Annotatef(err, "unable to load session"))
+		return
+	}
+	state, _ := s.Values[sessionOAuthStateKey].(string)
+	invite, _ := s.Values[sessionOAuthInviteKey].(string)
+	delete(s.Values, sessionOAuthStateKey)
+	delete(s.Values, sessionOAuthInviteKey)
+	if len(state) == 0 || state != q.Get("state") {
+		h.v.HandleErrors(w, r, errors.Forbiddenf("%s error: invalid authentication state", provider))
+		return
+	}
+
+	ctx := r.Context()
+	conf := GetOauth2Config(provider, h.conf.BaseURL)
+	tok, err := conf.Exchange(ctx, code)
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "provider": provider})("Unable to load token")
+		h.v.HandleErrors(w, r, err)
+		return
+	}
+	id, err := p.loadIdentity(ctx, conf.Client(ctx, tok))
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "provider": provider})("Unable to load identity")
+		h.v.HandleErrors(w, r, err)
+		return
+	}
+	id.Provider = provider
+	ltx := log.Ctx{"provider": provider, "id": id.ID, "login": id.Login}
+
+	linked, err := h.identities.Load(id.Provider, id.ID)
+	if err != nil && !errors.IsNotFound(err) {
+		h.errFn(ltx, log.Ctx{"err": err})("Unable to load linked identity")
+		h.v.HandleErrors(w, r, err)
+		return
+	}
+
+	if logged := loggedAccount(r); logged.IsLogged() {
+		if len(linked.Actor) > 0 && linked.Actor != logged.Metadata.ID {
+			h.v.addFlashMessage(Error, w, r, fmt.Sprintf("This %s account is already linked to another account", p.Name))
+		} else if err := h.identities.Link(Identity{Provider: id.Provider, ID: id.ID, Login: id.Login, Name: id.Name, Actor: logged.Metadata.ID}); err != nil {
+			h.errFn(ltx, log.Ctx{"err": err})("Unable to link identity")
+			h.v.addFlashMessage(Error, w, r, fmt.Sprintf("Unable to link %s account", p.Name))
+		} else {
+			h.infoFn(ltx, log.Ctx{"handle": logged.Handle})("Linked identity")
+			h.v.addFlashMessage(Success, w, r, fmt.Sprintf("Linked %s account %s", p.Name, id.Login))
+		}
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+
+	var acc *Account
+	if len(linked.Actor) > 0 {
+		if acc, err = h.storage.LoadAccount(ctx, pub.IRI(linked.Actor)); err != nil {
+			h.errFn(ltx, log.Ctx{"err": err, "actor": linked.Actor})("Unable to load linked account")
+			h.v.HandleErrors(w, r, errors.NotFoundf("the account linked to this %s account could not be loaded", p.Name))
+			return
+		}
+	} else {
+		if acc, err = h.identityAccount(ctx, id, invite); err != nil {
+			h.errFn(ltx, log.Ctx{"err": err})("Unable to create account for identity")
+			h.v.addFlashMessage(Error, w, r, fmt.Sprintf("Unable to create account: %s", err))
+			h.v.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		linked = Identity{Provider: id.Provider, ID: id.ID, Login: id.Login, Name: id.Name, Actor: acc.Metadata.ID, CreatedAccount: true}
+		if err := h.identities.Link(linked); err != nil {
+			h.errFn(ltx, log.Ctx{"err": err})("Unable to link identity")
+		}
+		h.infoFn(ltx, log.Ctx{"handle": acc.Handle})("Created account for identity")
+	}
+
+	tok, err = h.storage.accountToken(ctx, *acc, state)
+	if err != nil || tok == nil {
+		h.errFn(ltx, log.Ctx{"err": err, "handle": acc.Handle})("Unable to load FedBOX token for account")
+		h.v.addFlashMessage(Error, w, r, fmt.Sprintf("Login failed with %s", p.Name))
+		h.v.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	acc.Metadata.OAuth = OAuth{Provider: "fedbox", Token: tok}
+	h.loginAccount(w, r, *acc, fmt.Sprintf("Login successful with %s", p.Name))
+}
+
+func (h *handler) settingsModel(r *http.Request) *settingsModel {
+	acc := loggedAccount(r)
+	m := &settingsModel{Title: "Settings", Account: *acc, Providers: getAuthProviders()}
+	if acc.HasMetadata() {
+		ids, err := h.identities.ForAccount(acc.Metadata.ID)
+		if err != nil {
+			h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to load linked identities")
+		}
+		m.Identities = ids
+		if m.Tokens, err = h.accessTokens.ForAccount(acc.Metadata.ID); err != nil {
+			h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to load access tokens")
+		}
+		if m.SSHKeys, err = h.sshKeys.Load(*acc); err != nil {
+			h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to load SSH keys")
+		}
+		if reg := h.registrations.ForAccount(*acc); !reg.Verified() {
+			m.Registration = &reg
+		}
+	}
+	m.Scopes = accessTokenScopes
+	m.SigningKey = h.signingKeySettings(*acc)
+	m.KeyTypes = keyTypes
+	m.TwoFactor = h.twoFactorSettings(*acc)
+	return m
+}
+
+// HandleSettings serves GET /settings requests
+func (h *handler) HandleSettings(w http.ResponseWriter, r *http.Request) {
+	m := h.settingsModel(r)
+	h.v.RenderTemplate(r, w, m.Template(), m)
+}
+
+// HandleUnlinkIdentity serves POST /settings/identities/{provider}/{id}/rm requests
+func (h *handler) HandleUnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	id, err := h.identities.Load(chi.URLParam(r, "provider"), chi.URLParam(r, "id"))
+	if err != nil || !acc.HasMetadata() || id.Actor != acc.Metadata.ID {
+		h.v.HandleErrors(w, r, errors.NotFoundf("linked account"))
+		return
+	}
+	ids, _ := h.identities.ForAccount(acc.Metadata.ID)
+	if id.CreatedAccount && len(ids) == 1 {
+		// NOTE(marius): the account doesn't have a password, unlinking it would leave no way to log in
+		h.v.addFlashMessage(Error, w, r, fmt.Sprintf("The %s account is the only way to log in to this account", id.ProviderName()))
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	if err := h.identities.Unlink(id); err != nil {
+		h.errFn(log.Ctx{"err": err, "provider": id.Provider, "handle": acc.Handle})("unable to unlink identity")
+		h.v.addFlashMessage(Error, w, r, fmt.Sprintf("Unable to unlink %s account", id.ProviderName()))
+	} else {
+		h.v.addFlashMessage(Success, w, r, fmt.Sprintf("Unlinked %s account %s", id.ProviderName(), id.Login))
+	}
+	h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
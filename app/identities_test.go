@@ -0,0 +1,152 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/go-ap/errors"
+)
+
+func TestProviderIdentities(t *testing.T) {
+	tests := []struct {
+		provider string
+		body     string
+		want     Identity
+	}{
+		{
+			provider: "github",
+			body:     `{"id":583231,"login":"johndoe","name":"John Doe","avatar_url":"https://avatars.example/u/583231"}`,
+			want:     Identity{ID: "583231", Login: "johndoe", Name: "John Doe"},
+		},
+		{
+			provider: "gitlab",
+			body:     `{"id":1,"username":"jane.doe","name":"Jane Doe","state":"active"}`,
+			want:     Identity{ID: "1", Login: "jane.doe", Name: "Jane Doe"},
+		},
+		{
+			provider: "google",
+			body:     `{"sub":"110169484474386276334","name":"John Doe","given_name":"John","email":"john.doe@gmail.example"}`,
+			want:     Identity{ID: "110169484474386276334", Login: "john.doe", Name: "John Doe"},
+		},
+		{
+			provider: "facebook",
+			body:     `{"id":"10158372736052281","name":"Jane Doe","short_name":"Jane"}`,
+			want:     Identity{ID: "10158372736052281", Login: "Jane", Name: "Jane Doe"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.provider, func(t *testing.T) {
+			got, err := authProviders[tt.provider].identity([]byte(tt.body))
+			if err != nil {
+				t.Fatalf("identity() error = %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("identity() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthProvider_loadIdentity(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer tok" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"id":583231,"login":"johndoe"}`))
+	}))
+	defer srv.Close()
+
+	p := authProviders["github"]
+	p.userInfo = srv.URL
+	c := &http.Client{Transport: roundTripFn(func(r *http.Request) (*http.Response, error) {
+		r.Header.Set("Authorization", "Bearer tok")
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	id, err := p.loadIdentity(context.TODO(), c)
+	if err != nil {
+		t.Fatalf("loadIdentity() error = %s", err)
+	}
+	if id.ID != "583231" || id.Login != "johndoe" {
+		t.Errorf("loadIdentity() = %#v", id)
+	}
+	if _, err := p.loadIdentity(context.TODO(), http.DefaultClient); err == nil {
+		t.Errorf("loadIdentity() expected error for unauthorized request")
+	}
+}
+
+type roundTripFn func(*http.Request) (*http.Response, error)
+
+func (f roundTripFn) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestIdentityHandle(t *testing.T) {
+	tests := []struct {
+		id   Identity
+		want string
+	}{
+		{id: Identity{Provider: "github", Login: "johndoe"}, want: "johndoe"},
+		{id: Identity{Provider: "gitlab", Login: "jane.doe"}, want: "jane_doe"},
+		{id: Identity{Provider: "google", Login: "-john--doe-"}, want: "john_doe"},
+		{id: Identity{Provider: "facebook", Login: "Jo"}, want: "facebook_Jo"},
+		{id: Identity{Provider: "facebook", Login: ""}, want: "facebook"},
+		{id: Identity{Provider: "github", Login: "a-very-long-login-name-that-goes-on-and-on"}, want: "a_very_long_login_name_that"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := identityHandle(tt.id); got != tt.want {
+				t.Errorf("identityHandle() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdentityStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := newFileStore(dir, "identities")
+	if err != nil {
+		t.Fatalf("unable to create store: %s", err)
+	}
+	s := identityStore{fs}
+	actor := "https://fedbox.littr.example/actors/f7e0bd1a-2f5f-11eb-9d4b-0242ac130002"
+
+	if err := s.Link(Identity{Provider: "github", ID: "583231"}); err == nil {
+		t.Errorf("Link() expected error for identity without an account")
+	}
+	for _, id := range []Identity{
+		{Provider: "gitlab", ID: "1", Login: "johndoe", Actor: actor},
+		{Provider: "github", ID: "583231", Login: "johndoe", Actor: actor},
+		{Provider: "github", ID: "1", Login: "janedoe", Actor: "https://fedbox.littr.example/actors/other"},
+	} {
+		if err := s.Link(id); err != nil {
+			t.Fatalf("Link() error = %s", err)
+		}
+	}
+	id, err := s.Load("github", "583231")
+	if err != nil || id.Actor != actor || id.Linked.IsZero() {
+		t.Errorf("Load() = %#v, %v", id, err)
+	}
+	ids, err := s.ForAccount(actor)
+	if err != nil {
+		t.Fatalf("ForAccount() error = %s", err)
+	}
+	if len(ids) != 2 || ids[0].Provider != "github" || ids[1].Provider != "gitlab" {
+		t.Errorf("ForAccount() = %#v, want the github and gitlab identities", ids)
+	}
+	if err := s.Unlink(id); err != nil {
+		t.Fatalf("Unlink() error = %s", err)
+	}
+	if _, err := s.Load("github", "583231"); !errors.IsNotFound(err) {
+		t.Errorf("Load() error = %v after Unlink(), expected not found", err)
+	}
+}
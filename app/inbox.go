@@ -0,0 +1,484 @@
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+	"github.com/go-ap/errors"
+	"github.com/mariusor/go-littr/internal/log"
+	"github.com/spacemonkeygo/httpsig"
+)
+
+const (
+	inboxMaxBodyBytes = 1 << 20
+	// inboxMaxClockSkew is how far the Date header of a signed request can be from our clock
+	inboxMaxClockSkew = 12 * time.Hour
+	// signerFetchTimeout and signerMaxBodyBytes limit the requests loading the actor that signed an inbox request
+	signerFetchTimeout = 5 * time.Second
+	signerMaxBodyBytes = 256 << 10
+)
+
+// domainIsBlocked returns true if the host of iri is one of the blocked domains, or one of their subdomains
+func domainIsBlocked(iri string, blocked []string) bool {
+	h := strings.ToLower(host(iri))
+	if i := strings.LastIndex(h, ":"); i > 0 {
+		h = h[:i]
+	}
+	if len(h) == 0 {
+		return false
+	}
+	for _, d := range blocked {
+		if h == d || strings.HasSuffix(h, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// signatureKeyID returns the keyId parameter of the HTTP signature of the request, which can be sent
+// either in the Signature header or in the Authorization header
+func signatureKeyID(r *http.Request) string {
+	return signatureParams(r)["keyId"]
+}
+
+// signatureParams returns the parameters of the HTTP signature of the request
+func signatureParams(r *http.Request) map[string]string {
+	sig := r.Header.Get("Signature")
+	if auth := r.Header.Get("Authorization"); len(sig) == 0 && strings.HasPrefix(auth, "Signature ") {
+		sig = strings.TrimPrefix(auth, "Signature ")
+	}
+	params := make(map[string]string)
+	for _, param := range strings.Split(sig, ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return params
+}
+
+// verifyDate checks that the Date header of the request is not too far from the current time
+func verifyDate(r *http.Request, now time.Time) error {
+	d, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil {
+		return errors.BadRequestf("invalid Date header")
+	}
+	if skew := now.Sub(d); skew > inboxMaxClockSkew || skew < -inboxMaxClockSkew {
+		return errors.Unauthorizedf("request date %s is too far from the current time", d.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// verifyDigest checks the SHA-256 Digest header against the body of the request.
+// POST requests need to have it, otherwise a captured signature could be replayed with a different body.
+func verifyDigest(r *http.Request, body []byte) error {
+	digest := r.Header.Get("Digest")
+	if len(digest) == 0 {
+		if r.Method == http.MethodPost {
+			return errors.Unauthorizedf("missing Digest header")
+		}
+		return nil
+	}
+	for _, d := range strings.Split(digest, ",") {
+		kv := strings.SplitN(strings.TrimSpace(d), "=", 2)
+		if len(kv) != 2 || !strings.EqualFold(kv[0], "SHA-256") {
+			continue
+		}
+		if d := bodyDigest(body); kv[1] != strings.TrimPrefix(d, "SHA-256=") {
+			return errors.Unauthorizedf("the Digest header doesn't match the request body")
+		}
+		return nil
+	}
+	return errors.BadRequestf("unsupported Digest algorithm")
+}
+
+// parsePublicKeyPem parses the PEM encoded public key of an actor
+func parsePublicKeyPem(s string) (crypto.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.NotValidf("invalid PEM public key")
+	}
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unsupported public key")
+	}
+	return key, nil
+}
+
+// publicKeyGetter returns the key it was created with, to the httpsig verifier
+type publicKeyGetter struct {
+	id  string
+	key crypto.PublicKey
+}
+
+func (k publicKeyGetter) GetKey(id string) interface{} {
+	if id != k.id {
+		return nil
+	}
+	return k.key
+}
+
+// verifySignature checks the HTTP signature of the request with the public key identified by keyID.
+// The Digest header needs to be signed for POST requests, so the signature covers the body too.
+func verifySignature(r *http.Request, keyID string, key crypto.PublicKey) error {
+	required := []string{"(request-target)", "date"}
+	if r.Method == http.MethodPost {
+		required = append(required, "digest")
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, ed25519.PublicKey:
+		// NOTE(marius): the httpsig verifier supports only RSA and HMAC keys
+		if err := verifyHS2019(r, keyID, key, required); err != nil {
+			return errors.NewUnauthorized(err, "invalid HTTP signature")
+		}
+		return nil
+	}
+	v := httpsig.NewVerifier(publicKeyGetter{id: keyID, key: key})
+	v.SetRequiredHeaders(required)
+	if err := v.Verify(r); err != nil {
+		return errors.NewUnauthorized(err, "invalid HTTP signature")
+	}
+	return nil
+}
+
+// validateInboxActivity unmarshals the received activity and checks that it was sent by the actor that
+// signed the request, that none of its actor and object belong to a blocked domain, and that the content
+// it creates, changes or removes belongs to the signer
+func validateInboxActivity(body []byte, signer pub.IRI, blocked []string) (*pub.Activity, error) {
+	it, err := pub.UnmarshalJSON(body)
+	if err != nil || it == nil {
+		return nil, errors.BadRequestf("invalid ActivityPub object")
+	}
+	var act *pub.Activity
+	pub.OnActivity(it, func(a *pub.Activity) error {
+		act = a
+		return nil
+	})
+	if act == nil || !pub.ActivityTypes.Contains(act.GetType()) {
+		return nil, errors.BadRequestf("unsupported activity type %s", it.GetType())
+	}
+	if len(act.ID) == 0 || act.Actor == nil {
+		return nil, errors.BadRequestf("the activity needs an id and an actor")
+	}
+	if !act.Actor.GetLink().Equals(signer, false) {
+		return nil, errors.Forbiddenf("the activity actor %s is not the signer of the request", act.Actor.GetLink())
+	}
+	if HostIsLocal(act.Actor.GetLink().String()) {
+		return nil, errors.Forbiddenf("local actors post to their outbox")
+	}
+	for _, iri := range []pub.Item{act.Actor, act.Object} {
+		if iri != nil && domainIsBlocked(iri.GetLink().String(), blocked) {
+			return nil, errors.Forbiddenf("the domain of %s is blocked", iri.GetLink())
+		}
+	}
+	if err := validateInboxObjectOwner(act, signer); err != nil {
+		return nil, err
+	}
+	return act, nil
+}
+
+// validateInboxObjectOwner checks that the object of the activities creating, changing or removing content
+// belongs to the actor that signed the request, so a server can't act on the objects of other servers
+// or of its other actors.
+func validateInboxObjectOwner(act *pub.Activity, signer pub.IRI) error {
+	if act.Type != pub.CreateType && act.Type != pub.UpdateType && act.Type != pub.DeleteType {
+		return nil
+	}
+	if act.Object == nil || len(act.Object.GetLink()) == 0 {
+		return errors.BadRequestf("the %s activity needs an object with an id", act.Type)
+	}
+	ob := act.Object.GetLink()
+	if !strings.EqualFold(host(ob.String()), host(signer.String())) {
+		return errors.Forbiddenf("the object %s doesn't belong to the host of %s", ob, signer)
+	}
+	var by pub.IRI
+	pub.OnObject(act.Object, func(o *pub.Object) error {
+		if o.AttributedTo != nil {
+			by = o.AttributedTo.GetLink()
+		}
+		return nil
+	})
+	if len(by) > 0 {
+		if !by.Equals(signer, false) {
+			return errors.Forbiddenf("the object %s is not attributed to %s", ob, signer)
+		}
+		return nil
+	}
+	if act.Type == pub.CreateType || ob.Equals(signer, false) {
+		return nil
+	}
+	// NOTE(marius): the deletes are usually sent with a Tombstone or just the IRI of the object, without
+	// the attributedTo property, we accept them only for the objects under the signer's IRI
+	if !strings.HasPrefix(strings.ToLower(ob.String()), strings.ToLower(strings.TrimRight(signer.String(), "/"))+"/") {
+		return errors.Forbiddenf("the object %s is not attributed to %s", ob, signer)
+	}
+	return nil
+}
+
+// inboxActor returns the actor of the activity in the body, before it's verified, so we know which host
+// the signing key can be loaded from
+func inboxActor(body []byte) pub.IRI {
+	it, err := pub.UnmarshalJSON(body)
+	if err != nil || it == nil {
+		return ""
+	}
+	var actor pub.IRI
+	pub.OnActivity(it, func(a *pub.Activity) error {
+		if a.Actor != nil {
+			actor = a.Actor.GetLink()
+		}
+		return nil
+	})
+	return actor
+}
+
+// fetchActor loads the actor at iri from its server, with a shorter timeout and a smaller response than the
+// other remote requests, as it's made for unauthenticated requests
+func fetchActor(ctx context.Context, iri pub.IRI) (pub.Item, error) {
+	u, err := iri.URL()
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") {
+		return nil, errors.NotValidf("invalid actor IRI %s", iri)
+	}
+	if err := checkRemoteHost(ctx, u.Host); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, signerFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, iri.String(), nil)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid actor IRI %s", iri)
+	}
+	req.Header.Set("Accept", fmt.Sprintf("%s, %s", activityJsonMimeType, `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`))
+	req.Header.Set("User-Agent", client.UserAgent)
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to load actor %s", iri)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.NotFoundf("actor %s responded with %s", iri, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, signerMaxBodyBytes+1))
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to load actor %s", iri)
+	}
+	if len(body) > signerMaxBodyBytes {
+		return nil, errors.NotValidf("actor %s is too large", iri)
+	}
+	return pub.UnmarshalJSON(body)
+}
+
+// LoadSigner dereferences the key with keyID and returns the account that owns it together with the key.
+// The key needs to be on the same host as the actor of the activity.
+func (r *repository) LoadSigner(ctx context.Context, keyID string, actor pub.IRI) (*Account, crypto.PublicKey, error) {
+	if len(actor) == 0 || !strings.EqualFold(host(keyID), host(actor.String())) {
+		return nil, nil, errors.Forbiddenf("the key %s doesn't belong to the host of actor %s", keyID, actor)
+	}
+	u := keyID
+	if i := strings.Index(u, "#"); i > 0 {
+		u = u[:i]
+	}
+	it, err := fetchActor(ctx, pub.IRI(u))
+	if err != nil {
+		return nil, nil, err
+	}
+	if it == nil {
+		return nil, nil, errors.NotFoundf("no actor found for key %s", keyID)
+	}
+	var key crypto.PublicKey
+	acc := new(Account)
+	err = pub.OnActor(it, func(a *pub.Actor) error {
+		if len(a.PublicKey.PublicKeyPem) == 0 {
+			return errors.NotFoundf("no public key for %s", a.GetLink())
+		}
+		if len(a.PublicKey.ID) > 0 && pub.IRI(a.PublicKey.ID) != pub.IRI(keyID) {
+			return errors.NotValidf("key %s doesn't belong to %s", keyID, a.GetLink())
+		}
+		if key, err = parsePublicKeyPem(a.PublicKey.PublicKeyPem); err != nil {
+			return err
+		}
+		return acc.FromActivityPub(a)
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	if key == nil {
+		return nil, nil, errors.NotFoundf("no actor found for key %s", keyID)
+	}
+	acc.Hash = remoteHash(it.GetLink())
+	return acc, key, nil
+}
+
+// ForwardToInbox posts an activity received by littr to the inbox in FedBOX, on behalf of the application
+func (r *repository) ForwardToInbox(ctx context.Context, inbox pub.IRI, act pub.Item) error {
+	if r.app != nil {
+		r = r.WithAccount(r.app)
+	}
+	_, _, err := r.fedbox.ToCollection(ctx, inbox, act)
+	return err
+}
+
+// inboxRule returns the content rule matching the object created or updated by the activity
+func (h *handler) inboxRule(r *http.Request, act *pub.Activity, author Account) (*Item, *ContentRule) {
+	if act.Type != pub.CreateType && act.Type != pub.UpdateType {
+		return nil, nil
+	}
+	ob := act.Object
+	if ob == nil || !ob.IsObject() || !ValidContentTypes.Contains(ob.GetType()) {
+		return nil, nil
+	}
+	it := new(Item)
+	if err := it.FromActivityPub(ob); err != nil {
+		return nil, nil
+	}
+	it.SubmittedBy = &author
+	rules := h.rules
+	if comm := ContextCommunity(r.Context()); comm != nil {
+		rules = append(append(ContentRules{}, h.rules...), comm.Rules...)
+	}
+	return it, rules.Match(*it, author)
+}
+
+// inboxReplyParent returns the local item the object created by the activity replies to, if any
+func (h *handler) inboxReplyParent(ctx context.Context, act *pub.Activity) *Item {
+	var parent pub.IRI
+	pub.OnObject(act.Object, func(o *pub.Object) error {
+		if o.InReplyTo != nil {
+			parent = o.InReplyTo.GetLink()
+		}
+		return nil
+	})
+	if len(parent) == 0 || !HostIsLocal(parent.String()) {
+		return nil
+	}
+	it, err := h.storage.LoadItem(ctx, parent)
+	if err != nil || !it.IsValid() {
+		return nil
+	}
+	return &it
+}
+
+// holdInboxActivity adds the received activity to the moderation queue, together with the inbox it is
+// forwarded to when it's approved
+func (h *handler) holdInboxActivity(it Item, rule ContentRule, act *pub.Activity, inbox pub.IRI, body []byte, comm *Community) error {
+	held := newHeldItem(it, rule, comm)
+	held.Item = act.Object.GetLink().String()
+	held.ID = remoteHash(act.Object.GetLink()).String()
+	held.Activity = body
+	held.Inbox = inbox.String()
+	return h.held.Save(held.ID, held)
+}
+
+// HandleInbox serves POST /inbox and the inboxes of the local actors, /~{handle}/inbox and /c/{name}/inbox.
+// It verifies the HTTP signature of the request, applies the blocked domains and the content rules, and
+// forwards the accepted activities to the corresponding inbox in FedBOX.
+func (h *handler) HandleInbox(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
+	fail := func(err error, msg string) {
+		h.errFn(log.Ctx{"err": err, "path": r.URL.Path, "key": signatureKeyID(r)})(msg)
+		errors.HandleError(err).ServeHTTP(w, r)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, inboxMaxBodyBytes))
+	if err != nil {
+		fail(errors.NewBadRequest(err, "unable to read request body"), "invalid inbox request")
+		return
+	}
+	keyID := signatureKeyID(r)
+	if len(keyID) == 0 {
+		fail(errors.Unauthorizedf("missing HTTP signature"), "invalid inbox request")
+		return
+	}
+	if domainIsBlocked(keyID, h.conf.BlockedDomains) {
+		fail(errors.Forbiddenf("the domain of %s is blocked", keyID), "refused inbox request")
+		return
+	}
+	if err := verifyDate(r, time.Now().UTC()); err != nil {
+		fail(err, "invalid inbox request")
+		return
+	}
+	if err := verifyDigest(r, body); err != nil {
+		fail(err, "invalid inbox request")
+		return
+	}
+	signer, key, err := h.storage.LoadSigner(ctx, keyID, inboxActor(body))
+	if err != nil {
+		fail(errors.NewUnauthorized(err, "unable to load the key %s", keyID), "invalid inbox request")
+		return
+	}
+	if err := verifySignature(r, keyID, key); err != nil {
+		fail(err, "invalid inbox request")
+		return
+	}
+	act, err := validateInboxActivity(body, pub.IRI(signer.Metadata.ID), h.conf.BlockedDomains)
+	if err != nil {
+		fail(err, "refused inbox activity")
+		return
+	}
+
+	inbox := h.storage.fedbox.Service().Inbox.GetLink()
+	if authors := ContextAuthors(r.Context()); len(authors) > 0 {
+		// NOTE(marius): we only receive activities for the local actors, forwarding them to remote inboxes
+		// would make us an open relay
+		if !authors[0].HasMetadata() || !HostIsLocal(authors[0].Metadata.ID) || len(authors[0].Metadata.InboxIRI) == 0 {
+			fail(errors.NotFoundf("no inbox for %s", authors[0].Handle), "invalid inbox request")
+			return
+		}
+		inbox = pub.IRI(authors[0].Metadata.InboxIRI)
+	}
+
+	if act.Type == pub.CreateType {
+		if err := h.checkAcceptsReplies(ctx, h.inboxReplyParent(ctx, act)); err != nil {
+			fail(err, "refused inbox activity")
+			return
+		}
+	}
+	it, rule := h.inboxRule(r, act, *signer)
+	if rule != nil && rule.Action == RuleActionReject {
+		fail(errors.Forbiddenf("the object %s", rule.Reason()), "refused inbox activity")
+		return
+	}
+	if rule != nil {
+		h.infoFn(log.Ctx{"rule": rule.Name, "action": rule.Action, "iri": act.Object.GetLink()})("received object matched content rule")
+		if err := h.reportRuleMatch(ctx, *it, *rule, "federated object"); err != nil {
+			h.errFn(log.Ctx{"err": err, "iri": act.Object.GetLink(), "rule": rule.Name})("unable to report item")
+		}
+	}
+	if rule != nil && rule.Action == RuleActionHold {
+		// NOTE(marius): the activity is forwarded to FedBOX only when a moderator approves it
+		if err := h.holdInboxActivity(*it, *rule, act, inbox, body, ContextCommunity(r.Context())); err != nil {
+			fail(errors.Annotatef(err, "unable to hold activity"), "unable to hold inbox activity")
+			return
+		}
+		h.infoFn(log.Ctx{"type": act.Type, "iri": act.ID, "actor": signer.Metadata.ID, "inbox": inbox})("held activity")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err := h.storage.ForwardToInbox(ctx, inbox, act); err != nil {
+		fail(errors.Annotatef(err, "unable to forward activity"), "unable to forward inbox activity")
+		return
+	}
+	h.infoFn(log.Ctx{"type": act.Type, "iri": act.ID, "actor": signer.Metadata.ID, "inbox": inbox})("received activity")
+
+	if comm := ContextCommunity(r.Context()); comm != nil {
+		if err := h.communityInboxActivity(ctx, comm, act); err != nil {
+			h.errFn(log.Ctx{"err": err, "type": act.Type, "iri": act.ID, "community": comm.Name})("unable to handle community activity")
+		}
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,274 @@
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/mariusor/go-littr/internal/config"
+)
+
+func TestDomainIsBlocked(t *testing.T) {
+	blocked := []string{"spam.example", "bad.example"}
+	tests := []struct {
+		iri  string
+		want bool
+	}{
+		{iri: "https://spam.example/users/johndoe", want: true},
+		{iri: "https://www.spam.example/users/johndoe", want: true},
+		{iri: "https://SPAM.example:8443/inbox", want: true},
+		{iri: "https://notspam.example/users/johndoe", want: false},
+		{iri: "https://mastodon.example/users/johndoe", want: false},
+		{iri: "not an iri", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.iri, func(t *testing.T) {
+			if got := domainIsBlocked(tt.iri, blocked); got != tt.want {
+				t.Errorf("domainIsBlocked() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignatureKeyID(t *testing.T) {
+	r := httptest.NewRequest(http.MethodPost, "/inbox", nil)
+	if id := signatureKeyID(r); id != "" {
+		t.Errorf("signatureKeyID() = %q for unsigned request", id)
+	}
+	r.Header.Set("Signature", `keyId="https://mastodon.example/users/johndoe#main-key",algorithm="rsa-sha256",headers="(request-target) host date",signature="abc="`)
+	if id := signatureKeyID(r); id != "https://mastodon.example/users/johndoe#main-key" {
+		t.Errorf("signatureKeyID() = %q", id)
+	}
+	r = httptest.NewRequest(http.MethodPost, "/inbox", nil)
+	r.Header.Set("Authorization", `Signature keyId="https://lemmy.example/u/janedoe#main-key",signature="abc="`)
+	if id := signatureKeyID(r); id != "https://lemmy.example/u/janedoe#main-key" {
+		t.Errorf("signatureKeyID() = %q from Authorization header", id)
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	body := []byte(`{"type":"Like"}`)
+	sum := sha256.Sum256(body)
+	r := httptest.NewRequest(http.MethodPost, "/inbox", nil)
+	if err := verifyDigest(r, body); !errors.IsUnauthorized(err) {
+		t.Errorf("verifyDigest() error = %v, expected unauthorized for a POST without Digest header", err)
+	}
+	if err := verifyDigest(httptest.NewRequest(http.MethodGet, "/inbox", nil), nil); err != nil {
+		t.Errorf("verifyDigest() error = %s for a GET without Digest header", err)
+	}
+	r.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]))
+	if err := verifyDigest(r, body); err != nil {
+		t.Errorf("verifyDigest() error = %s", err)
+	}
+	if err := verifyDigest(r, []byte(`{"type":"Dislike"}`)); !errors.IsUnauthorized(err) {
+		t.Errorf("verifyDigest() error = %v, expected unauthorized for a different body", err)
+	}
+}
+
+func TestVerifySignature(t *testing.T) {
+	prv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	der, _ := x509.MarshalPKIXPublicKey(&prv.PublicKey)
+	key, err := parsePublicKeyPem(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	if err != nil {
+		t.Fatalf("parsePublicKeyPem() error = %s", err)
+	}
+	keyID := "https://mastodon.example/users/johndoe#main-key"
+
+	unsigned := httptest.NewRequest(http.MethodPost, "https://littr.example/inbox", strings.NewReader("{}"))
+	unsigned.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	unsigned.Header.Set("Digest", bodyDigest([]byte("{}")))
+	if err := getSigner(pub.ID(keyID), prv, signatureHeaders).Sign(unsigned); err != nil {
+		t.Fatalf("Sign() error = %s", err)
+	}
+	if err := verifySignature(unsigned, keyID, key); err == nil {
+		t.Errorf("verifySignature() expected error for a POST without a signed Digest")
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "https://littr.example/inbox", strings.NewReader("{}"))
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	r.Header.Set("Digest", bodyDigest([]byte("{}")))
+	if err := requestSigner(pub.ID(keyID), prv)(r); err != nil {
+		t.Fatalf("Sign() error = %s", err)
+	}
+	if err := verifyDate(r, time.Now().UTC()); err != nil {
+		t.Errorf("verifyDate() error = %s", err)
+	}
+	if err := verifyDate(r, time.Now().Add(2*inboxMaxClockSkew)); err == nil {
+		t.Errorf("verifyDate() expected error for a stale request")
+	}
+	if err := verifySignature(r, keyID, key); err != nil {
+		t.Errorf("verifySignature() error = %s", err)
+	}
+	if err := verifySignature(r, "https://mastodon.example/users/janedoe#main-key", key); err == nil {
+		t.Errorf("verifySignature() expected error for an unknown key")
+	}
+	r.Header.Set("Date", time.Now().Add(time.Minute).UTC().Format(http.TimeFormat))
+	if err := verifySignature(r, keyID, key); err == nil {
+		t.Errorf("verifySignature() expected error for a modified signed header")
+	}
+}
+
+func TestVerifySignatureHS2019(t *testing.T) {
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	keyID := "https://littr.example/~johndoe#main-key"
+	for name, prv := range map[string]crypto.Signer{"ecdsa": ecKey, "ed25519": edKey} {
+		t.Run(name, func(t *testing.T) {
+			der, _ := x509.MarshalPKIXPublicKey(prv.Public())
+			key, err := parsePublicKeyPem(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+			if err != nil {
+				t.Fatalf("parsePublicKeyPem() error = %s", err)
+			}
+			r := httptest.NewRequest(http.MethodPost, "https://littr.example/inbox", strings.NewReader("{}"))
+			r.Header.Set("Digest", bodyDigest([]byte("{}")))
+			if err := requestSigner(pub.ID(keyID), prv)(r); err != nil {
+				t.Fatalf("Sign() error = %s", err)
+			}
+			if err := verifySignature(r, keyID, key); err != nil {
+				t.Errorf("verifySignature() error = %s", err)
+			}
+			if err := verifySignature(r, "https://littr.example/~janedoe#main-key", key); err == nil {
+				t.Errorf("verifySignature() expected error for an unknown key")
+			}
+			r.Header.Set("Digest", bodyDigest([]byte("[]")))
+			if err := verifySignature(r, keyID, key); err == nil {
+				t.Errorf("verifySignature() expected error for a modified signed header")
+			}
+		})
+	}
+}
+
+func TestValidateInboxActivity(t *testing.T) {
+	prev := Instance.Conf
+	Instance.Conf = &config.Configuration{HostName: "littr.example", APIURL: "https://fedbox.littr.example"}
+	defer func() { Instance.Conf = prev }()
+
+	signer := pub.IRI("https://mastodon.example/users/johndoe")
+	blocked := []string{"spam.example"}
+	tests := []struct {
+		name string
+		body string
+		err  func(error) bool
+	}{
+		{
+			name: "valid",
+			body: `{"id":"https://mastodon.example/activities/1","type":"Like","actor":"https://mastodon.example/users/johndoe","object":"https://fedbox.littr.example/objects/1"}`,
+		},
+		{
+			name: "invalid json",
+			body: `{`,
+			err:  errors.IsBadRequest,
+		},
+		{
+			name: "not an activity",
+			body: `{"id":"https://mastodon.example/notes/1","type":"Note"}`,
+			err:  errors.IsBadRequest,
+		},
+		{
+			name: "other actor",
+			body: `{"id":"https://mastodon.example/activities/1","type":"Like","actor":"https://mastodon.example/users/janedoe","object":"https://fedbox.littr.example/objects/1"}`,
+			err:  errors.IsForbidden,
+		},
+		{
+			name: "blocked object",
+			body: `{"id":"https://mastodon.example/activities/1","type":"Announce","actor":"https://mastodon.example/users/johndoe","object":"https://spam.example/notes/1"}`,
+			err:  errors.IsForbidden,
+		},
+		{
+			name: "create",
+			body: `{"id":"https://mastodon.example/activities/1","type":"Create","actor":"https://mastodon.example/users/johndoe","object":{"id":"https://mastodon.example/users/johndoe/statuses/1","type":"Note","attributedTo":"https://mastodon.example/users/johndoe"}}`,
+		},
+		{
+			name: "create on another host",
+			body: `{"id":"https://mastodon.example/activities/1","type":"Create","actor":"https://mastodon.example/users/johndoe","object":{"id":"https://other.example/notes/1","type":"Note","attributedTo":"https://mastodon.example/users/johndoe"}}`,
+			err:  errors.IsForbidden,
+		},
+		{
+			name: "create without object",
+			body: `{"id":"https://mastodon.example/activities/1","type":"Create","actor":"https://mastodon.example/users/johndoe"}`,
+			err:  errors.IsBadRequest,
+		},
+		{
+			name: "update of another actor's object",
+			body: `{"id":"https://mastodon.example/activities/1","type":"Update","actor":"https://mastodon.example/users/johndoe","object":{"id":"https://mastodon.example/users/janedoe/statuses/1","type":"Note","attributedTo":"https://mastodon.example/users/janedoe"}}`,
+			err:  errors.IsForbidden,
+		},
+		{
+			name: "update of the signer",
+			body: `{"id":"https://mastodon.example/activities/1","type":"Update","actor":"https://mastodon.example/users/johndoe","object":{"id":"https://mastodon.example/users/johndoe","type":"Person"}}`,
+		},
+		{
+			name: "delete of a tombstone",
+			body: `{"id":"https://mastodon.example/activities/1","type":"Delete","actor":"https://mastodon.example/users/johndoe","object":{"id":"https://mastodon.example/users/johndoe/statuses/1","type":"Tombstone"}}`,
+		},
+		{
+			name: "delete of another actor's tombstone",
+			body: `{"id":"https://mastodon.example/activities/1","type":"Delete","actor":"https://mastodon.example/users/johndoe","object":"https://mastodon.example/users/johndoe2/statuses/1"}`,
+			err:  errors.IsForbidden,
+		},
+		{
+			name: "delete of another host's object",
+			body: `{"id":"https://mastodon.example/activities/1","type":"Delete","actor":"https://mastodon.example/users/johndoe","object":"https://fedbox.littr.example/objects/1"}`,
+			err:  errors.IsForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			act, err := validateInboxActivity([]byte(tt.body), signer, blocked)
+			if tt.err == nil {
+				if err != nil || act == nil {
+					t.Errorf("validateInboxActivity() = %v, %v, expected valid activity", act, err)
+				}
+				return
+			}
+			if !tt.err(err) {
+				t.Errorf("validateInboxActivity() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestInboxActor(t *testing.T) {
+	body := []byte(`{"id":"https://mastodon.example/activities/1","type":"Like","actor":"https://mastodon.example/users/johndoe","object":"https://littr.example/objects/1"}`)
+	if actor := inboxActor(body); actor != "https://mastodon.example/users/johndoe" {
+		t.Errorf("inboxActor() = %q", actor)
+	}
+	if actor := inboxActor([]byte(`{}`)); len(actor) > 0 {
+		t.Errorf("inboxActor() = %q, expected no actor", actor)
+	}
+}
+
+func TestRepository_LoadSignerOtherHost(t *testing.T) {
+	r := &repository{}
+	_, _, err := r.LoadSigner(context.Background(), "https://evil.example/users/johndoe#main-key", "https://mastodon.example/users/johndoe")
+	if !errors.IsForbidden(err) {
+		t.Errorf("LoadSigner() error = %v, expected forbidden for a key on another host", err)
+	}
+	if _, _, err := r.LoadSigner(context.Background(), "https://mastodon.example/users/johndoe#main-key", ""); !errors.IsForbidden(err) {
+		t.Errorf("LoadSigner() error = %v, expected forbidden without an actor", err)
+	}
+}
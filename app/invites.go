@@ -0,0 +1,218 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+// maxLineageDepth limits how far up the invitation tree we go when loading an account's lineage
+const maxLineageDepth = 16
+
+// accountIsModerator returns true if the account is logged in and is part of the instance's moderators
+func accountIsModerator(a *Account) bool {
+	if !a.IsLogged() {
+		return false
+	}
+	if Instance.Conf.ModeratorsRequire2FA && (!a.HasMetadata() || !a.Metadata.SecondFactor) {
+		return false
+	}
+	return stringInSlice(Instance.Conf.Moderators)(a.Handle)
+}
+
+// Lineage returns the accounts that are part of the invitation chain of the current account,
+// starting with the one that invited it
+func (a *Account) Lineage() AccountPtrCollection {
+	lineage := make(AccountPtrCollection, 0)
+	if a == nil {
+		return lineage
+	}
+	for p := a.Parent; p != nil && len(lineage) < maxLineageDepth; p = p.Parent {
+		lineage = append(lineage, p)
+	}
+	return lineage
+}
+
+// isInvitationRoot returns true if iri is one of the actors that create accounts outside of the invitation mechanism
+func (r *repository) isInvitationRoot(iri pub.IRI) bool {
+	if iri.Equals(r.fedbox.Service().GetLink(), false) || iri == pub.PublicNS {
+		return true
+	}
+	return r.app != nil && r.app.HasMetadata() && iri.Equals(pub.IRI(r.app.Metadata.ID), false)
+}
+
+// invitationError returns the reason for which invited can't be claimed as an invitation:
+// it needs to have been created by another account, and not be claimed already
+func invitationError(invited *Account, isRoot func(pub.IRI) bool) error {
+	if invited == nil || !invited.IsValid() {
+		return errors.NotFoundf("invalid invitation")
+	}
+	if !invited.CreatedBy.HasMetadata() || len(invited.CreatedBy.Metadata.ID) == 0 ||
+		isRoot(pub.IRI(invited.CreatedBy.Metadata.ID)) {
+		return errors.NotFoundf("invalid invitation")
+	}
+	if len(invited.Handle) > 0 {
+		return errors.Forbiddenf("the invitation was already used")
+	}
+	return nil
+}
+
+// LoadInvitation loads the account created by an invitation with the hash invite,
+// if it's still unclaimed. The invitation is used up by saving the account with a handle.
+func (r *repository) LoadInvitation(ctx context.Context, invite string) (*Account, error) {
+	invited, err := r.LoadAccount(ctx, actors.IRI(r.BaseURL()).AddPath(invite))
+	if err != nil {
+		return nil, errors.NotFoundf("invalid invitation")
+	}
+	if err := invitationError(invited, r.isInvitationRoot); err != nil {
+		return nil, err
+	}
+	return invited, nil
+}
+
+// LoadAccountLineage loads the accounts that invited acc, walking up the invitation tree,
+// and links them through the Parent property of each account.
+func (r *repository) LoadAccountLineage(ctx context.Context, acc *Account) error {
+	if acc == nil {
+		return nil
+	}
+	visited := make(Hashes, 0)
+	cur := acc
+	for i := 0; i < maxLineageDepth; i++ {
+		if !cur.CreatedBy.HasMetadata() || len(cur.CreatedBy.Metadata.ID) == 0 {
+			break
+		}
+		iri := pub.IRI(cur.CreatedBy.Metadata.ID)
+		if r.isInvitationRoot(iri) {
+			break
+		}
+		act, err := r.fedbox.Actor(ctx, iri)
+		if err != nil {
+			return errors.Annotatef(err, "unable to load inviter %s", iri)
+		}
+		par := new(Account)
+		if err := par.FromActivityPub(act); err != nil {
+			return err
+		}
+		if visited.Contains(par.Hash) {
+			break
+		}
+		visited = append(visited, par.Hash)
+		cur.Parent = par
+		cur = par
+	}
+	acc.Level = uint8(len(visited))
+	return nil
+}
+
+// Account returns the account that is the subject of the moderation group:
+// either the moderated account or the author of the moderated item
+func (m ModerationGroup) Account() *Account {
+	switch ob := m.Object.(type) {
+	case *Account:
+		return ob
+	case *Item:
+		return ob.SubmittedBy
+	}
+	return nil
+}
+
+// loadModerationLineage loads the invitation lineage for the accounts that are subject of moderation requests
+func (r *repository) loadModerationLineage(ctx context.Context, rl RenderableList) {
+	for _, it := range rl {
+		g, ok := it.(*ModerationGroup)
+		if !ok {
+			continue
+		}
+		acc := g.Account()
+		if acc == nil || acc.Parent != nil {
+			continue
+		}
+		if err := r.LoadAccountLineage(ctx, acc); err != nil {
+			r.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to load account lineage")
+		}
+	}
+}
+
+// moderatorsNameFilter returns the filter matching the moderators' accounts
+func moderatorsNameFilter() CompStrs {
+	f := make(CompStrs, 0)
+	for _, m := range Instance.Conf.Moderators {
+		f = append(f, EqualsString(m))
+	}
+	return f
+}
+
+// LoadInviteeSanctions counts the moderator blocks received by the accounts that inviter invited
+func (r *repository) LoadInviteeSanctions(ctx context.Context, inviter Account) (int, error) {
+	if !inviter.Hash.IsValid() || len(Instance.Conf.Moderators) == 0 {
+		return 0, nil
+	}
+	fi := new(Filters)
+	fi.AttrTo = CompStrs{LikeString(inviter.Hash.String())}
+	fi.Type = ActivityTypesFilter(ValidActorTypes...)
+	invitees, err := r.accounts(ctx, fi)
+	if err != nil {
+		return 0, errors.Annotatef(err, "unable to load invitees for %s", inviter.Handle)
+	}
+	if len(invitees) == 0 {
+		return 0, nil
+	}
+
+	fb := new(Filters)
+	fb.Type = ActivityTypesFilter(pub.BlockType)
+	fb.Object = &Filters{IRI: AccountHashFilter(invitees...)}
+	fb.Actor = &Filters{Name: moderatorsNameFilter()}
+	fb.MaxItems = 100
+	inbox := func(ctx context.Context, f *Filters) (pub.CollectionInterface, error) {
+		return r.fedbox.Inbox(ctx, r.fedbox.Service(), Values(f))
+	}
+	sanctions := 0
+	err = LoadFromCollection(ctx, inbox, &colCursor{filters: fb}, func(c pub.CollectionInterface) (bool, error) {
+		sanctions += len(c.Collection())
+		return false, nil
+	})
+	return sanctions, err
+}
+
+// NotifyInviter sends a private message to the account that invited the actioned account
+func (r *repository) NotifyInviter(ctx context.Context, moderator Account, invitee Account, action string, reason *Item) error {
+	if !invitee.CreatedBy.HasMetadata() || len(invitee.CreatedBy.Metadata.ID) == 0 {
+		return nil
+	}
+	iri := pub.IRI(invitee.CreatedBy.Metadata.ID)
+	if r.isInvitationRoot(iri) {
+		return nil
+	}
+	act, err := r.fedbox.Actor(ctx, iri)
+	if err != nil {
+		return errors.Annotatef(err, "unable to load inviter %s", iri)
+	}
+	inviter := Account{}
+	if err := inviter.FromActivityPub(act); err != nil {
+		return err
+	}
+
+	n := Item{
+		Title:       fmt.Sprintf("Moderation action on %s", invitee.Handle),
+		MimeType:    MimeTypeText,
+		SubmittedBy: &moderator,
+		Metadata: &ItemMetadata{
+			To: AccountCollection{inviter},
+		},
+	}
+	n.Data = fmt.Sprintf("Hello %s,\nThe account %s that you invited has been %s by a moderator.", inviter.Handle, invitee.Handle, action)
+	if reason != nil && len(reason.Data) > 0 {
+		n.Data = fmt.Sprintf("%s\nReason: %s", n.Data, reason.Data)
+	}
+	n.SubmittedAt = time.Now().UTC()
+	n.MakePrivate()
+	if _, err = r.SaveItem(ctx, n); err != nil {
+		r.errFn(log.Ctx{"err": err, "inviter": inviter.Handle})("unable to notify inviter")
+	}
+	return err
+}
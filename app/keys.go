@@ -0,0 +1,381 @@
+package app
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+	"github.com/go-ap/errors"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+const (
+	keyTypeRSA     = "id-rsa"
+	keyTypeECDSA   = "id-ecdsa"
+	keyTypeED25519 = "id-ed25519"
+
+	rsaKeyBits = 2048
+)
+
+// keyTypes are the types of keys the local actors can sign their requests with, with their descriptions
+var keyTypes = map[string]string{
+	keyTypeRSA:     "RSA, supported by most ActivityPub servers",
+	keyTypeECDSA:   "ECDSA P-256, refused by Mastodon and most other ActivityPub servers",
+	keyTypeED25519: "Ed25519, refused by Mastodon and most other ActivityPub servers",
+}
+
+// keyType returns the key type for the name, which can be rsa, ecdsa, ed25519 or one of the key types,
+// it defaults to RSA
+func keyType(name string) string {
+	switch strings.TrimPrefix(strings.ToLower(name), "id-") {
+	case "ecdsa":
+		return keyTypeECDSA
+	case "ed25519":
+		return keyTypeED25519
+	default:
+		return keyTypeRSA
+	}
+}
+
+// generateKey returns a new key pair of the type, with the private key in PKCS8 and the public one in PKIX form
+func generateKey(typ string) (*SSHKey, error) {
+	var prv crypto.Signer
+	var err error
+	switch typ {
+	case keyTypeRSA:
+		prv, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case keyTypeECDSA:
+		prv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case keyTypeED25519:
+		_, prv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, errors.NotValidf("unsupported key type %s", typ)
+	}
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to generate %s key", typ)
+	}
+	k := &SSHKey{ID: typ}
+	if k.Private, err = x509.MarshalPKCS8PrivateKey(prv); err != nil {
+		return nil, err
+	}
+	if k.Public, err = x509.MarshalPKIXPublicKey(prv.Public()); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// PrivateKey parses the private key, the keys saved before we used PKCS8 for all types can still be in
+// the PKCS1 or SEC 1 forms
+func (k SSHKey) PrivateKey() (crypto.PrivateKey, error) {
+	if len(k.Private) == 0 {
+		return nil, errors.NotFoundf("no private key")
+	}
+	prv, err := x509.ParsePKCS8PrivateKey(k.Private)
+	if err == nil {
+		return prv, nil
+	}
+	switch k.ID {
+	case keyTypeRSA:
+		return x509.ParsePKCS1PrivateKey(k.Private)
+	case keyTypeECDSA:
+		return x509.ParseECPrivateKey(k.Private)
+	}
+	return nil, errors.Annotatef(err, "unsupported private key type %s", k.ID)
+}
+
+// publicKeyPem returns the PEM encoding of the PKIX public key, as it's published in the actor's publicKeyPem
+func publicKeyPem(der []byte) string {
+	return strings.TrimSpace(string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+}
+
+// keyFingerprint returns the SHA256 fingerprint of the PKIX public key
+func keyFingerprint(der []byte) string {
+	sum := sha256.Sum256(der)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// keyStore keeps the private keys of the local actors, FedBOX publishes only their public keys
+type keyStore struct {
+	*fileStore
+}
+
+// Load returns the key pair of the account
+func (s keyStore) Load(a Account) (*SSHKey, error) {
+	if s.fileStore != nil && a.Hash.IsValid() {
+		k := new(SSHKey)
+		err := s.fileStore.Load(a.Hash.String(), k)
+		if err == nil && len(k.Private) > 0 {
+			return k, nil
+		}
+		if err != nil && !errors.IsNotFound(err) {
+			return nil, err
+		}
+	}
+	if a.HasMetadata() && a.Metadata.Key != nil && len(a.Metadata.Key.Private) > 0 {
+		return a.Metadata.Key, nil
+	}
+	return nil, errors.NotFoundf("no private key for %s", a.Handle)
+}
+
+func (s keyStore) Save(a Account, k *SSHKey) error {
+	if s.fileStore == nil {
+		return errors.Newf("keys storage is not available")
+	}
+	if !a.Hash.IsValid() {
+		return errors.NotValidf("invalid account %s", a.Handle)
+	}
+	return s.fileStore.Save(a.Hash.String(), k)
+}
+
+// signatureHeaders are the headers we sign in the requests to other servers
+var signatureHeaders = []string{"(request-target)", "host", "date"}
+
+// signedHeaders returns the headers to sign for the request, the Digest of the body being signed too when
+// the request has one, as servers like Mastodon refuse the POST requests without it
+func signedHeaders(req *http.Request) []string {
+	if len(req.Header.Get("Digest")) == 0 {
+		return signatureHeaders
+	}
+	return append(append([]string{}, signatureHeaders...), "digest")
+}
+
+// bodyDigest returns the value of the Digest header for the request body
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// requestSigner returns the function that signs the requests with the private key, RSA keys use rsa-sha256,
+// the ECDSA and Ed25519 ones, hs2019. Only littr and a few other servers can verify the latter, so RSA stays
+// the default for federation.
+func requestSigner(keyID pub.ID, prv crypto.PrivateKey) client.RequestSignFn {
+	switch key := prv.(type) {
+	case *rsa.PrivateKey:
+		return func(req *http.Request) error {
+			return getSigner(keyID, key, signedHeaders(req)).Sign(req)
+		}
+	case *ecdsa.PrivateKey, ed25519.PrivateKey:
+		return func(req *http.Request) error {
+			return signHS2019(req, string(keyID), key.(crypto.Signer))
+		}
+	}
+	return nil
+}
+
+// signingString builds the string that gets signed from the headers of the request
+func signingString(req *http.Request, headers []string) string {
+	lines := make([]string, 0, len(headers))
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, fmt.Sprintf("%s: %s %s", h, strings.ToLower(req.Method), req.URL.RequestURI()))
+		case "host":
+			host := req.Host
+			if len(host) == 0 {
+				host = req.URL.Host
+			}
+			lines = append(lines, fmt.Sprintf("%s: %s", h, host))
+		default:
+			lines = append(lines, fmt.Sprintf("%s: %s", h, strings.TrimSpace(req.Header.Get(h))))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// signHS2019 adds the HTTP signature of the request, made with an ECDSA or Ed25519 key
+func signHS2019(req *http.Request, keyID string, key crypto.Signer) error {
+	if len(req.Header.Get("Date")) == 0 {
+		req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+	headers := signedHeaders(req)
+	data := []byte(signingString(req, headers))
+	var sig []byte
+	var err error
+	switch key.(type) {
+	case ed25519.PrivateKey:
+		sig, err = key.Sign(rand.Reader, data, crypto.Hash(0))
+	case *ecdsa.PrivateKey:
+		sum := sha256.Sum256(data)
+		sig, err = key.Sign(rand.Reader, sum[:], crypto.SHA256)
+	default:
+		err = errors.Newf("unsupported key type %T", key)
+	}
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="hs2019",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig)))
+	return nil
+}
+
+// verifyHS2019 checks the hs2019 HTTP signature of the request, made with an ECDSA or Ed25519 key,
+// and that it covers the required headers
+func verifyHS2019(r *http.Request, keyID string, key crypto.PublicKey, required []string) error {
+	params := signatureParams(r)
+	if params["keyId"] != keyID {
+		return errors.Newf("unknown key %s", params["keyId"])
+	}
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	if len(headers) == 0 {
+		headers = []string{"date"}
+	}
+	for _, h := range required {
+		if !stringInSlice(headers)(h) {
+			return errors.Newf("the signature doesn't cover the %s header", h)
+		}
+	}
+	sig, err := base64.StdEncoding.DecodeString(params["signature"])
+	if err != nil {
+		return errors.NewNotValid(err, "invalid signature encoding")
+	}
+	data := []byte(signingString(r, headers))
+	valid := false
+	switch k := key.(type) {
+	case ed25519.PublicKey:
+		valid = ed25519.Verify(k, data, sig)
+	case *ecdsa.PublicKey:
+		esig := struct{ R, S *big.Int }{}
+		if _, err := asn1.Unmarshal(sig, &esig); err != nil {
+			return errors.NewNotValid(err, "invalid ECDSA signature")
+		}
+		sum := sha256.Sum256(data)
+		valid = ecdsa.Verify(k, sum[:], esig.R, esig.S)
+	default:
+		return errors.Newf("unsupported key type %T", key)
+	}
+	if !valid {
+		return errors.Newf("the signature doesn't match")
+	}
+	return nil
+}
+
+// RotateKey generates a new key pair for the account, and publishes its public key with an Update of the actor
+// made on behalf of by
+func (r *repository) RotateKey(ctx context.Context, a Account, by *Account, typ string) (Account, error) {
+	if !a.IsValid() || !a.HasMetadata() || len(a.Metadata.ID) == 0 {
+		return a, errors.NotValidf("invalid account %s", a.Handle)
+	}
+	k, err := generateKey(typ)
+	if err != nil {
+		return a, err
+	}
+	a.Metadata.Key = &SSHKey{ID: k.ID, Public: k.Public}
+	a.CreatedBy = by
+	saved, err := r.SaveAccount(ctx, a)
+	if err != nil {
+		return a, errors.Annotatef(err, "unable to publish the new public key")
+	}
+	if !saved.Hash.IsValid() {
+		saved.Hash = a.Hash
+	}
+	if err := r.keys.Save(saved, k); err != nil {
+		return saved, errors.Annotatef(err, "unable to save the new private key")
+	}
+	r.infoFn(log.Ctx{"handle": a.Handle, "type": k.ID, "fingerprint": keyFingerprint(k.Public)})("rotated signing key")
+	return saved, nil
+}
+
+// BackfillKeys generates keys for the local actors that don't have a private key, and returns how many got one
+func (r *repository) BackfillKeys(ctx context.Context, typ string) (int, error) {
+	actors := func(ctx context.Context, f *Filters) (pub.CollectionInterface, error) {
+		return r.fedbox.Actors(ctx, Values(f))
+	}
+	accounts := make([]Account, 0)
+	f := &Filters{Type: ActivityTypesFilter(ValidActorTypes...), MaxItems: MaxContentItems}
+	err := LoadFromCollection(ctx, actors, &colCursor{filters: f}, func(col pub.CollectionInterface) (bool, error) {
+		for _, it := range col.Collection() {
+			a := Account{}
+			if err := a.FromActivityPub(it); err != nil || !a.IsValid() || !a.HasMetadata() || !HostIsLocal(a.Metadata.ID) {
+				continue
+			}
+			accounts = append(accounts, a)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	repo := r
+	if r.app != nil {
+		repo = r.WithAccount(r.app)
+	}
+	count := 0
+	for _, a := range accounts {
+		ltx := log.Ctx{"handle": a.Handle, "iri": a.Metadata.ID}
+		if pub.IRI(a.Metadata.ID).Equals(r.fedbox.Service().GetLink(), false) {
+			continue
+		}
+		if _, err := r.keys.Load(a); err == nil {
+			continue
+		}
+		if _, err := repo.RotateKey(ctx, a, r.app, typ); err != nil {
+			r.errFn(ltx, log.Ctx{"err": err})("unable to backfill signing key")
+			continue
+		}
+		count++
+	}
+	return count, nil
+}
+
+// signingKeySettings is what we show about the signing key of an account on the settings page
+type signingKeySettings struct {
+	Type        string
+	Fingerprint string
+	// Missing is true when we don't have the private key, and the account can't sign its requests
+	Missing bool
+	// Default is the key type the instance generates for new accounts
+	Default string
+}
+
+func (h *handler) signingKeySettings(a Account) *signingKeySettings {
+	s := &signingKeySettings{Missing: true, Default: h.storage.keyType}
+	if a.HasMetadata() && a.Metadata.Key != nil && len(a.Metadata.Key.Public) > 0 {
+		s.Fingerprint = keyFingerprint(a.Metadata.Key.Public)
+	}
+	if k, err := h.storage.keys.Load(a); err == nil {
+		s.Type = keyTypes[k.ID]
+		s.Fingerprint = keyFingerprint(k.Public)
+		s.Missing = false
+	}
+	return s
+}
+
+// HandleRotateKey serves POST /settings/key requests, it replaces the signing key of the logged account
+func (h *handler) HandleRotateKey(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	typ := r.PostFormValue("type")
+	if _, ok := keyTypes[typ]; !ok {
+		h.v.addFlashMessage(Error, w, r, "Invalid key type")
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	saved, err := h.requestRepository(r).RotateKey(r.Context(), *acc, acc, typ)
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to rotate signing key")
+		h.v.addFlashMessage(Error, w, r, "Unable to generate a new signing key")
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	acc.Metadata.Key = saved.Metadata.Key
+	if err := h.v.saveAccountToSession(w, r, *acc); err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to save account to session")
+	}
+	h.v.addFlashMessage(Success, w, r, "Generated a new signing key, the other servers are notified of the change")
+	h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
@@ -0,0 +1,163 @@
+package app
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"testing"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+)
+
+func TestKeyType(t *testing.T) {
+	for name, want := range map[string]string{
+		"":           keyTypeRSA,
+		"rsa":        keyTypeRSA,
+		"ECDSA":      keyTypeECDSA,
+		"ed25519":    keyTypeED25519,
+		"id-ed25519": keyTypeED25519,
+		"dsa":        keyTypeRSA,
+	} {
+		if got := keyType(name); got != want {
+			t.Errorf("keyType(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestGenerateKey(t *testing.T) {
+	for typ := range keyTypes {
+		t.Run(typ, func(t *testing.T) {
+			k, err := generateKey(typ)
+			if err != nil {
+				t.Fatalf("generateKey() error = %s", err)
+			}
+			prv, err := k.PrivateKey()
+			if err != nil {
+				t.Fatalf("PrivateKey() error = %s", err)
+			}
+			switch prv.(type) {
+			case *rsa.PrivateKey, *ecdsa.PrivateKey, ed25519.PrivateKey:
+			default:
+				t.Fatalf("PrivateKey() = %T, unexpected type", prv)
+			}
+			pubKey, err := parsePublicKeyPem(publicKeyPem(k.Public))
+			if err != nil {
+				t.Fatalf("parsePublicKeyPem() error = %s", err)
+			}
+			der, _ := x509.MarshalPKIXPublicKey(pubKey)
+			if string(der) != string(k.Public) {
+				t.Errorf("the published public key doesn't match the generated one")
+			}
+		})
+	}
+	if _, err := generateKey("id-dsa"); err == nil {
+		t.Errorf("generateKey() expected error for unsupported key type")
+	}
+}
+
+var signatureRe = regexp.MustCompile(`^keyId="([^"]+)",algorithm="hs2019",headers="\(request-target\) host date",signature="([^"]+)"$`)
+
+func TestSignHS2019(t *testing.T) {
+	keyID := "https://littr.example/actors/johndoe#main-key"
+	for _, typ := range []string{keyTypeECDSA, keyTypeED25519} {
+		t.Run(typ, func(t *testing.T) {
+			k, _ := generateKey(typ)
+			prv, _ := k.PrivateKey()
+			pubKey, _ := x509.ParsePKIXPublicKey(k.Public)
+
+			req, _ := http.NewRequest(http.MethodPost, "https://mastodon.example/users/janedoe/inbox", nil)
+			if err := requestSigner(pub.ID(keyID), prv)(req); err != nil {
+				t.Fatalf("sign error = %s", err)
+			}
+			m := signatureRe.FindStringSubmatch(req.Header.Get("Signature"))
+			if m == nil || m[1] != keyID {
+				t.Fatalf("invalid Signature header %q", req.Header.Get("Signature"))
+			}
+			sig, _ := base64.StdEncoding.DecodeString(m[2])
+			data := []byte(signingString(req, signatureHeaders))
+			valid := false
+			switch key := pubKey.(type) {
+			case ed25519.PublicKey:
+				valid = ed25519.Verify(key, data, sig)
+			case *ecdsa.PublicKey:
+				var es struct{ R, S *big.Int }
+				if _, err := asn1.Unmarshal(sig, &es); err == nil {
+					sum := sha256.Sum256(data)
+					valid = ecdsa.Verify(key, sum[:], es.R, es.S)
+				}
+			}
+			if !valid {
+				t.Errorf("the signature doesn't verify with the public key")
+			}
+		})
+	}
+}
+
+func TestKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := newFileStore(dir, "keys")
+	if err != nil {
+		t.Fatalf("unable to create store: %s", err)
+	}
+	s := keyStore{fs}
+	a := Account{Handle: "johndoe", Hash: HashFromString("f7e0bd1a-2f5f-11eb-9d4b-0242ac130002"), Metadata: &AccountMetadata{}}
+
+	if _, err := s.Load(a); !errors.IsNotFound(err) {
+		t.Errorf("Load() error = %v, expected not found", err)
+	}
+	k, _ := generateKey(keyTypeED25519)
+	if err := s.Save(a, k); err != nil {
+		t.Fatalf("Save() error = %s", err)
+	}
+	if err := s.Save(Account{Handle: "anonymous"}, k); err == nil {
+		t.Errorf("Save() expected error for account without hash")
+	}
+	saved, err := s.Load(a)
+	if err != nil || saved.ID != keyTypeED25519 || string(saved.Private) != string(k.Private) {
+		t.Errorf("Load() = %v, %v, expected the saved key", saved, err)
+	}
+
+	other, _ := generateKey(keyTypeECDSA)
+	b := Account{Handle: "janedoe", Metadata: &AccountMetadata{Key: other}}
+	if loaded, err := s.Load(b); err != nil || loaded != other {
+		t.Errorf("Load() = %v, %v, expected the key from the account's metadata", loaded, err)
+	}
+}
+
+func TestSignedHeaders(t *testing.T) {
+	get, _ := http.NewRequest(http.MethodGet, "https://mastodon.example/users/janedoe", nil)
+	if got := signedHeaders(get); !reflect.DeepEqual(got, signatureHeaders) {
+		t.Errorf("signedHeaders() = %v for a request without Digest, want %v", got, signatureHeaders)
+	}
+	body := []byte(`{"type":"Create"}`)
+	post, _ := http.NewRequest(http.MethodPost, "https://mastodon.example/inbox", bytes.NewReader(body))
+	post.Header.Set("Digest", bodyDigest(body))
+	want := []string{"(request-target)", "host", "date", "digest"}
+	if got := signedHeaders(post); !reflect.DeepEqual(got, want) {
+		t.Errorf("signedHeaders() = %v for a request with Digest, want %v", got, want)
+	}
+	if len(signatureHeaders) != 3 {
+		t.Errorf("signedHeaders() modified the default headers: %v", signatureHeaders)
+	}
+	sum := sha256.Sum256(body)
+	if d := bodyDigest(body); d != "SHA-256="+base64.StdEncoding.EncodeToString(sum[:]) {
+		t.Errorf("bodyDigest() = %s", d)
+	}
+}
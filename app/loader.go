@@ -10,11 +10,14 @@ var (
 	ServicesCtxtKey      CtxtKey = "__di"
 	LoggedAccountCtxtKey CtxtKey = "__acct"
 	RepositoryCtxtKey    CtxtKey = "__repository"
+	AccessTokenCtxtKey   CtxtKey = "__access_token"
 	FilterCtxtKey        CtxtKey = "__filter"
 	ModelCtxtKey         CtxtKey = "__model"
 	AuthorCtxtKey        CtxtKey = "__author"
 	CursorCtxtKey        CtxtKey = "__cursor"
 	ContentCtxtKey       CtxtKey = "__content"
+	CommunityCtxtKey     CtxtKey = "__community"
+	SignerCtxtKey        CtxtKey = "__signer"
 )
 
 type WebInfo struct {
@@ -88,6 +91,12 @@ func ContextContent(ctx context.Context) *Item {
 	return i
 }
 
+func ContextCommunity(ctx context.Context) *Community {
+	var c *Community
+	c, _ = ctx.Value(CommunityCtxtKey).(*Community)
+	return c
+}
+
 func ContextRegisterModel(ctx context.Context) *registerModel {
 	var r *registerModel
 	r, _ = ctx.Value(ModelCtxtKey).(*registerModel)
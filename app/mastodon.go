@@ -0,0 +1,405 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ap/errors"
+	"github.com/go-chi/chi"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+const (
+	mastodonDefaultLimit = 20
+	mastodonMaxLimit     = 40
+	// mastodonAPIVersion is the version of the Mastodon API we're compatible with, crawlers parse it from the instance version
+	mastodonAPIVersion = "2.7.0"
+)
+
+// mastodonAccount is the Mastodon API representation of an Account
+type mastodonAccount struct {
+	ID             string        `json:"id"`
+	Username       string        `json:"username"`
+	Acct           string        `json:"acct"`
+	DisplayName    string        `json:"display_name"`
+	Locked         bool          `json:"locked"`
+	Bot            bool          `json:"bot"`
+	CreatedAt      time.Time     `json:"created_at"`
+	Note           string        `json:"note"`
+	URL            string        `json:"url"`
+	Avatar         string        `json:"avatar"`
+	AvatarStatic   string        `json:"avatar_static"`
+	Header         string        `json:"header"`
+	HeaderStatic   string        `json:"header_static"`
+	FollowersCount int           `json:"followers_count"`
+	FollowingCount int           `json:"following_count"`
+	StatusesCount  int           `json:"statuses_count"`
+	Emojis         []interface{} `json:"emojis"`
+	Fields         []interface{} `json:"fields"`
+}
+
+// mastodonTag is the Mastodon API representation of a hashtag
+type mastodonTag struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// mastodonStatus is the Mastodon API representation of an Item
+type mastodonStatus struct {
+	ID                 string          `json:"id"`
+	URI                string          `json:"uri"`
+	URL                string          `json:"url"`
+	CreatedAt          time.Time       `json:"created_at"`
+	EditedAt           *time.Time      `json:"edited_at"`
+	Account            mastodonAccount `json:"account"`
+	InReplyToID        *string         `json:"in_reply_to_id"`
+	InReplyToAccountID *string         `json:"in_reply_to_account_id"`
+	Reblog             *mastodonStatus `json:"reblog"`
+	Content            string          `json:"content"`
+	SpoilerText        string          `json:"spoiler_text"`
+	Sensitive          bool            `json:"sensitive"`
+	Visibility         string          `json:"visibility"`
+	Language           *string         `json:"language"`
+	RepliesCount       int             `json:"replies_count"`
+	ReblogsCount       int             `json:"reblogs_count"`
+	FavouritesCount    int             `json:"favourites_count"`
+	MediaAttachments   []interface{}   `json:"media_attachments"`
+	Mentions           []interface{}   `json:"mentions"`
+	Tags               []mastodonTag   `json:"tags"`
+	Emojis             []interface{}   `json:"emojis"`
+	Card               interface{}     `json:"card"`
+	Poll               interface{}     `json:"poll"`
+}
+
+// mastodonContext is the Mastodon API representation of the thread a status is part of
+type mastodonContext struct {
+	Ancestors   []mastodonStatus `json:"ancestors"`
+	Descendants []mastodonStatus `json:"descendants"`
+}
+
+func mastodonAccountFrom(a *Account) mastodonAccount {
+	m := mastodonAccount{
+		Emojis: []interface{}{},
+		Fields: []interface{}{},
+	}
+	if a == nil {
+		return m
+	}
+	m.ID = a.Hash.String()
+	m.Username = a.Handle
+	m.Acct = a.Handle
+	m.DisplayName = a.Handle
+	m.CreatedAt = a.CreatedAt
+	m.URL = accountURL(*a).String()
+	if a.HasMetadata() {
+		m.Note = string(a.Metadata.Blurb)
+		m.Avatar = a.Metadata.Icon.URI
+		m.AvatarStatic = a.Metadata.Icon.URI
+		if a.IsFederated() && len(a.Metadata.URL) > 0 {
+			m.URL = a.Metadata.URL
+		}
+	}
+	m.FollowersCount = len(a.Followers)
+	m.FollowingCount = len(a.Following)
+	return m
+}
+
+// mastodonContent renders the item's content as the HTML the Mastodon clients expect
+func mastodonContent(it Item) string {
+	b := strings.Builder{}
+	if it.IsLink() {
+		fmt.Fprintf(&b, `<p><a href="%s">%s</a></p>`, template.HTMLEscapeString(it.Data), template.HTMLEscapeString(it.Title))
+		return b.String()
+	}
+	if len(it.Title) > 0 {
+		fmt.Fprintf(&b, "<p><strong>%s</strong></p>", template.HTMLEscapeString(it.Title))
+	}
+	switch it.MimeType {
+	case MimeTypeMarkdown:
+		b.WriteString(string(Markdown(it.Data)))
+	case MimeTypeHTML:
+		b.WriteString(it.Data)
+	default:
+		for _, p := range strings.Split(it.Data, "\n\n") {
+			fmt.Fprintf(&b, "<p>%s</p>", strings.ReplaceAll(template.HTMLEscapeString(p), "\n", "<br/>"))
+		}
+	}
+	return b.String()
+}
+
+func mastodonStatusFrom(it Item) mastodonStatus {
+	s := mastodonStatus{
+		ID:               it.Hash.String(),
+		URL:              fmt.Sprintf("%s%s", Instance.BaseURL, ItemLocalLink(&it)),
+		CreatedAt:        it.SubmittedAt,
+		Account:          mastodonAccountFrom(it.SubmittedBy),
+		Content:          mastodonContent(it),
+		Visibility:       "public",
+		RepliesCount:     len(it.children),
+		MediaAttachments: []interface{}{},
+		Mentions:         []interface{}{},
+		Tags:             []mastodonTag{},
+		Emojis:           []interface{}{},
+	}
+	if it.Score > 0 {
+		s.FavouritesCount = it.Score
+	}
+	if it.HasMetadata() {
+		s.URI = it.Metadata.ID
+		if it.IsFederated() && len(it.Metadata.URL) > 0 {
+			s.URL = it.Metadata.URL
+		}
+		for _, t := range it.Metadata.Tags {
+			s.Tags = append(s.Tags, mastodonTag{Name: strings.TrimPrefix(t.Name, "#"), URL: t.URL})
+		}
+	}
+	if !it.UpdatedAt.IsZero() && it.UpdatedAt.After(it.SubmittedAt) {
+		updated := it.UpdatedAt
+		s.EditedAt = &updated
+	}
+	if it.Parent.IsValid() {
+		parent := it.Parent.Hash.String()
+		s.InReplyToID = &parent
+		if it.Parent.SubmittedBy.IsValid() {
+			by := it.Parent.SubmittedBy.Hash.String()
+			s.InReplyToAccountID = &by
+		}
+	}
+	return s
+}
+
+// mastodonVisible returns true for the items that can be shown to the anonymous Mastodon API clients
+func mastodonVisible(it *Item) bool {
+	return it.IsValid() && !it.Deleted() && !it.Private()
+}
+
+func mastodonStatuses(items []Renderable) []mastodonStatus {
+	statuses := make([]mastodonStatus, 0)
+	for _, ren := range items {
+		it, ok := ren.(*Item)
+		if !ok || !mastodonVisible(it) {
+			continue
+		}
+		statuses = append(statuses, mastodonStatusFrom(*it))
+	}
+	return statuses
+}
+
+func (h *handler) writeMastodonJSON(w http.ResponseWriter, status int, v interface{}) {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		h.errFn(log.Ctx{"err": err})("unable to marshal Mastodon API response")
+		status = http.StatusInternalServerError
+		dat = []byte(`{"error":"unable to marshal response"}`)
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.WriteHeader(status)
+	w.Write(dat)
+}
+
+func (h *handler) writeMastodonError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if errors.IsNotFound(err) {
+		status = http.StatusNotFound
+	}
+	h.writeMastodonJSON(w, status, struct {
+		Error string `json:"error"`
+	}{Error: err.Error()})
+}
+
+// loadMastodonStatus loads the public item with the hash in the URL
+func (h *handler) loadMastodonStatus(ctx context.Context, r *http.Request) (Item, error) {
+	hash := HashFromString(chi.URLParam(r, "id"))
+	if !hash.IsValid() {
+		return Item{}, errors.NotFoundf("Record not found")
+	}
+	it, err := h.storage.LoadItem(ctx, objects.IRI(h.storage.fedbox.Service()).AddPath(hash.String()))
+	if err != nil || !mastodonVisible(&it) {
+		return Item{}, errors.NotFoundf("Record not found")
+	}
+	return it, nil
+}
+
+// MastodonTimelineFiltersMw loads the filters for the public timeline from the Mastodon API query parameters.
+// The max_id and min_id values are the cursors we return in the Link header, not status IDs.
+func MastodonTimelineFiltersMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		f := new(Filters)
+		f.Type = CreateActivitiesFilter
+		f.Object = new(Filters)
+		f.Object.Type = ActivityTypesFilter(ValidContentTypes...)
+		f.MaxItems = mastodonDefaultLimit
+		if limit, err := strconv.Atoi(q.Get("limit")); err == nil && limit > 0 {
+			f.MaxItems = limit
+			if limit > mastodonMaxLimit {
+				f.MaxItems = mastodonMaxLimit
+			}
+		}
+		f.Next = q.Get("max_id")
+		f.Prev = q.Get("min_id")
+		ctx := context.WithValue(r.Context(), FilterCtxtKey, []*Filters{f})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// HandleMastodonInstance serves /api/v1/instance requests
+func (h *handler) HandleMastodonInstance(w http.ResponseWriter, r *http.Request) {
+	info := Instance.NodeInfo()
+	usage := h.nodeInfo.Usage()
+	d := Desc{
+		Description: info.Summary,
+		Email:       info.Email,
+		Title:       info.Title,
+		Lang:        []string{"en"},
+		URI:         h.conf.HostName,
+		Version:     fmt.Sprintf("%s (compatible; %s %s)", mastodonAPIVersion, softwareName, info.Version),
+		Stats: Stats{
+			UserCount:   uint(usage.Users.Total),
+			StatusCount: uint(usage.LocalPosts + usage.LocalComments),
+		},
+	}
+	h.writeMastodonJSON(w, http.StatusOK, d)
+}
+
+// HandleMastodonPublicTimeline serves /api/v1/timelines/public requests
+func (h *handler) HandleMastodonPublicTimeline(w http.ResponseWriter, r *http.Request) {
+	c := ContextCursor(r.Context())
+	if c == nil {
+		h.writeMastodonError(w, errors.NotFoundf("timeline not found"))
+		return
+	}
+	local, _ := strconv.ParseBool(r.URL.Query().Get("local"))
+	items := make([]Renderable, 0)
+	for _, ren := range ByDate(c.items) {
+		if it, ok := ren.(*Item); ok && local && !it.IsLocal() {
+			continue
+		}
+		items = append(items, ren)
+	}
+
+	links := make([]string, 0)
+	u := fmt.Sprintf("%s/api/v1/timelines/public", Instance.BaseURL)
+	q := r.URL.Query()
+	q.Del("min_id")
+	if c.after.IsValid() {
+		q.Set("max_id", c.after.String())
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="next"`, u, q.Encode()))
+	}
+	q.Del("max_id")
+	if c.before.IsValid() {
+		q.Set("min_id", c.before.String())
+		links = append(links, fmt.Sprintf(`<%s?%s>; rel="prev"`, u, q.Encode()))
+	}
+	if len(links) > 0 {
+		w.Header().Set("Link", strings.Join(links, ", "))
+	}
+	h.writeMastodonJSON(w, http.StatusOK, mastodonStatuses(items))
+}
+
+// HandleMastodonStatus serves /api/v1/statuses/{id} requests
+func (h *handler) HandleMastodonStatus(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
+	it, err := h.loadMastodonStatus(ctx, r)
+	if err != nil {
+		h.writeMastodonError(w, err)
+		return
+	}
+	items := ItemCollection{it}
+	if items, err = h.storage.loadItemsAuthors(ctx, items...); err != nil {
+		h.errFn(log.Ctx{"err": err})("unable to load item authors")
+	}
+	if items, err = h.storage.loadItemsVotes(ctx, items...); err != nil {
+		h.errFn(log.Ctx{"err": err})("unable to load item votes")
+	}
+	h.writeMastodonJSON(w, http.StatusOK, mastodonStatusFrom(items[0]))
+}
+
+// HandleMastodonStatusContext serves /api/v1/statuses/{id}/context requests
+func (h *handler) HandleMastodonStatusContext(w http.ResponseWriter, r *http.Request) {
+	ctx := context.TODO()
+	it, err := h.loadMastodonStatus(ctx, r)
+	if err != nil {
+		h.writeMastodonError(w, err)
+		return
+	}
+	thread := make(ItemCollection, 0)
+	if it.OP.IsValid() && it.OP.Hash != it.Hash {
+		if op, err := h.storage.LoadItem(ctx, objects.IRI(h.storage.fedbox.Service()).AddPath(it.OP.Hash.String())); err == nil {
+			thread = append(thread, op)
+		}
+	}
+	if replies, err := h.storage.loadItemsReplies(ctx, it); err == nil {
+		thread = append(thread, replies...)
+	}
+	if thread, err = h.storage.loadItemsAuthors(ctx, thread...); err != nil {
+		h.errFn(log.Ctx{"err": err})("unable to load item authors")
+	}
+	if thread, err = h.storage.loadItemsVotes(ctx, thread...); err != nil {
+		h.errFn(log.Ctx{"err": err})("unable to load item votes")
+	}
+	ancestors, descendants := splitThread(it, thread)
+	h.writeMastodonJSON(w, http.StatusOK, mastodonContext{
+		Ancestors:   mastodonStatuses(ancestors),
+		Descendants: mastodonStatuses(descendants),
+	})
+}
+
+// splitThread separates the items of the thread it is part of in its ancestors, from the top down,
+// and its descendants, in chronological order
+func splitThread(it Item, thread ItemCollection) ([]Renderable, []Renderable) {
+	byHash := make(map[Hash]*Item, len(thread)+1)
+	for i := range thread {
+		byHash[thread[i].Hash] = &thread[i]
+	}
+	byHash[it.Hash] = &it
+	parentOf := func(i *Item) *Item {
+		if i == nil || !i.Parent.IsValid() {
+			return nil
+		}
+		return byHash[i.Parent.Hash]
+	}
+
+	ancestors := make([]Renderable, 0)
+	for p := parentOf(&it); p != nil && len(ancestors) <= len(thread); p = parentOf(p) {
+		ancestors = append([]Renderable{p}, ancestors...)
+	}
+
+	descendants := make([]Renderable, 0)
+	for i := range thread {
+		cur := &thread[i]
+		for p, depth := parentOf(cur), 0; p != nil && depth <= len(thread); p, depth = parentOf(p), depth+1 {
+			if p.Hash == it.Hash {
+				descendants = append(descendants, cur)
+				break
+			}
+		}
+	}
+	sort.SliceStable(descendants, func(i, j int) bool {
+		return descendants[i].Date().Before(descendants[j].Date())
+	})
+	return ancestors, descendants
+}
+
+// MastodonRoutes mounts the subset of the Mastodon API read endpoints we can serve
+func (h *handler) MastodonRoutes() func(chi.Router) {
+	return func(r chi.Router) {
+		r.Get("/instance", h.HandleMastodonInstance)
+		r.With(MastodonTimelineFiltersMw, LoadServiceInboxMw).Get("/timelines/public", h.HandleMastodonPublicTimeline)
+		r.Route("/statuses/{id}", func(r chi.Router) {
+			r.Get("/", h.HandleMastodonStatus)
+			r.Get("/context", h.HandleMastodonStatusContext)
+		})
+		r.NotFound(func(w http.ResponseWriter, r *http.Request) {
+			h.writeMastodonError(w, errors.NotFoundf("%s not found", r.URL.Path))
+		})
+	}
+}
@@ -0,0 +1,67 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSplitThread(t *testing.T) {
+	now := time.Now().UTC()
+	op := Item{Hash: HashFromString("0ea3c1a8-f5c9-11ea-8f7b-02420a000002"), SubmittedAt: now.Add(-5 * time.Hour)}
+	r1 := Item{Hash: HashFromString("1ea3c1a8-f5c9-11ea-8f7b-02420a000002"), SubmittedAt: now.Add(-4 * time.Hour), Parent: &op, OP: &op}
+	r2 := Item{Hash: HashFromString("2ea3c1a8-f5c9-11ea-8f7b-02420a000002"), SubmittedAt: now.Add(-3 * time.Hour), Parent: &r1, OP: &op}
+	r3 := Item{Hash: HashFromString("3ea3c1a8-f5c9-11ea-8f7b-02420a000002"), SubmittedAt: now.Add(-2 * time.Hour), Parent: &r2, OP: &op}
+	other := Item{Hash: HashFromString("4ea3c1a8-f5c9-11ea-8f7b-02420a000002"), SubmittedAt: now.Add(-time.Hour), Parent: &op, OP: &op}
+
+	thread := ItemCollection{op, r3, other, r2, r1}
+	ancestors, descendants := splitThread(r2, thread)
+
+	if len(ancestors) != 2 {
+		t.Fatalf("expected 2 ancestors, received %d", len(ancestors))
+	}
+	if ancestors[0].ID() != op.Hash || ancestors[1].ID() != r1.Hash {
+		t.Errorf("ancestors = %s, %s, want %s, %s", ancestors[0].ID(), ancestors[1].ID(), op.Hash, r1.Hash)
+	}
+	if len(descendants) != 1 || descendants[0].ID() != r3.Hash {
+		t.Errorf("descendants = %v, want [%s]", descendants, r3.Hash)
+	}
+
+	ancestors, descendants = splitThread(op, ItemCollection{r3, other, r2, r1})
+	if len(ancestors) != 0 {
+		t.Errorf("expected no ancestors for the top item, received %d", len(ancestors))
+	}
+	if len(descendants) != 4 {
+		t.Fatalf("expected 4 descendants, received %d", len(descendants))
+	}
+	for i := 1; i < len(descendants); i++ {
+		if descendants[i].Date().Before(descendants[i-1].Date()) {
+			t.Errorf("descendants are not in chronological order")
+		}
+	}
+}
+
+func TestMastodonContent(t *testing.T) {
+	tests := []struct {
+		name string
+		it   Item
+		want string
+	}{
+		{
+			name: "link",
+			it:   Item{Title: "Example <site>", MimeType: MimeTypeURL, Data: "https://example.com/?a=1&b=2"},
+			want: `<p><a href="https://example.com/?a=1&amp;b=2">Example &lt;site&gt;</a></p>`,
+		},
+		{
+			name: "text",
+			it:   Item{MimeType: MimeTypeText, Data: "one\ntwo\n\nthree <b>"},
+			want: "<p>one<br/>two</p><p>three &lt;b&gt;</p>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mastodonContent(tt.it); got != tt.want {
+				t.Errorf("mastodonContent() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
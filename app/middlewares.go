@@ -6,6 +6,7 @@ import (
 	pub "github.com/go-ap/activitypub"
 	"github.com/go-ap/errors"
 	"github.com/go-chi/chi"
+	"github.com/mariusor/go-littr/internal/log"
 	"html/template"
 	"net/http"
 )
@@ -18,10 +19,22 @@ func (h handler) LoadAuthorMw(next http.Handler) http.Handler {
 			return
 		}
 		var authors []Account
-		if handle == selfName {
+		if _, host := parseHandle(handle); len(host) > 0 {
+			// NOTE(marius): resolving remote accounts makes us contact other servers, so it is limited to logged in users
+			if !loggedAccount(r).IsLogged() {
+				h.ErrorHandler(errors.Unauthorizedf("You need to be logged in to view remote accounts")).ServeHTTP(w, r)
+				return
+			}
+			acc, err := h.storage.LoadRemoteAccount(context.TODO(), handle)
+			if err != nil {
+				h.ErrorHandler(errors.NewNotFound(err, "Account %q", handle)).ServeHTTP(w, r)
+				return
+			}
+			authors = []Account{*acc}
+		} else if handle == selfName {
 			self := Account{}
 			self.FromActivityPub(h.storage.fedbox.Service())
-			authors = []Account { self }
+			authors = []Account{self}
 		} else {
 			var err error
 			fa := &Filters{
@@ -38,6 +51,13 @@ func (h handler) LoadAuthorMw(next http.Handler) http.Handler {
 			h.ErrorHandler(errors.NotFoundf("Account %q", chi.URLParam(r, "handle"))).ServeHTTP(w, r)
 			return
 		}
+		if accountIsModerator(loggedAccount(r)) {
+			for i := range authors {
+				if err := h.storage.LoadAccountLineage(context.TODO(), &authors[i]); err != nil {
+					h.errFn(log.Ctx{"err": err, "handle": authors[i].Handle})("unable to load account lineage")
+				}
+			}
+		}
 		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), AuthorCtxtKey, authors)))
 	})
 }
@@ -55,6 +75,13 @@ func LoadOutboxMw(next http.Handler) http.Handler {
 		var cursor = new(Cursor)
 		cursor.items = make(RenderableList, 0)
 		for _, author := range authors {
+			if _, host := parseHandle(author.Handle); len(host) > 0 {
+				if c, err := repo.LoadRemoteOutbox(context.TODO(), author); err == nil {
+					cursor.items.Merge(c.items)
+					cursor.total += c.total
+				}
+				continue
+			}
 			if c, err := repo.LoadAccountWithDetails(context.TODO(), author, f...); err == nil {
 				cursor.items.Merge(c.items)
 				cursor.total += c.total
@@ -100,6 +127,20 @@ func LoadServiceInboxMw(next http.Handler) http.Handler {
 	})
 }
 
+func LoadFederatedInboxMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f := ContextActivityFilters(r.Context())
+		repo := ContextRepository(r.Context())
+		cursor, err := repo.LoadFederatedInbox(context.TODO(), f...)
+		if err != nil {
+			ctxtErr(next, w, r, errors.Annotatef(err, "unable to load the federated items"))
+			return
+		}
+		ctx := context.WithValue(r.Context(), CursorCtxtKey, cursor)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
 func ctxtErr(next http.Handler, w http.ResponseWriter, r *http.Request, err error) {
 	status, _ := errors.HttpErrors(err)
 	ctx := context.WithValue(r.Context(), ModelCtxtKey, &errorModel{
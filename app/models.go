@@ -16,14 +16,15 @@ type Model interface {
 }
 
 type listingModel struct {
-	Title    string
-	tpl      string
-	User     *Account
-	Items    RenderableList
-	ShowText bool
-	after    Hash
-	before   Hash
-	sortFn   func(list RenderableList) []Renderable
+	Title     string
+	tpl       string
+	User      *Account
+	Community *Community
+	Items     RenderableList
+	ShowText  bool
+	after     Hash
+	before    Hash
+	sortFn    func(list RenderableList) []Renderable
 }
 
 func (m listingModel) NextPage() Hash {
@@ -225,6 +226,11 @@ func (*loginModel) SetCursor(c *Cursor) {}
 type registerModel struct {
 	Title   string
 	Account Account
+	Captcha *captcha
+	// VerifyEmail is true when the new accounts need to verify their email address
+	VerifyEmail bool
+	// Approval is true when the new accounts need to be approved by a moderator
+	Approval bool
 }
 
 func (m *registerModel) SetTitle(s string) {
@@ -251,6 +257,187 @@ func (m aboutModel) Template() string {
 
 func (*aboutModel) SetCursor(c *Cursor) {}
 
+type moderationReportModel struct {
+	Title  string
+	Report ModerationReport
+}
+
+func (m *moderationReportModel) SetTitle(s string) {
+	m.Title = s
+}
+
+func (moderationReportModel) Template() string {
+	return "transparency"
+}
+
+func (*moderationReportModel) SetCursor(c *Cursor) {}
+
+type deliveriesModel struct {
+	Title      string
+	Activities []OutgoingActivity
+}
+
+func (m *deliveriesModel) SetTitle(s string) {
+	m.Title = s
+}
+
+func (deliveriesModel) Template() string {
+	return "deliveries"
+}
+
+func (*deliveriesModel) SetCursor(c *Cursor) {}
+
+type registrationsModel struct {
+	Title         string
+	Registrations []registration
+}
+
+func (m *registrationsModel) SetTitle(s string) {
+	m.Title = s
+}
+
+func (registrationsModel) Template() string {
+	return "registrations"
+}
+
+func (*registrationsModel) SetCursor(c *Cursor) {}
+
+type heldItemsModel struct {
+	Title string
+	Items []heldItem
+}
+
+func (m *heldItemsModel) SetTitle(s string) {
+	m.Title = s
+}
+
+func (heldItemsModel) Template() string {
+	return "held"
+}
+
+func (*heldItemsModel) SetCursor(c *Cursor) {}
+
+type sessionsModel struct {
+	Title    string
+	Sessions []sessionInfo
+	// Current is the index ID of the session of the request
+	Current string
+}
+
+func (m *sessionsModel) SetTitle(s string) {
+	m.Title = s
+}
+
+func (sessionsModel) Template() string {
+	return "sessions"
+}
+
+func (*sessionsModel) SetCursor(c *Cursor) {}
+
+type settingsModel struct {
+	Title      string
+	Account    Account
+	Identities []Identity
+	Providers  map[string]string
+	TwoFactor  *twoFactorSettings
+	Tokens     []AccessToken
+	Scopes     map[string]string
+	SigningKey *signingKeySettings
+	KeyTypes   map[string]string
+	SSHKeys    []authorizedKey
+	// Registration is set when the account still needs to verify its email address
+	Registration *registration
+	// NewAccessToken is the access token that was just created, we show it only once
+	NewAccessToken string
+}
+
+func (m *settingsModel) SetTitle(s string) {
+	m.Title = s
+}
+
+func (settingsModel) Template() string {
+	return "settings"
+}
+
+func (*settingsModel) SetCursor(c *Cursor) {}
+
+// Linked returns the identity of the provider linked to the account, if any
+func (m settingsModel) Linked(provider string) *Identity {
+	for i := range m.Identities {
+		if m.Identities[i].Provider == provider {
+			return &m.Identities[i]
+		}
+	}
+	return nil
+}
+
+type twoFactorModel struct {
+	Title string
+}
+
+func (m *twoFactorModel) SetTitle(s string) {
+	m.Title = s
+}
+
+func (twoFactorModel) Template() string {
+	return "two-factor"
+}
+
+func (*twoFactorModel) SetCursor(c *Cursor) {}
+
+type authorizeInteractionModel struct {
+	Title string
+	// URI is the account to follow, as received from the remote follow form of the other server
+	URI     string
+	Account *Account
+}
+
+func (m *authorizeInteractionModel) SetTitle(s string) {
+	m.Title = s
+}
+
+func (authorizeInteractionModel) Template() string {
+	return "interaction"
+}
+
+func (*authorizeInteractionModel) SetCursor(c *Cursor) {}
+
+type sshLoginModel struct {
+	Title     string
+	Handle    string
+	Challenge string
+	Namespace string
+	// Command is the ssh-keygen command that signs the challenge
+	Command string
+}
+
+func (m *sshLoginModel) SetTitle(s string) {
+	m.Title = s
+}
+
+func (sshLoginModel) Template() string {
+	return "ssh-login"
+}
+
+func (*sshLoginModel) SetCursor(c *Cursor) {}
+
+type historyModel struct {
+	Title     string
+	Content   *Item
+	Revisions Revisions
+	Diffs     []RevisionDiff
+}
+
+func (m *historyModel) SetTitle(s string) {
+	m.Title = s
+}
+
+func (historyModel) Template() string {
+	return "history"
+}
+
+func (*historyModel) SetCursor(c *Cursor) {}
+
 type errorModel struct {
 	Status     int
 	StatusText string
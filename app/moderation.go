@@ -28,6 +28,7 @@ type ModerationGroup struct {
 	Object      Renderable      `json:"-"`
 	Requests    []*ModerationOp `json:"-"`
 	Followup    []*ModerationOp `json:"-"`
+	Original    *Revision       `json:"-"`
 }
 
 func (m ModerationGroup) ID() Hash {
@@ -216,7 +217,7 @@ func (m *ModerationOp) Deleted() bool {
 func GetRenderableByType(typ pub.ActivityVocabularyType) Renderable {
 	var result Renderable
 	if ValidAppreciationTypes.Contains(typ) {
-		result = new(Vote) 
+		result = new(Vote)
 	}
 	if ValidModerationActivityTypes.Contains(typ) {
 		result = new(ModerationOp)
@@ -230,8 +231,7 @@ func GetRenderableByType(typ pub.ActivityVocabularyType) Renderable {
 	return result
 }
 
-
-func loadItemActorOrActivityFromModerationActivityObject (it pub.Item) Renderable {
+func loadItemActorOrActivityFromModerationActivityObject(it pub.Item) Renderable {
 	result, _ := LoadFromActivityPubItem(it)
 	return result
 }
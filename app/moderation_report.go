@@ -0,0 +1,250 @@
+package app
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+const (
+	// moderationReportWeeks is the number of weeks covered by the transparency report
+	moderationReportWeeks = 12
+	// moderationReportInterval is how often the transparency report gets regenerated
+	moderationReportInterval = 6 * time.Hour
+
+	oneWeek = 7 * 24 * time.Hour
+)
+
+// ModerationReportWeek holds the aggregated moderation actions for one week
+type ModerationReportWeek struct {
+	Start    time.Time
+	Counts   map[string]int
+	Total    int
+	Resolved int
+	// MedianResolution is the median time between a moderation request and its first followup
+	MedianResolution time.Duration
+}
+
+// Median returns the human readable median resolution time
+func (w ModerationReportWeek) Median() string {
+	if w.Resolved == 0 {
+		return "-"
+	}
+	d := w.MedianResolution
+	switch {
+	case d >= 24*time.Hour:
+		return d.Truncate(time.Hour).String()
+	case d >= time.Hour:
+		return d.Truncate(time.Minute).String()
+	default:
+		return d.Truncate(time.Second).String()
+	}
+}
+
+// ModerationReport is the anonymized aggregate of the moderation activities of the instance
+type ModerationReport struct {
+	GeneratedAt time.Time
+	Categories  []string
+	Weeks       []ModerationReportWeek
+}
+
+// moderationAction is the anonymized representation of a moderation request
+type moderationAction struct {
+	Category    string
+	SubmittedAt time.Time
+	ResolvedAt  time.Time
+}
+
+// weekStart returns the beginning of the week t falls in. As the zero time.Time is a Monday,
+// truncating to a week duration gives us the Monday at 00:00 UTC.
+func weekStart(t time.Time) time.Time {
+	return t.UTC().Truncate(oneWeek)
+}
+
+func medianDuration(d []time.Duration) time.Duration {
+	if len(d) == 0 {
+		return 0
+	}
+	sort.Slice(d, func(i, j int) bool { return d[i] < d[j] })
+	mid := len(d) / 2
+	if len(d)%2 == 0 {
+		return (d[mid-1] + d[mid]) / 2
+	}
+	return d[mid]
+}
+
+// buildModerationReport aggregates the moderation actions by week and category, newest week first
+func buildModerationReport(actions []moderationAction) ModerationReport {
+	report := ModerationReport{GeneratedAt: time.Now().UTC()}
+
+	weeks := make(map[time.Time]*ModerationReportWeek)
+	durations := make(map[time.Time][]time.Duration)
+	for _, a := range actions {
+		start := weekStart(a.SubmittedAt)
+		w, ok := weeks[start]
+		if !ok {
+			w = &ModerationReportWeek{Start: start, Counts: make(map[string]int)}
+			weeks[start] = w
+		}
+		if !stringInSlice(report.Categories)(a.Category) {
+			report.Categories = append(report.Categories, a.Category)
+		}
+		w.Counts[a.Category]++
+		w.Total++
+		if !a.ResolvedAt.IsZero() && a.ResolvedAt.After(a.SubmittedAt) {
+			w.Resolved++
+			durations[start] = append(durations[start], a.ResolvedAt.Sub(a.SubmittedAt))
+		}
+	}
+	for start, w := range weeks {
+		w.MedianResolution = medianDuration(durations[start])
+		report.Weeks = append(report.Weeks, *w)
+	}
+	sort.Strings(report.Categories)
+	sort.Slice(report.Weeks, func(i, j int) bool {
+		return report.Weeks[i].Start.After(report.Weeks[j].Start)
+	})
+	return report
+}
+
+var moderationActionLabels = map[pub.ActivityVocabularyType]string{
+	pub.FlagType:   "report",
+	pub.BlockType:  "block",
+	pub.IgnoreType: "ignore",
+}
+
+// moderationCategory returns the category of a moderation activity, composed of the
+// action and the type of the object it was applied to
+func moderationCategory(a *pub.Activity) string {
+	action := moderationActionLabels[a.Type]
+	ob := "content"
+	if a.Object != nil && strings.Contains(a.Object.GetLink().String(), string(actors)) {
+		ob = "account"
+	}
+	return strings.Join([]string{action, ob}, " ")
+}
+
+// loadModerationActions loads the anonymized moderation requests received by the service since the time
+// received as a parameter, together with the time of the first moderator followup for each of them.
+func (r *repository) loadModerationActions(ctx context.Context, since time.Time) ([]moderationAction, error) {
+	requests := make(map[pub.IRI]*moderationAction)
+
+	f := new(Filters)
+	f.Type = ModerationActivitiesFilter
+	f.MaxItems = 100
+	inbox := func(ctx context.Context, f *Filters) (pub.CollectionInterface, error) {
+		return r.fedbox.Inbox(ctx, r.fedbox.Service(), Values(f))
+	}
+	err := LoadFromCollection(ctx, inbox, &colCursor{filters: f}, func(c pub.CollectionInterface) (bool, error) {
+		done := false
+		for _, it := range c.Collection() {
+			pub.OnActivity(it, func(a *pub.Activity) error {
+				if a.Published.Before(since) {
+					done = true
+					return nil
+				}
+				requests[a.GetLink()] = &moderationAction{
+					Category:    moderationCategory(a),
+					SubmittedAt: a.Published,
+				}
+				return nil
+			})
+		}
+		return done, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(requests) > 0 {
+		iris := make(pub.IRIs, 0, len(requests))
+		for iri := range requests {
+			iris = append(iris, iri)
+		}
+		ff := new(Filters)
+		ff.Type = ActivityTypesFilter(pub.DeleteType, pub.UpdateType)
+		ff.InReplTo = IRIsFilter(iris...)
+		ff.Actor = &Filters{IRI: notNilIRIs}
+		ff.MaxItems = 100
+		outbox := func(ctx context.Context, f *Filters) (pub.CollectionInterface, error) {
+			return r.fedbox.Outbox(ctx, r.fedbox.Service(), Values(f))
+		}
+		err = LoadFromCollection(ctx, outbox, &colCursor{filters: ff}, func(c pub.CollectionInterface) (bool, error) {
+			for _, it := range c.Collection() {
+				m := new(ModerationOp)
+				if err := m.FromActivityPub(it); err != nil || m.Metadata == nil {
+					continue
+				}
+				for _, iri := range m.Metadata.InReplyTo {
+					req, ok := requests[iri]
+					if !ok {
+						continue
+					}
+					if req.ResolvedAt.IsZero() || m.SubmittedAt.Before(req.ResolvedAt) {
+						req.ResolvedAt = m.SubmittedAt
+					}
+				}
+			}
+			return false, nil
+		})
+		if err != nil {
+			r.errFn(log.Ctx{"err": err})("unable to load moderation followups")
+		}
+	}
+
+	actions := make([]moderationAction, 0, len(requests))
+	for _, a := range requests {
+		actions = append(actions, *a)
+	}
+	return actions, nil
+}
+
+// moderationReportCache holds the last generated moderation report
+type moderationReportCache struct {
+	sync.RWMutex
+	report ModerationReport
+}
+
+// Load returns the cached moderation report, regenerating it if it's older than moderationReportInterval
+func (c *moderationReportCache) Load(ctx context.Context, r *repository) (ModerationReport, error) {
+	c.RLock()
+	report := c.report
+	c.RUnlock()
+	if time.Now().UTC().Sub(report.GeneratedAt) < moderationReportInterval {
+		return report, nil
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	if time.Now().UTC().Sub(c.report.GeneratedAt) < moderationReportInterval {
+		return c.report, nil
+	}
+	since := weekStart(time.Now()).Add(-(moderationReportWeeks - 1) * oneWeek)
+	actions, err := r.loadModerationActions(ctx, since)
+	if err != nil {
+		return c.report, err
+	}
+	c.report = buildModerationReport(actions)
+	return c.report, nil
+}
+
+// anonymizeModeration removes the identities of the accounts that submitted moderation requests
+func anonymizeModeration(rl RenderableList) {
+	for _, r := range rl {
+		switch m := r.(type) {
+		case *ModerationGroup:
+			for _, req := range m.Requests {
+				anon := AnonymousAccount
+				req.SubmittedBy = &anon
+			}
+		case *ModerationOp:
+			anon := AnonymousAccount
+			m.SubmittedBy = &anon
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMedianDuration(t *testing.T) {
+	tests := []struct {
+		in   []time.Duration
+		want time.Duration
+	}{
+		{nil, 0},
+		{[]time.Duration{time.Hour}, time.Hour},
+		{[]time.Duration{3 * time.Hour, time.Hour, 2 * time.Hour}, 2 * time.Hour},
+		{[]time.Duration{4 * time.Hour, time.Hour, 2 * time.Hour, 3 * time.Hour}, 150 * time.Minute},
+	}
+	for _, tt := range tests {
+		if got := medianDuration(tt.in); got != tt.want {
+			t.Errorf("medianDuration(%v) = %s, expected %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBuildModerationReport(t *testing.T) {
+	// 2020-06-01 is a Monday
+	monday := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	actions := []moderationAction{
+		{Category: "report content", SubmittedAt: monday.Add(time.Hour), ResolvedAt: monday.Add(3 * time.Hour)},
+		{Category: "report content", SubmittedAt: monday.Add(50 * time.Hour), ResolvedAt: monday.Add(54 * time.Hour)},
+		{Category: "block account", SubmittedAt: monday.Add(6 * 24 * time.Hour)},
+		{Category: "report account", SubmittedAt: monday.Add(8 * 24 * time.Hour), ResolvedAt: monday.Add(9 * 24 * time.Hour)},
+	}
+	report := buildModerationReport(actions)
+
+	if len(report.Categories) != 3 || report.Categories[0] != "block account" {
+		t.Errorf("invalid categories %v", report.Categories)
+	}
+	if len(report.Weeks) != 2 {
+		t.Fatalf("invalid number of weeks %d, expected 2", len(report.Weeks))
+	}
+	last, first := report.Weeks[0], report.Weeks[1]
+	if !first.Start.Equal(monday) || !last.Start.Equal(monday.Add(oneWeek)) {
+		t.Errorf("invalid week starts %s, %s", first.Start, last.Start)
+	}
+	if first.Total != 3 || first.Resolved != 2 || first.Counts["report content"] != 2 {
+		t.Errorf("invalid first week %#v", first)
+	}
+	if first.MedianResolution != 3*time.Hour {
+		t.Errorf("invalid median resolution %s, expected %s", first.MedianResolution, 3*time.Hour)
+	}
+	if last.Total != 1 || last.MedianResolution != 24*time.Hour {
+		t.Errorf("invalid last week %#v", last)
+	}
+}
@@ -0,0 +1,109 @@
+package app
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-ap/jsonld"
+	"github.com/go-chi/chi"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+const (
+	activityJsonMimeType = "application/activity+json"
+	jsonLDMimeType       = "application/ld+json"
+
+	securityContextURI = jsonld.IRI("https://w3id.org/security/v1")
+)
+
+// isActivityPubRequest returns true if the client prefers an ActivityPub representation of the resource
+// over the HTML one, as the remote servers do when resolving URLs.
+func isActivityPubRequest(r *http.Request) bool {
+	for _, typ := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(typ))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case activityJsonMimeType, jsonLDMimeType:
+			return true
+		case "text/html", "application/xhtml+xml":
+			return false
+		}
+	}
+	return false
+}
+
+// writeActivityPub writes the JSON-LD representation of the ActivityPub object it to the response
+func (h *handler) writeActivityPub(w http.ResponseWriter, r *http.Request, it pub.Item) {
+	if it == nil {
+		h.ErrorHandler(errors.NotFoundf("object not found")).ServeHTTP(w, r)
+		return
+	}
+	dat, err := jsonld.WithContext(jsonld.IRI(pub.ActivityBaseURI), securityContextURI).Marshal(it)
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "iri": it.GetLink()})("unable to marshal ActivityPub object")
+		h.ErrorHandler(err).ServeHTTP(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", activityJsonMimeType)
+	w.Header().Set("Vary", "Accept")
+	w.WriteHeader(http.StatusOK)
+	w.Write(dat)
+}
+
+// ActivityPubItemMw serves the ActivityPub object of the current item to clients that ask for it,
+// and lets the HTML listing handle all the others.
+func (h *handler) ActivityPubItemMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash := chi.URLParam(r, "hash")
+		if r.Method != http.MethodGet || !isActivityPubRequest(r) || path.Base(r.URL.Path) != hash {
+			w.Header().Add("Vary", "Accept")
+			next.ServeHTTP(w, r)
+			return
+		}
+		it, err := h.storage.LoadItem(context.TODO(), objects.IRI(h.storage.fedbox.Service()).AddPath(hash))
+		if err != nil {
+			h.ErrorHandler(errors.NewNotFound(err, "item not found")).ServeHTTP(w, r)
+			return
+		}
+		if it.Private() {
+			h.ErrorHandler(errors.NotFoundf("item not found")).ServeHTTP(w, r)
+			return
+		}
+		h.writeActivityPub(w, r, it.pub)
+	})
+}
+
+// ActivityPubActorMw serves the ActivityPub actor of the current account to clients that ask for it,
+// and lets the HTML listing handle all the others.
+func (h *handler) ActivityPubActorMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !isActivityPubRequest(r) {
+			w.Header().Add("Vary", "Accept")
+			next.ServeHTTP(w, r)
+			return
+		}
+		authors := ContextAuthors(r.Context())
+		if len(authors) == 0 {
+			h.ErrorHandler(errors.NotFoundf("account %q not found", chi.URLParam(r, "handle"))).ServeHTTP(w, r)
+			return
+		}
+		author := authors[0]
+		if !author.HasMetadata() || len(author.Metadata.ID) == 0 {
+			h.writeActivityPub(w, r, author.pub)
+			return
+		}
+		acc, err := h.storage.LoadAccount(context.TODO(), pub.IRI(author.Metadata.ID))
+		if err != nil {
+			h.ErrorHandler(errors.NewNotFound(err, "account not found")).ServeHTTP(w, r)
+			return
+		}
+		h.writeActivityPub(w, r, acc.pub)
+	})
+}
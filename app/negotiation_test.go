@@ -0,0 +1,29 @@
+package app
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestIsActivityPubRequest(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   bool
+	}{
+		{accept: "", want: false},
+		{accept: "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", want: false},
+		{accept: "application/activity+json", want: true},
+		{accept: `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`, want: true},
+		{accept: "application/activity+json, application/ld+json", want: true},
+		{accept: "text/html, application/activity+json", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.accept, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/~johndoe", nil)
+			r.Header.Set("Accept", tt.accept)
+			if got := isActivityPubRequest(r); got != tt.want {
+				t.Errorf("isActivityPubRequest() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-chi/chi"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+const (
+	githubUrl    = "https://github.com/mariusor/go-littr"
+	author       = "@mariusor@metalhead.club"
+	softwareName = "go-littr"
+
+	nodeInfoSchema20 = "2.0"
+	nodeInfoSchema21 = "2.1"
+
+	nodeInfoProfileURL = "http://nodeinfo.diaspora.software/ns/schema/%s"
+
+	// nodeInfoRefreshInterval is how long the usage statistics are cached before being computed again
+	nodeInfoRefreshInterval = 30 * time.Minute
+	// nodeInfoRefreshTimeout is how long computing the usage statistics can take
+	nodeInfoRefreshTimeout = 5 * time.Minute
+
+	activeHalfYear = 180 * 24 * time.Hour
+	activeMonth    = 30 * 24 * time.Hour
+)
+
+type nodeInfoUsers struct {
+	Total          int `json:"total"`
+	ActiveHalfYear int `json:"activeHalfyear"`
+	ActiveMonth    int `json:"activeMonth"`
+}
+
+type nodeInfoUsage struct {
+	Users         nodeInfoUsers `json:"users"`
+	LocalPosts    int           `json:"localPosts"`
+	LocalComments int           `json:"localComments"`
+}
+
+type nodeInfoSoftware struct {
+	Name       string `json:"name"`
+	Version    string `json:"version"`
+	Repository string `json:"repository,omitempty"`
+	Homepage   string `json:"homepage,omitempty"`
+}
+
+type nodeInfoServices struct {
+	Inbound  []string `json:"inbound"`
+	Outbound []string `json:"outbound"`
+}
+
+type nodeInfo struct {
+	Version           string                 `json:"version"`
+	Software          nodeInfoSoftware       `json:"software"`
+	Protocols         []string               `json:"protocols"`
+	Services          nodeInfoServices       `json:"services"`
+	OpenRegistrations bool                   `json:"openRegistrations"`
+	Usage             nodeInfoUsage          `json:"usage"`
+	Metadata          map[string]interface{} `json:"metadata"`
+}
+
+var (
+	actorsFilter = &Filters{
+		Type: ActivityTypesFilter(pub.PersonType),
+	}
+	postsFilter = &Filters{
+		Type: ActivityTypesFilter(ValidContentTypes...),
+		OP:   nilIRIs,
+	}
+	allFilter = &Filters{
+		Type: ActivityTypesFilter(ValidContentTypes...),
+	}
+)
+
+// NodeInfoResolver computes the usage statistics of the instance, and refreshes them periodically
+// in the background, so the NodeInfo requests never wait for them
+type NodeInfoResolver struct {
+	sync.Mutex
+	f          *fedbox
+	usage      nodeInfoUsage
+	updatedAt  time.Time
+	refreshing bool
+	errFn      CtxLogFn
+}
+
+func NodeInfoResolverNew(f *fedbox, errFn CtxLogFn) *NodeInfoResolver {
+	n := &NodeInfoResolver{f: f, errFn: errFn}
+	if f != nil {
+		n.refreshing = true
+		go n.update()
+	}
+	return n
+}
+
+// activeUsers returns how many of the activity dates are in the last half year and in the last month
+func activeUsers(lastActive []time.Time, now time.Time) (int, int) {
+	halfYear, month := 0, 0
+	for _, t := range lastActive {
+		if t.IsZero() || t.After(now) {
+			continue
+		}
+		age := now.Sub(t)
+		if age <= activeHalfYear {
+			halfYear++
+		}
+		if age <= activeMonth {
+			month++
+		}
+	}
+	return halfYear, month
+}
+
+// lastActivity returns the publishing date of the latest activity in the actor's outbox
+func (n *NodeInfoResolver) lastActivity(ctx context.Context, actor pub.Item) time.Time {
+	var last time.Time
+	col, err := n.f.Outbox(ctx, actor, Values(&Filters{MaxItems: 1}))
+	if err != nil || col == nil {
+		return last
+	}
+	for _, it := range col.Collection() {
+		pub.OnObject(it, func(o *pub.Object) error {
+			if o.Published.After(last) {
+				last = o.Published
+			}
+			return nil
+		})
+	}
+	return last
+}
+
+func (n *NodeInfoResolver) refresh(ctx context.Context) nodeInfoUsage {
+	u := nodeInfoUsage{}
+	if n.f == nil {
+		return u
+	}
+	lastActive := make([]time.Time, 0)
+	actors := func(ctx context.Context, f *Filters) (pub.CollectionInterface, error) {
+		return n.f.Actors(ctx, Values(f))
+	}
+	err := LoadFromCollection(ctx, actors, &colCursor{filters: &Filters{Type: actorsFilter.Type}}, func(col pub.CollectionInterface) (bool, error) {
+		for _, it := range col.Collection() {
+			if it == nil || !HostIsLocal(it.GetLink().String()) {
+				continue
+			}
+			u.Users.Total++
+			lastActive = append(lastActive, n.lastActivity(ctx, it))
+		}
+		return false, nil
+	})
+	if err != nil && n.errFn != nil {
+		n.errFn(log.Ctx{"err": err})("unable to load the actors for NodeInfo")
+	}
+	u.Users.ActiveHalfYear, u.Users.ActiveMonth = activeUsers(lastActive, time.Now().UTC())
+
+	if posts, _ := n.f.Objects(ctx, Values(postsFilter)); posts != nil {
+		u.LocalPosts = int(posts.Count())
+	}
+	if all, _ := n.f.Objects(ctx, Values(allFilter)); all != nil {
+		u.LocalComments = int(all.Count()) - u.LocalPosts
+	}
+	return u
+}
+
+// update computes the usage statistics and replaces the cached ones.
+// The lock is taken only to store the result, as computing them makes a request for each of the local actors.
+func (n *NodeInfoResolver) update() {
+	ctx, cancel := context.WithTimeout(context.Background(), nodeInfoRefreshTimeout)
+	defer cancel()
+	u := n.refresh(ctx)
+
+	n.Lock()
+	defer n.Unlock()
+	n.usage = u
+	n.updatedAt = time.Now()
+	n.refreshing = false
+}
+
+// Usage returns the cached usage statistics. If they are older than the refresh interval, they get computed
+// again in the background, and the next requests will receive the new ones.
+func (n *NodeInfoResolver) Usage() nodeInfoUsage {
+	n.Lock()
+	defer n.Unlock()
+	if time.Since(n.updatedAt) > nodeInfoRefreshInterval && !n.refreshing {
+		n.refreshing = true
+		go n.update()
+	}
+	return n.usage
+}
+
+// nodeInfoFeatures returns the features that are enabled in the configuration
+func nodeInfoFeatures() []string {
+	features := make([]string, 0)
+	if Instance.Conf == nil {
+		return features
+	}
+	if Instance.Conf.VotingEnabled {
+		features = append(features, "voting")
+	}
+	if Instance.Conf.DownvotingEnabled {
+		features = append(features, "downvoting")
+	}
+	if Instance.Conf.UserCreatingEnabled {
+		features = append(features, "registrations")
+	}
+	if Instance.Conf.ModerationEnabled {
+		features = append(features, "moderation")
+	}
+	return features
+}
+
+// NodeInfo returns the NodeInfo document for the schema version
+func (n *NodeInfoResolver) NodeInfo(version string) nodeInfo {
+	info := Instance.NodeInfo()
+	ni := nodeInfo{
+		Version: version,
+		Software: nodeInfoSoftware{
+			Name:    softwareName,
+			Version: info.Version,
+		},
+		Protocols: []string{"activitypub"},
+		Services: nodeInfoServices{
+			Inbound:  []string{},
+			Outbound: []string{"atom1.0"},
+		},
+		OpenRegistrations: Instance.Conf != nil && Instance.Conf.UserCreatingEnabled,
+		Usage:             n.Usage(),
+		Metadata: map[string]interface{}{
+			"nodeName":        regexp.MustCompile(`<[\/\w]+>`).ReplaceAllString(info.Title, ""),
+			"nodeDescription": info.Summary,
+			"private":         false,
+			"software": map[string]string{
+				"github":   githubUrl,
+				"homePage": Instance.BaseURL,
+				"follow":   author,
+			},
+			"features": nodeInfoFeatures(),
+		},
+	}
+	if version == nodeInfoSchema21 {
+		ni.Software.Repository = githubUrl
+		ni.Software.Homepage = Instance.BaseURL
+	}
+	return ni
+}
+
+// HandleNodeInfoDiscover serves /.well-known/nodeinfo requests
+func (h *handler) HandleNodeInfoDiscover(w http.ResponseWriter, r *http.Request) {
+	d := node{
+		Links: []link{
+			{
+				Rel:  fmt.Sprintf(nodeInfoProfileURL, nodeInfoSchema21),
+				Href: fmt.Sprintf("%s/nodeinfo/%s", h.conf.BaseURL, nodeInfoSchema21),
+			},
+			{
+				Rel:  fmt.Sprintf(nodeInfoProfileURL, nodeInfoSchema20),
+				Href: fmt.Sprintf("%s/nodeinfo/%s", h.conf.BaseURL, nodeInfoSchema20),
+			},
+		},
+	}
+	dat, _ := json.Marshal(d)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(dat)
+}
+
+// HandleNodeInfo serves /nodeinfo and /nodeinfo/{version} requests
+func (h *handler) HandleNodeInfo(w http.ResponseWriter, r *http.Request) {
+	version := chi.URLParam(r, "version")
+	if len(version) == 0 {
+		version = nodeInfoSchema20
+	}
+	if version != nodeInfoSchema20 && version != nodeInfoSchema21 {
+		h.v.HandleErrors(w, r, errors.NotFoundf("NodeInfo schema %s not supported", version))
+		return
+	}
+	dat, err := json.Marshal(h.nodeInfo.NodeInfo(version))
+	if err != nil {
+		h.v.HandleErrors(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", fmt.Sprintf(`application/json; profile="%s#"`, fmt.Sprintf(nodeInfoProfileURL, version)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(dat)
+}
@@ -0,0 +1,83 @@
+package app
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mariusor/go-littr/internal/config"
+)
+
+func TestActiveUsers(t *testing.T) {
+	now := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+	lastActive := []time.Time{
+		{},
+		now.Add(-time.Hour),
+		now.Add(-20 * 24 * time.Hour),
+		now.Add(-60 * 24 * time.Hour),
+		now.Add(-179 * 24 * time.Hour),
+		now.Add(-400 * 24 * time.Hour),
+		now.Add(time.Hour),
+	}
+	halfYear, month := activeUsers(lastActive, now)
+	if halfYear != 4 {
+		t.Errorf("activeUsers() half year = %d, want 4", halfYear)
+	}
+	if month != 2 {
+		t.Errorf("activeUsers() month = %d, want 2", month)
+	}
+}
+
+func TestNodeInfoResolver_NodeInfo(t *testing.T) {
+	prev := Instance
+	Instance.Conf = &config.Configuration{Name: "littr", VotingEnabled: true, UserCreatingEnabled: true, ModerationEnabled: true}
+	Instance.BaseURL = "https://littr.example"
+	defer func() { Instance = prev }()
+
+	n := NodeInfoResolverNew(nil, nil)
+
+	ni := n.NodeInfo(nodeInfoSchema20)
+	if ni.Version != nodeInfoSchema20 || len(ni.Software.Repository) > 0 {
+		t.Errorf("NodeInfo(2.0) = %#v, want version 2.0 without repository", ni.Software)
+	}
+	if !ni.OpenRegistrations {
+		t.Errorf("NodeInfo() openRegistrations = false, want true")
+	}
+	want := []string{"voting", "registrations", "moderation"}
+	if got := ni.Metadata["features"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("NodeInfo() features = %v, want %v", got, want)
+	}
+
+	ni = n.NodeInfo(nodeInfoSchema21)
+	if ni.Software.Repository != githubUrl || ni.Software.Homepage != "https://littr.example" {
+		t.Errorf("NodeInfo(2.1) software = %#v, want repository and homepage", ni.Software)
+	}
+}
+
+func TestNodeInfoResolver_Usage(t *testing.T) {
+	cached := nodeInfoUsage{Users: nodeInfoUsers{Total: 2}, LocalPosts: 3}
+	n := &NodeInfoResolver{usage: cached, updatedAt: time.Now().Add(-2 * nodeInfoRefreshInterval)}
+
+	if got := n.Usage(); !reflect.DeepEqual(got, cached) {
+		t.Errorf("Usage() = %#v, want the cached %#v while refreshing", got, cached)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		n.Lock()
+		refreshing, updatedAt := n.refreshing, n.updatedAt
+		n.Unlock()
+		if !refreshing {
+			if time.Since(updatedAt) > nodeInfoRefreshInterval {
+				t.Errorf("Usage() didn't refresh the stale statistics")
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Usage() refresh didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := n.Usage(); !reflect.DeepEqual(got, nodeInfoUsage{}) {
+		t.Errorf("Usage() = %#v, want the refreshed statistics", got)
+	}
+}
@@ -0,0 +1,335 @@
+package app
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ap/errors"
+	"github.com/go-chi/chi"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+const (
+	registrationPending  = "pending"
+	registrationApproved = "approved"
+	registrationRejected = "rejected"
+
+	// emailVerificationTimeout is how long the links in the verification emails are valid
+	emailVerificationTimeout = 48 * time.Hour
+	// maxRegistrationReason is the maximum length of the message for the moderators
+	maxRegistrationReason = 500
+)
+
+// registration keeps the state of the accounts that need a moderator's approval, or to verify their email address.
+// The accounts that don't have one were created before approvals were enabled, or from an invitation.
+type registration struct {
+	// ID is the hash of the account
+	ID     string
+	Actor  string
+	Handle string
+	// Reason is what the users wrote for the moderators when registering
+	Reason string
+	Status string
+	// By is the handle of the moderator that approved or rejected the registration
+	By    string
+	Email string
+	// EmailToken is the SHA-256 of the token from the verification link
+	EmailToken    string
+	EmailSent     time.Time
+	EmailVerified bool
+	Created       time.Time
+}
+
+// Verified returns false if the account still needs to verify its email address
+func (reg registration) Verified() bool {
+	return len(reg.Email) == 0 || reg.EmailVerified
+}
+
+func hashEmailToken(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+// newEmailToken sets a new email verification token and returns it in clear, to be sent in the email
+func (reg *registration) newEmailToken() string {
+	tok := randomState()
+	reg.EmailToken = hashEmailToken(tok)
+	reg.EmailSent = time.Now().UTC()
+	return tok
+}
+
+// verifyEmail marks the email as verified if the token matches the last one sent
+func (reg *registration) verifyEmail(tok string, now time.Time) bool {
+	if len(reg.EmailToken) == 0 || now.Sub(reg.EmailSent) > emailVerificationTimeout {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(reg.EmailToken), []byte(hashEmailToken(tok))) != 1 {
+		return false
+	}
+	reg.EmailVerified = true
+	reg.EmailToken = ""
+	return true
+}
+
+// registrationStore keeps the registrations, by the hash of the account
+type registrationStore struct {
+	*fileStore
+}
+
+func (s registrationStore) Load(hash string) (registration, error) {
+	reg := registration{}
+	if s.fileStore == nil {
+		return reg, errors.NotFoundf("registrations are not available")
+	}
+	err := s.fileStore.Load(hash, &reg)
+	return reg, err
+}
+
+// ForAccount returns the registration of the account, or a registration that needs nothing,
+// for the accounts that don't have one
+func (s registrationStore) ForAccount(a Account) registration {
+	reg, err := s.Load(a.Hash.String())
+	if err != nil {
+		return registration{ID: a.Hash.String(), Handle: a.Handle, Status: registrationApproved}
+	}
+	return reg
+}
+
+// Pending returns the registrations waiting for a moderator, the oldest first
+func (s registrationStore) Pending() ([]registration, error) {
+	if s.fileStore == nil {
+		return nil, nil
+	}
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	regs := make([]registration, 0)
+	for _, k := range keys {
+		reg := registration{}
+		if err := s.fileStore.Load(k, &reg); err != nil || reg.Status != registrationPending {
+			continue
+		}
+		regs = append(regs, reg)
+	}
+	sort.Slice(regs, func(i, j int) bool {
+		return regs[i].Created.Before(regs[j].Created)
+	})
+	return regs, nil
+}
+
+// validEmail returns the address part of the email, if it's valid
+func validEmail(email string) (string, error) {
+	addr, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil || !strings.Contains(addr.Address, "@") {
+		return "", errors.NotValidf("invalid email address")
+	}
+	return addr.Address, nil
+}
+
+// saveRegistration records the registration of the new account, if it needs to be approved or to verify its email,
+// and sends the verification email. When sending the email fails, the users can request a new one in the settings.
+func (h *handler) saveRegistration(a Account, reason, email string, approval bool) (*registration, error) {
+	if !approval && len(email) == 0 {
+		return nil, nil
+	}
+	reg := registration{
+		ID:      a.Hash.String(),
+		Actor:   a.Metadata.ID,
+		Handle:  a.Handle,
+		Reason:  reason,
+		Status:  registrationApproved,
+		Email:   email,
+		Created: time.Now().UTC(),
+	}
+	if approval {
+		reg.Status = registrationPending
+	}
+	var tok string
+	if len(email) > 0 {
+		tok = reg.newEmailToken()
+	}
+	if err := h.registrations.Save(reg.ID, reg); err != nil {
+		return nil, err
+	}
+	ltx := log.Ctx{"handle": a.Handle, "status": reg.Status}
+	h.infoFn(ltx)("saved registration")
+	if len(tok) > 0 {
+		if err := h.sendVerificationEmail(reg, tok); err != nil {
+			h.errFn(ltx, log.Ctx{"err": err})("unable to send verification email")
+		}
+	}
+	return &reg, nil
+}
+
+func (h *handler) sendVerificationEmail(reg registration, tok string) error {
+	// @todo(marius): :link_generation:
+	u := fmt.Sprintf("%s/verify-email/%s/%s", h.conf.BaseURL, reg.ID, tok)
+	subject := fmt.Sprintf("Verify your email address for %s", h.conf.Name)
+	body := fmt.Sprintf("Hello %s,\n\nTo verify the email address of your account on %s, visit the URL below:\n%s\n\n"+
+		"The link is valid for %d hours. If you didn't register this account you can ignore this email.\n",
+		reg.Handle, h.conf.Name, u, int(emailVerificationTimeout.Hours()))
+	return h.mailer.Send(reg.Email, subject, body)
+}
+
+// registrationError returns the reason the account can't log in, if its registration wasn't approved
+func (h *handler) registrationError(a Account) error {
+	switch h.registrations.ForAccount(a).Status {
+	case registrationPending:
+		return errors.Forbiddenf("your account is waiting for a moderator's approval")
+	case registrationRejected:
+		return errors.Forbiddenf("your registration was not approved")
+	}
+	return nil
+}
+
+// ValidateEmailVerified stops the logged accounts that haven't verified their email address from posting
+func (h *handler) ValidateEmailVerified(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		acc := loggedAccount(r)
+		if acc.IsLogged() && !h.registrations.ForAccount(*acc).Verified() {
+			e := errors.Forbiddenf("please verify your email address first, you can request a new verification email in the settings")
+			h.errFn(log.Ctx{"handle": acc.Handle})("Error: %s", e)
+			h.v.HandleErrors(w, r, e)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// HandleVerifyEmail serves GET /verify-email/{hash}/{token} requests, the links from the verification emails
+func (h *handler) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	reg, err := h.registrations.Load(chi.URLParam(r, "hash"))
+	if err != nil {
+		h.v.HandleErrors(w, r, errors.NotFoundf("invalid verification link"))
+		return
+	}
+	if !reg.EmailVerified {
+		if !reg.verifyEmail(chi.URLParam(r, "token"), time.Now()) {
+			h.v.HandleErrors(w, r, errors.NotValidf("the verification link is invalid or it expired, you can request a new one in the settings"))
+			return
+		}
+		if err := h.registrations.Save(reg.ID, reg); err != nil {
+			h.errFn(log.Ctx{"err": err, "handle": reg.Handle})("unable to save registration")
+			h.v.HandleErrors(w, r, errors.Annotatef(err, "unable to verify email address"))
+			return
+		}
+		h.infoFn(log.Ctx{"handle": reg.Handle})("verified email address")
+	}
+	h.v.addFlashMessage(Success, w, r, "Your email address is verified")
+	h.v.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// HandleResendVerification serves POST /settings/verify-email requests
+func (h *handler) HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	reg, err := h.registrations.Load(acc.Hash.String())
+	if err != nil || reg.Verified() {
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	tok := reg.newEmailToken()
+	if err := h.registrations.Save(reg.ID, reg); err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to save registration")
+		h.v.addFlashMessage(Error, w, r, "Unable to send the verification email")
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	if err := h.sendVerificationEmail(reg, tok); err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to send verification email")
+		h.v.addFlashMessage(Error, w, r, "Unable to send the verification email")
+	} else {
+		h.v.addFlashMessage(Success, w, r, fmt.Sprintf("We sent a new verification email to %s", reg.Email))
+	}
+	h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// HandleRegistrations serves GET /admin/registrations, the registrations waiting for a moderator
+func (h *handler) HandleRegistrations(w http.ResponseWriter, r *http.Request) {
+	m := &registrationsModel{Title: "Registrations"}
+	regs, err := h.registrations.Pending()
+	if err != nil {
+		h.errFn(log.Ctx{"err": err})("unable to load registrations")
+		h.v.HandleErrors(w, r, errors.Annotatef(err, "unable to load registrations"))
+		return
+	}
+	m.Registrations = regs
+	h.v.RenderTemplate(r, w, m.Template(), m)
+}
+
+// HandleRegistrationDecision serves POST /admin/registrations/{hash}/{action} requests,
+// where action is approve or reject
+func (h *handler) HandleRegistrationDecision(w http.ResponseWriter, r *http.Request) {
+	reg, err := h.registrations.Load(chi.URLParam(r, "hash"))
+	if err != nil || reg.Status != registrationPending {
+		h.v.HandleErrors(w, r, errors.NotFoundf("registration"))
+		return
+	}
+	by := loggedAccount(r)
+	switch chi.URLParam(r, "action") {
+	case "approve":
+		reg.Status = registrationApproved
+	case "reject":
+		reg.Status = registrationRejected
+	default:
+		h.v.HandleErrors(w, r, errors.NotFoundf("invalid action"))
+		return
+	}
+	reg.By = by.Handle
+	if reg.Status == registrationRejected {
+		if err := h.deleteRegisteredAccount(context.TODO(), reg); err != nil {
+			h.errFn(log.Ctx{"err": err, "handle": reg.Handle})("unable to delete rejected account")
+			h.v.addFlashMessage(Error, w, r, fmt.Sprintf("Unable to delete the account of %s", reg.Handle))
+			h.v.Redirect(w, r, "/admin/registrations", http.StatusSeeOther)
+			return
+		}
+	}
+	if err := h.registrations.Save(reg.ID, reg); err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": reg.Handle})("unable to save registration")
+		h.v.addFlashMessage(Error, w, r, "Unable to save the registration")
+		h.v.Redirect(w, r, "/admin/registrations", http.StatusSeeOther)
+		return
+	}
+	h.infoFn(log.Ctx{"handle": reg.Handle, "status": reg.Status, "by": by.Handle})("moderated registration")
+	if reg.Status == registrationApproved {
+		h.v.addFlashMessage(Success, w, r, fmt.Sprintf("Approved the registration of %s", reg.Handle))
+		if err := h.notifyApproval(reg); err != nil {
+			h.errFn(log.Ctx{"err": err, "handle": reg.Handle})("unable to notify approved account")
+		}
+	} else {
+		h.v.addFlashMessage(Success, w, r, fmt.Sprintf("Rejected the registration of %s", reg.Handle))
+	}
+	h.v.Redirect(w, r, "/admin/registrations", http.StatusSeeOther)
+}
+
+// deleteRegisteredAccount removes the FedBOX actor of a rejected registration,
+// so it can't log in or be used later
+func (h *handler) deleteRegisteredAccount(ctx context.Context, reg registration) error {
+	repo := h.storage.WithAccount(h.storage.app)
+	acc, err := repo.LoadAccount(ctx, actors.IRI(repo.BaseURL()).AddPath(reg.ID))
+	if err != nil {
+		return errors.Annotatef(err, "unable to load account %s", reg.Handle)
+	}
+	acc.Flags |= FlagsDeleted
+	_, err = repo.SaveAccount(ctx, *acc)
+	return err
+}
+
+// notifyApproval lets the users that gave us their email address know that they can log in
+func (h *handler) notifyApproval(reg registration) error {
+	if len(reg.Email) == 0 || h.mailer == nil {
+		return nil
+	}
+	subject := fmt.Sprintf("Your account on %s was approved", h.conf.Name)
+	body := fmt.Sprintf("Hello %s,\n\nA moderator approved your account, you can now log in at %s/login\n", reg.Handle, h.conf.BaseURL)
+	return h.mailer.Send(reg.Email, subject, body)
+}
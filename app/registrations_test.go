@@ -0,0 +1,113 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+)
+
+func TestRegistrationVerifyEmail(t *testing.T) {
+	reg := registration{Email: "jdoe@example.com"}
+	if reg.Verified() {
+		t.Errorf("expected the email to need verification")
+	}
+	tok := reg.newEmailToken()
+	if reg.EmailToken == tok {
+		t.Errorf("the token should be stored hashed")
+	}
+	if reg.verifyEmail("invalid", time.Now()) {
+		t.Errorf("expected invalid token to fail")
+	}
+	if reg.verifyEmail(tok, time.Now().Add(emailVerificationTimeout+time.Minute)) {
+		t.Errorf("expected expired token to fail")
+	}
+	if !reg.verifyEmail(tok, time.Now()) || !reg.Verified() {
+		t.Errorf("expected the email to be verified")
+	}
+	if reg.verifyEmail(tok, time.Now()) {
+		t.Errorf("expected the token to be usable only once")
+	}
+	if !(registration{}).Verified() {
+		t.Errorf("expected the registrations without an email to be verified")
+	}
+}
+
+func TestValidEmail(t *testing.T) {
+	if addr, err := validEmail(" John Doe <jdoe@example.com> "); err != nil || addr != "jdoe@example.com" {
+		t.Errorf("invalid address %q: %v", addr, err)
+	}
+	for _, e := range []string{"", "jdoe", "jdoe@example.com\r\nBcc: x@example.com"} {
+		if _, err := validEmail(e); err == nil {
+			t.Errorf("expected %q to be invalid", e)
+		}
+	}
+}
+
+func TestRegistrationStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-registrations")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := newFileStore(dir, "registrations")
+	if err != nil {
+		t.Fatalf("unable to create storage: %s", err)
+	}
+	s := registrationStore{fs}
+	now := time.Now().UTC()
+	regs := []registration{
+		{ID: "6f2b8c8e-1d5e-4f4f-9d4a-2c1b3a4d5e6f", Handle: "second", Status: registrationPending, Created: now},
+		{ID: "0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d", Handle: "first", Status: registrationPending, Created: now.Add(-time.Hour)},
+		{ID: "1b2c3d4e-5f6a-4b7c-8d9e-0f1a2b3c4d5e", Handle: "approved", Status: registrationApproved, Created: now},
+		{ID: "2c3d4e5f-6a7b-4c8d-9e0f-1a2b3c4d5e6f", Handle: "rejected", Status: registrationRejected, Created: now},
+	}
+	for _, reg := range regs {
+		if err := s.Save(reg.ID, reg); err != nil {
+			t.Fatalf("unable to save registration: %s", err)
+		}
+	}
+	pending, err := s.Pending()
+	if err != nil {
+		t.Fatalf("unable to load pending registrations: %s", err)
+	}
+	if len(pending) != 2 || pending[0].Handle != "first" || pending[1].Handle != "second" {
+		t.Errorf("invalid pending registrations %v", pending)
+	}
+	if reg := s.ForAccount(Account{Hash: HashFromString("3d4e5f6a-7b8c-4d9e-8f0a-2b3c4d5e6f7a")}); reg.Status != registrationApproved {
+		t.Errorf("expected the accounts without a registration to be approved, received %s", reg.Status)
+	}
+	if reg := s.ForAccount(Account{Hash: HashFromString("2c3d4e5f-6a7b-4c8d-9e0f-1a2b3c4d5e6f")}); reg.Status != registrationRejected {
+		t.Errorf("invalid registration status %s, expected %s", reg.Status, registrationRejected)
+	}
+}
+
+func TestInvitationError(t *testing.T) {
+	app := "https://fedbox.git/actors/4f449c81-1dbb-4108-b1a3-5a83926a0fbf"
+	isRoot := func(iri pub.IRI) bool {
+		return iri.Equals(pub.IRI(app), false)
+	}
+	inviter := &Account{Handle: "inviter", Metadata: &AccountMetadata{ID: "https://fedbox.git/actors/1b2c3d4e-5f6a-4b7c-8d9e-0f1a2b3c4d5e"}}
+	hash := HashFromString("6f2b8c8e-1d5e-4f4f-9d4a-2c1b3a4d5e6f")
+	tests := []struct {
+		name    string
+		invited *Account
+		valid   bool
+	}{
+		{"missing", nil, false},
+		{"no creator", &Account{Hash: hash}, false},
+		{"created by the application", &Account{Hash: hash, CreatedBy: &Account{Metadata: &AccountMetadata{ID: app}}}, false},
+		{"claimed", &Account{Hash: hash, Handle: "jdoe", CreatedBy: inviter}, false},
+		{"unclaimed", &Account{Hash: hash, CreatedBy: inviter}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := invitationError(tt.invited, isRoot); (err == nil) != tt.valid {
+				t.Errorf("invitationError() = %v, expected valid %t", err, tt.valid)
+			}
+		})
+	}
+}
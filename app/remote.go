@@ -0,0 +1,500 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/client"
+	"github.com/go-ap/errors"
+	"github.com/google/uuid"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+const (
+	remoteAccountTTL      = 6 * time.Hour
+	remoteOutboxMaxItems  = 50
+	ostatusSubscribeRel   = "http://ostatus.org/schema/1.0/subscribe"
+	webFingerMaxBodyBytes = 1 << 20
+	remoteMaxBodyBytes    = 4 << 20
+)
+
+var remoteClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         (&net.Dialer{Timeout: 5 * time.Second, Control: remoteDialControl}).DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+	},
+}
+
+// privateNetworks are the address ranges, besides the loopback, link-local and unspecified ones, that the remote
+// lookups can't reach, so visitors can't use them to probe the services on our network
+var privateNetworks = func() []*net.IPNet {
+	nets := make([]*net.IPNet, 0)
+	for _, cidr := range []string{"10.0.0.0/8", "172.16.0.0/12", "192.168.0.0/16", "100.64.0.0/10", "fc00::/7"} {
+		_, n, _ := net.ParseCIDR(cidr)
+		nets = append(nets, n)
+	}
+	return nets
+}()
+
+// ipIsPublic returns true if the address can be reached by the remote lookups
+func ipIsPublic(ip net.IP) bool {
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range privateNetworks {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// checkRemoteHost resolves the host and returns an error if any of its addresses is not a public one
+func checkRemoteHost(ctx context.Context, host string) error {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if len(host) == 0 {
+		return errors.NotValidf("empty host")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		if !ipIsPublic(ip) {
+			return errors.Forbiddenf("%s is not a public address", host)
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return errors.NewNotFound(err, "unable to resolve %s", host)
+	}
+	for _, addr := range addrs {
+		if !ipIsPublic(addr.IP) {
+			return errors.Forbiddenf("%s resolves to %s, which is not a public address", host, addr.IP)
+		}
+	}
+	return nil
+}
+
+// remoteDialControl refuses the connections of the remote client to non public addresses, which covers the
+// redirects and the DNS answers that change after checkRemoteHost
+func remoteDialControl(network, address string, _ syscall.RawConn) error {
+	h, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if !ipIsPublic(net.ParseIP(h)) {
+		return errors.Forbiddenf("%s is not a public address", h)
+	}
+	return nil
+}
+
+// remoteLookupLimiter limits how many remote lookups an address can trigger in a time window
+type remoteLookupLimiter struct {
+	sync.Mutex
+	max    int
+	window time.Duration
+	start  time.Time
+	counts map[string]int
+}
+
+// remoteLookups limits the anonymous requests, like the remote follow form, that make us contact other servers
+var remoteLookups = &remoteLookupLimiter{max: 10, window: time.Minute, counts: make(map[string]int)}
+
+// Allow returns false if key made more than the maximum number of lookups in the current window
+func (l *remoteLookupLimiter) Allow(key string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	if now.Sub(l.start) > l.window {
+		l.start = now
+		l.counts = make(map[string]int)
+	}
+	l.counts[key]++
+	return l.counts[key] <= l.max
+}
+
+// remoteAddr returns the address the request was received from, without the headers set by proxies
+func remoteAddr(r *http.Request) string {
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return h
+	}
+	return r.RemoteAddr
+}
+
+// loadRemote loads the item at iri from a remote server, after checking that its host is a public one.
+// The request is made with the unsigned remote client, so the FedBOX credentials of the application or of
+// the logged account never reach other servers.
+func loadRemote(ctx context.Context, iri pub.IRI) (pub.Item, error) {
+	u, err := iri.URL()
+	if err != nil {
+		return nil, errors.NewNotValid(err, "invalid IRI %s", iri)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, errors.NotValidf("invalid IRI %s", iri)
+	}
+	if err := checkRemoteHost(ctx, u.Host); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, iri.String(), nil)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid IRI %s", iri)
+	}
+	req.Header.Set("Accept", fmt.Sprintf("%s, %s", activityJsonMimeType, `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`))
+	req.Header.Set("User-Agent", client.UserAgent)
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, errors.Annotatef(err, "Unable to load remote IRI: %s", iri)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.NotFoundf("remote IRI %s responded with %s", iri, resp.Status)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, remoteMaxBodyBytes+1))
+	if err != nil {
+		return nil, errors.Annotatef(err, "Unable to load remote IRI: %s", iri)
+	}
+	if len(body) > remoteMaxBodyBytes {
+		return nil, errors.NotValidf("remote IRI %s is too large", iri)
+	}
+	it, err := pub.UnmarshalJSON(body)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid response for remote IRI: %s", iri)
+	}
+	if it == nil {
+		return nil, errors.NotFoundf("Unable to load remote IRI, nil item: %s", iri)
+	}
+	return it, nil
+}
+
+// parseHandle splits a [@]user@host handle in its parts.
+// The host is empty for handles that belong to the current instance.
+func parseHandle(handle string) (string, string) {
+	handle = strings.TrimPrefix(strings.TrimSpace(handle), "@")
+	i := strings.LastIndex(handle, "@")
+	if i < 0 {
+		return handle, ""
+	}
+	user, host := handle[:i], strings.ToLower(handle[i+1:])
+	if len(host) == 0 || HostIsLocal(fmt.Sprintf("https://%s", host)) {
+		return user, ""
+	}
+	return user, host
+}
+
+// remoteHash returns a stable hash for the remote ActivityPub objects, as their IRIs are not based on UUIDs
+// like the ones in FedBOX.
+func remoteHash(iri pub.IRI) Hash {
+	return Hash(uuid.NewSHA1(uuid.NameSpaceURL, []byte(iri)))
+}
+
+// link returns the first link of the WebFinger node with the rel relation and one of the types
+func (n node) link(rel string, types ...string) *link {
+	for i, l := range n.Links {
+		if l.Rel != rel {
+			continue
+		}
+		if len(types) == 0 || stringInSlice(types)(l.Type) {
+			return &n.Links[i]
+		}
+	}
+	return nil
+}
+
+// webFinger loads the WebFinger node of the user@host account from its server
+func webFinger(ctx context.Context, user, host string) (*node, error) {
+	if len(user) == 0 || len(host) == 0 {
+		return nil, errors.NotValidf("invalid account %s@%s", user, host)
+	}
+	if err := checkRemoteHost(ctx, host); err != nil {
+		return nil, err
+	}
+	u := fmt.Sprintf("https://%s/.well-known/webfinger?resource=%s", host, url.QueryEscape(fmt.Sprintf("acct:%s@%s", user, host)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, errors.Annotatef(err, "invalid WebFinger request for %s@%s", user, host)
+	}
+	req.Header.Set("Accept", "application/jrd+json, application/json")
+	req.Header.Set("User-Agent", client.UserAgent)
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to load WebFinger for %s@%s", user, host)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.NotFoundf("account %s@%s not found", user, host)
+	}
+	n := new(node)
+	if err := json.NewDecoder(io.LimitReader(resp.Body, webFingerMaxBodyBytes)).Decode(n); err != nil {
+		return nil, errors.Annotatef(err, "invalid WebFinger response for %s@%s", user, host)
+	}
+	return n, nil
+}
+
+type remoteAccount struct {
+	acc      Account
+	loadedAt time.Time
+}
+
+// remoteAccounts caches the remote actors resolved through WebFinger, so we don't dereference them on every request
+type remoteAccounts struct {
+	sync.RWMutex
+	ttl time.Duration
+	m   map[string]remoteAccount
+}
+
+func newRemoteAccounts(ttl time.Duration) *remoteAccounts {
+	return &remoteAccounts{ttl: ttl, m: make(map[string]remoteAccount)}
+}
+
+// Get returns the account cached for handle, if it didn't expire
+func (c *remoteAccounts) Get(handle string) (Account, bool) {
+	if c == nil {
+		return AnonymousAccount, false
+	}
+	c.RLock()
+	defer c.RUnlock()
+	ra, ok := c.m[handle]
+	if !ok || time.Since(ra.loadedAt) > c.ttl {
+		return AnonymousAccount, false
+	}
+	return ra.acc, true
+}
+
+// Set caches the account for handle
+func (c *remoteAccounts) Set(handle string, acc Account) {
+	if c == nil {
+		return
+	}
+	c.Lock()
+	defer c.Unlock()
+	for k, ra := range c.m {
+		if time.Since(ra.loadedAt) > c.ttl {
+			delete(c.m, k)
+		}
+	}
+	c.m[handle] = remoteAccount{acc: acc, loadedAt: time.Now()}
+}
+
+// LoadRemoteAccount resolves the user@host handle through WebFinger and dereferences the actor it points to
+func (r *repository) LoadRemoteAccount(ctx context.Context, handle string) (*Account, error) {
+	user, host := parseHandle(handle)
+	if len(host) == 0 {
+		return nil, errors.NotValidf("%s is not a remote account", handle)
+	}
+	handle = fmt.Sprintf("%s@%s", user, host)
+	if acc, ok := r.remote.Get(handle); ok {
+		return &acc, nil
+	}
+	wf, err := webFinger(ctx, user, host)
+	if err != nil {
+		return nil, err
+	}
+	self := wf.link("self", activityJsonMimeType, jsonLDMimeType)
+	if self == nil || len(self.Href) == 0 {
+		return nil, errors.NotFoundf("no ActivityPub actor found for %s", handle)
+	}
+	it, err := loadRemote(ctx, pub.IRI(self.Href))
+	if err != nil {
+		return nil, err
+	}
+	acc := new(Account)
+	if err := acc.FromActivityPub(it); err != nil {
+		return nil, errors.Annotatef(err, "invalid ActivityPub actor for %s", handle)
+	}
+	acc.Handle = handle
+	acc.Hash = remoteHash(it.GetLink())
+	r.remote.Set(handle, *acc)
+	r.infoFn(log.Ctx{"handle": handle, "iri": it.GetLink()})("loaded remote account")
+	return acc, nil
+}
+
+// LoadRemoteOutbox loads the items the remote account created from its outbox.
+// Only the first page is loaded, as remote servers don't understand our filters.
+func (r *repository) LoadRemoteOutbox(ctx context.Context, acc Account) (*Cursor, error) {
+	if !acc.HasMetadata() || len(acc.Metadata.OutboxIRI) == 0 {
+		return nil, errors.NotFoundf("no outbox for %s", acc.Handle)
+	}
+	col, err := loadRemote(ctx, pub.IRI(acc.Metadata.OutboxIRI))
+	if err != nil {
+		return nil, err
+	}
+	var first pub.Item
+	pub.OnOrderedCollection(col, func(c *pub.OrderedCollection) error {
+		if len(c.OrderedItems) == 0 {
+			first = c.First
+		}
+		return nil
+	})
+	if first != nil {
+		if first.IsLink() {
+			if col, err = loadRemote(ctx, first.GetLink()); err != nil {
+				return nil, err
+			}
+		} else {
+			col = first
+		}
+	}
+
+	cursor := new(Cursor)
+	cursor.items = make(RenderableList, 0)
+	err = pub.OnCollectionIntf(col, func(c pub.CollectionInterface) error {
+		for _, it := range c.Collection() {
+			if len(cursor.items) >= remoteOutboxMaxItems {
+				break
+			}
+			pub.OnActivity(it, func(a *pub.Activity) error {
+				ob := a.Object
+				if a.GetType() != pub.CreateType || ob == nil || !ob.IsObject() || !ValidContentTypes.Contains(ob.GetType()) {
+					return nil
+				}
+				i := new(Item)
+				if err := i.FromActivityPub(ob); err != nil {
+					r.errFn(log.Ctx{"err": err, "iri": ob.GetLink()})("unable to load remote item")
+					return nil
+				}
+				i.Hash = remoteHash(ob.GetLink())
+				author := acc
+				i.SubmittedBy = &author
+				cursor.items.Append(i)
+				return nil
+			})
+		}
+		return nil
+	})
+	cursor.total = uint(len(cursor.items))
+	return cursor, err
+}
+
+// HandleRemoteFollow serves POST /~handle/remote-follow requests.
+// It redirects visitors to the subscribe page of their own instance, where they can follow the local account.
+func (h *handler) HandleRemoteFollow(w http.ResponseWriter, r *http.Request) {
+	authors := ContextAuthors(r.Context())
+	if len(authors) == 0 {
+		h.v.HandleErrors(w, r, errors.NotFoundf("account not found"))
+		return
+	}
+	toFollow := authors[0]
+	back := AccountPermaLink(&toFollow)
+	if !toFollow.HasMetadata() || len(toFollow.Metadata.ID) == 0 {
+		h.v.HandleErrors(w, r, errors.NotValidf("account %s can not be followed", toFollow.Handle))
+		return
+	}
+	user, host := parseHandle(r.PostFormValue("handle"))
+	if len(user) == 0 || len(host) == 0 {
+		h.v.addFlashMessage(Error, w, r, "Please enter your account as user@your.instance")
+		h.v.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	if !remoteLookups.Allow(remoteAddr(r), time.Now()) {
+		h.v.addFlashMessage(Error, w, r, "Too many requests, please try again in a minute")
+		h.v.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	wf, err := webFinger(context.TODO(), user, host)
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": fmt.Sprintf("%s@%s", user, host)})("unable to load remote account")
+		h.v.addFlashMessage(Error, w, r, fmt.Sprintf("Unable to find the account %s@%s", user, host))
+		h.v.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	sub := wf.link(ostatusSubscribeRel)
+	if sub == nil || !strings.Contains(sub.Template, "{uri}") {
+		h.v.addFlashMessage(Error, w, r, fmt.Sprintf("The instance %s does not support remote follows", host))
+		h.v.Redirect(w, r, back, http.StatusSeeOther)
+		return
+	}
+	h.v.Redirect(w, r, strings.Replace(sub.Template, "{uri}", url.QueryEscape(toFollow.Metadata.ID), 1), http.StatusSeeOther)
+}
+
+// loadInteractionAccount loads the account that the uri of an ostatus subscribe request points to,
+// which can be a [acct:]user@host handle or an actor IRI
+func (r *repository) loadInteractionAccount(ctx context.Context, uri string) (*Account, error) {
+	uri = strings.TrimPrefix(strings.TrimSpace(uri), "acct:")
+	if !strings.HasPrefix(uri, "http://") && !strings.HasPrefix(uri, "https://") {
+		user, host := parseHandle(uri)
+		if len(host) == 0 {
+			accounts, err := r.accounts(ctx, &Filters{Name: CompStrs{EqualsString(user)}, MaxItems: 1})
+			if err != nil {
+				return nil, err
+			}
+			return AccountCollection(accounts).First()
+		}
+		return r.LoadRemoteAccount(ctx, uri)
+	}
+	iri := pub.IRI(uri)
+	if HostIsLocal(uri) {
+		return r.LoadAccount(ctx, iri)
+	}
+	it, err := loadRemote(ctx, iri)
+	if err != nil {
+		return nil, err
+	}
+	acc := new(Account)
+	if err := acc.FromActivityPub(it); err != nil {
+		return nil, errors.Annotatef(err, "invalid ActivityPub actor %s", iri)
+	}
+	acc.Handle = fmt.Sprintf("%s@%s", acc.Handle, host(uri))
+	acc.Hash = remoteHash(it.GetLink())
+	return acc, nil
+}
+
+// HandleAuthorizeInteraction serves GET /authorize_interaction?uri={uri} requests, the ostatus subscribe
+// template we advertise through WebFinger. It asks the logged account to confirm following the account uri
+// points to, the follow being done by HandleAuthorizeInteractionFollow.
+func (h *handler) HandleAuthorizeInteraction(w http.ResponseWriter, r *http.Request) {
+	uri := r.URL.Query().Get("uri")
+	toFollow, err := h.interactionAccount(r, uri)
+	if err != nil {
+		h.v.HandleErrors(w, r, err)
+		return
+	}
+	m := &authorizeInteractionModel{Title: fmt.Sprintf("Follow %s", toFollow.Handle), URI: uri, Account: toFollow}
+	h.v.RenderTemplate(r, w, m.Template(), m)
+}
+
+// HandleAuthorizeInteractionFollow serves POST /authorize_interaction requests, sent by the confirmation form
+// of HandleAuthorizeInteraction. It makes the logged account follow the account uri points to.
+func (h *handler) HandleAuthorizeInteractionFollow(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	toFollow, err := h.interactionAccount(r, r.PostFormValue("uri"))
+	if err != nil {
+		h.v.HandleErrors(w, r, err)
+		return
+	}
+	if err = h.requestRepository(r).FollowAccount(context.TODO(), *acc, *toFollow, nil); err != nil {
+		h.v.HandleErrors(w, r, err)
+		return
+	}
+	acc.Metadata.OutboxUpdated = time.Time{}
+	h.v.addFlashMessage(Success, w, r, fmt.Sprintf("You are now following %s", toFollow.Handle))
+	h.v.Redirect(w, r, AccountPermaLink(toFollow), http.StatusSeeOther)
+}
+
+// interactionAccount loads the account the logged account wants to follow
+func (h *handler) interactionAccount(r *http.Request, uri string) (*Account, error) {
+	if len(uri) == 0 {
+		return nil, errors.BadRequestf("missing uri")
+	}
+	toFollow, err := h.storage.loadInteractionAccount(context.TODO(), uri)
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "uri": uri})("unable to load account to follow")
+		return nil, errors.NotFoundf("account %s not found", uri)
+	}
+	if toFollow.Hash == loggedAccount(r).Hash {
+		return nil, errors.NotValidf("you can not follow yourself")
+	}
+	return toFollow, nil
+}
@@ -0,0 +1,130 @@
+package app
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/mariusor/go-littr/internal/config"
+)
+
+func TestParseHandle(t *testing.T) {
+	prev := Instance.Conf
+	Instance.Conf = &config.Configuration{HostName: "littr.example", APIURL: "https://fedbox.littr.example"}
+	defer func() { Instance.Conf = prev }()
+
+	tests := []struct {
+		handle string
+		user   string
+		host   string
+	}{
+		{handle: "johndoe", user: "johndoe"},
+		{handle: "johndoe@littr.example", user: "johndoe"},
+		{handle: "johndoe@mastodon.example", user: "johndoe", host: "mastodon.example"},
+		{handle: "@johndoe@Mastodon.Example", user: "johndoe", host: "mastodon.example"},
+		{handle: "johndoe@", user: "johndoe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.handle, func(t *testing.T) {
+			user, host := parseHandle(tt.handle)
+			if user != tt.user || host != tt.host {
+				t.Errorf("parseHandle() = %q, %q, want %q, %q", user, host, tt.user, tt.host)
+			}
+		})
+	}
+}
+
+func TestNode_link(t *testing.T) {
+	n := node{
+		Links: []link{
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: "https://mastodon.example/@johndoe"},
+			{Rel: "self", Type: "application/activity+json", Href: "https://mastodon.example/users/johndoe"},
+			{Rel: ostatusSubscribeRel, Template: "https://mastodon.example/authorize_interaction?uri={uri}"},
+		},
+	}
+	if l := n.link("self", activityJsonMimeType, jsonLDMimeType); l == nil || l.Href != "https://mastodon.example/users/johndoe" {
+		t.Errorf("link(self) = %v, expected the actor link", l)
+	}
+	if l := n.link("self", "text/html"); l != nil {
+		t.Errorf("link(self, text/html) = %v, expected nil", l)
+	}
+	if l := n.link(ostatusSubscribeRel); l == nil || len(l.Template) == 0 {
+		t.Errorf("link(subscribe) = %v, expected the subscribe template", l)
+	}
+}
+
+func TestRemoteHash(t *testing.T) {
+	h := remoteHash("https://mastodon.example/users/johndoe/statuses/1")
+	if !h.IsValid() {
+		t.Errorf("remoteHash() = %s, expected a valid hash", h)
+	}
+	if h != remoteHash("https://mastodon.example/users/johndoe/statuses/1") {
+		t.Errorf("remoteHash() is not stable")
+	}
+	if h == remoteHash("https://mastodon.example/users/johndoe/statuses/2") {
+		t.Errorf("remoteHash() returned the same hash for different IRIs")
+	}
+}
+
+func TestIpIsPublic(t *testing.T) {
+	tests := map[string]bool{
+		"127.0.0.1":       false,
+		"::1":             false,
+		"0.0.0.0":         false,
+		"10.1.2.3":        false,
+		"172.16.0.10":     false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"fe80::1":         false,
+		"fd00::1":         false,
+		"93.184.216.34":   true,
+		"2606:4700::1":    true,
+	}
+	for addr, want := range tests {
+		if got := ipIsPublic(net.ParseIP(addr)); got != want {
+			t.Errorf("ipIsPublic(%s) = %t, want %t", addr, got, want)
+		}
+	}
+}
+
+func TestRemoteLookupLimiter_Allow(t *testing.T) {
+	l := &remoteLookupLimiter{max: 2, window: time.Minute, counts: make(map[string]int)}
+	now := time.Now()
+	if !l.Allow("192.0.2.1", now) || !l.Allow("192.0.2.1", now) {
+		t.Fatalf("Allow() refused a lookup under the limit")
+	}
+	if l.Allow("192.0.2.1", now) {
+		t.Errorf("Allow() accepted a lookup over the limit")
+	}
+	if !l.Allow("192.0.2.2", now) {
+		t.Errorf("Allow() refused a lookup from a different address")
+	}
+	if !l.Allow("192.0.2.1", now.Add(2*time.Minute)) {
+		t.Errorf("Allow() refused a lookup in a new window")
+	}
+}
+
+func TestLoadRemote(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	if _, err := loadRemote(context.Background(), pub.IRI(srv.URL+"/actors/jdoe")); err == nil {
+		t.Errorf("loadRemote() loaded an IRI on a loopback address")
+	}
+	if _, err := loadRemote(context.Background(), pub.IRI("file:///etc/passwd")); err == nil {
+		t.Errorf("loadRemote() accepted an IRI that is not http")
+	}
+	if called {
+		t.Errorf("loadRemote() contacted a server on a loopback address")
+	}
+	if err := remoteDialControl("tcp", srv.Listener.Addr().String(), nil); err == nil {
+		t.Errorf("remoteDialControl() allowed dialing %s", srv.Listener.Addr())
+	}
+}
@@ -3,8 +3,6 @@ package app
 import (
 	"context"
 	"crypto"
-	"crypto/x509"
-	"encoding/base64"
 	"fmt"
 	pub "github.com/go-ap/activitypub"
 	"github.com/go-ap/client"
@@ -36,6 +34,16 @@ type repository struct {
 	fedbox  *fedbox
 	infoFn  CtxLogFn
 	errFn   CtxLogFn
+
+	revisions  *fileStore
+	remote     *remoteAccounts
+	deliveries *deliveries
+	// stopDeliveries stops the delivery queue, which closes deliveriesDone once the current delivery finishes
+	stopDeliveries context.CancelFunc
+	deliveriesDone chan struct{}
+	keys           keyStore
+	// keyType is the type of the keys we generate for the new accounts
+	keyType string
 }
 
 func (r repository) BaseURL() pub.IRI {
@@ -51,6 +59,15 @@ func (h handler) Repository(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+// requestRepository returns the repository bound to the account logged in the current request,
+// falling back to the shared one for anonymous requests
+func (h handler) requestRepository(r *http.Request) *repository {
+	if repo := ContextRepository(r.Context()); repo != nil {
+		return repo
+	}
+	return h.storage
+}
+
 func ActivityPubService(c appConfig) (*repository, error) {
 	pub.ItemTyperFunc = pub.GetItemByType
 
@@ -66,8 +83,30 @@ func ActivityPubService(c appConfig) (*repository, error) {
 		SelfURL: c.BaseURL,
 		infoFn:  infoFn,
 		errFn:   errFn,
+		remote:  newRemoteAccounts(remoteAccountTTL),
 	}
 	var err error
+	if repo.revisions, err = newFileStore(c.DataPath, "revisions"); err != nil {
+		errFn(log.Ctx{"err": err})("unable to initialize item revisions storage")
+	}
+	if repo.keys.fileStore, err = newFileStore(c.DataPath, "keys"); err != nil {
+		errFn(log.Ctx{"err": err})("unable to initialize keys storage")
+	}
+	repo.keyType = keyType(c.SignatureKeyType)
+	if repo.keyType != keyTypeRSA {
+		errFn(log.Ctx{"type": repo.keyType})("the new accounts get keys that Mastodon and most other ActivityPub servers refuse, use rsa to federate with them")
+	}
+	if c.DeliveriesEnabled {
+		deliveryStore, err := newFileStore(c.DataPath, "deliveries")
+		if err != nil {
+			errFn(log.Ctx{"err": err})("unable to initialize deliveries storage")
+		}
+		repo.deliveries = newDeliveries(deliveryStore)
+		var ctx context.Context
+		ctx, repo.stopDeliveries = context.WithCancel(context.Background())
+		repo.deliveriesDone = make(chan struct{})
+		go repo.runDeliveries(ctx, repo.deliveriesDone)
+	}
 	repo.fedbox, err = NewClient(SetURL(c.APIURL), SetInfoLogger(infoFn), SetErrorLogger(errFn), SetUA(ua))
 	if err != nil {
 		return repo, err
@@ -75,6 +114,22 @@ func ActivityPubService(c appConfig) (*repository, error) {
 	return repo, nil
 }
 
+// Close stops the delivery queue, waiting for the delivery in progress to finish
+func (r *repository) Close() {
+	if r.stopDeliveries == nil {
+		return
+	}
+	r.stopDeliveries()
+	<-r.deliveriesDone
+}
+
+// systemAccount returns the SystemAccount with the metadata of the service actor
+func (r *repository) systemAccount() Account {
+	sys := SystemAccount
+	sys.Metadata = &AccountMetadata{ID: r.fedbox.Service().GetLink().String()}
+	return sys
+}
+
 func accountURL(acc Account) pub.IRI {
 	return pub.IRI(fmt.Sprintf("%s%s", Instance.BaseURL, AccountLocalLink(&acc)))
 }
@@ -289,7 +344,9 @@ func (r *repository) loadAPPerson(a Account) *pub.Actor {
 	} else {
 		p = new(pub.Actor)
 	}
-	p.Type = pub.PersonType
+	if p.Type != pub.GroupType {
+		p.Type = pub.PersonType
+	}
 	p.Name = pub.NaturalLanguageValuesNew()
 	p.PreferredUsername = pub.NaturalLanguageValuesNew()
 
@@ -341,23 +398,30 @@ func (r *repository) loadAPPerson(a Account) *pub.Actor {
 		p.PublicKey = pub.PublicKey{
 			ID:           pub.ID(fmt.Sprintf("%s#main-key", p.ID)),
 			Owner:        p.ID,
-			PublicKeyPem: fmt.Sprintf("-----BEGIN PUBLIC KEY-----\n%s\n-----END PUBLIC KEY-----", base64.StdEncoding.EncodeToString(a.Metadata.Key.Public)),
+			PublicKeyPem: publicKeyPem(a.Metadata.Key.Public),
 		}
 	}
 	return p
 }
 
-func getSigner(pubKeyID pub.ID, key crypto.PrivateKey) *httpsig.Signer {
-	hdrs := []string{"(request-target)", "host", "date"}
+func getSigner(pubKeyID pub.ID, key crypto.PrivateKey, hdrs []string) *httpsig.Signer {
 	return httpsig.NewSigner(string(pubKeyID), key, httpsig.RSASHA256, hdrs)
 }
 
 // @todo(marius): the decision which sign function to use (the one for S2S or the one for C2S)
-//   should be made in fedbox, because that's the place where we know if the request we're signing
-//   is addressed to an IRI belonging to that specific fedbox instance or to another ActivityPub server
+//
+//	should be made in fedbox, because that's the place where we know if the request we're signing
+//	is addressed to an IRI belonging to that specific fedbox instance or to another ActivityPub server
+//
+// WithAccount returns a copy of the repository that makes its requests on behalf of a. The copy shares the
+// FedBOX transport, the caches and the storages with r, so it can be created for every request, while r
+// itself is never modified.
 func (r *repository) WithAccount(a *Account) *repository {
-	r.fedbox.SignFn(r.withAccountC2S(a))
-	return r
+	rr := *r
+	if r.fedbox != nil {
+		rr.fedbox = r.fedbox.WithSigner(r.withAccountC2S(a))
+	}
+	return &rr
 }
 
 func (r *repository) withAccountC2S(a *Account) client.RequestSignFn {
@@ -366,7 +430,12 @@ func (r *repository) withAccountC2S(a *Account) client.RequestSignFn {
 		if !a.IsValid() || !a.IsLogged() {
 			return nil
 		}
-		if a.Metadata.OAuth.Token == nil {
+		tok, err := r.refreshToken(req.Context(), a, 0)
+		if err != nil {
+			r.errFn(log.Ctx{"handle": a.Handle, "err": err})("unable to refresh OAuth2 token")
+			return err
+		}
+		if tok == nil {
 			r.errFn(log.Ctx{
 				"handle":   a.Handle,
 				"logged":   a.IsLogged(),
@@ -374,7 +443,7 @@ func (r *repository) withAccountC2S(a *Account) client.RequestSignFn {
 			})("account has no OAuth2 token")
 			return nil
 		}
-		a.Metadata.OAuth.Token.SetAuthHeader(req)
+		tok.SetAuthHeader(req)
 		return nil
 	}
 }
@@ -385,35 +454,22 @@ func (r *repository) withAccountS2S(a *Account) client.RequestSignFn {
 		return nil
 	}
 
-	k := a.Metadata.Key
-	if k == nil {
-		return nil
-	}
-	var prv crypto.PrivateKey
-	var err error
-	if k.ID == "id-rsa" {
-		prv, err = x509.ParsePKCS8PrivateKey(k.Private)
-	}
+	k, err := r.keys.Load(*a)
 	if err != nil {
-		r.errFn(log.Ctx{
-			"handle":   a.Handle,
-			"logged":   a.IsLogged(),
-			"metadata": a.Metadata,
-		})(err.Error())
+		r.errFn(log.Ctx{"handle": a.Handle, "err": err})("unable to load signing key")
 		return nil
 	}
-	if k.ID == "id-ecdsa" {
-		//prv, err = x509.ParseECPrivateKey(k.Private)
-		err := errors.Errorf("unsupported private key type %s", k.ID)
+	prv, err := k.PrivateKey()
+	if err != nil {
 		r.errFn(log.Ctx{
-			"handle":   a.Handle,
-			"logged":   a.IsLogged(),
-			"metadata": a.Metadata,
-		})(err.Error())
+			"handle": a.Handle,
+			"type":   k.ID,
+			"err":    err,
+		})("unable to parse signing key")
 		return nil
 	}
 	p := *r.loadAPPerson(*a)
-	return getSigner(p.PublicKey.ID, prv).Sign
+	return requestSigner(pub.ID(fmt.Sprintf("%s#main-key", p.ID)), prv)
 }
 
 func (r *repository) LoadItem(ctx context.Context, iri pub.IRI) (Item, error) {
@@ -672,6 +728,7 @@ func (r *repository) loadItemsVotes(ctx context.Context, items ...Item) (ItemCol
 				for k, ob := range items {
 					if itemsEqual(*v.Item, ob) {
 						items[k].Score += v.Weight
+						items[k].Votes.Add(*v)
 					}
 				}
 			}
@@ -1101,6 +1158,107 @@ func LoadFromCollection(ctx context.Context, loadColFn CollectionFn, cur *colCur
 	return err
 }
 
+// acceptedMaxPages is the maximum number of collection pages we load when looking for enough accepted items
+const acceptedMaxPages = 10
+
+// loadAcceptedFromCollection loads pages from the collection until f.MaxItems items have been accepted,
+// or we reached the end of the collection, calling accum for each of the accepted items.
+// When it stops in the middle of a page, the next cursor points to the last accepted item, so the following
+// page of results starts right after it, instead of skipping the rest of the collection page.
+func loadAcceptedFromCollection(ctx context.Context, fn CollectionFn, f *Filters, accept func(pub.Item) bool, accum func(pub.Item)) error {
+	if len(f.Prev) > 0 && len(f.Next) == 0 {
+		return loadAcceptedBefore(ctx, fn, f, accept, accum)
+	}
+	var (
+		pages     int
+		accepted  int
+		truncated bool
+		first     string
+		last      string
+	)
+	paging := len(f.Next) > 0
+	err := LoadFromCollection(ctx, fn, &colCursor{filters: f}, func(col pub.CollectionInterface) (bool, error) {
+		pages++
+		for _, it := range col.Collection() {
+			if accepted >= f.MaxItems {
+				truncated = true
+				break
+			}
+			if it == nil || !accept(it) {
+				continue
+			}
+			accum(it)
+			accepted++
+			last = path.Base(it.GetLink().String())
+			if len(first) == 0 {
+				first = last
+			}
+		}
+		return accepted >= f.MaxItems || pages >= acceptedMaxPages, nil
+	})
+	if err != nil {
+		return err
+	}
+	if truncated {
+		f.Next = last
+	}
+	if paging && len(first) > 0 {
+		f.Prev = first
+	}
+	return nil
+}
+
+// loadAcceptedBefore loads the f.MaxItems accepted items that come right before the f.Prev cursor, walking the
+// collection pages backwards, as LoadFromCollection only follows the next pages.
+// The items are passed to accum in the collection order, and the cursors are set around them: the next one to
+// the last accepted item, and the previous one to the first, if the collection has more items before it.
+func loadAcceptedBefore(ctx context.Context, fn CollectionFn, f *Filters, accept func(pub.Item) bool, accum func(pub.Item)) error {
+	var (
+		pages    int
+		more     bool
+		accepted = make(pub.ItemCollection, 0)
+	)
+	pf := *f
+	for len(pf.Prev) > 0 && pages < acceptedMaxPages {
+		col, err := fn(ctx, &pf)
+		if err != nil {
+			return err
+		}
+		pages++
+		items := col.Collection()
+		i := len(items) - 1
+		for ; i >= 0 && len(accepted) < f.MaxItems; i-- {
+			if it := items[i]; it != nil && accept(it) {
+				accepted = append(accepted, it)
+			}
+		}
+		prev, _ := getCollectionPrevNext(col)
+		if len(accepted) >= f.MaxItems {
+			// NOTE(marius): there are more items before the accepted ones if we stopped inside the page,
+			// or if the page has a previous one
+			more = i >= 0 || len(prev) > 0
+			break
+		}
+		if len(items) == 0 {
+			break
+		}
+		more = len(prev) > 0
+		pf.Prev = prev
+		pf.Next = ""
+	}
+	f.Next, f.Prev = "", ""
+	for i := len(accepted) - 1; i >= 0; i-- {
+		accum(accepted[i])
+	}
+	if len(accepted) > 0 {
+		f.Next = path.Base(accepted[0].GetLink().String())
+		if more {
+			f.Prev = path.Base(accepted[len(accepted)-1].GetLink().String())
+		}
+	}
+	return nil
+}
+
 func (r *repository) account(ctx context.Context, ff *Filters) (Account, error) {
 	accounts, err := r.accounts(ctx, ff)
 	if err != nil {
@@ -1290,9 +1448,17 @@ func IRIsFilter(iris ...pub.IRI) CompStrs {
 // ActorCollection loads the service's collection returned by fn.
 // First step is to load the Create activities from the inbox
 // Iterating over the activities in the resulting collection, we gather the objects and accounts
-//  With the resulting Object IRIs we load from the objects collection with our matching filters
-//  With the resulting Actor IRIs we load from the accounts collection with matching filters
+//
+//	With the resulting Object IRIs we load from the objects collection with our matching filters
+//	With the resulting Actor IRIs we load from the accounts collection with matching filters
 func (r *repository) ActorCollection(ctx context.Context, fn CollectionFn, ff ...*Filters) (Cursor, error) {
+	return r.actorCollection(ctx, fn, nil, ff...)
+}
+
+// actorCollection loads the activities in the collection and the objects they operate on.
+// If accept is not nil, the activities it rejects are skipped, and more pages get loaded to fill the requested
+// number of items.
+func (r *repository) actorCollection(ctx context.Context, fn CollectionFn, accept func(pub.Item) bool, ff ...*Filters) (Cursor, error) {
 	items := make(ItemCollection, 0)
 	follows := make(FollowRequests, 0)
 	accounts := make(AccountCollection, 0)
@@ -1327,65 +1493,73 @@ func (r *repository) ActorCollection(ctx context.Context, fn CollectionFn, ff ..
 	for j := range ff {
 		f := ff[j]
 		g.Go(func() error {
-			err := LoadFromCollection(ctx, fn, &colCursor{filters: f}, func(col pub.CollectionInterface) (bool, error) {
-				for _, it := range col.Collection() {
-					pub.OnActivity(it, func(a *pub.Activity) error {
-						relM.Lock()
-						defer relM.Unlock()
-
-						typ := it.GetType()
-						if typ == pub.CreateType {
-							ob := a.Object
-							if ob == nil {
-								return nil
-							}
-							if ob.IsObject() {
-								if ValidContentTypes.Contains(ob.GetType()) {
-									i := Item{}
-									i.FromActivityPub(ob)
-									if validItem(i, f) {
-										items = append(items, i)
-									}
-								}
-								if ValidActorTypes.Contains(ob.GetType()) {
-									a := Account{}
-									a.FromActivityPub(ob)
-									accounts = append(accounts, a)
-								}
-							} else {
+			accum := func(it pub.Item) {
+				pub.OnActivity(it, func(a *pub.Activity) error {
+					relM.Lock()
+					defer relM.Unlock()
+
+					typ := it.GetType()
+					if typ == pub.CreateType {
+						ob := a.Object
+						if ob == nil {
+							return nil
+						}
+						if ob.IsObject() {
+							if ValidContentTypes.Contains(ob.GetType()) {
 								i := Item{}
-								i.FromActivityPub(a)
-								appendToDeferred(ob, LikeString)
+								i.FromActivityPub(ob)
+								if validItem(i, f) {
+									items = append(items, i)
+								}
 							}
-							relations[a.GetLink()] = ob.GetLink()
-						}
-						if it.GetType() == pub.FollowType {
-							f := FollowRequest{}
-							f.FromActivityPub(a)
-							follows = append(follows, f)
-							relations[a.GetLink()] = a.GetLink()
-							appendToDeferred(a.Object, EqualsString)
-						}
-						if ValidModerationActivityTypes.Contains(typ) {
-							m := ModerationOp{}
-							m.FromActivityPub(a)
-							moderations = append(moderations, m)
-							relations[a.GetLink()] = a.GetLink()
-							appendToDeferred(a.Object, EqualsString)
-						}
-						if ValidAppreciationTypes.Contains(typ) {
-							v := Vote{}
-							v.FromActivityPub(a)
-							appreciations = append(appreciations, v)
-							relations[a.GetLink()] = a.GetLink()
+							if ValidActorTypes.Contains(ob.GetType()) {
+								a := Account{}
+								a.FromActivityPub(ob)
+								accounts = append(accounts, a)
+							}
+						} else {
+							i := Item{}
+							i.FromActivityPub(a)
+							appendToDeferred(ob, LikeString)
 						}
-						return nil
-					})
-				}
-				// TODO(marius): this needs to be externalized also to a different function that we can pass from outer scope
-				//   This function implements the logic for breaking out of the collection iteration cycle and returns a bool
-				return true, nil
-			})
+						relations[a.GetLink()] = ob.GetLink()
+					}
+					if it.GetType() == pub.FollowType {
+						f := FollowRequest{}
+						f.FromActivityPub(a)
+						follows = append(follows, f)
+						relations[a.GetLink()] = a.GetLink()
+						appendToDeferred(a.Object, EqualsString)
+					}
+					if ValidModerationActivityTypes.Contains(typ) {
+						m := ModerationOp{}
+						m.FromActivityPub(a)
+						moderations = append(moderations, m)
+						relations[a.GetLink()] = a.GetLink()
+						appendToDeferred(a.Object, EqualsString)
+					}
+					if ValidAppreciationTypes.Contains(typ) {
+						v := Vote{}
+						v.FromActivityPub(a)
+						appreciations = append(appreciations, v)
+						relations[a.GetLink()] = a.GetLink()
+					}
+					return nil
+				})
+			}
+			var err error
+			if accept != nil {
+				err = loadAcceptedFromCollection(ctx, fn, f, accept, accum)
+			} else {
+				err = LoadFromCollection(ctx, fn, &colCursor{filters: f}, func(col pub.CollectionInterface) (bool, error) {
+					for _, it := range col.Collection() {
+						accum(it)
+					}
+					// TODO(marius): this needs to be externalized also to a different function that we can pass from outer scope
+					//   This function implements the logic for breaking out of the collection iteration cycle and returns a bool
+					return true, nil
+				})
+			}
 			if err != nil {
 				return err
 			}
@@ -1553,7 +1727,7 @@ func (r *repository) SaveVote(ctx context.Context, v Vote) (Vote, error) {
 
 	if exists.HasMetadata() {
 		act.Object = pub.IRI(exists.Metadata.IRI)
-		if _, _, err := r.fedbox.ToOutbox(ctx, act); err != nil {
+		if _, _, err := r.toOutbox(ctx, act); err != nil {
 			r.errFn()(err.Error())
 		}
 	}
@@ -1567,7 +1741,7 @@ func (r *repository) SaveVote(ctx context.Context, v Vote) (Vote, error) {
 		act.Object = o.GetLink()
 	}
 
-	_, _, err = r.fedbox.ToOutbox(ctx, act)
+	_, _, err = r.toOutbox(ctx, act)
 	if err != nil {
 		r.errFn()(err.Error())
 		return v, err
@@ -1764,12 +1938,23 @@ func (r *repository) SaveItem(ctx context.Context, it Item) (Item, error) {
 			act.Type = pub.UpdateType
 		}
 	}
+	var prev Item
+	if act.Type == pub.UpdateType {
+		if prev, err = r.LoadItem(ctx, id); err != nil {
+			r.errFn(log.Ctx{"err": err, "iri": id})("unable to load previous version of item")
+		}
+	}
 	var ob pub.Item
-	_, ob, err = r.fedbox.ToOutbox(ctx, act)
+	_, ob, err = r.toOutbox(ctx, act)
 	if err != nil {
 		r.errFn()(err.Error())
 		return it, err
 	}
+	if prev.IsValid() {
+		if err := r.saveRevision(prev); err != nil {
+			r.errFn(log.Ctx{"err": err, "hash": prev.Hash})("unable to save item revision")
+		}
+	}
 	err = it.FromActivityPub(ob)
 	if err != nil {
 		r.errFn()(err.Error())
@@ -1848,7 +2033,7 @@ func (r *repository) LoadAccounts(ctx context.Context, ff ...*Filters) (AccountC
 }
 
 func (r *repository) LoadAccountDetails(ctx context.Context, acc *Account) error {
-	r.WithAccount(acc)
+	r = r.WithAccount(acc)
 	ltx := log.Ctx{
 		"handle": acc.Handle,
 		"hash":   acc.Hash,
@@ -1952,7 +2137,7 @@ func (r *repository) SendFollowResponse(ctx context.Context, f FollowRequest, ac
 		response.Type = pub.AcceptType
 	}
 
-	_, _, err := r.fedbox.ToOutbox(ctx, response)
+	_, _, err := r.toOutbox(ctx, response)
 	if err != nil {
 		r.errFn(log.Ctx{
 			"err":      err,
@@ -1987,7 +2172,7 @@ func (r *repository) FollowAccount(ctx context.Context, er, ed Account, reason *
 	follow.BCC = bcc
 	follow.Object = followed.GetLink()
 	follow.Actor = follower.GetLink()
-	_, _, err := r.fedbox.ToOutbox(ctx, follow)
+	_, _, err := r.toOutbox(ctx, follow)
 	if err != nil {
 		r.errFn(log.Ctx{
 			"err":      err,
@@ -2000,6 +2185,17 @@ func (r *repository) FollowAccount(ctx context.Context, er, ed Account, reason *
 }
 
 func (r *repository) SaveAccount(ctx context.Context, a Account) (Account, error) {
+	var key *SSHKey
+	if !a.Deleted() && a.HasMetadata() && len(a.Metadata.ID) == 0 && a.Metadata.Key == nil {
+		// NOTE(marius): the new accounts get a key pair for signing their requests to other servers,
+		// the private key is saved once we know the account's hash
+		var err error
+		if key, err = generateKey(r.keyType); err != nil {
+			r.errFn(log.Ctx{"handle": a.Handle, "err": err})("unable to generate signing key")
+		} else {
+			a.Metadata.Key = &SSHKey{ID: key.ID, Public: key.Public}
+		}
+	}
 	p := r.loadAPPerson(a)
 	id := p.GetLink()
 
@@ -2049,7 +2245,7 @@ func (r *repository) SaveAccount(ctx context.Context, a Account) (Account, error
 
 	var ap pub.Item
 	ltx := log.Ctx{"actor": a.Handle}
-	if _, ap, err = r.fedbox.ToOutbox(ctx, act); err != nil {
+	if _, ap, err = r.toOutbox(ctx, act); err != nil {
 		ltx["parent"] = parent.GetLink()
 		if ap != nil {
 			ltx["activity"] = ap.GetLink()
@@ -2060,6 +2256,11 @@ func (r *repository) SaveAccount(ctx context.Context, a Account) (Account, error
 	if err := a.FromActivityPub(ap); err != nil {
 		r.errFn(ltx, log.Ctx{"err": err})("loading of actor from JSON failed")
 	}
+	if key != nil {
+		if err := r.keys.Save(a, key); err != nil {
+			r.errFn(ltx, log.Ctx{"err": err})("unable to save signing key")
+		}
+	}
 	return a, nil
 }
 
@@ -2134,6 +2335,30 @@ func (r *repository) LoadActorInbox(ctx context.Context, actor pub.Item, f ...*F
 	return &cursor, nil
 }
 
+// isFederatedActivity returns true if the object of the activity didn't originate on the current instance
+func isFederatedActivity(it pub.Item) bool {
+	federated := false
+	pub.OnActivity(it, func(a *pub.Activity) error {
+		federated = a.Object != nil && !HostIsLocal(a.Object.GetLink().String())
+		return nil
+	})
+	return federated
+}
+
+// LoadFederatedInbox loads the items from the service's inbox that originated on other instances.
+// FedBOX doesn't support negating filter values, so we filter out the local items here, loading as many
+// collection pages as needed to fill the listing.
+func (r *repository) LoadFederatedInbox(ctx context.Context, f ...*Filters) (*Cursor, error) {
+	collFn := func(ctx context.Context, f *Filters) (pub.CollectionInterface, error) {
+		return r.fedbox.Inbox(ctx, r.fedbox.Service(), Values(f))
+	}
+	cursor, err := r.actorCollection(ctx, collFn, isFederatedActivity, f...)
+	if err != nil {
+		return nil, err
+	}
+	return &cursor, nil
+}
+
 func (r repository) moderationActivity(ctx context.Context, er *pub.Actor, ed pub.Item, reason *Item) (*pub.Activity, error) {
 	bcc := make(pub.ItemCollection, 0)
 	bcc = append(bcc, r.fedbox.Service().ID, pub.PublicNS)
@@ -2192,7 +2417,7 @@ func (r *repository) BlockAccount(ctx context.Context, er, ed Account, reason *I
 		return err
 	}
 	block.Type = pub.BlockType
-	if _, _, err = r.fedbox.ToOutbox(ctx, block); err != nil {
+	if _, _, err = r.toOutbox(ctx, block); err != nil {
 		r.errFn()(err.Error())
 		return err
 	}
@@ -2206,7 +2431,7 @@ func (r *repository) BlockItem(ctx context.Context, er Account, ed Item, reason
 		return err
 	}
 	block.Type = pub.BlockType
-	if _, _, err = r.fedbox.ToOutbox(ctx, block); err != nil {
+	if _, _, err = r.toOutbox(ctx, block); err != nil {
 		r.errFn()(err.Error())
 		return err
 	}
@@ -2220,7 +2445,7 @@ func (r *repository) ReportItem(ctx context.Context, er Account, it Item, reason
 		return err
 	}
 	flag.Type = pub.FlagType
-	if _, _, err = r.fedbox.ToOutbox(ctx, flag); err != nil {
+	if _, _, err = r.toOutbox(ctx, flag); err != nil {
 		r.errFn()(err.Error())
 		return err
 	}
@@ -2234,7 +2459,7 @@ func (r *repository) ReportAccount(ctx context.Context, er, ed Account, reason *
 		return err
 	}
 	flag.Type = pub.FlagType
-	if _, _, err = r.fedbox.ToOutbox(ctx, flag); err != nil {
+	if _, _, err = r.toOutbox(ctx, flag); err != nil {
 		r.errFn()(err.Error())
 		return err
 	}
@@ -0,0 +1,174 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/mariusor/go-littr/internal/config"
+	"golang.org/x/oauth2"
+)
+
+// mockInbox returns a CollectionFn that pages over activities, three at a time, using their hash as "after"
+// and "before" cursors
+func mockInbox(activities pub.ItemCollection) CollectionFn {
+	const pageSize = 3
+	index := func(hash string) int {
+		for i, it := range activities {
+			if it.GetLink() == pub.IRI(fmt.Sprintf("https://fedbox.littr.example/activities/%s", hash)) {
+				return i
+			}
+		}
+		return -1
+	}
+	return func(ctx context.Context, f *Filters) (pub.CollectionInterface, error) {
+		start, end := 0, 0
+		if len(f.Prev) > 0 && len(f.Next) == 0 {
+			end = index(f.Prev)
+			if start = end - pageSize; start < 0 {
+				start = 0
+			}
+		} else {
+			if len(f.Next) > 0 {
+				start = index(f.Next) + 1
+			}
+			if end = start + pageSize; end > len(activities) {
+				end = len(activities)
+			}
+		}
+		page := &pub.OrderedCollectionPage{
+			Type:         pub.OrderedCollectionPageType,
+			TotalItems:   uint(len(activities)),
+			OrderedItems: activities[start:end],
+		}
+		if start > 0 && start < end {
+			page.Prev = pub.IRI(fmt.Sprintf("https://fedbox.littr.example/inbox?before=%s", activityHash(activities[start])))
+		}
+		if end < len(activities) && start < end {
+			page.Next = pub.IRI(fmt.Sprintf("https://fedbox.littr.example/inbox?after=%s", activityHash(activities[end-1])))
+		}
+		return page, nil
+	}
+}
+
+func activityHash(it pub.Item) string {
+	u, _ := it.GetLink().URL()
+	return u.Path[len("/activities/"):]
+}
+
+func TestLoadAcceptedFromCollection(t *testing.T) {
+	prev := Instance.Conf
+	Instance.Conf = &config.Configuration{HostName: "littr.example", APIURL: "https://fedbox.littr.example"}
+	defer func() { Instance.Conf = prev }()
+
+	activities := make(pub.ItemCollection, 0)
+	for i, host := range []string{"fedbox.littr.example", "mastodon.example", "fedbox.littr.example", "mastodon.example",
+		"fedbox.littr.example", "lemmy.example", "mastodon.example", "lemmy.example", "fedbox.littr.example"} {
+		activities = append(activities, &pub.Activity{
+			ID:     pub.IRI(fmt.Sprintf("https://fedbox.littr.example/activities/%d", i+1)),
+			Type:   pub.CreateType,
+			Object: pub.IRI(fmt.Sprintf("https://%s/objects/%d", host, i+1)),
+		})
+	}
+
+	tests := []struct {
+		name     string
+		after    string
+		before   string
+		maxItems int
+		want     []string
+		next     string
+		prev     string
+	}{
+		{name: "first page", maxItems: 3, want: []string{"2", "4", "6"}, next: "6"},
+		{name: "truncated page", maxItems: 2, want: []string{"2", "4"}, next: "4"},
+		{name: "after truncated page", after: "4", maxItems: 2, want: []string{"6", "7"}, next: "7", prev: "6"},
+		{name: "last page", after: "7", maxItems: 3, want: []string{"8"}, prev: "8"},
+		{name: "before last page", before: "8", maxItems: 2, want: []string{"6", "7"}, next: "7", prev: "6"},
+		{name: "before across pages", before: "7", maxItems: 3, want: []string{"2", "4", "6"}, next: "6", prev: "2"},
+		{name: "before truncated page", before: "6", maxItems: 1, want: []string{"4"}, next: "4", prev: "4"},
+		{name: "before first item", before: "1", maxItems: 3, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &Filters{Next: tt.after, Prev: tt.before, MaxItems: tt.maxItems}
+			got := make([]string, 0)
+			err := loadAcceptedFromCollection(context.Background(), mockInbox(activities), f, isFederatedActivity, func(it pub.Item) {
+				got = append(got, activityHash(it))
+			})
+			if err != nil {
+				t.Fatalf("loadAcceptedFromCollection() error = %s", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("loadAcceptedFromCollection() loaded %v, want %v", got, tt.want)
+			}
+			if f.Next != tt.next {
+				t.Errorf("loadAcceptedFromCollection() next = %q, want %q", f.Next, tt.next)
+			}
+			if (len(tt.after) > 0 || len(tt.before) > 0) && f.Prev != tt.prev {
+				t.Errorf("loadAcceptedFromCollection() prev = %q, want %q", f.Prev, tt.prev)
+			}
+		})
+	}
+}
+
+// TestRepository_WithAccountConcurrent checks that concurrent requests made on behalf of different accounts
+// are each signed with the token of their own account. Run it with "go test -race".
+func TestRepository_WithAccountConcurrent(t *testing.T) {
+	pub.ItemTyperFunc = pub.GetItemByType
+
+	var mismatches int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/activity+json")
+		if r.URL.Path == "/" {
+			fmt.Fprintf(w, `{"id":"http://%s/","type":"Service"}`, r.Host)
+			return
+		}
+		n := strings.TrimPrefix(r.URL.Path, "/actors/")
+		if r.Header.Get("Authorization") != "Bearer tok-"+n {
+			atomic.AddInt32(&mismatches, 1)
+		}
+		fmt.Fprintf(w, `{"id":"http://%s%s","type":"Person","preferredUsername":"user%s"}`, r.Host, r.URL.Path, n)
+	}))
+	defer srv.Close()
+
+	f, err := NewClient(SetURL(srv.URL + "/"))
+	if err != nil {
+		t.Fatalf("NewClient() error = %s", err)
+	}
+	base := &repository{fedbox: f, infoFn: defaultCtxLogFn, errFn: defaultCtxLogFn}
+
+	const requests = 50
+	wg := sync.WaitGroup{}
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			acc := &Account{
+				Handle:    fmt.Sprintf("user%d", i),
+				Hash:      HashFromString(fmt.Sprintf("%08x-2f5f-11eb-9d4b-0242ac130002", i+1)),
+				CreatedAt: time.Now(),
+				Metadata: &AccountMetadata{
+					OAuth: OAuth{Token: &oauth2.Token{AccessToken: fmt.Sprintf("tok-%d", i), TokenType: "Bearer"}},
+				},
+			}
+			repo := base.WithAccount(acc)
+			if _, err := repo.fedbox.Actor(context.TODO(), pub.IRI(fmt.Sprintf("%s/actors/%d", srv.URL, i))); err != nil {
+				t.Errorf("Actor() error = %s", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if mismatches > 0 {
+		t.Errorf("%d of %d requests were signed with the token of another account", mismatches, requests)
+	}
+}
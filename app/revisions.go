@@ -0,0 +1,266 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/go-ap/errors"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+// Revision is a version of an item's content
+type Revision struct {
+	Title     string    `json:"title,omitempty"`
+	Data      string    `json:"data,omitempty"`
+	MimeType  string    `json:"mimeType,omitempty"`
+	UpdatedAt time.Time `json:"updatedAt"`
+	UpdatedBy string    `json:"updatedBy,omitempty"`
+}
+
+// Revisions is the list of versions of an item, oldest first
+type Revisions []Revision
+
+func revisionFromItem(it Item) Revision {
+	rev := Revision{
+		Title:     it.Title,
+		Data:      it.Data,
+		MimeType:  it.MimeType,
+		UpdatedAt: it.SubmittedAt,
+	}
+	if it.SubmittedBy.IsValid() {
+		rev.UpdatedBy = it.SubmittedBy.Handle
+	}
+	if !it.UpdatedAt.IsZero() && it.UpdatedAt.After(it.SubmittedAt) {
+		rev.UpdatedAt = it.UpdatedAt
+		if it.UpdatedBy.IsValid() {
+			rev.UpdatedBy = it.UpdatedBy.Handle
+		}
+	}
+	return rev
+}
+
+// Equals returns true if the two revisions have the same content
+func (r Revision) Equals(o Revision) bool {
+	return r.Title == o.Title && r.Data == o.Data && r.MimeType == o.MimeType
+}
+
+// At returns the revision that was current at time t, or nil if the item didn't exist yet
+func (rs Revisions) At(t time.Time) *Revision {
+	var found *Revision
+	for i, rev := range rs {
+		if rev.UpdatedAt.After(t) {
+			break
+		}
+		found = &rs[i]
+	}
+	return found
+}
+
+// DiffOp is the type of change a DiffLine represents
+type DiffOp string
+
+const (
+	DiffEqual  DiffOp = " "
+	DiffInsert DiffOp = "+"
+	DiffDelete DiffOp = "-"
+)
+
+// DiffLine is a line in the difference between two texts
+type DiffLine struct {
+	Op   DiffOp
+	Text string
+}
+
+// maxDiffCells limits the size of the table diffLines builds for the lines that changed between two texts,
+// above it the changed lines are shown as removed and added, without looking for the ones they have in common
+const maxDiffCells = 1 << 18
+
+// diffLines computes the line by line difference between a and b, using the longest common subsequence
+// of the lines between their common beginning and end
+func diffLines(a, b string) []DiffLine {
+	al := splitLines(a)
+	bl := splitLines(b)
+
+	diff := make([]DiffLine, 0, len(al)+len(bl))
+	pre := 0
+	for pre < len(al) && pre < len(bl) && al[pre] == bl[pre] {
+		diff = append(diff, DiffLine{Op: DiffEqual, Text: al[pre]})
+		pre++
+	}
+	suf := 0
+	for suf < len(al)-pre && suf < len(bl)-pre && al[len(al)-1-suf] == bl[len(bl)-1-suf] {
+		suf++
+	}
+	diff = append(diff, diffChangedLines(al[pre:len(al)-suf], bl[pre:len(bl)-suf])...)
+	for _, l := range al[len(al)-suf:] {
+		diff = append(diff, DiffLine{Op: DiffEqual, Text: l})
+	}
+	return diff
+}
+
+// diffChangedLines computes the difference between al and bl using their longest common subsequence,
+// when its table has at most maxDiffCells
+func diffChangedLines(al, bl []string) []DiffLine {
+	diff := make([]DiffLine, 0, len(al)+len(bl))
+	if (len(al)+1)*(len(bl)+1) > maxDiffCells {
+		for _, l := range al {
+			diff = append(diff, DiffLine{Op: DiffDelete, Text: l})
+		}
+		for _, l := range bl {
+			diff = append(diff, DiffLine{Op: DiffInsert, Text: l})
+		}
+		return diff
+	}
+
+	lcs := make([][]int, len(al)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(bl)+1)
+	}
+	for i := len(al) - 1; i >= 0; i-- {
+		for j := len(bl) - 1; j >= 0; j-- {
+			if al[i] == bl[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	i, j := 0, 0
+	for i < len(al) && j < len(bl) {
+		switch {
+		case al[i] == bl[j]:
+			diff = append(diff, DiffLine{Op: DiffEqual, Text: al[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, DiffLine{Op: DiffDelete, Text: al[i]})
+			i++
+		default:
+			diff = append(diff, DiffLine{Op: DiffInsert, Text: bl[j]})
+			j++
+		}
+	}
+	for ; i < len(al); i++ {
+		diff = append(diff, DiffLine{Op: DiffDelete, Text: al[i]})
+	}
+	for ; j < len(bl); j++ {
+		diff = append(diff, DiffLine{Op: DiffInsert, Text: bl[j]})
+	}
+	return diff
+}
+
+func splitLines(s string) []string {
+	if len(s) == 0 {
+		return nil
+	}
+	return strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+}
+
+// RevisionDiff holds the changes between two consecutive revisions
+type RevisionDiff struct {
+	From    Revision
+	To      Revision
+	Title   []DiffLine
+	Content []DiffLine
+}
+
+// Diffs returns the differences between each revision and the one preceding it, newest first
+func (rs Revisions) Diffs() []RevisionDiff {
+	diffs := make([]RevisionDiff, 0)
+	for i := len(rs) - 1; i > 0; i-- {
+		from, to := rs[i-1], rs[i]
+		d := RevisionDiff{From: from, To: to, Content: diffLines(from.Data, to.Data)}
+		if from.Title != to.Title {
+			d.Title = diffLines(from.Title, to.Title)
+		}
+		diffs = append(diffs, d)
+	}
+	return diffs
+}
+
+// historyVisible returns true if acc can see the edit history of the item. Like on the item page, the deleted items
+// don't show their content and the private ones are shown only to their author and recipients.
+func historyVisible(it Item, acc *Account) bool {
+	if it.Deleted() {
+		return false
+	}
+	if it.Public() {
+		return true
+	}
+	if !acc.IsLogged() {
+		return false
+	}
+	if it.SubmittedBy != nil && it.SubmittedBy.Hash == acc.Hash && acc.Hash != AnonymousHash {
+		return true
+	}
+	if !it.HasMetadata() {
+		return false
+	}
+	for _, rec := range append(append(AccountCollection{}, it.Metadata.To...), it.Metadata.CC...) {
+		if rec.Hash == acc.Hash && acc.Hash != AnonymousHash {
+			return true
+		}
+		if rec.HasMetadata() && acc.HasMetadata() && len(rec.Metadata.ID) > 0 && rec.Metadata.ID == acc.Metadata.ID {
+			return true
+		}
+	}
+	return false
+}
+
+// saveRevision stores the previous version of an item before it gets updated
+func (r *repository) saveRevision(prev Item) error {
+	if r.revisions == nil || !prev.Hash.IsValid() {
+		return nil
+	}
+	revs := make(Revisions, 0)
+	rev := revisionFromItem(prev)
+	return r.revisions.Update(prev.Hash.String(), &revs, func() error {
+		if len(revs) > 0 && revs[len(revs)-1].Equals(rev) {
+			return nil
+		}
+		revs = append(revs, rev)
+		return nil
+	})
+}
+
+// LoadRevisions returns the previous versions of the item, followed by its current version
+func (r *repository) LoadRevisions(ctx context.Context, it Item) (Revisions, error) {
+	revs := make(Revisions, 0)
+	if r.revisions != nil {
+		if err := r.revisions.Load(it.Hash.String(), &revs); err != nil && !errors.IsNotFound(err) {
+			r.errFn(log.Ctx{"err": err, "hash": it.Hash})("unable to load item revisions")
+			return nil, err
+		}
+	}
+	cur := revisionFromItem(it)
+	if len(revs) == 0 || !revs[len(revs)-1].Equals(cur) {
+		revs = append(revs, cur)
+	}
+	return revs, nil
+}
+
+// loadModerationOriginals loads for the items that were edited after being reported
+// the version that was current at the time of the report
+func (r *repository) loadModerationOriginals(ctx context.Context, rl RenderableList) {
+	for _, ren := range rl {
+		g, ok := ren.(*ModerationGroup)
+		if !ok || len(g.Requests) == 0 {
+			continue
+		}
+		it, ok := g.Object.(*Item)
+		if !ok || it.UpdatedAt.IsZero() || !it.UpdatedAt.After(g.Date()) {
+			continue
+		}
+		revs, err := r.LoadRevisions(ctx, *it)
+		if err != nil {
+			continue
+		}
+		if orig := revs.At(g.Date()); orig != nil && !orig.Equals(revisionFromItem(*it)) {
+			g.Original = orig
+		}
+	}
+}
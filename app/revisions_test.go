@@ -0,0 +1,130 @@
+package app
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDiffLines(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want []DiffLine
+	}{
+		{
+			name: "empty",
+			want: []DiffLine{},
+		},
+		{
+			name: "equal",
+			a:    "one\ntwo",
+			b:    "one\ntwo",
+			want: []DiffLine{{DiffEqual, "one"}, {DiffEqual, "two"}},
+		},
+		{
+			name: "insert",
+			a:    "one\nthree",
+			b:    "one\ntwo\nthree",
+			want: []DiffLine{{DiffEqual, "one"}, {DiffInsert, "two"}, {DiffEqual, "three"}},
+		},
+		{
+			name: "delete",
+			a:    "one\ntwo\nthree",
+			b:    "one\nthree",
+			want: []DiffLine{{DiffEqual, "one"}, {DiffDelete, "two"}, {DiffEqual, "three"}},
+		},
+		{
+			name: "replace",
+			a:    "one\ntwo",
+			b:    "one\n2",
+			want: []DiffLine{{DiffEqual, "one"}, {DiffDelete, "two"}, {DiffInsert, "2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := diffLines(tt.a, tt.b); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("diffLines() = %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDiffLines_large(t *testing.T) {
+	a := make([]string, 0, 2000)
+	b := make([]string, 0, 2000)
+	for i := 0; i < 1000; i++ {
+		a = append(a, fmt.Sprintf("a%d", i))
+		b = append(b, fmt.Sprintf("b%d", i))
+	}
+	a = append([]string{"title"}, append(a, "signature")...)
+	b = append([]string{"title"}, append(b, "signature")...)
+
+	diff := diffLines(strings.Join(a, "\n"), strings.Join(b, "\n"))
+	if len(diff) != 2002 {
+		t.Fatalf("diffLines() returned %d lines, expected %d", len(diff), 2002)
+	}
+	if diff[0].Op != DiffEqual || diff[len(diff)-1].Op != DiffEqual {
+		t.Errorf("diffLines() didn't keep the common lines, %v %v", diff[0], diff[len(diff)-1])
+	}
+	if diff[1] != (DiffLine{DiffDelete, "a0"}) || diff[1001] != (DiffLine{DiffInsert, "b0"}) {
+		t.Errorf("diffLines() expected the changed lines to be replaced, %v %v", diff[1], diff[1001])
+	}
+}
+
+func TestRevisions_At(t *testing.T) {
+	now := time.Now()
+	revs := Revisions{
+		{Data: "first", UpdatedAt: now.Add(-3 * time.Hour)},
+		{Data: "second", UpdatedAt: now.Add(-2 * time.Hour)},
+		{Data: "third", UpdatedAt: now.Add(-time.Hour)},
+	}
+	if rev := revs.At(now.Add(-4 * time.Hour)); rev != nil {
+		t.Errorf("At() = %q, expected nil before the first revision", rev.Data)
+	}
+	if rev := revs.At(now.Add(-90 * time.Minute)); rev == nil || rev.Data != "second" {
+		t.Errorf("At() = %v, expected the second revision", rev)
+	}
+	if rev := revs.At(now); rev == nil || rev.Data != "third" {
+		t.Errorf("At() = %v, expected the last revision", rev)
+	}
+	if diffs := revs.Diffs(); len(diffs) != 2 || diffs[0].To.Data != "third" {
+		t.Errorf("Diffs() = %v, expected two diffs, newest first", diffs)
+	}
+}
+
+func TestHistoryVisible(t *testing.T) {
+	author := Account{Handle: "author", Hash: HashFromString("5cf1e2d0-0d2b-11eb-adc1-0242ac120002"), Metadata: &AccountMetadata{ID: "https://example.com/actors/author"}}
+	recipient := Account{Handle: "recipient", Hash: HashFromString("6a7b8c9d-0d2b-11eb-adc1-0242ac120002"), Metadata: &AccountMetadata{ID: "https://example.com/actors/recipient"}}
+	other := Account{Handle: "other", Hash: HashFromString("7b8c9d0e-0d2b-11eb-adc1-0242ac120002"), Metadata: &AccountMetadata{ID: "https://example.com/actors/other"}}
+	anonymous := AnonymousAccount
+
+	public := Item{SubmittedBy: &author, Metadata: &ItemMetadata{}}
+	private := Item{SubmittedBy: &author, Metadata: &ItemMetadata{To: AccountCollection{{Metadata: &AccountMetadata{ID: recipient.Metadata.ID}}}}}
+	private.MakePrivate()
+	deleted := Item{SubmittedBy: &author, Metadata: &ItemMetadata{}}
+	deleted.Delete()
+
+	tests := []struct {
+		name string
+		item Item
+		acc  *Account
+		want bool
+	}{
+		{"public-anonymous", public, &anonymous, true},
+		{"private-anonymous", private, &anonymous, false},
+		{"private-author", private, &author, true},
+		{"private-recipient", private, &recipient, true},
+		{"private-other", private, &other, false},
+		{"deleted-author", deleted, &author, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := historyVisible(tt.item, tt.acc); got != tt.want {
+				t.Errorf("historyVisible() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -11,22 +11,31 @@ import (
 	"path/filepath"
 )
 
-func (h *handler) ItemRoutes () func(chi.Router) {
+func (h *handler) ItemRoutes() func(chi.Router) {
 	return func(r chi.Router) {
-		r.Use(h.CSRF, ContentModelMw, h.ItemFiltersMw, LoadObjectFromInboxMw, ThreadedListingMw, SortByScore)
-		r.Get("/", h.HandleShow)
-		r.With(h.ValidateLoggedIn(h.v.RedirectToErrors)).Post("/", h.HandleSubmit)
+		r.Use(h.ActivityPubItemMw, ContentModelMw, h.ItemFiltersMw, LoadObjectFromInboxMw, h.ThreadStateMw, ThreadedListingMw, SortByScore)
+		r.With(h.CSRF).Get("/", h.HandleShow)
+		r.With(h.CSRF).Get("/history", h.HandleItemHistory)
+		// NOTE(marius): the access token scopes need to come before the CSRF check, as they skip it
+		r.With(h.AccessTokenScope(scopeSubmit), h.CSRF, h.ValidateLoggedIn(h.v.RedirectToErrors), h.ValidateEmailVerified).Post("/", h.HandleSubmit)
 
-		r.Group(func(r chi.Router) {
-			r.Use(h.ValidateLoggedIn(h.v.RedirectToErrors))
+		r.With(h.AccessTokenScope(scopeVote), h.CSRF, h.ValidateLoggedIn(h.v.RedirectToErrors), h.ValidateEmailVerified).Group(func(r chi.Router) {
 			r.Get("/yay", h.HandleVoting)
 			r.Get("/nay", h.HandleVoting)
+		})
+		r.With(h.AccessTokenScope(scopeReport), h.CSRF, h.ValidateLoggedIn(h.v.RedirectToErrors), h.ValidateEmailVerified).Post("/bad", h.ReportItem)
+
+		r.Group(func(r chi.Router) {
+			r.Use(h.CSRF, h.ValidateLoggedIn(h.v.RedirectToErrors))
+			r.Post("/lock", h.HandleThreadState)
+			r.Post("/unlock", h.HandleThreadState)
+			r.Post("/sticky", h.HandleThreadState)
+			r.Post("/unsticky", h.HandleThreadState)
 
 			//r.Get("/bad", h.ShowReport)
 			r.With(ReportContentModelMw).Get("/bad", h.HandleShow)
-			r.Post("/bad", h.ReportItem)
 			r.With(BlockContentModelMw).Get("/block", h.HandleShow)
-			r.Post("/block", h.BlockItem)
+			r.With(h.ValidateEmailVerified).Post("/block", h.BlockItem)
 
 			r.Group(func(r chi.Router) {
 				r.With(h.ValidateItemAuthor("edit"), EditContentModelMw).Get("/edit", h.HandleShow)
@@ -44,96 +53,181 @@ func (h *handler) Routes(c *config.Configuration) func(chi.Router) {
 		workDir, _ := os.Getwd()
 		assetsDir := filepath.Join(workDir, "assets")
 		h.v.assets = assets.AssetFiles{
-			"moderate.css":     []string{"main.css", "listing.css", "article.css", "moderate.css", "user.css"},
-			"content.css":      []string{"main.css", "article.css", "content.css"},
-			"listing.css":      []string{"main.css", "listing.css", "article.css", "moderate.css"},
-			"moderation.css":   []string{"main.css", "listing.css", "article.css", "moderation.css"},
-			"user.css":         []string{"main.css", "listing.css", "article.css", "user.css"},
-			"user-message.css": []string{"main.css", "listing.css", "article.css", "user-message.css"},
-			"new.css":          []string{"main.css", "listing.css", "article.css"},
-			"404.css":          []string{"main.css", "error.css"},
-			"about.css":        []string{"main.css", "about.css"},
-			"error.css":        []string{"main.css", "error.css"},
-			"login.css":        []string{"main.css", "login.css"},
-			"register.css":     []string{"main.css", "login.css"},
-			"inline.css":       []string{"inline.css"},
-			"main.js":          []string{"base.js", "main.js"},
+			"moderate.css":      []string{"main.css", "listing.css", "article.css", "moderate.css", "user.css"},
+			"content.css":       []string{"main.css", "article.css", "content.css"},
+			"listing.css":       []string{"main.css", "listing.css", "article.css", "moderate.css"},
+			"moderation.css":    []string{"main.css", "listing.css", "article.css", "moderation.css"},
+			"transparency.css":  []string{"main.css", "transparency.css"},
+			"deliveries.css":    []string{"main.css", "deliveries.css"},
+			"registrations.css": []string{"main.css", "registrations.css"},
+			"held.css":          []string{"main.css", "held.css"},
+			"user.css":          []string{"main.css", "listing.css", "article.css", "user.css"},
+			"community.css":     []string{"main.css", "listing.css", "article.css", "community.css"},
+			"communities.css":   []string{"main.css", "listing.css", "article.css", "community.css"},
+			"user-message.css":  []string{"main.css", "listing.css", "article.css", "user-message.css"},
+			"new.css":           []string{"main.css", "listing.css", "article.css"},
+			"404.css":           []string{"main.css", "error.css"},
+			"about.css":         []string{"main.css", "about.css"},
+			"history.css":       []string{"main.css", "article.css", "history.css"},
+			"error.css":         []string{"main.css", "error.css"},
+			"login.css":         []string{"main.css", "login.css"},
+			"register.css":      []string{"main.css", "login.css"},
+			"settings.css":      []string{"main.css", "settings.css"},
+			"two-factor.css":    []string{"main.css", "login.css"},
+			"ssh-login.css":     []string{"main.css", "login.css"},
+			"interaction.css":   []string{"main.css", "login.css"},
+			"sessions.css":      []string{"main.css", "settings.css", "sessions.css"},
+			"inline.css":        []string{"inline.css"},
+			"main.js":           []string{"base.js", "main.js"},
 		}
 
 		r.Group(func(r chi.Router) {
 			//r.Use(middleware.Timeout(60 * time.Millisecond))
 			r.Use(h.SetSecurityHeaders)
 			r.Use(h.LoadSession)
+			r.Use(h.LoadAccessToken)
 			r.Use(h.OutOfOrderMw)
 
+			r.With(h.AccessTokenScope(scopeSubmit), h.CSRF, h.ValidateEmailVerified).Post("/submit", h.HandleSubmit)
 			r.With(h.CSRF).Group(func(r chi.Router) {
 				r.With(AddModelMw).Get("/submit", h.HandleShow)
-				r.Post("/submit", h.HandleSubmit)
 				r.With(c.CheckUserCreatingEnabled).Route("/register", func(r chi.Router) {
 					r.Group(func(r chi.Router) {
-						r.With(ModelMw(&registerModel{Title: "Register new account"})).Get("/", h.HandleShow)
-						r.With(ModelMw(&registerModel{Title: "Register account from invite"}), LoadInvitedMw).Get("/{hash}", h.HandleShow)
+						r.With(ModelMw(&registerModel{Title: "Register new account"}), h.RegistrationModelMw).Get("/", h.HandleShow)
+						r.With(ModelMw(&registerModel{Title: "Register account from invite"}), h.RegistrationModelMw, LoadInvitedMw).Get("/{hash}", h.HandleShow)
 					})
 					r.Post("/", h.HandleRegister)
 				})
 				r.With(h.NeedsSessions).Group(func(r chi.Router) {
 					r.With(ModelMw(&loginModel{Title: "Local authentication"})).Get("/login", h.HandleShow)
 					r.Post("/login", h.HandleLogin)
+					r.With(ModelMw(&twoFactorModel{Title: "Two-factor authentication"})).Get("/login/2fa", h.HandleShow)
+					r.Post("/login/2fa", h.HandleTwoFactorLogin)
+					r.Get("/login/ssh", h.HandleShowSSHLogin)
+					r.Post("/login/ssh", h.HandleSSHChallenge)
+					r.Post("/login/ssh/verify", h.HandleSSHLogin)
 				})
 			})
 
 			r.With(h.LoadAuthorMw).Route("/~{handle}", func(r chi.Router) {
-				r.With(AccountListingModelMw, AccountFiltersMw, LoadOutboxMw).Get("/", h.HandleShow)
+				r.With(h.ActivityPubActorMw, h.CSRF, AccountListingModelMw, AccountFiltersMw, LoadOutboxMw).Get("/", h.HandleShow)
+				r.With(h.CSRF).Post("/remote-follow", h.HandleRemoteFollow)
+				if c.InboxEnabled {
+					r.Post("/inbox", h.HandleInbox)
+				}
 
-				r.Group(func(r chi.Router) {
-					r.Use(h.ValidateLoggedIn(h.v.RedirectToErrors))
+				r.With(h.AccessTokenScope(scopeFollow), h.ValidateLoggedIn(h.v.RedirectToErrors), h.ValidateEmailVerified).Group(func(r chi.Router) {
 					r.Get("/follow", h.FollowAccount)
 					r.Get("/follow/{action}", h.HandleFollowRequest)
+				})
+				r.With(h.AccessTokenScope(scopeSubmit), h.ValidateLoggedIn(h.v.RedirectToErrors), h.ValidateEmailVerified, h.CSRF, MessageUserContentModelMw, MessageFiltersMw, LoadOutboxMw).
+					Post("/message", h.HandleSubmit)
+				r.With(h.AccessTokenScope(scopeReport), h.ValidateLoggedIn(h.v.RedirectToErrors), h.ValidateEmailVerified, h.CSRF, MessageUserContentModelMw, AccountFiltersMw, LoadOutboxMw).
+					Post("/bad", h.ReportAccount)
 
-					r.With(h.CSRF, MessageUserContentModelMw, MessageFiltersMw, LoadOutboxMw).Route("/message", func(r chi.Router) {
-						r.Get("/", h.HandleShow)
-						r.Post("/", h.HandleSubmit)
-					})
+				r.Group(func(r chi.Router) {
+					r.Use(h.ValidateLoggedIn(h.v.RedirectToErrors))
+					r.With(h.CSRF, MessageUserContentModelMw, MessageFiltersMw, LoadOutboxMw).Get("/message", h.HandleShow)
 
 					r.With(h.CSRF, MessageUserContentModelMw, AccountFiltersMw, LoadOutboxMw).Group(func(r chi.Router) {
 						r.With(BlockAccountModelMw).Get("/block", h.HandleShow)
-						r.Post("/block", h.BlockAccount)
+						r.With(h.ValidateEmailVerified).Post("/block", h.BlockAccount)
 						r.With(ReportAccountModelMw).Get("/bad", h.HandleShow)
-						r.Post("/bad", h.ReportAccount)
 					})
 				})
 
 				r.Route("/{hash}", h.ItemRoutes())
 			})
+			r.With(h.CSRF, h.ValidateLoggedIn(h.v.RedirectToErrors), h.ValidateEmailVerified).Post("/c", h.HandleCreateCommunity)
+			r.With(h.LoadCommunityMw).Route("/c/{name}", func(r chi.Router) {
+				r.With(h.ActivityPubActorMw, h.CSRF, CommunityListingModelMw, CommunityFiltersMw, LoadCommunityInboxMw, h.ThreadStateMw, SortByScore).
+					Get("/", h.HandleShow)
+				if c.InboxEnabled {
+					r.Post("/inbox", h.HandleInbox)
+				}
+
+				r.With(h.AccessTokenScope(scopeFollow), h.ValidateLoggedIn(h.v.RedirectToErrors), h.ValidateEmailVerified).Get("/follow", h.FollowAccount)
+				r.With(h.AccessTokenScope(scopeSubmit), h.ValidateLoggedIn(h.v.RedirectToErrors), h.ValidateEmailVerified, h.CSRF).Post("/submit", h.HandleSubmit)
+
+				r.Group(func(r chi.Router) {
+					r.Use(h.ValidateLoggedIn(h.v.RedirectToErrors))
+
+					r.With(h.CSRF).Group(func(r chi.Router) {
+						r.With(AddModelMw, CommunityContentModelMw).Get("/submit", h.HandleShow)
+						r.Post("/settings", h.HandleCommunitySettings)
+						r.Post("/rm", h.HandleCommunityRemove)
+					})
+				})
+			})
 			r.Route("/{year:[0-9]{4}}/{month:[0-9]{2}}/{day:[0-9]{2}}/{hash}", h.ItemRoutes())
 
 			// @todo(marius) :link_generation:
 			r.Get("/i/{hash}", h.HandleItemRedirect)
+			r.With(h.ValidateLoggedIn(h.v.RedirectToErrors), h.CSRF).Group(func(r chi.Router) {
+				r.Get("/authorize_interaction", h.HandleAuthorizeInteraction)
+				r.With(h.ValidateEmailVerified).Post("/authorize_interaction", h.HandleAuthorizeInteractionFollow)
+			})
+			if c.InboxEnabled {
+				r.Post("/inbox", h.HandleInbox)
+			}
 
 			r.With(h.NeedsSessions).Get("/logout", h.HandleLogout)
-			r.With(h.NeedsSessions, h.ValidateLoggedIn(h.v.RedirectToErrors)).Post("/invite", h.HandleSendInvite)
+			r.Get("/verify-email/{hash}/{token}", h.HandleVerifyEmail)
+			r.With(h.NeedsSessions, h.ValidateLoggedIn(h.v.RedirectToErrors), h.ValidateEmailVerified).Post("/invite", h.HandleSendInvite)
 
-			r.With(ListingModelMw).Group(func(r chi.Router) {
+			// NOTE(marius): the listings need the CSRF token for the lock and sticky forms of the items
+			r.With(h.CSRF, ListingModelMw).Group(func(r chi.Router) {
 				// @todo(marius) :link_generation:
-				r.With(DefaultFilters, LoadServiceInboxMw, SortByScore).Get("/", h.HandleShow)
+				r.With(DefaultFilters, LoadServiceInboxMw, h.StickyItemsMw, h.ThreadStateMw, SortByScore).Get("/", h.HandleShow)
 				r.With(DomainFiltersMw, LoadServiceInboxMw, middleware.StripSlashes, SortByDate).Get("/d", h.HandleShow)
 				r.With(DomainFiltersMw, LoadServiceInboxMw, SortByDate).Get("/d/{domain}", h.HandleShow)
 				r.With(TagFiltersMw, LoadServiceInboxMw, ModerationListing, SortByDate).Get("/t/{tag}", h.HandleShow)
 				r.With(SelfFiltersMw(h.storage.fedbox.Service().ID), LoadServiceInboxMw, SortByScore).Get("/self", h.HandleShow)
-				r.With(FederatedFiltersMw(h.storage.fedbox.Service().ID), LoadServiceInboxMw, SortByScore).Get("/federated", h.HandleShow)
+				r.With(FederatedFiltersMw, LoadFederatedInboxMw, SortByScore).Get("/federated", h.HandleShow)
 				r.With(h.NeedsSessions, FollowedFiltersMw, h.ValidateLoggedIn(h.v.RedirectToErrors), LoadInboxMw, SortByDate).
 					Get("/followed", h.HandleShow)
 				r.With(ModelMw(&listingModel{tpl: "moderation", sortFn: ByDate}), ModerationFiltersMw, LoadServiceInboxMw, ModerationListing).
 					Get("/moderation", h.HandleShow)
 				r.With(ModelMw(&listingModel{tpl: "listing", sortFn: ByDate}), ActorsFiltersMw, LoadServiceInboxMw, ThreadedListingMw).
 					Get("/~", h.HandleShow)
+				r.With(CommunitiesFiltersMw, LoadServiceInboxMw).Get("/c", h.HandleShow)
 			})
 
 			r.Get("/about", h.HandleAbout)
+			r.Get("/moderation/report", h.HandleModerationReport)
+			r.With(h.ValidateModerator).Route("/admin/deliveries", func(r chi.Router) {
+				r.With(h.CSRF).Get("/", h.HandleDeliveries)
+				r.With(h.CSRF).Post("/{hash}/retry", h.HandleDeliveryRetry)
+			})
+			r.With(h.ValidateModerator, h.CSRF).Route("/admin/registrations", func(r chi.Router) {
+				r.Get("/", h.HandleRegistrations)
+				r.Post("/{hash}/{action}", h.HandleRegistrationDecision)
+			})
+			r.With(h.ValidateModerator, h.CSRF).Route("/admin/held", func(r chi.Router) {
+				r.Get("/", h.HandleHeldItems)
+				r.Post("/{hash}/{action}", h.HandleHeldItemDecision)
+			})
 			r.Route("/auth", func(r chi.Router) {
 				r.Use(h.NeedsSessions)
+				r.Get("/{provider}", h.HandleAuthProvider)
 				r.Get("/{provider}/callback", h.HandleCallback)
 			})
+			r.With(h.NeedsSessions, h.ValidateLoggedIn(h.v.RedirectToErrors), h.CSRF).Route("/settings", func(r chi.Router) {
+				r.Get("/", h.HandleSettings)
+				r.Post("/identities/{provider}/{id}/rm", h.HandleUnlinkIdentity)
+				r.Post("/2fa/enroll", h.HandleTwoFactorEnroll)
+				r.Post("/2fa/confirm", h.HandleTwoFactorConfirm)
+				r.Post("/2fa/disable", h.HandleTwoFactorDisable)
+				r.Post("/tokens", h.HandleCreateAccessToken)
+				r.Post("/tokens/{id}/rm", h.HandleRevokeAccessToken)
+				r.Post("/key", h.HandleRotateKey)
+				r.Post("/ssh-keys", h.HandleAddSSHKey)
+				r.Post("/ssh-keys/{id}/rm", h.HandleRemoveSSHKey)
+				r.Post("/verify-email", h.HandleResendVerification)
+				r.Get("/sessions", h.HandleSessions)
+				r.Post("/sessions/rm", h.HandleRevokeAllSessions)
+				r.Post("/sessions/{id}/rm", h.HandleRevokeSession)
+			})
 
 			r.NotFound(func(w http.ResponseWriter, r *http.Request) {
 				h.v.HandleErrors(w, r, errors.NotFoundf("%q", r.RequestURI))
@@ -143,6 +237,8 @@ func (h *handler) Routes(c *config.Configuration) func(chi.Router) {
 			})
 		})
 
+		r.Route("/api/v1", h.MastodonRoutes())
+
 		r.Group(func(r chi.Router) {
 			r.Get("/ns", assets.ServeStatic(filepath.Join(assetsDir, "/ns.json")))
 			r.Get("/favicon.ico", assets.ServeStatic(filepath.Join(assetsDir, "/favicon.ico")))
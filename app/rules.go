@@ -0,0 +1,188 @@
+package app
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-ap/errors"
+)
+
+// RuleAction represents what happens to a submission matching a ContentRule
+type RuleAction string
+
+const (
+	// RuleActionFlag saves the submission and reports it to the moderators
+	RuleActionFlag RuleAction = "flag"
+	// RuleActionHold saves the submission privately until a moderator reviews it
+	RuleActionHold RuleAction = "hold"
+	// RuleActionReject refuses to save the submission
+	RuleActionReject RuleAction = "reject"
+)
+
+var ruleActionSeverity = map[RuleAction]int{
+	RuleActionFlag:   1,
+	RuleActionHold:   2,
+	RuleActionReject: 3,
+}
+
+// ContentRule is an admin defined rule that gets evaluated against new submissions.
+// All the conditions that are set on a rule need to match for the rule to apply.
+type ContentRule struct {
+	Name        string     `json:"name"`
+	Title       string     `json:"title,omitempty"`
+	Content     string     `json:"content,omitempty"`
+	Domains     []string   `json:"domains,omitempty"`
+	NewAccount  string     `json:"newAccountWithLink,omitempty"`
+	MaxMentions int        `json:"maxMentions,omitempty"`
+	Action      RuleAction `json:"action"`
+
+	title      *regexp.Regexp
+	content    *regexp.Regexp
+	newAccount time.Duration
+}
+
+// ContentRules is the set of rules that new submissions are checked against, the instance wide ones loaded from
+// the MODERATION_RULES file, to which the rules of the community the item is submitted to get appended
+type ContentRules []ContentRule
+
+var linkRegexp = regexp.MustCompile(`https?://[^\s<>"')\]]+`)
+
+// LoadContentRules reads the rule set from the JSON file at path
+func LoadContentRules(path string) (ContentRules, error) {
+	if len(path) == 0 {
+		return nil, nil
+	}
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to read content rules file %s", path)
+	}
+	rules := make(ContentRules, 0)
+	if err := json.Unmarshal(dat, &rules); err != nil {
+		return nil, errors.Annotatef(err, "unable to parse content rules file %s", path)
+	}
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return nil, err
+		}
+	}
+	return rules, nil
+}
+
+func (r *ContentRule) compile() error {
+	var err error
+	if _, ok := ruleActionSeverity[r.Action]; !ok {
+		return errors.NotValidf("invalid action %q for rule %q", r.Action, r.Name)
+	}
+	if len(r.Title) > 0 {
+		if r.title, err = regexp.Compile(r.Title); err != nil {
+			return errors.Annotatef(err, "invalid title expression for rule %q", r.Name)
+		}
+	}
+	if len(r.Content) > 0 {
+		if r.content, err = regexp.Compile(r.Content); err != nil {
+			return errors.Annotatef(err, "invalid content expression for rule %q", r.Name)
+		}
+	}
+	if len(r.NewAccount) > 0 {
+		if r.newAccount, err = time.ParseDuration(r.NewAccount); err != nil {
+			return errors.Annotatef(err, "invalid account age for rule %q", r.Name)
+		}
+	}
+	for i, d := range r.Domains {
+		r.Domains[i] = strings.ToLower(strings.TrimPrefix(d, "."))
+	}
+	return nil
+}
+
+// IsValid returns true if the rule has at least one condition set
+func (r ContentRule) IsValid() bool {
+	return r.title != nil || r.content != nil || len(r.Domains) > 0 || r.newAccount > 0 || r.MaxMentions > 0
+}
+
+// Reason returns the human readable explanation for the rule matching
+func (r ContentRule) Reason() string {
+	name := r.Name
+	if len(name) == 0 {
+		name = "unnamed"
+	}
+	return fmt.Sprintf("matched content rule %q", name)
+}
+
+func itemLinkHosts(it Item) []string {
+	links := linkRegexp.FindAllString(it.Data, -1)
+	if it.IsLink() {
+		links = append(links, it.Data)
+	}
+	hosts := make([]string, 0)
+	for _, l := range links {
+		u, err := url.Parse(l)
+		if err != nil || len(u.Host) == 0 {
+			continue
+		}
+		hosts = append(hosts, strings.ToLower(u.Hostname()))
+	}
+	return hosts
+}
+
+func domainMatches(host, domain string) bool {
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// Matches verifies if the item submitted by author matches all the conditions of the rule
+func (r ContentRule) Matches(it Item, author Account) bool {
+	if !r.IsValid() {
+		return false
+	}
+	if r.title != nil && !r.title.MatchString(it.Title) {
+		return false
+	}
+	if r.content != nil && !r.content.MatchString(it.Data) {
+		return false
+	}
+	if len(r.Domains) > 0 || r.newAccount > 0 {
+		hosts := itemLinkHosts(it)
+		if r.newAccount > 0 {
+			if len(hosts) == 0 || author.CreatedAt.IsZero() || time.Now().UTC().Sub(author.CreatedAt) > r.newAccount {
+				return false
+			}
+		}
+		if len(r.Domains) > 0 {
+			found := false
+			for _, h := range hosts {
+				for _, d := range r.Domains {
+					if domainMatches(h, d) {
+						found = true
+					}
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	if r.MaxMentions > 0 {
+		if !it.HasMetadata() || len(it.Metadata.Mentions) <= r.MaxMentions {
+			return false
+		}
+	}
+	return true
+}
+
+// Match returns the matching rule with the most severe action, or nil if none match
+func (c ContentRules) Match(it Item, author Account) *ContentRule {
+	var match *ContentRule
+	for i, r := range c {
+		if !r.Matches(it, author) {
+			continue
+		}
+		if match == nil || ruleActionSeverity[r.Action] > ruleActionSeverity[match.Action] {
+			match = &c[i]
+		}
+	}
+	return match
+}
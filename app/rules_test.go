@@ -0,0 +1,109 @@
+package app
+
+import (
+	"testing"
+	"time"
+)
+
+func mustCompileRules(t *testing.T, rules ...ContentRule) ContentRules {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			t.Fatalf("unable to compile rule %q: %s", rules[i].Name, err)
+		}
+	}
+	return rules
+}
+
+func TestContentRules_Match(t *testing.T) {
+	old := Account{Handle: "old", CreatedAt: time.Now().Add(-365 * 24 * time.Hour)}
+	fresh := Account{Handle: "fresh", CreatedAt: time.Now().Add(-time.Hour)}
+
+	rules := mustCompileRules(t,
+		ContentRule{Name: "spam-title", Title: `(?i)cheap pills`, Action: RuleActionReject},
+		ContentRule{Name: "bad-domain", Domains: []string{"example.com"}, Action: RuleActionHold},
+		ContentRule{Name: "new-with-link", NewAccount: "24h", Action: RuleActionFlag},
+		ContentRule{Name: "mentions", MaxMentions: 2, Action: RuleActionFlag},
+	)
+
+	tests := []struct {
+		name   string
+		item   Item
+		author Account
+		want   string
+	}{
+		{
+			name:   "no-match",
+			item:   Item{Title: "Hello", Data: "world", Metadata: &ItemMetadata{}},
+			author: old,
+			want:   "",
+		},
+		{
+			name:   "title",
+			item:   Item{Title: "Buy CHEAP pills", Data: "https://example.com", MimeType: MimeTypeURL, Metadata: &ItemMetadata{}},
+			author: fresh,
+			want:   "spam-title",
+		},
+		{
+			name:   "subdomain",
+			item:   Item{Data: "look at https://www.example.com/page", MimeType: MimeTypeText, Metadata: &ItemMetadata{}},
+			author: old,
+			want:   "bad-domain",
+		},
+		{
+			name:   "similar-domain",
+			item:   Item{Data: "look at https://notexample.com/page", MimeType: MimeTypeText, Metadata: &ItemMetadata{}},
+			author: old,
+			want:   "",
+		},
+		{
+			name:   "new-account-with-link",
+			item:   Item{Data: "https://brutalinks.tech", MimeType: MimeTypeURL, Metadata: &ItemMetadata{}},
+			author: fresh,
+			want:   "new-with-link",
+		},
+		{
+			name:   "new-account-without-link",
+			item:   Item{Data: "just text", MimeType: MimeTypeText, Metadata: &ItemMetadata{}},
+			author: fresh,
+			want:   "",
+		},
+		{
+			name: "too-many-mentions",
+			item: Item{Data: "~a ~b ~c", MimeType: MimeTypeText, Metadata: &ItemMetadata{
+				Mentions: TagCollection{{Name: "a"}, {Name: "b"}, {Name: "c"}},
+			}},
+			author: old,
+			want:   "mentions",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := rules.Match(tt.item, tt.author)
+			if len(tt.want) == 0 {
+				if got != nil {
+					t.Errorf("Match() = %q, expected no match", got.Name)
+				}
+				return
+			}
+			if got == nil {
+				t.Fatalf("Match() = nil, expected %q", tt.want)
+			}
+			if got.Name != tt.want {
+				t.Errorf("Match() = %q, expected %q", got.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentRule_compile(t *testing.T) {
+	invalid := []ContentRule{
+		{Name: "no-action", Title: "test"},
+		{Name: "bad-regexp", Title: "(", Action: RuleActionFlag},
+		{Name: "bad-duration", NewAccount: "soon", Action: RuleActionFlag},
+	}
+	for _, r := range invalid {
+		if err := r.compile(); err == nil {
+			t.Errorf("rule %q should have failed compiling", r.Name)
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package app
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-ap/errors"
+	"github.com/go-chi/chi"
+	"github.com/gorilla/sessions"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+const (
+	sessionIDKey = "__session_id"
+
+	// sessionSeenInterval is how often we update the last time we've seen a session, so we don't write to the
+	// index on every request
+	sessionSeenInterval = time.Minute
+)
+
+// sessionInfo is the entry of a logged in session in the session index
+type sessionInfo struct {
+	ID        string
+	Actor     string
+	Handle    string
+	Created   time.Time
+	LastSeen  time.Time
+	UserAgent string
+	IP        string
+}
+
+// sessionIndex keeps the logged in sessions on the server side, independent of the sessions backend, so users can
+// see their active sessions and end them. Sessions that are missing from the index are not valid anymore.
+type sessionIndex struct {
+	*fileStore
+}
+
+func (s sessionIndex) Load(id string) (sessionInfo, error) {
+	i := sessionInfo{}
+	if s.fileStore == nil || len(id) == 0 {
+		return i, errors.NotFoundf("session %q", id)
+	}
+	err := s.fileStore.Load(id, &i)
+	return i, err
+}
+
+// ForAccount returns the sessions of the account with the actor IRI, the most recently seen first.
+// Only the entries with the account's prefix get loaded, see newSessionID.
+func (s sessionIndex) ForAccount(actor string) ([]sessionInfo, error) {
+	if s.fileStore == nil {
+		return nil, nil
+	}
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	prefix := sessionAccountPrefix(actor)
+	infos := make([]sessionInfo, 0)
+	for _, k := range keys {
+		// NOTE(marius): the sessions started before we prefixed their IDs need to be loaded to find their account
+		if !strings.HasPrefix(k, prefix) && strings.Contains(k, "-") {
+			continue
+		}
+		i := sessionInfo{}
+		if err := s.fileStore.Load(k, &i); err != nil || i.Actor != actor {
+			continue
+		}
+		infos = append(infos, i)
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].LastSeen.After(infos[j].LastSeen)
+	})
+	return infos, nil
+}
+
+// RevokeAll removes all the sessions of the account with the actor IRI from the index
+func (s sessionIndex) RevokeAll(actor string) (int, error) {
+	infos, err := s.ForAccount(actor)
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, i := range infos {
+		if err := s.Delete(i.ID); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// Prune removes the sessions that haven't been seen since before, as their cookies have expired, and returns
+// how many there were
+func (s sessionIndex) Prune(before time.Time) (int, error) {
+	if s.fileStore == nil {
+		return 0, nil
+	}
+	keys, err := s.Keys()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, k := range keys {
+		i := sessionInfo{}
+		if err := s.fileStore.Load(k, &i); err == nil && i.LastSeen.After(before) {
+			continue
+		}
+		if err := s.Delete(k); err != nil {
+			return count, err
+		}
+		count++
+	}
+	return count, nil
+}
+
+// ipIsTrusted returns true if ip is one of the trusted addresses, or part of one of the trusted networks
+func ipIsTrusted(ip string, trusted []string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+	for _, t := range trusted {
+		if _, n, err := net.ParseCIDR(t); err == nil {
+			if n.Contains(addr) {
+				return true
+			}
+		} else if tip := net.ParseIP(t); tip != nil && tip.Equal(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// requestIP returns the address of the client. The addresses reported by the X-Real-IP and X-Forwarded-For headers
+// are used only when the request comes from one of the trusted proxies, as anyone else can set them.
+func requestIP(r *http.Request, trustedProxies []string) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if !ipIsTrusted(host, trustedProxies) {
+		return host
+	}
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); len(ip) > 0 {
+		return ip
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); len(fwd) > 0 {
+		// NOTE(marius): every proxy appends the address it received the request from, so the client is
+		// the last one that isn't a trusted proxy
+		hops := strings.Split(fwd, ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if i == 0 || !ipIsTrusted(hop, trustedProxies) {
+				return hop
+			}
+		}
+	}
+	return host
+}
+
+// sessionAccountPrefix returns the prefix of the index IDs of the sessions of the account with the actor IRI
+func sessionAccountPrefix(actor string) string {
+	sum := sha256.Sum256([]byte(actor))
+	return hex.EncodeToString(sum[:8]) + "-"
+}
+
+// newSessionID returns a new index ID for a session of the account with the actor IRI, prefixed by the hash of
+// the IRI, so we can find the sessions of an account without loading the others
+func newSessionID(actor string) string {
+	return sessionAccountPrefix(actor) + randomState()
+}
+
+// startSession saves the logged in account to the session and adds the session to the index
+func (h *handler) startSession(s *sessions.Session, r *http.Request, acct Account) {
+	s.Values[SessionUserKey] = acct
+	if h.sessions.fileStore == nil || !acct.HasMetadata() {
+		return
+	}
+	now := time.Now().UTC()
+	i := sessionInfo{
+		ID:        newSessionID(acct.Metadata.ID),
+		Actor:     acct.Metadata.ID,
+		Handle:    acct.Handle,
+		Created:   now,
+		LastSeen:  now,
+		UserAgent: r.UserAgent(),
+		IP:        requestIP(r, h.conf.TrustedProxies),
+	}
+	if err := h.sessions.Save(i.ID, i); err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acct.Handle})("unable to save session to index")
+		return
+	}
+	s.Values[sessionIDKey] = i.ID
+}
+
+// endSession removes the current session from the index
+func (h *handler) endSession(w http.ResponseWriter, r *http.Request) {
+	s, err := h.v.s.get(w, r)
+	if err != nil || s == nil {
+		return
+	}
+	if id, ok := s.Values[sessionIDKey].(string); ok && len(id) > 0 && h.sessions.fileStore != nil {
+		if err := h.sessions.Delete(id); err != nil && !errors.IsNotFound(err) {
+			h.errFn(log.Ctx{"err": err})("unable to remove session from index")
+		}
+	}
+	delete(s.Values, sessionIDKey)
+}
+
+// validSession returns false if the session of the logged account has been revoked, or it's missing from the index.
+// For the valid ones, it records when we've last seen them.
+func (h *handler) validSession(w http.ResponseWriter, r *http.Request, acc Account) bool {
+	if h.sessions.fileStore == nil {
+		return true
+	}
+	s, err := h.v.s.get(w, r)
+	if err != nil || s == nil {
+		return false
+	}
+	id, _ := s.Values[sessionIDKey].(string)
+	i, err := h.sessions.Load(id)
+	if err != nil || !acc.HasMetadata() || i.Actor != acc.Metadata.ID {
+		return false
+	}
+	if time.Since(i.LastSeen) > sessionSeenInterval {
+		i.LastSeen = time.Now().UTC()
+		i.UserAgent = r.UserAgent()
+		i.IP = requestIP(r, h.conf.TrustedProxies)
+		if err := h.sessions.Save(i.ID, i); err != nil {
+			h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to update session in index")
+		}
+	}
+	return true
+}
+
+// currentSessionID returns the index ID of the current session
+func (h *handler) currentSessionID(w http.ResponseWriter, r *http.Request) string {
+	s, err := h.v.s.get(w, r)
+	if err != nil || s == nil {
+		return ""
+	}
+	id, _ := s.Values[sessionIDKey].(string)
+	return id
+}
+
+// HandleSessions serves GET /settings/sessions requests
+func (h *handler) HandleSessions(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	m := &sessionsModel{Title: "Active sessions", Current: h.currentSessionID(w, r)}
+	if acc.HasMetadata() {
+		var err error
+		if m.Sessions, err = h.sessions.ForAccount(acc.Metadata.ID); err != nil {
+			h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to load sessions")
+		}
+	}
+	h.v.RenderTemplate(r, w, m.Template(), m)
+}
+
+// HandleRevokeSession serves POST /settings/sessions/{id}/rm requests
+func (h *handler) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	i, err := h.sessions.Load(chi.URLParam(r, "id"))
+	if err != nil || !acc.HasMetadata() || i.Actor != acc.Metadata.ID {
+		h.v.HandleErrors(w, r, errors.NotFoundf("session"))
+		return
+	}
+	if i.ID == h.currentSessionID(w, r) {
+		h.HandleLogout(w, r)
+		return
+	}
+	if err := h.sessions.Delete(i.ID); err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to revoke session")
+		h.v.addFlashMessage(Error, w, r, "Unable to end session")
+	} else {
+		h.infoFn(log.Ctx{"handle": acc.Handle, "session": i.ID})("revoked session")
+		h.v.addFlashMessage(Success, w, r, "The session has been ended")
+	}
+	h.v.Redirect(w, r, "/settings/sessions", http.StatusSeeOther)
+}
+
+// HandleRevokeAllSessions serves POST /settings/sessions/rm requests, it logs the account out everywhere,
+// including the current session
+func (h *handler) HandleRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	if !acc.HasMetadata() {
+		h.v.HandleErrors(w, r, errors.NotFoundf("sessions"))
+		return
+	}
+	count, err := h.sessions.RevokeAll(acc.Metadata.ID)
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to revoke sessions")
+		h.v.addFlashMessage(Error, w, r, "Unable to end all sessions")
+		h.v.Redirect(w, r, "/settings/sessions", http.StatusSeeOther)
+		return
+	}
+	h.infoFn(log.Ctx{"handle": acc.Handle, "count": count})("revoked all sessions")
+	h.HandleLogout(w, r)
+}
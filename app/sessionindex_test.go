@@ -0,0 +1,138 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-ap/errors"
+	"github.com/gorilla/sessions"
+)
+
+func TestRequestIP(t *testing.T) {
+	trusted := []string{"127.0.0.1", "10.0.0.0/8"}
+	tests := []struct {
+		name    string
+		remote  string
+		headers map[string]string
+		want    string
+	}{
+		{name: "remote", remote: "192.0.2.1:52314", want: "192.0.2.1"},
+		{name: "ipv6", remote: "[2001:db8::1]:52314", want: "2001:db8::1"},
+		{name: "real ip", remote: "127.0.0.1:52314", headers: map[string]string{"X-Real-IP": "192.0.2.2"}, want: "192.0.2.2"},
+		{name: "forwarded", remote: "127.0.0.1:52314", headers: map[string]string{"X-Forwarded-For": "192.0.2.3, 10.0.0.1"}, want: "192.0.2.3"},
+		{name: "spoofed forwarded", remote: "127.0.0.1:52314", headers: map[string]string{"X-Forwarded-For": "198.51.100.1, 192.0.2.3"}, want: "192.0.2.3"},
+		{name: "untrusted real ip", remote: "192.0.2.1:52314", headers: map[string]string{"X-Real-IP": "192.0.2.2"}, want: "192.0.2.1"},
+		{name: "untrusted forwarded", remote: "192.0.2.1:52314", headers: map[string]string{"X-Forwarded-For": "192.0.2.3"}, want: "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, _ := http.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tt.remote
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := requestIP(r, trusted); got != tt.want {
+				t.Errorf("requestIP() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSessionIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := newFileStore(dir, "session-index")
+	if err != nil {
+		t.Fatalf("unable to create store: %s", err)
+	}
+	h := handler{sessions: sessionIndex{fs}, infoFn: defaultCtxLogFn, errFn: defaultCtxLogFn}
+	actor := "https://fedbox.littr.example/actors/f7e0bd1a-2f5f-11eb-9d4b-0242ac130002"
+	acct := Account{Handle: "johndoe", Metadata: &AccountMetadata{ID: actor}}
+
+	ids := make([]string, 0)
+	for _, ua := range []string{"Firefox", "curl"} {
+		r, _ := http.NewRequest(http.MethodPost, "/login", nil)
+		r.RemoteAddr = "192.0.2.1:52314"
+		r.Header.Set("User-Agent", ua)
+		s := sessions.NewSession(nil, sessionName)
+		h.startSession(s, r, acct)
+		if _, ok := s.Values[SessionUserKey].(Account); !ok {
+			t.Errorf("startSession() didn't save the account to the session")
+		}
+		id, _ := s.Values[sessionIDKey].(string)
+		i, err := h.sessions.Load(id)
+		if err != nil || i.Actor != actor || i.UserAgent != ua || i.IP != "192.0.2.1" {
+			t.Errorf("Load() = %#v, %v", i, err)
+		}
+		ids = append(ids, id)
+	}
+	otherActor := "https://fedbox.littr.example/actors/other"
+	other := sessionInfo{ID: newSessionID(otherActor), Actor: otherActor, LastSeen: time.Now()}
+	if err := h.sessions.Save(other.ID, other); err != nil {
+		t.Fatalf("Save() error = %s", err)
+	}
+	// NOTE(marius): a session from before the IDs were prefixed with the account
+	legacy := sessionInfo{ID: randomState(), Actor: actor, LastSeen: time.Now()}
+	if err := h.sessions.Save(legacy.ID, legacy); err != nil {
+		t.Fatalf("Save() error = %s", err)
+	}
+	ids = append(ids, legacy.ID)
+
+	infos, err := h.sessions.ForAccount(actor)
+	if err != nil {
+		t.Fatalf("ForAccount() error = %s", err)
+	}
+	if len(infos) != 3 {
+		t.Errorf("ForAccount() = %#v, want the three sessions of %s", infos, acct.Handle)
+	}
+	if count, err := h.sessions.RevokeAll(actor); err != nil || count != 3 {
+		t.Errorf("RevokeAll() = %d, %v, want 3 revoked sessions", count, err)
+	}
+	for _, id := range ids {
+		if _, err := h.sessions.Load(id); !errors.IsNotFound(err) {
+			t.Errorf("Load(%s) error = %v after RevokeAll(), expected not found", id, err)
+		}
+	}
+	if _, err := h.sessions.Load(other.ID); err != nil {
+		t.Errorf("Load() error = %s, expected the sessions of other accounts to be kept", err)
+	}
+}
+
+func TestSessionIndex_Prune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := newFileStore(dir, "session-index")
+	if err != nil {
+		t.Fatalf("unable to create store: %s", err)
+	}
+	s := sessionIndex{fs}
+	actor := "https://fedbox.littr.example/actors/f7e0bd1a-2f5f-11eb-9d4b-0242ac130002"
+	now := time.Now()
+	recent := sessionInfo{ID: newSessionID(actor), Actor: actor, LastSeen: now.Add(-time.Hour)}
+	expired := sessionInfo{ID: newSessionID(actor), Actor: actor, LastSeen: now.Add(-31 * 24 * time.Hour)}
+	for _, i := range []sessionInfo{recent, expired} {
+		if err := s.Save(i.ID, i); err != nil {
+			t.Fatalf("Save() error = %s", err)
+		}
+	}
+	if count, err := s.Prune(now.Add(-30 * 24 * time.Hour)); err != nil || count != 1 {
+		t.Errorf("Prune() = %d, %v, want 1 removed session", count, err)
+	}
+	if _, err := s.Load(expired.ID); !errors.IsNotFound(err) {
+		t.Errorf("Load() error = %v, expected the expired session to be removed", err)
+	}
+	if _, err := s.Load(recent.ID); err != nil {
+		t.Errorf("Load() error = %s, expected the recent session to be kept", err)
+	}
+}
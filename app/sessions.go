@@ -5,12 +5,18 @@ import (
 	"github.com/go-ap/errors"
 	"github.com/gorilla/sessions"
 	"github.com/mariusor/go-littr/internal/log"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
+// sessionsGCInterval is how often we remove the expired sessions of the fs and boltdb backends
+const sessionsGCInterval = time.Hour
+
 type flashType string
 
 const (
@@ -30,8 +36,12 @@ type sess struct {
 	path    string
 	name    string
 	s       sessions.Store
-	infoFn  CtxLogFn
-	errFn   CtxLogFn
+	// gc removes the sessions that expired before the time it receives, for the backends that keep them on the server
+	gc func(time.Time) (int, error)
+	// maxAge is how long the sessions last after they've been saved
+	maxAge time.Duration
+	infoFn CtxLogFn
+	errFn  CtxLogFn
 }
 
 func initSession(c appConfig, infoFn, errFn CtxLogFn) (sess, error) {
@@ -52,7 +62,19 @@ func initSession(c appConfig, infoFn, errFn CtxLogFn) (sess, error) {
 	var err error
 	switch strings.ToLower(c.SessionsBackend) {
 	case sessionsCookieBackend:
-		s.s, err = initCookieSession(c, infoFn, errFn)
+		var cs *sessions.CookieStore
+		if cs, err = initCookieSession(c, infoFn, errFn); err == nil {
+			s.s = cs
+			s.maxAge = time.Duration(cs.Options.MaxAge) * time.Second
+		}
+	case sessionsBoltBackend:
+		s.path = path.Join(c.SessionsPath, string(c.Env), c.HostName)
+		var bs *boltStore
+		if bs, err = initBoltSession(c, s.path, infoFn, errFn); err == nil {
+			s.s = bs
+			s.gc = bs.gc
+			s.maxAge = time.Duration(bs.Options.MaxAge) * time.Second
+		}
 	case sessionsFSBackend:
 		fallthrough
 	default:
@@ -61,9 +83,15 @@ func initSession(c appConfig, infoFn, errFn CtxLogFn) (sess, error) {
 			c.SessionsBackend = sessionsFSBackend
 		}
 		s.path = path.Join(c.SessionsPath, string(c.Env), c.HostName)
-		s.s, err = initFileSession(c, s.path, infoFn, errFn)
+		var fs *sessions.FilesystemStore
+		if fs, err = initFileSession(c, s.path, infoFn, errFn); err == nil {
+			s.s = fs
+			s.maxAge = time.Duration(fs.Options.MaxAge) * time.Second
+			s.gc = fileSessionsGC(s.path, s.maxAge)
+		}
 	}
 	if err != nil {
+		errFn(log.Ctx{"err": err, "backend": c.SessionsBackend})("Unable to initialize sessions")
 		s.enabled = false
 	}
 	return s, nil
@@ -77,7 +105,7 @@ func hideSessionKeys(keys ...[]byte) []string {
 	return hidden
 }
 
-func initCookieSession(c appConfig, infoFn, errFn CtxLogFn) (sessions.Store, error) {
+func initCookieSession(c appConfig, infoFn, errFn CtxLogFn) (*sessions.CookieStore, error) {
 	ss := sessions.NewCookieStore(c.SessionKeys...)
 	ss.Options.Path = "/"
 	ss.Options.HttpOnly = true
@@ -105,7 +133,7 @@ func makeSessionsPath(path string) error {
 	return nil
 }
 
-func initFileSession(c appConfig, path string, infoFn, errFn CtxLogFn) (sessions.Store, error) {
+func initFileSession(c appConfig, path string, infoFn, errFn CtxLogFn) (*sessions.FilesystemStore, error) {
 	if _, err := os.Stat(path); err != nil && os.IsNotExist(err) {
 		if err := makeSessionsPath(path); err != nil {
 			return nil, err
@@ -136,6 +164,86 @@ func initFileSession(c appConfig, path string, infoFn, errFn CtxLogFn) (sessions
 	return ss, nil
 }
 
+func initBoltSession(c appConfig, path string, infoFn, errFn CtxLogFn) (*boltStore, error) {
+	if err := makeSessionsPath(path); err != nil {
+		return nil, err
+	}
+	file := filepath.Join(path, "sessions.bdb")
+	infoFn(log.Ctx{
+		"type":     c.SessionsBackend,
+		"env":      c.Env,
+		"path":     file,
+		"keys":     hideSessionKeys(c.SessionKeys...),
+		"hostname": c.HostName,
+	})("Session settings")
+	ss, err := newBoltStore(file, c.SessionKeys...)
+	if err != nil {
+		return nil, err
+	}
+	ss.Options.HttpOnly = true
+	ss.Options.Secure = c.Secure
+	ss.Options.SameSite = http.SameSiteLaxMode
+	if c.Env.IsProd() {
+		ss.Options.Domain = c.HostName
+		ss.Options.SameSite = http.SameSiteStrictMode
+	}
+	ss.MaxLength(1 << 20)
+	return ss, nil
+}
+
+// fileSessionsGC returns a function that removes the session files of the fs backend that haven't been saved
+// for longer than maxAge
+func fileSessionsGC(path string, maxAge time.Duration) func(time.Time) (int, error) {
+	return func(now time.Time) (int, error) {
+		files, err := ioutil.ReadDir(path)
+		if err != nil {
+			return 0, err
+		}
+		count := 0
+		for _, f := range files {
+			if f.IsDir() || !strings.HasPrefix(f.Name(), "session_") || f.ModTime().Add(maxAge).After(now) {
+				continue
+			}
+			if err := os.Remove(filepath.Join(path, f.Name())); err != nil && !os.IsNotExist(err) {
+				return count, err
+			}
+			count++
+		}
+		return count, nil
+	}
+}
+
+// collectGarbage removes the expired sessions at start-up, and then every interval, together with their entries
+// in the session index
+func (s *sess) collectGarbage(interval time.Duration, index sessionIndex) {
+	collect := func() {
+		now := time.Now()
+		if s.gc != nil {
+			count, err := s.gc(now)
+			if err != nil {
+				s.errFn(log.Ctx{"err": err})("Unable to remove expired sessions")
+			} else if count > 0 {
+				s.infoFn(log.Ctx{"count": count})("Removed expired sessions")
+			}
+		}
+		if s.maxAge <= 0 {
+			return
+		}
+		count, err := index.Prune(now.Add(-s.maxAge))
+		if err != nil {
+			s.errFn(log.Ctx{"err": err})("Unable to remove expired sessions from the index")
+		} else if count > 0 {
+			s.infoFn(log.Ctx{"count": count})("Removed expired sessions from the index")
+		}
+	}
+	collect()
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for range t.C {
+		collect()
+	}
+}
+
 func (s *sess) clear(w http.ResponseWriter, r *http.Request) error {
 	if !s.enabled {
 		return nil
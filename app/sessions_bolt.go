@@ -0,0 +1,216 @@
+package app
+
+import (
+	"encoding/base32"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-ap/errors"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+	bolt "go.etcd.io/bbolt"
+)
+
+var sessionsBucket = []byte("sessions")
+
+// boltSession is how a session gets saved in the BoltDB database, the values are encoded with the session keys,
+// same as for the fs backend
+type boltSession struct {
+	Expires time.Time
+	Values  string
+}
+
+// boltStore is a sessions.Store that keeps the sessions in a BoltDB database, the cookie holds only the session ID
+type boltStore struct {
+	db      *bolt.DB
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+}
+
+func newBoltStore(path string, keys ...[]byte) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, errors.Annotatef(err, "unable to open sessions database %s", path)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(sessionsBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Annotatef(err, "unable to create sessions bucket")
+	}
+	s := &boltStore{
+		db:     db,
+		Codecs: securecookie.CodecsFromPairs(keys...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+	}
+	s.MaxAge(s.Options.MaxAge)
+	return s, nil
+}
+
+// MaxLength restricts the maximum length of the encoded session values, 0 removes the limit
+func (s *boltStore) MaxLength(l int) {
+	for _, c := range s.Codecs {
+		if codec, ok := c.(*securecookie.SecureCookie); ok {
+			codec.MaxLength(l)
+		}
+	}
+}
+
+// MaxAge sets the maximum age of the sessions, and of the cookies holding their IDs
+func (s *boltStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, c := range s.Codecs {
+		if codec, ok := c.(*securecookie.SecureCookie); ok {
+			codec.MaxAge(age)
+		}
+	}
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// Get returns the session with the name, from the registry of the request
+func (s *boltStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session with the name, loading it from the database when the request has a valid session cookie
+func (s *boltStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err = securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...); err != nil {
+		return session, err
+	}
+	if err = s.load(session); err != nil {
+		if errors.IsNotFound(err) {
+			// NOTE(marius): the session expired, or it was removed, we start a new one
+			session.ID = ""
+			return session, nil
+		}
+		return session, err
+	}
+	session.IsNew = false
+	return session, nil
+}
+
+// Save saves the session to the database and its ID to the cookie, or removes both when MaxAge is negative
+func (s *boltStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if err := s.delete(session.ID); err != nil {
+			return err
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	if err := s.save(session); err != nil {
+		return err
+	}
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (s *boltStore) save(session *sessions.Session) error {
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.Values, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	maxAge := session.Options.MaxAge
+	if maxAge == 0 {
+		maxAge = s.Options.MaxAge
+	}
+	raw, err := json.Marshal(boltSession{
+		Expires: time.Now().UTC().Add(time.Duration(maxAge) * time.Second),
+		Values:  encoded,
+	})
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Put([]byte(session.ID), raw)
+	})
+}
+
+func (s *boltStore) load(session *sessions.Session) error {
+	var raw []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket(sessionsBucket).Get([]byte(session.ID)); v != nil {
+			// NOTE(marius): the value is valid only during the transaction
+			raw = append(raw, v...)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if raw == nil {
+		return errors.NotFoundf("session %s", session.ID)
+	}
+	bs := boltSession{}
+	if err := json.Unmarshal(raw, &bs); err != nil {
+		return err
+	}
+	if bs.Expires.Before(time.Now()) {
+		return errors.NotFoundf("session %s expired", session.ID)
+	}
+	return securecookie.DecodeMulti(session.Name(), bs.Values, &session.Values, s.Codecs...)
+}
+
+func (s *boltStore) delete(id string) error {
+	if len(id) == 0 {
+		return nil
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sessionsBucket).Delete([]byte(id))
+	})
+}
+
+// gc removes the sessions that expired before now, and returns how many there were
+func (s *boltStore) gc(now time.Time) (int, error) {
+	expired := make([][]byte, 0)
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sessionsBucket)
+		// NOTE(marius): deleting while iterating with the cursor skips keys, so we collect them first
+		err := b.ForEach(func(k, v []byte) error {
+			bs := boltSession{}
+			if err := json.Unmarshal(v, &bs); err != nil || !bs.Expires.After(now) {
+				expired = append(expired, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(expired), nil
+}
@@ -0,0 +1,91 @@
+package app
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBoltStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s, err := newBoltStore(filepath.Join(dir, "sessions.bdb"), []byte("0123456789abcdef0123456789abcdef"))
+	if err != nil {
+		t.Fatalf("newBoltStore() error = %s", err)
+	}
+	defer s.Close()
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	ss, err := s.Get(r, sessionName)
+	if err != nil || !ss.IsNew {
+		t.Fatalf("Get() = %v, %v, expected a new session", ss, err)
+	}
+	ss.Values[SessionUserKey] = "johndoe"
+	w := httptest.NewRecorder()
+	if err := ss.Save(r, w); err != nil {
+		t.Fatalf("Save() error = %s", err)
+	}
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("Save() set %d cookies, expected one", len(cookies))
+	}
+	load := func() (string, bool) {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.AddCookie(cookies[0])
+		ss, err := s.Get(r, sessionName)
+		if err != nil {
+			t.Fatalf("Get() error = %s", err)
+		}
+		handle, _ := ss.Values[SessionUserKey].(string)
+		return handle, ss.IsNew
+	}
+	if handle, isNew := load(); isNew || handle != "johndoe" {
+		t.Errorf("Get() = %q, %t, expected the saved session", handle, isNew)
+	}
+
+	if count, err := s.gc(time.Now()); err != nil || count != 0 {
+		t.Errorf("gc() = %d, %v, expected no expired sessions", count, err)
+	}
+	if count, err := s.gc(time.Now().Add(time.Duration(s.Options.MaxAge+1) * time.Second)); err != nil || count != 1 {
+		t.Errorf("gc() = %d, %v, expected one expired session", count, err)
+	}
+	if handle, isNew := load(); !isNew || handle != "" {
+		t.Errorf("Get() = %q, %t, expected a new session after the old one was removed", handle, isNew)
+	}
+}
+
+func TestFileSessionsGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"session_old", "session_new", "other"} {
+		f := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(f, []byte("data"), 0600); err != nil {
+			t.Fatalf("unable to write %s: %s", f, err)
+		}
+		if name != "session_new" {
+			os.Chtimes(f, old, old)
+		}
+	}
+	count, err := fileSessionsGC(dir, time.Hour)(time.Now())
+	if err != nil || count != 1 {
+		t.Errorf("fileSessionsGC() = %d, %v, expected one removed session", count, err)
+	}
+	for name, exists := range map[string]bool{"session_old": false, "session_new": true, "other": true} {
+		if _, err := os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) == exists {
+			t.Errorf("%s exists: %t, want %t", name, !os.IsNotExist(err), exists)
+		}
+	}
+}
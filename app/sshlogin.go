@@ -0,0 +1,391 @@
+package app
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-ap/errors"
+	"github.com/go-chi/chi"
+	"github.com/mariusor/go-littr/internal/log"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	sshSigMagic      = "SSHSIG"
+	sshSigVersion    = 1
+	sshSigArmorBegin = "-----BEGIN SSH SIGNATURE-----"
+	sshSigArmorEnd   = "-----END SSH SIGNATURE-----"
+
+	maxSSHKeys = 10
+
+	sessionSSHChallengeKey       = "__ssh_challenge"
+	sessionSSHChallengeHandleKey = "__ssh_challenge_handle"
+)
+
+// authorizedKey is an SSH public key the account can log in with
+type authorizedKey struct {
+	// ID is the hex encoded SHA-256 of the key, we use it in the URLs
+	ID          string
+	Fingerprint string
+	Type        string
+	Comment     string
+	// Key is the key in the authorized_keys format
+	Key      string
+	Added    time.Time
+	LastUsed time.Time
+}
+
+func (k authorizedKey) PublicKey() (ssh.PublicKey, error) {
+	pk, _, _, _, err := ssh.ParseAuthorizedKey([]byte(k.Key))
+	return pk, err
+}
+
+// parseAuthorizedKey reads a public key in the authorized_keys format, as found in the id_*.pub files
+func parseAuthorizedKey(line string) (authorizedKey, error) {
+	k := authorizedKey{}
+	pk, comment, _, _, err := ssh.ParseAuthorizedKey([]byte(strings.TrimSpace(line)))
+	if err != nil {
+		return k, errors.NotValidf("invalid SSH public key")
+	}
+	sum := sha256.Sum256(pk.Marshal())
+	k.ID = hex.EncodeToString(sum[:])
+	k.Fingerprint = ssh.FingerprintSHA256(pk)
+	k.Type = pk.Type()
+	k.Comment = comment
+	k.Key = strings.TrimSpace(string(ssh.MarshalAuthorizedKey(pk)))
+	return k, nil
+}
+
+// sshKeyStore keeps the SSH public keys of the accounts, by their hash
+type sshKeyStore struct {
+	*fileStore
+}
+
+func (s sshKeyStore) Load(a Account) ([]authorizedKey, error) {
+	keys := make([]authorizedKey, 0)
+	if s.fileStore == nil {
+		return keys, errors.NotFoundf("SSH keys are not available")
+	}
+	err := s.fileStore.Load(a.Hash.String(), &keys)
+	if errors.IsNotFound(err) {
+		return keys, nil
+	}
+	return keys, err
+}
+
+// Add saves the key to the keys of the account, unless it's already there
+func (s sshKeyStore) Add(a Account, k authorizedKey) error {
+	keys, err := s.Load(a)
+	if err != nil {
+		return err
+	}
+	for _, ex := range keys {
+		if ex.ID == k.ID {
+			return errors.Newf("the key %s was already added", k.Fingerprint)
+		}
+	}
+	if len(keys) >= maxSSHKeys {
+		return errors.Forbiddenf("an account can have at most %d SSH keys", maxSSHKeys)
+	}
+	k.Added = time.Now().UTC()
+	return s.Save(a.Hash.String(), append(keys, k))
+}
+
+// Remove removes the key with the id from the keys of the account
+func (s sshKeyStore) Remove(a Account, id string) (authorizedKey, error) {
+	keys, err := s.Load(a)
+	if err != nil {
+		return authorizedKey{}, err
+	}
+	for i, k := range keys {
+		if k.ID == id {
+			return k, s.Save(a.Hash.String(), append(keys[:i], keys[i+1:]...))
+		}
+	}
+	return authorizedKey{}, errors.NotFoundf("SSH key")
+}
+
+// sshSignature is the signature blob ssh-keygen -Y sign generates, see PROTOCOL.sshsig in the OpenSSH sources
+type sshSignature struct {
+	Magic         [6]byte
+	Version       uint32
+	PublicKey     []byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Signature     []byte
+}
+
+// sshSignedData is what the signature of the sshSignature is made over
+type sshSignedData struct {
+	Magic         [6]byte
+	Namespace     string
+	Reserved      string
+	HashAlgorithm string
+	Hash          []byte
+}
+
+// parseSSHSignature decodes the armored signature ssh-keygen outputs
+func parseSSHSignature(armored string) (*sshSignature, error) {
+	armored = strings.TrimSpace(armored)
+	if !strings.HasPrefix(armored, sshSigArmorBegin) || !strings.HasSuffix(armored, sshSigArmorEnd) {
+		return nil, errors.NotValidf("the signature needs to start with %s and end with %s", sshSigArmorBegin, sshSigArmorEnd)
+	}
+	armored = strings.TrimSuffix(strings.TrimPrefix(armored, sshSigArmorBegin), sshSigArmorEnd)
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(armored), ""))
+	if err != nil {
+		return nil, errors.NotValidf("invalid signature encoding")
+	}
+	sig := new(sshSignature)
+	if err := ssh.Unmarshal(raw, sig); err != nil {
+		return nil, errors.NotValidf("invalid signature")
+	}
+	if string(sig.Magic[:]) != sshSigMagic || sig.Version != sshSigVersion {
+		return nil, errors.NotValidf("unsupported signature version %d", sig.Version)
+	}
+	return sig, nil
+}
+
+// verify checks that the signature of the message was made in the namespace with one of the keys,
+// and returns the one that made it
+func (sig sshSignature) verify(message []byte, namespace string, keys []authorizedKey) (*authorizedKey, error) {
+	if sig.Namespace != namespace {
+		return nil, errors.NotValidf("the signature was made for the %q namespace instead of %q", sig.Namespace, namespace)
+	}
+	var sum []byte
+	switch sig.HashAlgorithm {
+	case "sha256":
+		h := sha256.Sum256(message)
+		sum = h[:]
+	case "sha512":
+		h := sha512.Sum512(message)
+		sum = h[:]
+	default:
+		return nil, errors.NotValidf("unsupported hash algorithm %q", sig.HashAlgorithm)
+	}
+	var key *authorizedKey
+	for i, k := range keys {
+		pk, err := k.PublicKey()
+		if err == nil && bytes.Equal(pk.Marshal(), sig.PublicKey) {
+			key = &keys[i]
+			break
+		}
+	}
+	if key == nil {
+		return nil, errors.NotFoundf("the signature wasn't made with one of the account's keys")
+	}
+	pk, err := key.PublicKey()
+	if err != nil {
+		return nil, err
+	}
+	s := new(ssh.Signature)
+	if err := ssh.Unmarshal(sig.Signature, s); err != nil {
+		return nil, errors.NotValidf("invalid signature")
+	}
+	data := sshSignedData{
+		Namespace:     sig.Namespace,
+		Reserved:      sig.Reserved,
+		HashAlgorithm: sig.HashAlgorithm,
+		Hash:          sum,
+	}
+	copy(data.Magic[:], sshSigMagic)
+	if err := pk.Verify(ssh.Marshal(data), s); err != nil {
+		return nil, errors.NotValidf("invalid signature")
+	}
+	return key, nil
+}
+
+// sshNamespace is the namespace the challenges need to be signed in, so the signatures can't be used elsewhere
+func sshNamespace(host string) string {
+	return "login@" + host
+}
+
+func newSSHChallenge(host, handle string) string {
+	return fmt.Sprintf("%s %s %s", host, handle, randomState())
+}
+
+// sshSignCommand is the command users can run in their terminal to sign the challenge
+func sshSignCommand(challenge, namespace string) string {
+	return fmt.Sprintf("printf '%%s' '%s' | ssh-keygen -Y sign -n %s -f ~/.ssh/id_ed25519", challenge, namespace)
+}
+
+// HandleShowSSHLogin serves GET /login/ssh requests, it shows the challenge to sign if there's one pending
+func (h *handler) HandleShowSSHLogin(w http.ResponseWriter, r *http.Request) {
+	m := &sshLoginModel{Title: "SSH key authentication"}
+	if s, err := h.v.s.get(w, r); err == nil && s != nil {
+		started, _ := s.Values[sessionPendingLoginTimeKey].(int64)
+		if time.Since(time.Unix(started, 0)) < pendingLoginTimeout {
+			m.Challenge, _ = s.Values[sessionSSHChallengeKey].(string)
+			m.Handle, _ = s.Values[sessionSSHChallengeHandleKey].(string)
+		}
+	}
+	if len(m.Challenge) > 0 {
+		m.Namespace = sshNamespace(h.conf.HostName)
+		m.Command = sshSignCommand(m.Challenge, m.Namespace)
+	}
+	h.v.RenderTemplate(r, w, m.Template(), m)
+}
+
+// HandleSSHChallenge serves POST /login/ssh requests, it issues the challenge the account's SSH key needs to sign.
+// We don't check that the account exists here, so the form can't be used to find out which accounts have SSH keys.
+func (h *handler) HandleSSHChallenge(w http.ResponseWriter, r *http.Request) {
+	handle := strings.TrimSpace(r.PostFormValue("handle"))
+	if len(handle) == 0 || strings.ContainsAny(handle, " '\"\\") {
+		h.v.addFlashMessage(Error, w, r, "Invalid handle")
+		h.v.Redirect(w, r, "/login/ssh", http.StatusSeeOther)
+		return
+	}
+	s, err := h.v.s.get(w, r)
+	if err != nil {
+		h.v.HandleErrors(w, r, errors.Annotatef(err, "unable to load session"))
+		return
+	}
+	s.Values[sessionSSHChallengeKey] = newSSHChallenge(h.conf.HostName, handle)
+	s.Values[sessionSSHChallengeHandleKey] = handle
+	s.Values[sessionPendingLoginTimeKey] = time.Now().Unix()
+	h.v.Redirect(w, r, "/login/ssh", http.StatusSeeOther)
+}
+
+// HandleSSHLogin serves POST /login/ssh/verify requests, it logs in the account when the challenge was signed
+// with one of its SSH keys
+func (h *handler) HandleSSHLogin(w http.ResponseWriter, r *http.Request) {
+	s, err := h.v.s.get(w, r)
+	if err != nil {
+		h.v.HandleErrors(w, r, errors.Annotatef(err, "unable to load session"))
+		return
+	}
+	challenge, _ := s.Values[sessionSSHChallengeKey].(string)
+	handle, _ := s.Values[sessionSSHChallengeHandleKey].(string)
+	started, _ := s.Values[sessionPendingLoginTimeKey].(int64)
+	clearChallenge := func() {
+		delete(s.Values, sessionSSHChallengeKey)
+		delete(s.Values, sessionSSHChallengeHandleKey)
+		delete(s.Values, sessionPendingLoginTimeKey)
+	}
+	restart := func(msg string) {
+		clearChallenge()
+		h.v.addFlashMessage(Error, w, r, msg)
+		h.v.Redirect(w, r, "/login/ssh", http.StatusSeeOther)
+	}
+	if len(challenge) == 0 || time.Since(time.Unix(started, 0)) > pendingLoginTimeout {
+		restart("Login failed: the challenge expired, please try again")
+		return
+	}
+
+	ctx := r.Context()
+	ltx := log.Ctx{"handle": handle}
+	fail := func(err error) {
+		h.errFn(ltx, log.Ctx{"err": err})("SSH key login failed")
+		h.v.addFlashMessage(Error, w, r, "Login failed: invalid signature")
+		h.v.Redirect(w, r, "/login/ssh", http.StatusSeeOther)
+	}
+	accts, err := h.storage.accounts(ctx, &Filters{
+		Name: CompStrs{EqualsString(handle)},
+		Type: ActivityTypesFilter(ValidActorTypes...),
+	})
+	if err != nil || len(accts) == 0 {
+		if err == nil {
+			err = errors.NotFoundf("%s", handle)
+		}
+		fail(err)
+		return
+	}
+	acct := accts[0]
+	keys, err := h.sshKeys.Load(acct)
+	if err != nil {
+		fail(err)
+		return
+	}
+	var key *authorizedKey
+	var sigErr error
+	valid, err := h.loginAttempts.Attempt("ssh", acct, time.Now(), func() bool {
+		sig, err := parseSSHSignature(r.PostFormValue("signature"))
+		if err != nil {
+			sigErr = err
+			return false
+		}
+		// NOTE(marius): echo adds a new line at the end of the challenge, we accept the signatures made that way too
+		msg := []byte(challenge)
+		key, sigErr = sig.verify(msg, sshNamespace(h.conf.HostName), keys)
+		if sigErr != nil && !errors.IsNotFound(sigErr) {
+			key, sigErr = sig.verify(append(msg, '\n'), sshNamespace(h.conf.HostName), keys)
+		}
+		return sigErr == nil
+	})
+	if errors.IsForbidden(err) {
+		h.infoFn(ltx)("too many invalid SSH signatures")
+		restart("Login failed: too many invalid signatures, try again later")
+		return
+	}
+	if err == nil && !valid {
+		err = sigErr
+	}
+	if err != nil {
+		fail(err)
+		return
+	}
+	clearChallenge()
+
+	tok, err := h.storage.accountToken(ctx, acct, randomState())
+	if err != nil {
+		h.errFn(ltx, log.Ctx{"err": err})("unable to load FedBOX token for SSH key login")
+		h.v.addFlashMessage(Error, w, r, "Login failed: unable to authorize the account")
+		h.v.Redirect(w, r, "/login/ssh", http.StatusSeeOther)
+		return
+	}
+	for i := range keys {
+		if keys[i].ID == key.ID {
+			keys[i].LastUsed = time.Now().UTC()
+		}
+	}
+	if err := h.sshKeys.Save(acct.Hash.String(), keys); err != nil {
+		h.errFn(ltx, log.Ctx{"err": err})("unable to save SSH keys")
+	}
+	h.infoFn(ltx, log.Ctx{"fingerprint": key.Fingerprint})("logged in with SSH key")
+	acct.Metadata.OAuth.Provider = "fedbox"
+	acct.Metadata.OAuth.Token = tok
+	h.loginAccount(w, r, acct, "")
+}
+
+// HandleAddSSHKey serves POST /settings/ssh-keys requests
+func (h *handler) HandleAddSSHKey(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	k, err := parseAuthorizedKey(r.PostFormValue("key"))
+	if err == nil {
+		err = h.sshKeys.Add(*acc, k)
+	}
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to add SSH key")
+		h.v.addFlashMessage(Error, w, r, fmt.Sprintf("Unable to add SSH key: %s", err))
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	h.infoFn(log.Ctx{"handle": acc.Handle, "fingerprint": k.Fingerprint})("added SSH key")
+	h.v.addFlashMessage(Success, w, r, fmt.Sprintf("Added SSH key %s", k.Fingerprint))
+	h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// HandleRemoveSSHKey serves POST /settings/ssh-keys/{id}/rm requests
+func (h *handler) HandleRemoveSSHKey(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	k, err := h.sshKeys.Remove(*acc, chi.URLParam(r, "id"))
+	if errors.IsNotFound(err) {
+		h.v.HandleErrors(w, r, err)
+		return
+	}
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to remove SSH key")
+		h.v.addFlashMessage(Error, w, r, "Unable to remove SSH key")
+	} else {
+		h.infoFn(log.Ctx{"handle": acc.Handle, "fingerprint": k.Fingerprint})("removed SSH key")
+		h.v.addFlashMessage(Success, w, r, fmt.Sprintf("Removed SSH key %s", k.Fingerprint))
+	}
+	h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
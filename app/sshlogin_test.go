@@ -0,0 +1,136 @@
+package app
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-ap/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// signSSH makes the signature ssh-keygen -Y sign -n namespace would make for the message
+func signSSH(t *testing.T, signer ssh.Signer, namespace string, message []byte) string {
+	sum := sha512.Sum512(message)
+	data := sshSignedData{Namespace: namespace, HashAlgorithm: "sha512", Hash: sum[:]}
+	copy(data.Magic[:], sshSigMagic)
+	s, err := signer.Sign(rand.Reader, ssh.Marshal(data))
+	if err != nil {
+		t.Fatalf("unable to sign: %s", err)
+	}
+	sig := sshSignature{
+		Version:       sshSigVersion,
+		PublicKey:     signer.PublicKey().Marshal(),
+		Namespace:     namespace,
+		HashAlgorithm: "sha512",
+		Signature:     ssh.Marshal(s),
+	}
+	copy(sig.Magic[:], sshSigMagic)
+	enc := base64.StdEncoding.EncodeToString(ssh.Marshal(sig))
+	lines := []string{sshSigArmorBegin}
+	for len(enc) > 70 {
+		lines = append(lines, enc[:70])
+		enc = enc[70:]
+	}
+	return strings.Join(append(lines, enc, sshSigArmorEnd), "\n")
+}
+
+func newTestSSHKey(t *testing.T) (ssh.Signer, authorizedKey) {
+	_, prv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate key: %s", err)
+	}
+	signer, err := ssh.NewSignerFromKey(prv)
+	if err != nil {
+		t.Fatalf("unable to create signer: %s", err)
+	}
+	k, err := parseAuthorizedKey(strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))) + " user@host")
+	if err != nil {
+		t.Fatalf("unable to parse public key: %s", err)
+	}
+	return signer, k
+}
+
+func TestParseAuthorizedKey(t *testing.T) {
+	signer, k := newTestSSHKey(t)
+	if k.Type != ssh.KeyAlgoED25519 {
+		t.Errorf("invalid key type %s, expected %s", k.Type, ssh.KeyAlgoED25519)
+	}
+	if k.Comment != "user@host" {
+		t.Errorf("invalid comment %q, expected %q", k.Comment, "user@host")
+	}
+	if k.Fingerprint != ssh.FingerprintSHA256(signer.PublicKey()) {
+		t.Errorf("invalid fingerprint %s", k.Fingerprint)
+	}
+	if _, err := parseAuthorizedKey("ssh-ed25519 not-a-key"); err == nil {
+		t.Errorf("expected an error for an invalid key")
+	}
+}
+
+func TestSSHSignatureVerify(t *testing.T) {
+	signer, k := newTestSSHKey(t)
+	_, other := newTestSSHKey(t)
+	ns := sshNamespace("example.com")
+	challenge := newSSHChallenge("example.com", "jdoe")
+
+	sig, err := parseSSHSignature(signSSH(t, signer, ns, []byte(challenge)))
+	if err != nil {
+		t.Fatalf("unable to parse signature: %s", err)
+	}
+	key, err := sig.verify([]byte(challenge), ns, []authorizedKey{other, k})
+	if err != nil {
+		t.Fatalf("unable to verify signature: %s", err)
+	}
+	if key.ID != k.ID {
+		t.Errorf("invalid key %s, expected %s", key.Fingerprint, k.Fingerprint)
+	}
+	if _, err := sig.verify([]byte(challenge), ns, []authorizedKey{other}); !errors.IsNotFound(err) {
+		t.Errorf("expected not found error for the keys of another account, received %v", err)
+	}
+	if _, err := sig.verify([]byte(challenge+"x"), ns, []authorizedKey{k}); err == nil {
+		t.Errorf("expected an error for a different message")
+	}
+	if _, err := sig.verify([]byte(challenge), sshNamespace("example.org"), []authorizedKey{k}); err == nil {
+		t.Errorf("expected an error for a different namespace")
+	}
+	if _, err := parseSSHSignature("-----BEGIN SSH SIGNATURE-----\nU1NIU0lH\n-----END SSH SIGNATURE-----"); err == nil {
+		t.Errorf("expected an error for an invalid signature")
+	}
+}
+
+func TestSSHKeyStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-ssh-keys")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := newFileStore(dir, "ssh-keys")
+	if err != nil {
+		t.Fatalf("unable to create storage: %s", err)
+	}
+	s := sshKeyStore{fs}
+	a := Account{Hash: HashFromString("6bc8e2ce-1fb4-4f1a-9c2d-3e0b1a37c5f0")}
+	_, k := newTestSSHKey(t)
+	if err := s.Add(a, k); err != nil {
+		t.Fatalf("unable to add key: %s", err)
+	}
+	if err := s.Add(a, k); err == nil {
+		t.Errorf("expected an error when adding the same key twice")
+	}
+	keys, err := s.Load(a)
+	if err != nil || len(keys) != 1 || keys[0].ID != k.ID {
+		t.Fatalf("invalid keys %v: %v", keys, err)
+	}
+	if _, err := s.Remove(a, k.ID); err != nil {
+		t.Errorf("unable to remove key: %s", err)
+	}
+	if _, err := s.Remove(a, k.ID); !errors.IsNotFound(err) {
+		t.Errorf("expected not found error, received %v", err)
+	}
+}
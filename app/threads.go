@@ -0,0 +1,328 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/go-ap/errors"
+	"github.com/go-chi/chi"
+	"github.com/mariusor/go-littr/internal/log"
+)
+
+// ThreadState holds the moderation state of a thread, identified by the hash of its top level item
+type ThreadState struct {
+	Locked   bool      `json:"locked,omitempty"`
+	LockedAt time.Time `json:"lockedAt,omitempty"`
+	LockedBy string    `json:"lockedBy,omitempty"`
+	// LockedByModerator is set when a moderator locked the thread, then only moderators can unlock it
+	LockedByModerator bool `json:"lockedByModerator,omitempty"`
+	Sticky            bool `json:"sticky,omitempty"`
+}
+
+const threadStatesKey = "states"
+
+// threadStates keeps the locked and sticky threads in memory, and persists them to the file storage
+type threadStates struct {
+	sync.RWMutex
+	store  *fileStore
+	states map[string]ThreadState
+}
+
+func loadThreadStates(store *fileStore) (*threadStates, error) {
+	t := &threadStates{store: store, states: make(map[string]ThreadState)}
+	if store == nil {
+		return t, nil
+	}
+	if err := store.Load(threadStatesKey, &t.states); err != nil && !errors.IsNotFound(err) {
+		return t, err
+	}
+	return t, nil
+}
+
+// Get returns the state of the thread with the hash h
+func (t *threadStates) Get(h Hash) ThreadState {
+	if t == nil {
+		return ThreadState{}
+	}
+	t.RLock()
+	defer t.RUnlock()
+	return t.states[h.String()]
+}
+
+// Update applies fn to the state of the thread with the hash h and persists the result
+func (t *threadStates) Update(h Hash, fn func(*ThreadState)) error {
+	if t == nil || !h.IsValid() {
+		return errors.NotValidf("invalid thread %s", h)
+	}
+	t.Lock()
+	defer t.Unlock()
+	st := t.states[h.String()]
+	fn(&st)
+	if st == (ThreadState{}) {
+		delete(t.states, h.String())
+	} else {
+		t.states[h.String()] = st
+	}
+	if t.store == nil {
+		return nil
+	}
+	return t.store.Save(threadStatesKey, t.states)
+}
+
+// Sticky returns the hashes of the sticky threads
+func (t *threadStates) Sticky() Hashes {
+	hashes := make(Hashes, 0)
+	if t == nil {
+		return hashes
+	}
+	t.RLock()
+	defer t.RUnlock()
+	for k, st := range t.states {
+		if st.Sticky {
+			hashes = append(hashes, HashFromString(k))
+		}
+	}
+	return hashes
+}
+
+// threadRoot returns the top level item of the thread it is part of
+func threadRoot(it *Item) *Item {
+	if it == nil {
+		return nil
+	}
+	if it.OP.IsValid() {
+		return it.OP
+	}
+	if it.Parent.IsValid() {
+		return it.Parent
+	}
+	return it
+}
+
+// isArchived returns true if the thread started by op is older than the archiving age
+func isArchived(op *Item, age time.Duration) bool {
+	if age <= 0 || op == nil || op.SubmittedAt.IsZero() {
+		return false
+	}
+	return time.Now().UTC().Sub(op.SubmittedAt) > age
+}
+
+// Locked returns true if the item is part of a locked thread
+func (i *Item) Locked() bool {
+	return i != nil && i.Flags&FlagsLocked == FlagsLocked
+}
+
+// LockedByModerator returns true if the item is part of a thread that a moderator locked
+func (i *Item) LockedByModerator() bool {
+	return i != nil && i.Flags&FlagsModeratorLocked == FlagsModeratorLocked
+}
+
+// Sticky returns true if the item is pinned at the top of the listings
+func (i *Item) Sticky() bool {
+	return i != nil && i.Flags&FlagsSticky == FlagsSticky
+}
+
+// Archived returns true if the item is part of an archived thread
+func (i *Item) Archived() bool {
+	return i != nil && i.Flags&FlagsArchived == FlagsArchived
+}
+
+// AcceptsReplies returns true if new replies can be added to the item
+func (i *Item) AcceptsReplies() bool {
+	return !i.Locked() && !i.Archived()
+}
+
+// applyThreadState sets the locked, sticky and archived flags on the items in the list, and removes
+// the replies that were received by locked or archived threads after they were closed
+func (h *handler) applyThreadState(items RenderableList) RenderableList {
+	result := make(RenderableList)
+	for k, ren := range items {
+		it, ok := ren.(*Item)
+		if !ok {
+			result[k] = ren
+			continue
+		}
+		root := threadRoot(it)
+		if loaded := getItemFromList(root.Hash, items); loaded != nil {
+			root = loaded
+		}
+		st := h.threads.Get(root.Hash)
+		if st.Sticky && root.Hash == it.Hash {
+			it.Flags |= FlagsSticky
+		}
+		if st.Locked {
+			if root.Hash != it.Hash && !st.LockedAt.IsZero() && it.SubmittedAt.After(st.LockedAt) {
+				continue
+			}
+			it.Flags |= FlagsLocked
+			if st.LockedByModerator {
+				it.Flags |= FlagsModeratorLocked
+			}
+		}
+		if isArchived(root, h.conf.ArchiveAge) {
+			if root.Hash != it.Hash && it.SubmittedAt.After(root.SubmittedAt.Add(h.conf.ArchiveAge)) {
+				continue
+			}
+			it.Flags |= FlagsArchived
+		}
+		result[k] = it
+	}
+	return result
+}
+
+// ThreadStateMw marks the items in the current cursor with the state of their threads
+func (h *handler) ThreadStateMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c := ContextCursor(r.Context()); c != nil {
+			c.items = h.applyThreadState(c.items)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// StickyItemsMw loads the sticky items at the top of the first page of the listing
+func (h *handler) StickyItemsMw(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c := ContextCursor(r.Context())
+		sticky := h.threads.Sticky()
+		if c == nil || len(sticky) == 0 || len(r.URL.Query().Get("after")) > 0 || len(r.URL.Query().Get("before")) > 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		f := new(Filters)
+		for _, hash := range sticky {
+			f.IRI = append(f.IRI, LikeString(hash.String()))
+		}
+		items, err := h.storage.objects(context.TODO(), f)
+		if err != nil {
+			h.errFn(log.Ctx{"err": err})("unable to load sticky items")
+			next.ServeHTTP(w, r)
+			return
+		}
+		if items, err = h.storage.loadItemsAuthors(context.TODO(), items...); err != nil {
+			h.errFn(log.Ctx{"err": err})("unable to load sticky items authors")
+		}
+		if items, err = h.storage.loadItemsVotes(context.TODO(), items...); err != nil {
+			h.errFn(log.Ctx{"err": err})("unable to load sticky items votes")
+		}
+		for i := range items {
+			it := items[i]
+			if !it.IsValid() || it.Deleted() || getItemFromList(it.Hash, c.items) != nil {
+				continue
+			}
+			c.items.Append(&it)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// loadThreadRoot returns the top level item of the thread it is part of, loading it from storage if needed
+func (h *handler) loadThreadRoot(ctx context.Context, it *Item) *Item {
+	root := threadRoot(it)
+	if root != nil && root.SubmittedAt.IsZero() {
+		if op, err := h.storage.LoadItem(ctx, objects.IRI(h.storage.fedbox.Service()).AddPath(root.Hash.String())); err == nil {
+			root = &op
+		}
+	}
+	return root
+}
+
+// checkAcceptsReplies returns an error if the thread the parent item is part of can't receive new replies
+func (h *handler) checkAcceptsReplies(ctx context.Context, parent *Item) error {
+	if parent == nil {
+		return nil
+	}
+	root := h.loadThreadRoot(ctx, parent)
+	if h.threads.Get(root.Hash).Locked {
+		return errors.Forbiddenf("the thread is locked, it does not accept new replies")
+	}
+	if isArchived(root, h.conf.ArchiveAge) {
+		return errors.Forbiddenf("the thread is archived, it does not accept new replies")
+	}
+	return nil
+}
+
+// canLockThread returns true if the account is a moderator or the author of the top level item of the thread.
+// The author can't unlock a thread that a moderator locked.
+func canLockThread(acc *Account, op *Item, st ThreadState) bool {
+	if accountIsModerator(acc) {
+		return true
+	}
+	if st.Locked && st.LockedByModerator {
+		return false
+	}
+	return acc.IsLogged() && op != nil && op.SubmittedBy.IsValid() && op.SubmittedBy.Hash == acc.Hash
+}
+
+// canLockItem returns true if the account can lock or unlock the thread of the item, from the thread state
+// applied to the item's flags
+func canLockItem(acc *Account, it *Item) bool {
+	root := threadRoot(it)
+	return canLockThread(acc, root, ThreadState{Locked: root.Locked(), LockedByModerator: root.LockedByModerator()})
+}
+
+// HandleThreadState serves the POST /lock, /unlock, /sticky and /unsticky requests for an item
+func (h *handler) HandleThreadState(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	ctx := context.TODO()
+	it, err := h.storage.LoadItem(ctx, objects.IRI(h.storage.fedbox.Service()).AddPath(chi.URLParam(r, "hash")))
+	if err != nil {
+		h.v.HandleErrors(w, r, errors.NewNotFound(err, "item not found"))
+		return
+	}
+	root := h.loadThreadRoot(ctx, &it)
+
+	action := path.Base(r.URL.Path)
+	var fn func(*ThreadState)
+	var msg string
+	switch action {
+	case "lock", "unlock":
+		if !canLockThread(acc, root, h.threads.Get(root.Hash)) {
+			h.v.HandleErrors(w, r, errors.Forbiddenf("only moderators and the original poster can lock a thread"))
+			return
+		}
+		lock := action == "lock"
+		fn = func(st *ThreadState) {
+			st.Locked = lock
+			st.LockedAt = time.Time{}
+			st.LockedBy = ""
+			st.LockedByModerator = false
+			if lock {
+				st.LockedAt = time.Now().UTC()
+				st.LockedBy = acc.Handle
+				st.LockedByModerator = accountIsModerator(acc)
+			}
+		}
+		msg = "Thread was unlocked"
+		if lock {
+			msg = "Thread was locked"
+		}
+	case "sticky", "unsticky":
+		if !accountIsModerator(acc) {
+			h.v.HandleErrors(w, r, errors.Forbiddenf("only moderators can sticky items"))
+			return
+		}
+		sticky := action == "sticky"
+		fn = func(st *ThreadState) {
+			st.Sticky = sticky
+		}
+		msg = "Item is no longer sticky"
+		if sticky {
+			msg = "Item is now sticky"
+		}
+	default:
+		h.v.HandleErrors(w, r, errors.NotFoundf("invalid action %s", action))
+		return
+	}
+	if err := h.threads.Update(root.Hash, fn); err != nil {
+		h.errFn(log.Ctx{"err": err, "hash": root.Hash, "action": action})("unable to update thread state")
+		h.v.HandleErrors(w, r, err)
+		return
+	}
+	h.infoFn(log.Ctx{"hash": root.Hash, "action": action, "by": acc.Handle})("updated thread state")
+	h.v.addFlashMessage(Success, w, r, msg)
+	h.v.Redirect(w, r, ItemPermaLink(&it), http.StatusSeeOther)
+}
@@ -0,0 +1,105 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/mariusor/go-littr/internal/config"
+)
+
+func TestIsArchived(t *testing.T) {
+	now := time.Now().UTC()
+	tests := []struct {
+		name string
+		op   *Item
+		age  time.Duration
+		want bool
+	}{
+		{name: "nil", op: nil, age: time.Hour, want: false},
+		{name: "disabled", op: &Item{SubmittedAt: now.Add(-48 * time.Hour)}, age: 0, want: false},
+		{name: "no date", op: &Item{}, age: time.Hour, want: false},
+		{name: "recent", op: &Item{SubmittedAt: now.Add(-time.Minute)}, age: time.Hour, want: false},
+		{name: "old", op: &Item{SubmittedAt: now.Add(-2 * time.Hour)}, age: time.Hour, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isArchived(tt.op, tt.age); got != tt.want {
+				t.Errorf("isArchived() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestThreadStates_Update(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	store, err := newFileStore(dir, "threads")
+	if err != nil {
+		t.Fatalf("unable to create store: %s", err)
+	}
+	states, _ := loadThreadStates(store)
+	h := HashFromString("a51e3f28-8b15-4a3c-9c46-1dd67f0fd2b1")
+	if err := states.Update(h, func(st *ThreadState) { st.Sticky = true }); err != nil {
+		t.Fatalf("unable to update state: %s", err)
+	}
+	loaded, err := loadThreadStates(store)
+	if err != nil {
+		t.Fatalf("unable to load states: %s", err)
+	}
+	if !loaded.Get(h).Sticky {
+		t.Errorf("expected thread %s to be sticky after reloading", h)
+	}
+	if s := loaded.Sticky(); len(s) != 1 || s[0] != h {
+		t.Errorf("Sticky() = %v, want [%s]", s, h)
+	}
+	if err := loaded.Update(h, func(st *ThreadState) { st.Sticky = false }); err != nil {
+		t.Fatalf("unable to update state: %s", err)
+	}
+	if len(loaded.Sticky()) != 0 {
+		t.Errorf("expected no sticky threads")
+	}
+}
+
+func TestCanLockThread(t *testing.T) {
+	prev := Instance.Conf
+	Instance.Conf = &config.Configuration{Moderators: []string{"admin"}}
+	defer func() { Instance.Conf = prev }()
+
+	author := Account{Handle: "author", Hash: HashFromString("5cf1e2d0-0d2b-11eb-adc1-0242ac120002")}
+	other := Account{Handle: "other", Hash: HashFromString("6a7b8c9d-0d2b-11eb-adc1-0242ac120002")}
+	admin := Account{Handle: "admin", Hash: HashFromString("7b8c9d0e-0d2b-11eb-adc1-0242ac120002")}
+	op := &Item{Hash: HashFromString("8c9d0e1f-0d2b-11eb-adc1-0242ac120002"), SubmittedBy: &author}
+
+	tests := []struct {
+		name string
+		acc  *Account
+		st   ThreadState
+		want bool
+	}{
+		{name: "author-lock", acc: &author, st: ThreadState{}, want: true},
+		{name: "author-unlock-own", acc: &author, st: ThreadState{Locked: true, LockedBy: "author"}, want: true},
+		{name: "author-unlock-moderator", acc: &author, st: ThreadState{Locked: true, LockedBy: "admin", LockedByModerator: true}, want: false},
+		{name: "moderator-unlock", acc: &admin, st: ThreadState{Locked: true, LockedBy: "admin", LockedByModerator: true}, want: true},
+		{name: "other", acc: &other, st: ThreadState{}, want: false},
+		{name: "anonymous", acc: &AnonymousAccount, st: ThreadState{}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := canLockThread(tt.acc, op, tt.st); got != tt.want {
+				t.Errorf("canLockThread() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+
+	locked := *op
+	locked.Flags |= FlagsLocked | FlagsModeratorLocked
+	if canLockItem(&author, &locked) {
+		t.Errorf("canLockItem() = true, expected the author not to be able to unlock a thread locked by a moderator")
+	}
+}
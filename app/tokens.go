@@ -0,0 +1,246 @@
+package app
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ap/errors"
+	"github.com/mariusor/go-littr/internal/log"
+	"golang.org/x/oauth2"
+)
+
+// sessionTokenRefreshMargin is how long before its expiry we refresh the token of a logged account when loading the
+// session, so it doesn't expire in the middle of the request, when we can't save the new token to the session anymore
+const sessionTokenRefreshMargin = 5 * time.Minute
+
+// refreshedTokenCacheDuration is how long we keep a refreshed token around for the requests that still carry the old
+// refresh token, as FedBOX invalidates it once it has been used
+const refreshedTokenCacheDuration = time.Minute
+
+// tokenRefresh is a refresh of an OAuth2 token, shared by all the requests that try to refresh the same token
+type tokenRefresh struct {
+	done  chan struct{}
+	tok   *oauth2.Token
+	err   error
+	until time.Time
+}
+
+// tokenLockStripes is the number of locks in a stripedLocks set
+const tokenLockStripes = 64
+
+// stripedLocks is a fixed set of locks, the one guarding a key is picked by the key's hash, so the number
+// of locks doesn't grow with the accounts, or with the random tokens we receive
+type stripedLocks [tokenLockStripes]sync.Mutex
+
+// get returns the lock guarding key
+func (l *stripedLocks) get(key string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return &l[h.Sum32()%tokenLockStripes]
+}
+
+var (
+	// accountTokenLocks guard the OAuth2 token of each account, as the application account is shared by all requests
+	accountTokenLocks stripedLocks
+	// tokenRefreshes holds the in progress and the recent token refreshes, keyed by the refresh token they used
+	tokenRefreshes   = make(map[string]*tokenRefresh)
+	tokenRefreshLock sync.Mutex
+)
+
+// accountTokenLock returns the lock guarding the OAuth2 token of the account
+func accountTokenLock(a *Account) *sync.Mutex {
+	return accountTokenLocks.get(a.Handle)
+}
+
+// tokenExpires returns true if the token is invalid or expires in less than margin
+func tokenExpires(tok *oauth2.Token, margin time.Duration) bool {
+	if tok == nil || len(tok.AccessToken) == 0 {
+		return true
+	}
+	if tok.Expiry.IsZero() {
+		return false
+	}
+	return tok.Expiry.Add(-margin).Before(time.Now())
+}
+
+// loadApplicationAccount loads the actor of the OAuth2 client littr uses with FedBOX, and authenticates it
+// with the client's credentials. The account is kept even when the authentication fails, so refreshToken can
+// try again later.
+func (r *repository) loadApplicationAccount(ctx context.Context, config oauth2.Config) error {
+	if len(config.ClientID) == 0 {
+		return errors.NotValidf("no OAuth2 client ID")
+	}
+	oauth, err := r.fedbox.Actor(ctx, actors.IRI(r.BaseURL()).AddPath(config.ClientID))
+	if err != nil || oauth == nil {
+		return errors.NewNotFound(err, "unable to load the actor of the OAuth2 client")
+	}
+	app := new(Account)
+	if err := app.FromActivityPub(oauth); err != nil || !app.HasMetadata() {
+		return errors.NotValidf("invalid actor for the OAuth2 client")
+	}
+	app.Metadata.OAuth.Provider = "fedbox"
+	r.app = app
+
+	tok, err := config.PasswordCredentialsToken(ctx, app.Handle, config.ClientSecret)
+	if err != nil {
+		return err
+	}
+	if tok == nil {
+		return errors.Newf("no valid OAuth2 token received for the client")
+	}
+	app.Metadata.OAuth.Token = tok
+	return nil
+}
+
+// refreshToken returns the OAuth2 token of the account, refreshing it first, if it expires in less than margin.
+// The new token replaces the old one in the account's metadata.
+// For the application account, when the refresh fails, we authenticate again with the client's credentials,
+// like we do at start-up.
+func (r *repository) refreshToken(ctx context.Context, a *Account, margin time.Duration) (*oauth2.Token, error) {
+	if !a.HasMetadata() {
+		return nil, nil
+	}
+	isApp := r.app != nil && a == r.app
+
+	l := accountTokenLock(a)
+	l.Lock()
+	tok := a.Metadata.OAuth.Token
+	l.Unlock()
+
+	if tok == nil && !isApp {
+		return nil, nil
+	}
+	if !tokenExpires(tok, margin) {
+		return tok, nil
+	}
+
+	fresh, err := r.sharedTokenRefresh(ctx, a, tok, isApp)
+	if err != nil {
+		return nil, err
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if cur := a.Metadata.OAuth.Token; cur != tok && !tokenExpires(cur, margin) {
+		// NOTE(marius): another request refreshed the token while we were waiting
+		return cur, nil
+	}
+	a.Metadata.OAuth.Token = fresh
+	return fresh, nil
+}
+
+// sharedTokenRefresh refreshes tok only once for all the concurrent requests, and returns the same fresh token
+// for a while to the ones that come later with the old refresh token, instead of failing to use it a second time.
+// The network requests are made without holding any lock.
+func (r *repository) sharedTokenRefresh(ctx context.Context, a *Account, tok *oauth2.Token, isApp bool) (*oauth2.Token, error) {
+	key := "password:" + a.Handle
+	if tok != nil && len(tok.RefreshToken) > 0 {
+		key = "refresh:" + tok.RefreshToken
+	}
+
+	now := time.Now()
+	tokenRefreshLock.Lock()
+	for k, rf := range tokenRefreshes {
+		if !rf.until.IsZero() && rf.until.Before(now) {
+			delete(tokenRefreshes, k)
+		}
+	}
+	rf, inProgress := tokenRefreshes[key]
+	if !inProgress {
+		rf = &tokenRefresh{done: make(chan struct{})}
+		tokenRefreshes[key] = rf
+	}
+	tokenRefreshLock.Unlock()
+
+	if inProgress {
+		select {
+		case <-rf.done:
+			return rf.tok, rf.err
+		case <-ctx.Done():
+			return nil, errors.Annotatef(ctx.Err(), "unable to refresh the OAuth2 token of %s", a.Handle)
+		}
+	}
+
+	rf.tok, rf.err = r.requestToken(ctx, a, tok, isApp)
+
+	tokenRefreshLock.Lock()
+	if rf.err != nil {
+		delete(tokenRefreshes, key)
+	} else {
+		rf.until = time.Now().Add(refreshedTokenCacheDuration)
+	}
+	tokenRefreshLock.Unlock()
+	close(rf.done)
+
+	return rf.tok, rf.err
+}
+
+// requestToken asks FedBOX for a new OAuth2 token for the account
+func (r *repository) requestToken(ctx context.Context, a *Account, tok *oauth2.Token, isApp bool) (*oauth2.Token, error) {
+	config := GetOauth2Config("fedbox", Instance.BaseURL)
+	err := errors.Unauthorizedf("no refresh token")
+	var fresh *oauth2.Token
+	if tok != nil && len(tok.RefreshToken) > 0 {
+		// NOTE(marius): the token source refreshes the token when it's expired, so we mark it as such
+		// for the ones that are still valid but inside the margin
+		expired := *tok
+		expired.Expiry = time.Now().Add(-time.Second)
+		fresh, err = config.TokenSource(ctx, &expired).Token()
+	}
+	if err != nil && isApp {
+		fresh, err = config.PasswordCredentialsToken(ctx, a.Handle, config.ClientSecret)
+	}
+	if err != nil || fresh == nil {
+		if err == nil {
+			err = errors.Newf("nil token received")
+		}
+		return nil, errors.NewUnauthorized(err, "unable to refresh the OAuth2 token of %s", a.Handle)
+	}
+	r.infoFn(log.Ctx{
+		"handle": a.Handle,
+		"token":  hideString(fresh.AccessToken),
+		"expiry": fresh.Expiry,
+	})("refreshed OAuth2 token")
+	return fresh, nil
+}
+
+// revokeToken asks FedBOX to invalidate the refresh token and the access token of tok, using the token revocation
+// end-point from RFC7009 next to the token one
+func revokeToken(ctx context.Context, tok *oauth2.Token) error {
+	if tok == nil {
+		return nil
+	}
+	config := GetOauth2Config("fedbox", Instance.BaseURL)
+	revokeURL := strings.TrimSuffix(config.Endpoint.TokenURL, "/token") + "/revoke"
+	toRevoke := [][2]string{
+		{"refresh_token", tok.RefreshToken},
+		{"access_token", tok.AccessToken},
+	}
+	for _, rt := range toRevoke {
+		hint, t := rt[0], rt[1]
+		if len(t) == 0 {
+			continue
+		}
+		form := url.Values{"token": {t}, "token_type_hint": {hint}}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, revokeURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(url.QueryEscape(config.ClientID), url.QueryEscape(config.ClientSecret))
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return errors.Annotatef(err, "unable to revoke the OAuth2 %s", hint)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return errors.Newf("unable to revoke the OAuth2 %s: %s", hint, res.Status)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,294 @@
+package app
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	pub "github.com/go-ap/activitypub"
+	"github.com/go-ap/errors"
+	"github.com/go-chi/chi"
+	"github.com/gorilla/csrf"
+	"github.com/mariusor/go-littr/internal/log"
+	"golang.org/x/oauth2"
+)
+
+const (
+	scopeSubmit = "submit"
+	scopeVote   = "vote"
+	scopeFollow = "follow"
+	scopeReport = "report"
+
+	accessTokenPrefix = "littr_"
+	maxAccessTokens   = 20
+
+	// accessTokenUseInterval is how often we record the last time an access token was used, so we don't write
+	// to the store on every request
+	accessTokenUseInterval = time.Minute
+)
+
+// accessTokenScopes are the actions personal access tokens can be allowed to perform, with their descriptions
+var accessTokenScopes = map[string]string{
+	scopeSubmit: "Submit items, comments and messages",
+	scopeVote:   "Vote on items",
+	scopeFollow: "Follow accounts and communities",
+	scopeReport: "Report items and accounts",
+}
+
+// AccessToken is a personal access token, that scripts and bots use in the Authorization header
+// instead of logging in. We store only the hash of the token.
+type AccessToken struct {
+	ID     string
+	Name   string
+	Scopes []string
+	// Actor is the IRI of the account the token belongs to
+	Actor string
+	// Token are the FedBOX credentials the requests authenticated with the access token use
+	Token    *oauth2.Token
+	Created  time.Time
+	LastUsed time.Time
+}
+
+// Allows returns true if the token has the scope
+func (t AccessToken) Allows(scope string) bool {
+	return stringInSlice(t.Scopes)(scope)
+}
+
+func hashAccessToken(tok string) string {
+	sum := sha256.Sum256([]byte(tok))
+	return hex.EncodeToString(sum[:])
+}
+
+func newAccessToken() string {
+	b := make([]byte, 32)
+	rand.Read(b)
+	return accessTokenPrefix + hex.EncodeToString(b)
+}
+
+// bearerToken returns the personal access token from the Authorization header of the request
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < 7 || !strings.EqualFold(auth[:7], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[7:])
+}
+
+// accessTokenLocks serialize the concurrent requests using the same access token, so they don't overwrite
+// the FedBOX credentials each other refreshed. They are separate from the accountTokenLocks, which
+// Use takes too, through refreshToken.
+var accessTokenLocks stripedLocks
+
+// accessTokenStore keeps the personal access tokens, by the hash of the token
+type accessTokenStore struct {
+	*fileStore
+}
+
+func (s *accessTokenStore) Load(id string) (AccessToken, error) {
+	t := AccessToken{}
+	if s.fileStore == nil {
+		return t, errors.NotFoundf("access tokens are not available")
+	}
+	err := s.fileStore.Load(id, &t)
+	return t, err
+}
+
+// ForAccount returns the access tokens of the account with the actor IRI
+func (s *accessTokenStore) ForAccount(actor string) ([]AccessToken, error) {
+	if s.fileStore == nil {
+		return nil, nil
+	}
+	keys, err := s.Keys()
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]AccessToken, 0)
+	for _, k := range keys {
+		t := AccessToken{}
+		if err := s.fileStore.Load(k, &t); err != nil || t.Actor != actor {
+			continue
+		}
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].Created.Before(tokens[j].Created)
+	})
+	return tokens, nil
+}
+
+// Create saves a new access token and returns it in clear, it is the only time it is available
+func (s *accessTokenStore) Create(t AccessToken) (string, error) {
+	tokens, err := s.ForAccount(t.Actor)
+	if err != nil {
+		return "", err
+	}
+	if len(tokens) >= maxAccessTokens {
+		return "", errors.Forbiddenf("an account can have at most %d access tokens", maxAccessTokens)
+	}
+	tok := newAccessToken()
+	t.ID = hashAccessToken(tok)
+	t.Created = time.Now().UTC()
+	if err := s.Save(t.ID, t); err != nil {
+		return "", err
+	}
+	return tok, nil
+}
+
+// Use loads the access token, refreshes its FedBOX credentials if needed and records the time it was used.
+// The time is saved only when it's older than accessTokenUseInterval, or together with the refreshed credentials.
+func (s *accessTokenStore) Use(ctx context.Context, r *repository, tok string) (AccessToken, error) {
+	id := hashAccessToken(tok)
+	l := accessTokenLocks.get(id)
+	l.Lock()
+	defer l.Unlock()
+
+	t, err := s.Load(id)
+	if err != nil {
+		return t, errors.NewUnauthorized(err, "invalid access token")
+	}
+	old := t.Token
+	// NOTE(marius): the token's ID stands for the handle, as its credentials are refreshed separately from the account's
+	a := Account{Handle: id, Metadata: &AccountMetadata{OAuth: OAuth{Token: t.Token}}}
+	if t.Token, err = r.refreshToken(ctx, &a, 0); err != nil {
+		return t, err
+	}
+	if t.Token == old && time.Since(t.LastUsed) < accessTokenUseInterval {
+		return t, nil
+	}
+	t.LastUsed = time.Now().UTC()
+	if err := s.Save(t.ID, t); err != nil {
+		return t, err
+	}
+	return t, nil
+}
+
+func ContextAccessToken(ctx context.Context) *AccessToken {
+	var t *AccessToken
+	t, _ = ctx.Value(AccessTokenCtxtKey).(*AccessToken)
+	return t
+}
+
+// LoadAccessToken verifies the personal access token of the requests that have one in the Authorization header.
+// The account it belongs to is used only on the routes that allow the token's scopes, see AccessTokenScope.
+func (h *handler) LoadAccessToken(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		tok := bearerToken(r)
+		if len(tok) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t, err := h.accessTokens.Use(r.Context(), h.storage, tok)
+		if err != nil {
+			h.errFn(log.Ctx{"err": err, "path": r.URL.Path})("invalid access token")
+			errors.HandleError(errors.NewUnauthorized(err, "invalid access token")).ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), AccessTokenCtxtKey, &t)))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// AccessTokenScope logs in the account of the request's access token, if the token has the scope.
+// As browsers don't send the Authorization header on their own, the CSRF check is skipped for these requests,
+// so it needs to come before the CSRF middleware on the route.
+func (h *handler) AccessTokenScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			t := ContextAccessToken(r.Context())
+			if t == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if !t.Allows(scope) {
+				errors.HandleError(errors.Forbiddenf("the access token doesn't have the %s scope", scope)).ServeHTTP(w, r)
+				return
+			}
+			ctx := r.Context()
+			acc, err := h.storage.LoadAccount(ctx, pub.IRI(t.Actor))
+			if err != nil || !acc.IsValid() {
+				h.errFn(log.Ctx{"err": err, "actor": t.Actor})("unable to load access token account")
+				errors.HandleError(errors.Unauthorizedf("invalid access token")).ServeHTTP(w, r)
+				return
+			}
+			acc.Metadata.OAuth = OAuth{Provider: "fedbox", Token: t.Token}
+			ctx = context.WithValue(ctx, LoggedAccountCtxtKey, acc)
+			ctx = context.WithValue(ctx, RepositoryCtxtKey, h.storage.WithAccount(acc))
+			next.ServeHTTP(w, csrf.UnsafeSkipCheck(r.WithContext(ctx)))
+		}
+		return http.HandlerFunc(fn)
+	}
+}
+
+// HandleCreateAccessToken serves POST /settings/tokens requests
+func (h *handler) HandleCreateAccessToken(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	name := strings.TrimSpace(r.PostFormValue("name"))
+	if len(name) == 0 || len(name) > 64 {
+		h.v.addFlashMessage(Error, w, r, "The access token needs a name of at most 64 characters")
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	scopes := make([]string, 0)
+	for _, s := range r.PostForm["scopes"] {
+		if _, ok := accessTokenScopes[s]; ok && !stringInSlice(scopes)(s) {
+			scopes = append(scopes, s)
+		}
+	}
+	if len(scopes) == 0 {
+		h.v.addFlashMessage(Error, w, r, "The access token needs at least one scope")
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	sort.Strings(scopes)
+
+	ctx := r.Context()
+	ltx := log.Ctx{"handle": acc.Handle, "name": name}
+	// NOTE(marius): the token gets its own FedBOX credentials, so it doesn't share a refresh token with the session
+	fedboxTok, err := h.storage.accountToken(ctx, *acc, randomState())
+	if err != nil {
+		h.errFn(ltx, log.Ctx{"err": err})("unable to load FedBOX token for access token")
+		h.v.addFlashMessage(Error, w, r, "Unable to create access token")
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	tok, err := h.accessTokens.Create(AccessToken{Name: name, Scopes: scopes, Actor: acc.Metadata.ID, Token: fedboxTok})
+	if err != nil {
+		h.errFn(ltx, log.Ctx{"err": err})("unable to create access token")
+		h.v.addFlashMessage(Error, w, r, err.Error())
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	h.infoFn(ltx, log.Ctx{"scopes": scopes})("created access token")
+	m := h.settingsModel(r)
+	m.NewAccessToken = tok
+	h.v.RenderTemplate(r, w, m.Template(), m)
+}
+
+// HandleRevokeAccessToken serves POST /settings/tokens/{id}/rm requests
+func (h *handler) HandleRevokeAccessToken(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	t, err := h.accessTokens.Load(chi.URLParam(r, "id"))
+	if err != nil || !acc.HasMetadata() || t.Actor != acc.Metadata.ID {
+		h.v.HandleErrors(w, r, errors.NotFoundf("access token"))
+		return
+	}
+	ltx := log.Ctx{"handle": acc.Handle, "name": t.Name}
+	// NOTE(marius): we remove the access token even when FedBOX can't revoke its credentials, as they're only
+	// available to the requests authenticated with it
+	if err := revokeToken(r.Context(), t.Token); err != nil {
+		h.errFn(ltx, log.Ctx{"err": err})("unable to revoke the FedBOX credentials of access token")
+	}
+	if err := h.accessTokens.Delete(t.ID); err != nil {
+		h.errFn(ltx, log.Ctx{"err": err})("unable to revoke access token")
+		h.v.addFlashMessage(Error, w, r, "Unable to revoke access token")
+	} else {
+		h.infoFn(ltx)("revoked access token")
+		h.v.addFlashMessage(Success, w, r, "Revoked access token "+t.Name)
+	}
+	h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
@@ -0,0 +1,108 @@
+package app
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-ap/errors"
+	"golang.org/x/oauth2"
+)
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		header string
+		want   string
+	}{
+		{header: "", want: ""},
+		{header: "Basic am9objpkb2U=", want: ""},
+		{header: "Bearer", want: ""},
+		{header: "Bearer littr_0123", want: "littr_0123"},
+		{header: "bearer  littr_0123 ", want: "littr_0123"},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest(http.MethodPost, "/submit", nil)
+		if len(tt.header) > 0 {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if got := bearerToken(r); got != tt.want {
+			t.Errorf("bearerToken(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestAccessTokenStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-test")
+	if err != nil {
+		t.Fatalf("unable to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := newFileStore(dir, "tokens")
+	if err != nil {
+		t.Fatalf("unable to create store: %s", err)
+	}
+	s := accessTokenStore{fs}
+	actor := "https://fedbox.littr.example/actors/f7e0bd1a-2f5f-11eb-9d4b-0242ac130002"
+	fedboxTok := &oauth2.Token{AccessToken: "fedbox", TokenType: "Bearer"}
+
+	tok, err := s.Create(AccessToken{Name: "bot", Scopes: []string{scopeSubmit, scopeVote}, Actor: actor, Token: fedboxTok})
+	if err != nil {
+		t.Fatalf("Create() error = %s", err)
+	}
+	if !strings.HasPrefix(tok, accessTokenPrefix) {
+		t.Errorf("Create() = %s, expected the %s prefix", tok, accessTokenPrefix)
+	}
+	if _, err := s.Create(AccessToken{Name: "other", Scopes: []string{scopeFollow}, Actor: "https://fedbox.littr.example/actors/other"}); err != nil {
+		t.Fatalf("Create() error = %s", err)
+	}
+
+	saved, err := s.Load(hashAccessToken(tok))
+	if err != nil {
+		t.Fatalf("Load() error = %s", err)
+	}
+	if saved.ID == tok || saved.Token.AccessToken != "fedbox" {
+		t.Errorf("Load() = %#v, expected the hashed token with the FedBOX credentials", saved)
+	}
+	if !saved.Allows(scopeVote) || saved.Allows(scopeReport) {
+		t.Errorf("Allows() doesn't match the scopes %v", saved.Scopes)
+	}
+
+	r := &repository{infoFn: defaultCtxLogFn, errFn: defaultCtxLogFn}
+	used, err := s.Use(context.TODO(), r, tok)
+	if err != nil || used.LastUsed.IsZero() {
+		t.Errorf("Use() = %#v, %v, expected the last use time to be recorded", used, err)
+	}
+	if again, err := s.Use(context.TODO(), r, tok); err != nil || !again.LastUsed.Equal(used.LastUsed) {
+		t.Errorf("Use() = %#v, %v, expected the last use time to be saved at most every %s", again, err, accessTokenUseInterval)
+	}
+	if _, err := s.Use(context.TODO(), r, accessTokenPrefix+"invalid"); !errors.IsUnauthorized(err) {
+		t.Errorf("Use() error = %v, expected unauthorized for an unknown token", err)
+	}
+
+	tokens, err := s.ForAccount(actor)
+	if err != nil {
+		t.Fatalf("ForAccount() error = %s", err)
+	}
+	if len(tokens) != 1 || tokens[0].Name != "bot" {
+		t.Errorf("ForAccount() = %#v, want the bot token", tokens)
+	}
+	for i := len(tokens); i < maxAccessTokens; i++ {
+		if _, err := s.Create(AccessToken{Name: "bot", Scopes: []string{scopeVote}, Actor: actor}); err != nil {
+			t.Fatalf("Create() error = %s", err)
+		}
+	}
+	if _, err := s.Create(AccessToken{Name: "bot", Scopes: []string{scopeVote}, Actor: actor}); !errors.IsForbidden(err) {
+		t.Errorf("Create() error = %v, expected forbidden over the limit of %d tokens", err, maxAccessTokens)
+	}
+
+	if err := s.Delete(saved.ID); err != nil {
+		t.Fatalf("Delete() error = %s", err)
+	}
+	if _, err := s.Use(context.TODO(), r, tok); !errors.IsUnauthorized(err) {
+		t.Errorf("Use() error = %v, expected unauthorized for a revoked token", err)
+	}
+}
@@ -0,0 +1,195 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-ap/errors"
+	"golang.org/x/oauth2"
+)
+
+func TestTokenExpires(t *testing.T) {
+	tests := []struct {
+		name string
+		tok  *oauth2.Token
+		want bool
+	}{
+		{name: "nil", tok: nil, want: true},
+		{name: "empty", tok: &oauth2.Token{}, want: true},
+		{name: "no expiry", tok: &oauth2.Token{AccessToken: "tok"}, want: false},
+		{name: "valid", tok: &oauth2.Token{AccessToken: "tok", Expiry: time.Now().Add(time.Hour)}, want: false},
+		{name: "inside margin", tok: &oauth2.Token{AccessToken: "tok", Expiry: time.Now().Add(time.Minute)}, want: true},
+		{name: "expired", tok: &oauth2.Token{AccessToken: "tok", Expiry: time.Now().Add(-time.Minute)}, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tokenExpires(tt.tok, sessionTokenRefreshMargin); got != tt.want {
+				t.Errorf("tokenExpires() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStripedLocks(t *testing.T) {
+	var locks stripedLocks
+	if locks.get("jdoe") != locks.get("jdoe") {
+		t.Errorf("get() returned different locks for the same key")
+	}
+	used := make(map[*sync.Mutex]bool)
+	for i := 0; i < 10*tokenLockStripes; i++ {
+		used[locks.get(fmt.Sprintf("token-%d", i))] = true
+	}
+	if len(used) > tokenLockStripes {
+		t.Errorf("get() returned %d locks, expected at most %d", len(used), tokenLockStripes)
+	}
+}
+
+func TestRepository_refreshToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth/token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Form.Get("grant_type") == "refresh_token" && r.Form.Get("refresh_token") == "refresh":
+			fmt.Fprint(w, `{"access_token":"refreshed","token_type":"Bearer","refresh_token":"refresh2","expires_in":3600}`)
+		case r.Form.Get("grant_type") == "password" && r.Form.Get("username") == "app":
+			fmt.Fprint(w, `{"access_token":"app","token_type":"Bearer","expires_in":3600}`)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+		}
+	}))
+	defer srv.Close()
+
+	prev := os.Getenv("API_URL")
+	os.Setenv("API_URL", srv.URL)
+	defer os.Setenv("API_URL", prev)
+
+	expired := time.Now().Add(-time.Minute)
+	app := &Account{Handle: "app", Metadata: &AccountMetadata{}}
+	r := &repository{app: app, infoFn: defaultCtxLogFn, errFn: defaultCtxLogFn}
+
+	valid := &oauth2.Token{AccessToken: "valid", Expiry: time.Now().Add(time.Hour)}
+	a := &Account{Handle: "johndoe", Metadata: &AccountMetadata{OAuth: OAuth{Token: valid}}}
+	if tok, err := r.refreshToken(context.TODO(), a, 0); err != nil || tok != valid {
+		t.Errorf("refreshToken() = %v, %v, expected the valid token to be kept", tok, err)
+	}
+
+	a.Metadata.OAuth.Token = &oauth2.Token{AccessToken: "old", RefreshToken: "refresh", Expiry: expired}
+	tok, err := r.refreshToken(context.TODO(), a, 0)
+	if err != nil {
+		t.Fatalf("refreshToken() error = %s", err)
+	}
+	if tok.AccessToken != "refreshed" || a.Metadata.OAuth.Token != tok {
+		t.Errorf("refreshToken() = %v, expected the refreshed token to be saved on the account", tok)
+	}
+
+	a.Metadata.OAuth.Token = &oauth2.Token{AccessToken: "old", RefreshToken: "invalid", Expiry: expired}
+	if _, err := r.refreshToken(context.TODO(), a, 0); !errors.IsUnauthorized(err) {
+		t.Errorf("refreshToken() error = %v, expected unauthorized", err)
+	}
+
+	app.Metadata.OAuth.Token = &oauth2.Token{AccessToken: "old", RefreshToken: "invalid", Expiry: expired}
+	if tok, err := r.refreshToken(context.TODO(), app, 0); err != nil || tok.AccessToken != "app" {
+		t.Errorf("refreshToken() = %v, %v, expected the application to authenticate again", tok, err)
+	}
+}
+
+func TestRepository_refreshTokenConcurrent(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		w.Header().Set("Content-Type", "application/json")
+		if r.Form.Get("refresh_token") != "single-use" || atomic.AddInt32(&calls, 1) > 1 {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":"invalid_grant"}`)
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, `{"access_token":"fresh","token_type":"Bearer","refresh_token":"single-use2","expires_in":3600}`)
+	}))
+	defer srv.Close()
+
+	prev := os.Getenv("API_URL")
+	os.Setenv("API_URL", srv.URL)
+	defer os.Setenv("API_URL", prev)
+
+	r := &repository{infoFn: defaultCtxLogFn, errFn: defaultCtxLogFn}
+	expired := &oauth2.Token{AccessToken: "old", RefreshToken: "single-use", Expiry: time.Now().Add(-time.Minute)}
+
+	// NOTE(marius): each request loads its own copy of the session account, with the same refresh token
+	var wg sync.WaitGroup
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tok := *expired
+			a := &Account{Handle: "johndoe", Metadata: &AccountMetadata{OAuth: OAuth{Token: &tok}}}
+			fresh, err := r.refreshToken(context.TODO(), a, 0)
+			if err == nil && fresh.AccessToken != "fresh" {
+				err = errors.Newf("received token %s", fresh.AccessToken)
+			}
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("refreshToken() error = %s, expected all the requests to receive the refreshed token", err)
+		}
+	}
+
+	// NOTE(marius): a request that comes after the refresh finished, with the old token from its session
+	tok := *expired
+	a := &Account{Handle: "johndoe", Metadata: &AccountMetadata{OAuth: OAuth{Token: &tok}}}
+	if fresh, err := r.refreshToken(context.TODO(), a, 0); err != nil || fresh.AccessToken != "fresh" {
+		t.Errorf("refreshToken() = %v, %v, expected the cached refreshed token", fresh, err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("refreshToken() used the refresh token %d times, expected once", n)
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+	revoked := make([]string, 0)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth/revoke" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		r.ParseForm()
+		if r.Form.Get("token") == "unknown" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		revoked = append(revoked, r.Form.Get("token_type_hint")+":"+r.Form.Get("token"))
+	}))
+	defer srv.Close()
+
+	prev := os.Getenv("API_URL")
+	os.Setenv("API_URL", srv.URL)
+	defer os.Setenv("API_URL", prev)
+
+	if err := revokeToken(context.TODO(), &oauth2.Token{AccessToken: "access", RefreshToken: "refresh"}); err != nil {
+		t.Fatalf("revokeToken() error = %s", err)
+	}
+	want := []string{"refresh_token:refresh", "access_token:access"}
+	if len(revoked) != len(want) || revoked[0] != want[0] || revoked[1] != want[1] {
+		t.Errorf("revokeToken() revoked %v, want %v", revoked, want)
+	}
+	if err := revokeToken(context.TODO(), &oauth2.Token{AccessToken: "unknown"}); err == nil {
+		t.Errorf("revokeToken() expected error when FedBOX refuses the revocation")
+	}
+}
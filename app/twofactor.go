@@ -0,0 +1,443 @@
+package app
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-ap/errors"
+	"github.com/mariusor/go-littr/internal/log"
+	"github.com/skip2/go-qrcode"
+)
+
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	// totpSkew is the number of periods before and after the current one for which we accept codes
+	totpSkew = 1
+
+	recoveryCodesCount = 10
+
+	sessionPendingLoginKey     = "__pending_login"
+	sessionPendingLoginTimeKey = "__pending_login_time"
+
+	// pendingLoginTimeout is how long the users have to provide the second factor after the password
+	pendingLoginTimeout = 5 * time.Minute
+	// pendingLoginAttempts is how many invalid codes we accept before the account's logins are locked
+	pendingLoginAttempts = 5
+	// loginLockout is how long the logins of an account stay locked after too many invalid codes
+	loginLockout = 15 * time.Minute
+)
+
+var b32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// twoFactor holds the TOTP secret and the recovery codes of an account
+type twoFactor struct {
+	Secret string
+	// Enabled is false until the users confirm the enrolment with a valid code
+	Enabled bool
+	// RecoveryCodes are the SHA-256 hashes of the unused recovery codes
+	RecoveryCodes []string
+	// LastStep is the time step of the last accepted code, so codes can't be used twice
+	LastStep int64
+	Enrolled time.Time
+}
+
+// totpCode returns the RFC 6238 code for the time step, using HMAC-SHA1
+func totpCode(secret []byte, step int64) string {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, bin%1000000)
+}
+
+func totpStep(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+// validateTOTP checks code against the time steps around now, and returns the matching step,
+// which needs to be newer than the last one used
+func (t twoFactor) validateTOTP(code string, now time.Time) (int64, bool) {
+	secret, err := b32.DecodeString(t.Secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+	cur := totpStep(now)
+	for step := cur - totpSkew; step <= cur+totpSkew; step++ {
+		if step <= t.LastStep {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(totpCode(secret, step)), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func hashRecoveryCode(code string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(strings.TrimSpace(code))))
+	return hex.EncodeToString(sum[:])
+}
+
+// useRecoveryCode removes code from the unused recovery codes, it returns false if it wasn't one of them
+func (t *twoFactor) useRecoveryCode(code string) bool {
+	h := hashRecoveryCode(code)
+	for i, c := range t.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(c), []byte(h)) == 1 {
+			t.RecoveryCodes = append(t.RecoveryCodes[:i], t.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// verify accepts either a TOTP code or one of the recovery codes
+func (t *twoFactor) verify(code string, now time.Time) bool {
+	code = strings.ReplaceAll(strings.TrimSpace(code), " ", "")
+	if step, ok := t.validateTOTP(code, now); ok {
+		t.LastStep = step
+		return true
+	}
+	return t.useRecoveryCode(code)
+}
+
+func newTOTPSecret() string {
+	b := make([]byte, 20)
+	rand.Read(b)
+	return b32.EncodeToString(b)
+}
+
+// newRecoveryCodes generates the recovery codes, it returns them in clear, to be shown once to the user,
+// and their hashes that we store
+func newRecoveryCodes() ([]string, []string) {
+	codes := make([]string, recoveryCodesCount)
+	hashes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		rand.Read(b)
+		c := hex.EncodeToString(b)
+		codes[i] = fmt.Sprintf("%s-%s", c[:5], c[5:])
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+	return codes, hashes
+}
+
+// provisioningURI returns the otpauth URI that authenticator applications read from the QR code
+func (t twoFactor) provisioningURI(issuer, handle string) string {
+	q := url.Values{}
+	q.Set("secret", t.Secret)
+	q.Set("issuer", issuer)
+	q.Set("algorithm", "SHA1")
+	q.Set("digits", fmt.Sprintf("%d", totpDigits))
+	q.Set("period", fmt.Sprintf("%d", totpPeriod))
+	label := url.PathEscape(fmt.Sprintf("%s:%s", issuer, handle))
+	return fmt.Sprintf("otpauth://totp/%s?%s", label, q.Encode())
+}
+
+// twoFactorStore keeps the two-factor authentication settings of the accounts, by their hash
+type twoFactorStore struct {
+	*fileStore
+}
+
+func (s twoFactorStore) Load(a Account) (twoFactor, error) {
+	t := twoFactor{}
+	if s.fileStore == nil {
+		return t, errors.NotFoundf("two-factor authentication is not available")
+	}
+	err := s.fileStore.Load(a.Hash.String(), &t)
+	return t, err
+}
+
+// Enabled returns true if the account has confirmed its two-factor enrolment
+func (s twoFactorStore) Enabled(a Account) bool {
+	t, err := s.Load(a)
+	return err == nil && t.Enabled
+}
+
+// loginAttempts are the failed login attempts of an account, since the last successful one
+type loginAttempts struct {
+	Failed      int
+	LockedUntil time.Time
+}
+
+// loginAttemptStore keeps the failed login attempts of the accounts on the server, by the kind of
+// the login and the account hash, so the users can't reset them by sending an older session cookie
+type loginAttemptStore struct {
+	*fileStore
+}
+
+// loginAttemptLocks serialize the login attempts of an account, so they are all counted
+var loginAttemptLocks stripedLocks
+
+// errLoginLocked is returned for the accounts whose logins are locked after too many failed attempts
+var errLoginLocked = errors.Forbiddenf("too many failed attempts, try again later")
+
+// Attempt runs verify for the login of kind, eg: 2fa or ssh, of the account and records its result.
+// After pendingLoginAttempts failures the account's logins of kind are locked for loginLockout,
+// and Attempt returns errLoginLocked without running verify.
+func (s loginAttemptStore) Attempt(kind string, a Account, now time.Time, verify func() bool) (bool, error) {
+	if s.fileStore == nil {
+		return false, errors.NotFoundf("login attempts are not available")
+	}
+	key := fmt.Sprintf("%s-%s", kind, a.Hash)
+	l := loginAttemptLocks.get(key)
+	l.Lock()
+	defer l.Unlock()
+
+	at := loginAttempts{}
+	if err := s.Load(key, &at); err != nil && !errors.IsNotFound(err) {
+		return false, err
+	}
+	if now.Before(at.LockedUntil) {
+		return false, errLoginLocked
+	}
+	if verify() {
+		if at.Failed > 0 {
+			return true, s.Delete(key)
+		}
+		return true, nil
+	}
+	at.Failed++
+	if at.Failed >= pendingLoginAttempts {
+		at = loginAttempts{LockedUntil: now.Add(loginLockout)}
+	}
+	if err := s.Save(key, at); err != nil {
+		return false, err
+	}
+	if now.Before(at.LockedUntil) {
+		return false, errLoginLocked
+	}
+	return false, nil
+}
+
+// twoFactorSettings is the two-factor authentication part of the settings page
+type twoFactorSettings struct {
+	Enabled  bool
+	Pending  bool
+	Required bool
+	Secret   string
+	QR       template.URL
+	// RecoveryCodes are only shown once, right after the enrolment is confirmed
+	RecoveryCodes []string
+	Remaining     int
+}
+
+func (h *handler) twoFactorSettings(a Account) *twoFactorSettings {
+	s := &twoFactorSettings{Required: h.conf.ModeratorsRequire2FA && stringInSlice(h.conf.Moderators)(a.Handle)}
+	t, err := h.twoFactor.Load(a)
+	if err != nil {
+		return s
+	}
+	s.Enabled = t.Enabled
+	s.Pending = !t.Enabled
+	s.Remaining = len(t.RecoveryCodes)
+	if s.Pending {
+		s.Secret = t.Secret
+		issuer := h.conf.Name
+		if len(issuer) == 0 {
+			issuer = h.conf.HostName
+		}
+		if png, err := qrcode.Encode(t.provisioningURI(issuer, a.Handle), qrcode.Medium, 256); err == nil {
+			s.QR = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+		}
+	}
+	return s
+}
+
+// loginAccount saves the authenticated account to the session. When the account has two-factor authentication
+// enabled, it is kept aside until the second step of the login at /login/2fa succeeds. The accounts that are
+// waiting for a moderator's approval can't log in.
+func (h *handler) loginAccount(w http.ResponseWriter, r *http.Request, acct Account, msg string) {
+	s, err := h.v.s.get(w, r)
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acct.Handle})("unable to save session")
+		h.v.addFlashMessage(Error, w, r, "Login failed: unable to save session")
+		h.v.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if err := h.registrationError(acct); err != nil {
+		h.infoFn(log.Ctx{"handle": acct.Handle, "err": err})("refused login")
+		h.v.addFlashMessage(Error, w, r, fmt.Sprintf("Login failed: %s", err))
+		h.v.Redirect(w, r, "/login", http.StatusSeeOther)
+		return
+	}
+	if h.twoFactor.Enabled(acct) {
+		s.Values[sessionPendingLoginKey] = acct
+		s.Values[sessionPendingLoginTimeKey] = time.Now().Unix()
+		h.v.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+	h.startSession(s, r, acct)
+	if len(msg) > 0 {
+		h.v.addFlashMessage(Success, w, r, msg)
+	}
+	if h.conf.ModeratorsRequire2FA && stringInSlice(h.conf.Moderators)(acct.Handle) {
+		h.v.addFlashMessage(Warning, w, r, "Moderators need to enable two-factor authentication before they can moderate")
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	h.v.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// HandleTwoFactorLogin serves POST /login/2fa requests, the second step of the login for the accounts
+// with two-factor authentication enabled
+func (h *handler) HandleTwoFactorLogin(w http.ResponseWriter, r *http.Request) {
+	s, err := h.v.s.get(w, r)
+	if err != nil {
+		h.v.HandleErrors(w, r, errors.Annotatef(err, "unable to load session"))
+		return
+	}
+	acct, ok := s.Values[sessionPendingLoginKey].(Account)
+	started, _ := s.Values[sessionPendingLoginTimeKey].(int64)
+	restart := func(msg string) {
+		delete(s.Values, sessionPendingLoginKey)
+		delete(s.Values, sessionPendingLoginTimeKey)
+		h.v.addFlashMessage(Error, w, r, msg)
+		h.v.Redirect(w, r, "/login", http.StatusSeeOther)
+	}
+	if !ok || time.Since(time.Unix(started, 0)) > pendingLoginTimeout {
+		restart("Login failed: the login expired, please try again")
+		return
+	}
+
+	ltx := log.Ctx{"handle": acct.Handle}
+	var t twoFactor
+	var loadErr error
+	// NOTE(marius): the settings are loaded while holding the attempt's lock, so a code can't be used twice
+	valid, err := h.loginAttempts.Attempt("2fa", acct, time.Now(), func() bool {
+		if t, loadErr = h.twoFactor.Load(acct); loadErr != nil || !t.Enabled {
+			return false
+		}
+		if !t.verify(r.PostFormValue("code"), time.Now()) {
+			return false
+		}
+		if err := h.twoFactor.Save(acct.Hash.String(), t); err != nil {
+			h.errFn(ltx, log.Ctx{"err": err})("unable to save two-factor settings")
+		}
+		return true
+	})
+	if errors.IsForbidden(err) {
+		h.infoFn(ltx)("too many invalid two-factor codes")
+		restart("Login failed: too many invalid authentication codes, try again later")
+		return
+	}
+	if err == nil {
+		err = loadErr
+	}
+	if err != nil || !t.Enabled {
+		h.errFn(ltx, log.Ctx{"err": err})("unable to load two-factor settings")
+		restart("Login failed: unable to verify the authentication code")
+		return
+	}
+	if !valid {
+		h.v.addFlashMessage(Error, w, r, "Invalid authentication code")
+		h.v.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+	delete(s.Values, sessionPendingLoginKey)
+	delete(s.Values, sessionPendingLoginTimeKey)
+
+	acct.Metadata.SecondFactor = true
+	h.startSession(s, r, acct)
+	if len(t.RecoveryCodes) < 3 {
+		h.v.addFlashMessage(Warning, w, r, fmt.Sprintf("You have %d recovery codes left", len(t.RecoveryCodes)))
+	}
+	h.v.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// HandleTwoFactorEnroll serves POST /settings/2fa/enroll requests, it generates a new secret that
+// needs to be confirmed with a valid code before it's used at login
+func (h *handler) HandleTwoFactorEnroll(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	if h.twoFactor.Enabled(*acc) {
+		h.v.addFlashMessage(Error, w, r, "Two-factor authentication is already enabled")
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	if err := h.twoFactor.Save(acc.Hash.String(), twoFactor{Secret: newTOTPSecret()}); err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to save two-factor settings")
+		h.v.addFlashMessage(Error, w, r, "Unable to enable two-factor authentication")
+	}
+	h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
+
+// HandleTwoFactorConfirm serves POST /settings/2fa/confirm requests, it enables two-factor authentication
+// when the code matches the new secret, and shows the recovery codes
+func (h *handler) HandleTwoFactorConfirm(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	t, err := h.twoFactor.Load(*acc)
+	if err != nil || t.Enabled {
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	step, ok := t.validateTOTP(strings.TrimSpace(r.PostFormValue("code")), time.Now())
+	if !ok {
+		h.v.addFlashMessage(Error, w, r, "Invalid authentication code, check the time of your device and try again")
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	codes, hashes := newRecoveryCodes()
+	t.Enabled = true
+	t.LastStep = step
+	t.RecoveryCodes = hashes
+	t.Enrolled = time.Now().UTC()
+	if err := h.twoFactor.Save(acc.Hash.String(), t); err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to save two-factor settings")
+		h.v.HandleErrors(w, r, errors.Annotatef(err, "unable to enable two-factor authentication"))
+		return
+	}
+	h.infoFn(log.Ctx{"handle": acc.Handle})("enabled two-factor authentication")
+
+	acc.Metadata.SecondFactor = true
+	if err := h.v.saveAccountToSession(w, r, *acc); err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to save account to session")
+	}
+	h.v.addFlashMessage(Success, w, r, "Two-factor authentication is enabled")
+	m := h.settingsModel(r)
+	m.TwoFactor.RecoveryCodes = codes
+	h.v.RenderTemplate(r, w, m.Template(), m)
+}
+
+// HandleTwoFactorDisable serves POST /settings/2fa/disable requests, it needs a valid code or recovery code
+func (h *handler) HandleTwoFactorDisable(w http.ResponseWriter, r *http.Request) {
+	acc := loggedAccount(r)
+	t, err := h.twoFactor.Load(*acc)
+	if err != nil {
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	if t.Enabled && !t.verify(r.PostFormValue("code"), time.Now()) {
+		h.v.addFlashMessage(Error, w, r, "Invalid authentication code")
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	if err := h.twoFactor.Delete(acc.Hash.String()); err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to remove two-factor settings")
+		h.v.addFlashMessage(Error, w, r, "Unable to disable two-factor authentication")
+		h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+		return
+	}
+	h.infoFn(log.Ctx{"handle": acc.Handle})("disabled two-factor authentication")
+	acc.Metadata.SecondFactor = false
+	if err := h.v.saveAccountToSession(w, r, *acc); err != nil {
+		h.errFn(log.Ctx{"err": err, "handle": acc.Handle})("unable to save account to session")
+	}
+	h.v.addFlashMessage(Success, w, r, "Two-factor authentication is disabled")
+	h.v.Redirect(w, r, "/settings", http.StatusSeeOther)
+}
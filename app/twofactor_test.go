@@ -0,0 +1,106 @@
+package app
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTotpCode(t *testing.T) {
+	// NOTE(marius): the SHA1 test vectors from RFC 6238, truncated to 6 digits
+	secret := []byte("12345678901234567890")
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{unix: 59, want: "287082"},
+		{unix: 1111111109, want: "081804"},
+		{unix: 1111111111, want: "050471"},
+		{unix: 1234567890, want: "005924"},
+		{unix: 2000000000, want: "279037"},
+	}
+	for _, tt := range tests {
+		if got := totpCode(secret, totpStep(time.Unix(tt.unix, 0))); got != tt.want {
+			t.Errorf("totpCode(%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestTwoFactor_verify(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	tf := twoFactor{Secret: b32.EncodeToString([]byte("12345678901234567890")), Enabled: true}
+	codes, hashes := newRecoveryCodes()
+	tf.RecoveryCodes = hashes
+
+	if tf.verify("000000", now) {
+		t.Errorf("verify() accepted an invalid code")
+	}
+	if !tf.verify("005924", now.Add(totpPeriod*time.Second)) {
+		t.Errorf("verify() rejected the code of the previous period")
+	}
+	if tf.verify("005924", now) {
+		t.Errorf("verify() accepted the same code twice")
+	}
+	if !tf.verify(strings.ToUpper(codes[3]), now) {
+		t.Errorf("verify() rejected a recovery code")
+	}
+	if tf.verify(codes[3], now) {
+		t.Errorf("verify() accepted the same recovery code twice")
+	}
+	if len(tf.RecoveryCodes) != recoveryCodesCount-1 {
+		t.Errorf("%d recovery codes left, want %d", len(tf.RecoveryCodes), recoveryCodesCount-1)
+	}
+}
+
+func TestTwoFactor_provisioningURI(t *testing.T) {
+	tf := twoFactor{Secret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"}
+	want := "otpauth://totp/littr.me:johndoe?algorithm=SHA1&digits=6&issuer=littr.me&period=30&secret=GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	if got := tf.provisioningURI("littr.me", "johndoe"); got != want {
+		t.Errorf("provisioningURI() = %s, want %s", got, want)
+	}
+}
+
+func TestLoginAttemptStore_Attempt(t *testing.T) {
+	dir, err := ioutil.TempDir("", "littr-login-attempts")
+	if err != nil {
+		t.Fatalf("unable to create temporary directory: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := newFileStore(dir, "login-attempts")
+	if err != nil {
+		t.Fatalf("unable to create storage: %s", err)
+	}
+	s := loginAttemptStore{fs}
+	acct := Account{Hash: HashFromString("6f2b8c8e-1d5e-4f4f-9d4a-2c1b3a4d5e6f")}
+	now := time.Now()
+	invalid := func() bool { return false }
+	valid := func() bool { return true }
+
+	if ok, err := s.Attempt("2fa", acct, now, invalid); ok || err != nil {
+		t.Fatalf("Attempt() = %t, %v, expected a failed attempt", ok, err)
+	}
+	if ok, err := s.Attempt("2fa", acct, now, valid); !ok || err != nil {
+		t.Fatalf("Attempt() = %t, %v, expected a valid attempt", ok, err)
+	}
+	for i := 1; i < pendingLoginAttempts; i++ {
+		if _, err := s.Attempt("2fa", acct, now, invalid); err != nil {
+			t.Fatalf("Attempt() error = %v after %d failures", err, i)
+		}
+	}
+	if _, err := s.Attempt("2fa", acct, now, invalid); err != errLoginLocked {
+		t.Fatalf("Attempt() error = %v, expected the account to be locked", err)
+	}
+	called := false
+	if ok, err := s.Attempt("2fa", acct, now, func() bool { called = true; return true }); ok || err != errLoginLocked || called {
+		t.Errorf("Attempt() = %t, %v, expected the locked account to be refused without verifying", ok, err)
+	}
+	if ok, err := s.Attempt("ssh", acct, now, valid); !ok || err != nil {
+		t.Errorf("Attempt() = %t, %v, expected the other logins to work", ok, err)
+	}
+	if ok, err := s.Attempt("2fa", acct, now.Add(loginLockout+time.Second), valid); !ok || err != nil {
+		t.Errorf("Attempt() = %t, %v, expected the lock to expire", ok, err)
+	}
+}
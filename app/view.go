@@ -16,7 +16,6 @@ import (
 	"math"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
 	"strings"
 	"time"
@@ -165,6 +164,9 @@ func (v *view) RenderTemplate(r *http.Request, w http.ResponseWriter, name strin
 			"IsVote":                func(t Renderable) bool { return t.Type() == AppreciationType },
 			"IsAccount":             func(t Renderable) bool { return t.Type() == ActorType },
 			"IsModeration":          func(t Renderable) bool { return t.Type() == ModerationType },
+			"IsModerator":           func() bool { return accountIsModerator(accountFromRequest()) },
+			"CanLock":               func(it *Item) bool { return canLockItem(accountFromRequest(), it) },
+			"IsCommunityModerator":  func(c *Community) bool { return c.IsModerator(accountFromRequest()) },
 			"SessionEnabled":        func() bool { return v.s.enabled },
 			"LoadFlashMessages":     v.loadFlashMessages(w, r),
 			"Mod10":                 mod10,
@@ -580,19 +582,11 @@ func sluggify(s string) string {
 
 func getAuthProviders() map[string]string {
 	p := make(map[string]string)
-	if os.Getenv("GITHUB_KEY") != "" {
-		p["github"] = "Github"
-	}
-	if os.Getenv("GITLAB_KEY") != "" {
-		p["gitlab"] = "Gitlab"
-	}
-	if os.Getenv("GOOGLE_KEY") != "" {
-		p["google"] = "Google"
-	}
-	if os.Getenv("FACEBOOK_KEY") != "" {
-		p["facebook"] = "Facebook"
+	for k, prov := range authProviders {
+		if prov.Enabled() {
+			p[k] = prov.Name
+		}
 	}
-
 	return p
 }
 
@@ -1021,34 +1015,37 @@ func ShowAccountHandle(a *Account) string {
 
 func AccountLocalLink(a *Account) string {
 	// @todo(marius) :link_generation:
+	if a.IsCommunity() {
+		return fmt.Sprintf("/c/%s", a.Handle)
+	}
 	return fmt.Sprintf("/~%s", ShowAccountHandle(a))
 }
 
 const (
 	unknownDomain = "unknown"
-	githubDomain = "github.com"
-	gitlabDomain = "gitlab.com"
-	twitchDomain = "twitch.tv"
+	githubDomain  = "github.com"
+	gitlabDomain  = "gitlab.com"
+	twitchDomain  = "twitch.tv"
 	twitterDomain = "twitter.com"
 )
 
 var twitchValidUser = func(n string) bool {
-	return !(stringInSlice([]string{ "directory", "p", "downloads", "jobs", "store", "turbo" })(n))
+	return !(stringInSlice([]string{"directory", "p", "downloads", "jobs", "store", "turbo"})(n))
 }
 
 var githubValidUser = func(n string) bool {
-	return !(stringInSlice([]string{ "features", "security", "team", "enterprise", "topics", "collections",
+	return !(stringInSlice([]string{"features", "security", "team", "enterprise", "topics", "collections",
 		"trending", "events", "marketplace", "pricing", "nonprofit", "join", "contact", "about", "site", "git-guides",
 		"discussions", "pulls", "issues", "explore", "settings", "mine", "new", "import", "organizations",
 	})(n))
 }
 
 var gitlabValidUser = func(n string) bool {
-	return !(stringInSlice([]string{"users", "explore", "-", "dashboard", "help" })(n))
+	return !(stringInSlice([]string{"users", "explore", "-", "dashboard", "help"})(n))
 }
 
 var twitterValidUser = func(n string) bool {
-	return !(stringInSlice([]string{ "home", "explore", "notifications", "messages", "bookmarks", "settings", "i",
+	return !(stringInSlice([]string{"home", "explore", "notifications", "messages", "bookmarks", "settings", "i",
 		"compose", "search", "tos", "privacy",
 	})(n))
 }
@@ -1065,7 +1062,7 @@ func getDomain(u *url.URL) string {
 			if twitterValidUser(maybeUser) {
 				return fmt.Sprintf("%s/%s", u.Host, maybeUser)
 			}
-		case gitlabDomain, "www."+gitlabDomain:
+		case gitlabDomain, "www." + gitlabDomain:
 			if gitlabValidUser(maybeUser) {
 				return fmt.Sprintf("%s/%s", u.Host, maybeUser)
 			}
@@ -1090,7 +1087,7 @@ func getDomain(u *url.URL) string {
 	return u.Host
 }
 
-func GetDomainTitle (i Item) template.HTML {
+func GetDomainTitle(i Item) template.HTML {
 	if !i.IsLink() {
 		return unknownDomain
 	}
@@ -1,6 +1,7 @@
 package app
 
 import (
+	"fmt"
 	pub "github.com/go-ap/activitypub"
 	"time"
 
@@ -91,6 +92,64 @@ func (v VoteCollection) Contains(vot Vote) bool {
 	return false
 }
 
+// VoteTally holds the votes an item received, split by the origin of the accounts that submitted them
+type VoteTally struct {
+	LocalUps    int
+	LocalDowns  int
+	RemoteUps   int
+	RemoteDowns int
+}
+
+// Add counts the vote v as local or remote, depending on where its author is hosted
+func (t *VoteTally) Add(v Vote) {
+	if t == nil || v.Weight == 0 {
+		return
+	}
+	local := v.SubmittedBy == nil || v.SubmittedBy.IsLocal()
+	switch {
+	case local && v.Weight > 0:
+		t.LocalUps += v.Weight
+	case local && v.Weight < 0:
+		t.LocalDowns -= v.Weight
+	case v.Weight > 0:
+		t.RemoteUps += v.Weight
+	default:
+		t.RemoteDowns -= v.Weight
+	}
+}
+
+// Local returns the score from the local votes
+func (t VoteTally) Local() int {
+	return t.LocalUps - t.LocalDowns
+}
+
+// Remote returns the score from the votes submitted on other instances
+func (t VoteTally) Remote() int {
+	return t.RemoteUps - t.RemoteDowns
+}
+
+// Weighted returns the score used for ranking, where a remote vote counts weight times a local one
+func (t VoteTally) Weighted(weight float64) float64 {
+	return float64(t.Local()) + weight*float64(t.Remote())
+}
+
+// String returns the breakdown of the votes, as shown on the score tooltip
+func (t VoteTally) String() string {
+	s := fmt.Sprintf("local: +%d/-%d", t.LocalUps, t.LocalDowns)
+	if t.RemoteUps > 0 || t.RemoteDowns > 0 {
+		s = fmt.Sprintf("%s, remote: +%d/-%d", s, t.RemoteUps, t.RemoteDowns)
+	}
+	return s
+}
+
+// remoteVoteWeight returns the configured weight of remote votes in ranking
+func remoteVoteWeight() float64 {
+	if Instance.Conf == nil {
+		return 1
+	}
+	return Instance.Conf.RemoteVoteWeight
+}
+
 type ScoreType int
 
 const (
@@ -0,0 +1,51 @@
+package app
+
+import (
+	"testing"
+
+	"github.com/mariusor/go-littr/internal/config"
+)
+
+func TestVoteTally_Add(t *testing.T) {
+	prev := Instance.Conf
+	Instance.Conf = &config.Configuration{HostName: "littr.example", APIURL: "https://fedbox.littr.example", RemoteVoteWeight: 0.5}
+	defer func() { Instance.Conf = prev }()
+
+	local := &Account{Metadata: &AccountMetadata{ID: "https://fedbox.littr.example/actors/johndoe"}}
+	remote := &Account{Metadata: &AccountMetadata{ID: "https://mastodon.example/users/janedoe"}}
+
+	it := Item{}
+	for _, v := range []Vote{
+		{SubmittedBy: local, Weight: 1},
+		{SubmittedBy: local, Weight: 1},
+		{SubmittedBy: local, Weight: -1},
+		{SubmittedBy: remote, Weight: 1},
+		{SubmittedBy: remote, Weight: 1},
+		{SubmittedBy: remote, Weight: 1},
+		{SubmittedBy: remote, Weight: 1},
+		{SubmittedBy: remote, Weight: 0},
+	} {
+		it.Score += v.Weight
+		it.Votes.Add(v)
+	}
+	want := VoteTally{LocalUps: 2, LocalDowns: 1, RemoteUps: 4}
+	if it.Votes != want {
+		t.Errorf("Votes = %#v, want %#v", it.Votes, want)
+	}
+	if it.Votes.Local() != 1 || it.Votes.Remote() != 4 {
+		t.Errorf("Local() = %d, Remote() = %d, want 1, 4", it.Votes.Local(), it.Votes.Remote())
+	}
+	if s := it.RankScore(); s != 3 {
+		t.Errorf("RankScore() = %f, want 3", s)
+	}
+	if s := it.Votes.String(); s != "local: +2/-1, remote: +4/-0" {
+		t.Errorf("String() = %q", s)
+	}
+}
+
+func TestItem_RankScoreWithoutVotes(t *testing.T) {
+	it := Item{Score: 7}
+	if s := it.RankScore(); s != 7 {
+		t.Errorf("RankScore() = %f, want 7", s)
+	}
+}
@@ -5,12 +5,12 @@ import (
 	"encoding/json"
 	"fmt"
 	pub "github.com/go-ap/activitypub"
-	"github.com/writeas/go-nodeinfo"
 	"net/http"
-	"regexp"
+	"net/url"
 	"strings"
 
 	"github.com/go-ap/errors"
+	"github.com/mariusor/go-littr/internal/log"
 )
 
 type link struct {
@@ -26,98 +26,6 @@ type node struct {
 	Links   []link   `json:"links"`
 }
 
-type NodeInfoResolver struct {
-	users    int
-	comments int
-	posts    int
-}
-
-var (
-	actorsFilter = &Filters{
-		Type: ActivityTypesFilter(ValidActorTypes...),
-	}
-	postsFilter = &Filters{
-		Type: ActivityTypesFilter(ValidContentTypes...),
-		OP:   nilIRIs,
-	}
-	allFilter = &Filters{
-		Type: ActivityTypesFilter(ValidContentTypes...),
-	}
-)
-
-func NodeInfoResolverNew(f *fedbox) NodeInfoResolver {
-	n := NodeInfoResolver{}
-	if f == nil {
-		return n
-	}
-
-	us, _ := f.Actors(context.TODO(), Values(actorsFilter))
-	if us != nil {
-		n.users = int(us.Count())
-	}
-
-	posts, _ := f.Objects(context.TODO(), Values(postsFilter))
-	if posts != nil {
-		n.posts = int(posts.Count())
-	}
-	all, _ := f.Objects(context.TODO(), Values(allFilter))
-
-	if all != nil {
-		n.comments = int(all.Count()) - n.posts
-	}
-	return n
-}
-
-func (n NodeInfoResolver) IsOpenRegistration() (bool, error) {
-	return Instance.Conf.UserCreatingEnabled, nil
-}
-
-func (n NodeInfoResolver) Usage() (nodeinfo.Usage, error) {
-	u := nodeinfo.Usage{
-		Users: nodeinfo.UsageUsers{
-			Total: n.users,
-		},
-		LocalComments: n.comments,
-		LocalPosts:    n.posts,
-	}
-	return u, nil
-}
-
-const (
-	githubUrl    = "https://github.com/mariusor/go-littr"
-	author       = "@mariusor@metalhead.club"
-	softwareName = "go-littr"
-)
-
-func NodeInfoConfig() nodeinfo.Config {
-	return nodeinfo.Config{
-		BaseURL: Instance.BaseURL,
-		InfoURL: "/nodeinfo",
-
-		Metadata: nodeinfo.Metadata{
-			NodeName:        string(regexp.MustCompile(`<[\/\w]+>`).ReplaceAll([]byte(Instance.NodeInfo().Title), []byte{})),
-			NodeDescription: Instance.NodeInfo().Summary,
-			Private:         false,
-			Software: nodeinfo.SoftwareMeta{
-				GitHub:   githubUrl,
-				HomePage: Instance.BaseURL,
-				Follow:   author,
-			},
-		},
-		Protocols: []nodeinfo.NodeProtocol{
-			nodeinfo.ProtocolActivityPub,
-		},
-		Services: nodeinfo.Services{
-			Inbound:  []nodeinfo.NodeService{},
-			Outbound: []nodeinfo.NodeService{nodeinfo.ServiceAtom},
-		},
-		Software: nodeinfo.SoftwareInfo{
-			Name:    softwareName,
-			Version: Instance.NodeInfo().Version,
-		},
-	}
-}
-
 // HandleHostMeta serves /.well-known/host-meta
 func (h handler) HandleHostMeta(w http.ResponseWriter, r *http.Request) {
 	hm := node{
@@ -138,97 +46,239 @@ func (h handler) HandleHostMeta(w http.ResponseWriter, r *http.Request) {
 	w.Write(dat)
 }
 
-const selfName = "self"
+const (
+	selfName = "self"
 
-// HandleWebFinger serves /.well-known/webfinger/
-func (h handler) HandleWebFinger(w http.ResponseWriter, r *http.Request) {
-	res := r.URL.Query().Get("resource")
+	profilePageRel = "http://webfinger.net/rel/profile-page"
+	avatarRel      = "http://webfinger.net/rel/avatar"
+	alternateRel   = "alternate"
+)
 
-	typ, handle := func(res string) (string, string) {
-		split := ":"
-		if strings.Contains(res, "://") {
-			split = "://"
-		}
-		ar := strings.Split(res, split)
-		if len(ar) != 2 {
-			return "", ""
-		}
-		typ := ar[0]
-		handle := ar[1]
-		if handle[0] == '@' && len(handle) > 1 {
-			handle = handle[1:]
-		}
-		return typ, handle
-	}(res)
+type webFingerResourceType int
 
-	if typ == "" || handle == "" {
-		errors.HandleError(errors.BadRequestf("invalid resource %s", res)).ServeHTTP(w, r)
-		return
-	}
+const (
+	resourceUnknown webFingerResourceType = iota
+	resourceAccount
+	resourceCommunity
+	resourceItem
+)
 
-	wf := node{}
-	if strings.Contains(handle, "@") {
-		handle, _ = func(s string) (string, string) {
-			split := "@"
-			ar := strings.Split(s, split)
-			if len(ar) != 2 {
-				return "", ""
-			}
-			return ar[0], ar[1]
-		}(handle)
-	}
-	var a *Account
-	fedbox := h.storage.fedbox.Service()
-	handleIRI := pub.IRI(fmt.Sprintf("https://%s/", handle))
-	if fedbox.GetLink().Equals(handleIRI, false) || handle == selfName {
-		a = new(Account)
-		if err := a.FromActivityPub(fedbox); err != nil {
-			err := errors.NotFoundf("resource not found %s", res)
-			h.errFn()("Error: %s", err)
-			errors.HandleError(err).ServeHTTP(w, r)
-			return
-		}
-	} else {
-		ff := &Filters{Name: CompStrs{EqualsString(handle)}}
-		accounts, _, err := h.storage.LoadAccounts(context.TODO(), ff)
-		if err != nil {
-			err := errors.NotFoundf("resource not found %s", res)
-			h.errFn()("Error: %s", err)
-			errors.HandleError(err).ServeHTTP(w, r)
-			return
+// localResource returns the type and the name, or hash, of the resource a local permalink points to:
+// /~handle, /c/name, /~handle/hash, /i/hash and /yyyy/mm/dd/hash
+func localResource(u *url.URL) (webFingerResourceType, string) {
+	parts := strings.Split(strings.Trim(u.Path, "/"), "/")
+	switch {
+	case len(parts) == 1 && strings.HasPrefix(parts[0], "~") && len(parts[0]) > 1:
+		return resourceAccount, parts[0][1:]
+	case len(parts) == 2 && parts[0] == "c" && len(parts[1]) > 0:
+		return resourceCommunity, parts[1]
+	case len(parts) == 2 && (strings.HasPrefix(parts[0], "~") || parts[0] == "i"),
+		len(parts) == 4:
+		if h := HashFromString(parts[len(parts)-1]); h.IsValid() {
+			return resourceItem, h.String()
 		}
-		a, err = accounts.First()
-		if err != nil {
-			err := errors.NotFoundf("resource not found %s", res)
-			h.errFn()("Error: %s", err)
-			errors.HandleError(err).ServeHTTP(w, r)
-			return
+	}
+	return resourceUnknown, ""
+}
+
+// filterLinks keeps only the links with one of the rels, as described in RFC 7033, section 4.3
+func filterLinks(links []link, rels []string) []link {
+	if len(rels) == 0 {
+		return links
+	}
+	filtered := make([]link, 0)
+	for _, l := range links {
+		if stringInSlice(rels)(l.Rel) {
+			filtered = append(filtered, l)
 		}
 	}
+	return filtered
+}
+
+// accountNode returns the WebFinger node for a.
+// Besides the actor and its profile pages, it advertises the avatar and the template that remote users
+// can use to follow accounts from this instance.
+func (h handler) accountNode(a Account) node {
 	id := a.GetLink()
-	url := accountURL(*a).String()
-	url1 := a.Metadata.URL
-	wf.Aliases = []string{id, url}
-	wf.Subject = res
-	wf.Links = []link{
-		{
-			Rel:  "self",
-			Type: "application/activity+json",
-			Href: id,
+	if a.HasMetadata() && len(a.Metadata.ID) > 0 {
+		id = a.Metadata.ID
+	}
+	url := accountURL(a).String()
+	wf := node{
+		Aliases: []string{id, url},
+		Links: []link{
+			{
+				Rel:  "self",
+				Type: "application/activity+json",
+				Href: id,
+			},
+			{
+				Rel:  profilePageRel,
+				Type: "text/html",
+				Href: url,
+			},
 		},
-		{
-			Rel:  "http://webfinger.net/rel/profile-page",
+	}
+	if a.HasMetadata() && len(a.Metadata.URL) > 0 && a.Metadata.URL != url && a.Metadata.URL != id {
+		wf.Links = append(wf.Links, link{
+			Rel:  profilePageRel,
 			Type: "text/html",
-			Href: url,
+			Href: a.Metadata.URL,
+		})
+	}
+	if a.HasIcon() {
+		href := a.Metadata.Icon.URI
+		if !strings.HasPrefix(href, "http://") && !strings.HasPrefix(href, "https://") {
+			href = fmt.Sprintf("data:%s;base64,%s", a.Metadata.Icon.MimeType, href)
+		}
+		wf.Links = append(wf.Links, link{
+			Rel:  avatarRel,
+			Type: a.Metadata.Icon.MimeType,
+			Href: href,
+		})
+	}
+	wf.Links = append(wf.Links, link{
+		Rel:      ostatusSubscribeRel,
+		Template: fmt.Sprintf("%s/authorize_interaction?uri={uri}", h.conf.BaseURL),
+	})
+	return wf
+}
+
+// itemNode returns the WebFinger node for the it item, pointing to its ActivityPub object and to its permalink
+func (h handler) itemNode(it Item) node {
+	id := it.Metadata.ID
+	url := fmt.Sprintf("%s%s", h.conf.BaseURL, ItemLocalLink(&it))
+	wf := node{
+		Aliases: []string{id, url},
+		Links: []link{
+			{
+				Rel:  "self",
+				Type: "application/activity+json",
+				Href: id,
+			},
+			{
+				Rel:  alternateRel,
+				Type: "text/html",
+				Href: url,
+			},
 		},
 	}
-	if url1 != url && url1 != id {
+	if it.SubmittedBy != nil && it.SubmittedBy.HasMetadata() {
 		wf.Links = append(wf.Links, link{
-			Rel:  "http://webfinger.net/rel/profile-page",
-			Type: "text/html",
-			Href: url1,
+			Rel:  "author",
+			Type: "application/activity+json",
+			Href: it.SubmittedBy.Metadata.ID,
 		})
 	}
+	return wf
+}
+
+func (h handler) loadLocalAccount(ctx context.Context, handle string) (*Account, error) {
+	ff := &Filters{Name: CompStrs{EqualsString(handle)}}
+	accounts, _, err := h.storage.LoadAccounts(ctx, ff)
+	if err != nil {
+		return nil, err
+	}
+	return accounts.First()
+}
+
+func (h handler) loadItemNode(ctx context.Context, iri pub.IRI) (*node, error) {
+	it, err := h.storage.LoadItem(ctx, iri)
+	if err != nil {
+		return nil, err
+	}
+	if !it.HasMetadata() || len(it.Metadata.ID) == 0 {
+		return nil, errors.NotFoundf("item %s not found", iri)
+	}
+	wf := h.itemNode(it)
+	return &wf, nil
+}
+
+func (h handler) loadAccountNode(a *Account, err error) (*node, error) {
+	if err != nil {
+		return nil, err
+	}
+	if a == nil || !a.HasMetadata() {
+		return nil, errors.NotFoundf("account not found")
+	}
+	wf := h.accountNode(*a)
+	return &wf, nil
+}
+
+// resolveAcct resolves acct:handle[@host] resources, where host has to be the current instance
+func (h handler) resolveAcct(ctx context.Context, handle string) (*node, error) {
+	user, host := parseHandle(handle)
+	if len(host) > 0 {
+		return nil, errors.NotFoundf("account %s is not local", handle)
+	}
+	if user == selfName {
+		a := new(Account)
+		return h.loadAccountNode(a, a.FromActivityPub(h.storage.fedbox.Service()))
+	}
+	return h.loadAccountNode(h.loadLocalAccount(ctx, user))
+}
+
+// resolveIRI resolves the local permalinks of accounts, communities and items, and the IRIs of
+// the corresponding ActivityPub objects
+func (h handler) resolveIRI(ctx context.Context, u *url.URL) (*node, error) {
+	iri := pub.IRI(u.String())
+	if !HostIsLocal(u.String()) {
+		return nil, errors.NotFoundf("resource %s is not local", iri)
+	}
+	service := h.storage.fedbox.Service()
+	if service.GetLink().Equals(iri, false) || strings.Trim(u.Path, "/") == "" {
+		a := new(Account)
+		return h.loadAccountNode(a, a.FromActivityPub(service))
+	}
+	if strings.EqualFold(u.Host, host(h.conf.BaseURL)) {
+		typ, name := localResource(u)
+		switch typ {
+		case resourceAccount:
+			return h.loadAccountNode(h.loadLocalAccount(ctx, name))
+		case resourceCommunity:
+			return h.loadAccountNode(h.storage.LoadCommunity(ctx, name))
+		case resourceItem:
+			return h.loadItemNode(ctx, objects.IRI(service).AddPath(name))
+		}
+		return nil, errors.NotFoundf("resource %s not found", iri)
+	}
+	if wf, err := h.loadAccountNode(h.storage.LoadAccount(ctx, iri)); err == nil {
+		return wf, nil
+	}
+	return h.loadItemNode(ctx, iri)
+}
+
+// HandleWebFinger serves /.well-known/webfinger/
+// It resolves acct: handles of local accounts, the IRIs of local actors and objects, and the permalinks of
+// accounts, communities and items. The "rel" query parameters restrict the links of the response.
+func (h handler) HandleWebFinger(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	res := q.Get("resource")
+	if len(res) == 0 {
+		errors.HandleError(errors.BadRequestf("missing resource")).ServeHTTP(w, r)
+		return
+	}
+
+	var (
+		wf  *node
+		err error
+	)
+	ctx := context.TODO()
+	if u, uerr := url.Parse(res); uerr == nil && (u.Scheme == "http" || u.Scheme == "https") && len(u.Host) > 0 {
+		wf, err = h.resolveIRI(ctx, u)
+	} else if strings.HasPrefix(res, "acct:") && len(res) > len("acct:") {
+		wf, err = h.resolveAcct(ctx, strings.TrimPrefix(res, "acct:"))
+	} else {
+		errors.HandleError(errors.BadRequestf("invalid resource %s", res)).ServeHTTP(w, r)
+		return
+	}
+	if err != nil {
+		h.errFn(log.Ctx{"err": err, "resource": res})("unable to resolve WebFinger resource")
+		errors.HandleError(errors.NotFoundf("resource not found %s", res)).ServeHTTP(w, r)
+		return
+	}
+	wf.Subject = res
+	wf.Links = filterLinks(wf.Links, q["rel"])
 
 	dat, _ := json.Marshal(wf)
 	w.Header().Set("Content-Type", "application/jrd+json")
@@ -0,0 +1,80 @@
+package app
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/mariusor/go-littr/internal/config"
+)
+
+func TestLocalResource(t *testing.T) {
+	hash := "f7e0bd1a-2f5f-11eb-9d4b-0242ac130002"
+	tests := []struct {
+		path string
+		typ  webFingerResourceType
+		name string
+	}{
+		{path: "/~johndoe", typ: resourceAccount, name: "johndoe"},
+		{path: "/~johndoe/", typ: resourceAccount, name: "johndoe"},
+		{path: "/c/golang", typ: resourceCommunity, name: "golang"},
+		{path: "/~johndoe/" + hash, typ: resourceItem, name: hash},
+		{path: "/i/" + hash, typ: resourceItem, name: hash},
+		{path: "/2020/11/26/" + hash, typ: resourceItem, name: hash},
+		{path: "/~johndoe/not-a-hash", typ: resourceUnknown},
+		{path: "/~", typ: resourceUnknown},
+		{path: "/about", typ: resourceUnknown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			typ, name := localResource(&url.URL{Path: tt.path})
+			if typ != tt.typ || name != tt.name {
+				t.Errorf("localResource() = %d, %q, want %d, %q", typ, name, tt.typ, tt.name)
+			}
+		})
+	}
+}
+
+func TestFilterLinks(t *testing.T) {
+	links := []link{
+		{Rel: "self", Href: "https://fedbox.littr.example/actors/1"},
+		{Rel: profilePageRel, Href: "https://littr.example/~johndoe"},
+		{Rel: ostatusSubscribeRel, Template: "https://littr.example/authorize_interaction?uri={uri}"},
+	}
+	if got := filterLinks(links, nil); !reflect.DeepEqual(got, links) {
+		t.Errorf("filterLinks() = %v, want all links", got)
+	}
+	got := filterLinks(links, []string{"self", ostatusSubscribeRel})
+	if !reflect.DeepEqual(got, []link{links[0], links[2]}) {
+		t.Errorf("filterLinks() = %v, want self and subscribe links", got)
+	}
+	if got := filterLinks(links, []string{"unknown"}); len(got) != 0 {
+		t.Errorf("filterLinks() = %v, want no links", got)
+	}
+}
+
+func TestHandler_accountNode(t *testing.T) {
+	prev := Instance
+	Instance.Conf = &config.Configuration{HostName: "littr.example", APIURL: "https://fedbox.littr.example"}
+	Instance.BaseURL = "https://littr.example"
+	defer func() { Instance = prev }()
+
+	h := handler{conf: appConfig{BaseURL: "https://littr.example"}}
+	a := Account{
+		Handle: "johndoe",
+		Metadata: &AccountMetadata{
+			ID:   "https://fedbox.littr.example/actors/1",
+			Icon: ImageMetadata{URI: "PHN2Zz48L3N2Zz4", MimeType: "image/svg+xml"},
+		},
+	}
+	wf := h.accountNode(a)
+	if !reflect.DeepEqual(wf.Aliases, []string{"https://fedbox.littr.example/actors/1", "https://littr.example/~johndoe"}) {
+		t.Errorf("accountNode() aliases = %v", wf.Aliases)
+	}
+	if l := wf.link(avatarRel); l == nil || l.Href != "data:image/svg+xml;base64,PHN2Zz48L3N2Zz4" {
+		t.Errorf("accountNode() avatar = %v, want a data URI", l)
+	}
+	if l := wf.link(ostatusSubscribeRel); l == nil || l.Template != "https://littr.example/authorize_interaction?uri={uri}" {
+		t.Errorf("accountNode() subscribe = %v, want the authorize_interaction template", l)
+	}
+}
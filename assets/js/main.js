@@ -70,6 +70,34 @@ OnReady( function() {
             }
         });
     });
+    $("input.captcha-pow").forEach(function (inp) {
+        // The proof of work for the registration captcha: find a nonce that, appended to the challenge,
+        // gives a SHA-256 sum starting with difficulty zero bits
+        if (!window.crypto || !window.crypto.subtle || !window.TextEncoder) { return; }
+        let btn = inp.closest("form").querySelector("button[type='submit']");
+        let challenge = inp.getAttribute("data-challenge");
+        let difficulty = parseInt(inp.getAttribute("data-difficulty"), 10);
+        let enc = new TextEncoder();
+        let leadingZeros = function (buf) {
+            let bytes = new Uint8Array(buf), count = 0;
+            for (let i = 0; i < bytes.length; i++) {
+                if (bytes[i] !== 0) { return count + Math.clz32(bytes[i]) - 24; }
+                count += 8;
+            }
+            return count;
+        };
+        let solve = async function () {
+            for (let nonce = 0; ; nonce++) {
+                let sum = await window.crypto.subtle.digest("SHA-256", enc.encode(challenge + nonce));
+                if (leadingZeros(sum) >= difficulty) { return nonce.toString(); }
+            }
+        };
+        btn.disabled = true;
+        solve().then(function (nonce) {
+            inp.value = nonce;
+            btn.disabled = false;
+        });
+    });
     $("button.close").forEach(function (close) {
         addEvent(close, "click", function(e) {
             e.stopPropagation();
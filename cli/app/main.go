@@ -42,6 +42,7 @@ func Run(a app.Application) int {
 		if err := srvStop(); err != nil {
 			a.Logger.Errorf("Error: %s", err)
 		}
+		a.Close()
 	}()
 
 	runFn := func() error {
@@ -54,7 +55,7 @@ func Run(a app.Application) int {
 	}
 
 	// Set up the signal handlers functions so the OS can tell us if the it requires us to stop
-	sigHandlerFns := w.SignalHandlers {
+	sigHandlerFns := w.SignalHandlers{
 		syscall.SIGHUP: func(_ chan int) {
 			a.Logger.Info("SIGHUP received, reloading configuration")
 			a.Conf = config.Load(a.Conf.Env, a.Conf.TimeOut)
@@ -108,5 +109,10 @@ func main() {
 		r.Use(middleware.Recoverer)
 		http.DefaultTransport.(*http.Transport).TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
 	}
-	os.Exit(Run(app.New(c, host, port, version, r)))
+	a, err := app.New(c, host, port, version, r)
+	if err != nil {
+		// NOTE(marius): the error has been logged already
+		os.Exit(1)
+	}
+	os.Exit(Run(a))
 }
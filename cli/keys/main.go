@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/mariusor/go-littr/app"
+	"github.com/mariusor/go-littr/internal/config"
+)
+
+var version = "HEAD"
+
+func main() {
+	var env string
+	var typ string
+
+	flag.StringVar(&env, "env", "unknown", "the environment type")
+	flag.StringVar(&typ, "type", "", "the type of the generated keys: rsa, ecdsa or ed25519, defaults to SIGNATURE_KEY_TYPE")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Generates HTTP signature keys for the local accounts that don't have one.\n\nUsage of %s:\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	c := config.Load(config.EnvType(env), 10*time.Second)
+	count, err := app.BackfillKeys(context.Background(), c, version, typ)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Generated keys for %d accounts\n", count)
+}
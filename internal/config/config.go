@@ -32,6 +32,25 @@ type Configuration struct {
 	UserFollowingEnabled       bool
 	ModerationEnabled          bool
 	MaintenanceMode            bool
+	ModerationRulesPath        string
+	AnonymousModeration        bool
+	Moderators                 []string
+	NotifyInviters             bool
+	InviteSanctionsLimit       int
+	ModeratorsRequire2FA       bool
+	DataPath                   string
+	ArchiveAge                 time.Duration
+	RemoteVoteWeight           float64
+	InboxEnabled               bool
+	BlockedDomains             []string
+	SignatureKeyType           string
+	DeliveriesEnabled          bool
+	RegistrationApproval       bool
+	RegistrationVerifyEmail    bool
+	RegistrationCaptcha        string
+	SMTPURL                    string
+	MailFrom                   string
+	TrustedProxies             []string
 }
 
 const (
@@ -60,6 +79,25 @@ const (
 	KeyDisableUserFollowing       = "DISABLE_USER_FOLLOWING"
 	KeyDisableModeration          = "DISABLE_MODERATION"
 	KeyAdminContact               = "ADMIN_CONTACT"
+	KeyModerationRules            = "MODERATION_RULES"
+	KeyAnonymousModeration        = "ANONYMOUS_MODERATION"
+	KeyModerators                 = "MODERATORS"
+	KeyNotifyInviters             = "NOTIFY_INVITERS"
+	KeyInviteSanctionsLimit       = "INVITE_SANCTIONS_LIMIT"
+	KeyModeratorsRequire2FA       = "MODERATORS_REQUIRE_2FA"
+	KeyDataPath                   = "DATA_PATH"
+	KeyArchiveAfter               = "ARCHIVE_AFTER"
+	KeyRemoteVoteWeight           = "REMOTE_VOTE_WEIGHT"
+	KeyEnableInbox                = "ENABLE_INBOX"
+	KeyBlockedDomains             = "BLOCKED_DOMAINS"
+	KeySignatureKeyType           = "SIGNATURE_KEY_TYPE"
+	KeyEnableDeliveries           = "DELIVERIES_ENABLED"
+	KeyRegistrationApproval       = "REGISTRATION_APPROVAL"
+	KeyRegistrationVerifyEmail    = "REGISTRATION_VERIFY_EMAIL"
+	KeyRegistrationCaptcha        = "REGISTRATION_CAPTCHA"
+	KeySMTPURL                    = "SMTP_URL"
+	KeyMailFrom                   = "MAIL_FROM"
+	KeyTrustedProxies             = "TRUSTED_PROXIES"
 )
 
 func prefKey(k string) string {
@@ -154,7 +192,47 @@ func Load(e EnvType, wait time.Duration) *Configuration {
 	c.UserFollowingEnabled = !userFollowingDisabled
 	moderationDisabled, _ := strconv.ParseBool(loadKeyFromEnv(KeyDisableModeration, "")) // DISABLE_MODERATION
 	c.ModerationEnabled = !moderationDisabled
-	c.AdminContact = loadKeyFromEnv(KeyAdminContact, "") // ADMIN_CONTACT
+	c.AdminContact = loadKeyFromEnv(KeyAdminContact, "")                                     // ADMIN_CONTACT
+	c.ModerationRulesPath = loadKeyFromEnv(KeyModerationRules, "")                           // MODERATION_RULES
+	c.AnonymousModeration, _ = strconv.ParseBool(loadKeyFromEnv(KeyAnonymousModeration, "")) // ANONYMOUS_MODERATION
+	c.Moderators = make([]string, 0)
+	for _, m := range strings.Split(loadKeyFromEnv(KeyModerators, ""), ",") { // MODERATORS
+		if m = strings.TrimSpace(m); len(m) > 0 {
+			c.Moderators = append(c.Moderators, m)
+		}
+	}
+	c.NotifyInviters, _ = strconv.ParseBool(loadKeyFromEnv(KeyNotifyInviters, ""))                    // NOTIFY_INVITERS
+	if limit, _ := strconv.ParseInt(loadKeyFromEnv(KeyInviteSanctionsLimit, ""), 10, 32); limit > 0 { // INVITE_SANCTIONS_LIMIT
+		c.InviteSanctionsLimit = int(limit)
+	}
+	c.ModeratorsRequire2FA, _ = strconv.ParseBool(loadKeyFromEnv(KeyModeratorsRequire2FA, "")) // MODERATORS_REQUIRE_2FA
+
+	c.DataPath = loadKeyFromEnv(KeyDataPath, "")                              // DATA_PATH
+	c.ArchiveAge, _ = time.ParseDuration(loadKeyFromEnv(KeyArchiveAfter, "")) // ARCHIVE_AFTER
+	c.RemoteVoteWeight = 1
+	if w, err := strconv.ParseFloat(loadKeyFromEnv(KeyRemoteVoteWeight, ""), 64); err == nil && w >= 0 { // REMOTE_VOTE_WEIGHT
+		c.RemoteVoteWeight = w
+	}
+	c.InboxEnabled, _ = strconv.ParseBool(loadKeyFromEnv(KeyEnableInbox, "")) // ENABLE_INBOX
+	c.BlockedDomains = make([]string, 0)
+	for _, d := range strings.Split(loadKeyFromEnv(KeyBlockedDomains, ""), ",") { // BLOCKED_DOMAINS
+		if d = strings.ToLower(strings.TrimSpace(d)); len(d) > 0 {
+			c.BlockedDomains = append(c.BlockedDomains, d)
+		}
+	}
+	c.SignatureKeyType = loadKeyFromEnv(KeySignatureKeyType, "rsa")                                  // SIGNATURE_KEY_TYPE
+	c.DeliveriesEnabled, _ = strconv.ParseBool(loadKeyFromEnv(KeyEnableDeliveries, ""))              // DELIVERIES_ENABLED
+	c.RegistrationApproval, _ = strconv.ParseBool(loadKeyFromEnv(KeyRegistrationApproval, ""))       // REGISTRATION_APPROVAL
+	c.RegistrationVerifyEmail, _ = strconv.ParseBool(loadKeyFromEnv(KeyRegistrationVerifyEmail, "")) // REGISTRATION_VERIFY_EMAIL
+	c.RegistrationCaptcha = strings.ToLower(loadKeyFromEnv(KeyRegistrationCaptcha, ""))              // REGISTRATION_CAPTCHA
+	c.SMTPURL = loadKeyFromEnv(KeySMTPURL, "")                                                       // SMTP_URL
+	c.MailFrom = loadKeyFromEnv(KeyMailFrom, "")                                                     // MAIL_FROM
+	c.TrustedProxies = make([]string, 0)
+	for _, p := range strings.Split(loadKeyFromEnv(KeyTrustedProxies, ""), ",") { // TRUSTED_PROXIES
+		if p = strings.TrimSpace(p); len(p) > 0 {
+			c.TrustedProxies = append(c.TrustedProxies, p)
+		}
+	}
 
 	c.APIURL = loadKeyFromEnv(KeyAPIUrl, "")
 